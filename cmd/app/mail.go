@@ -0,0 +1,19 @@
+package main
+
+import (
+	"portier/internal/config"
+	"portier/pkg/mail"
+)
+
+// mailSender returns the sender of the configured backend, nil for none
+func mailSender(cfg config.MailConfig) mail.Sender {
+	switch cfg.Backend {
+	case "smtp":
+		return mail.NewSMTP(cfg.SMTP, cfg.From)
+	case "file":
+		return mail.NewFile(cfg.Dir, cfg.From)
+	case "memory":
+		return mail.NewMemory()
+	}
+	return nil
+}
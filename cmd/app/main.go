@@ -1,68 +1,310 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"os"
 	"os/signal"
 	"portier/internal/config"
 	"portier/internal/delivery/http"
+	"portier/internal/health"
+	"portier/internal/jobs"
+	"portier/internal/service"
+	"portier/pkg/cache"
+	"portier/pkg/certs"
 	"portier/pkg/db"
+	"portier/pkg/idempotency"
+	"portier/pkg/logging"
+	"portier/pkg/metrics"
+	"portier/pkg/oidc"
+	"portier/pkg/ratelimit"
 	"portier/pkg/storage"
+	"portier/pkg/tracing"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/joho/godotenv"
 )
 
-func requestLogger(c *fiber.Ctx) error {
-	log.Printf("Received request: %s %s", c.Method(), c.Path())
-	return c.Next()
+// registerDomainMetrics exposes gauges read from the database on every scrape
+func registerDomainMetrics() {
+	perTenant := func(count func(context.Context) ([]service.TenantCount, error)) func(context.Context) ([]metrics.Sample, error) {
+		return func(ctx context.Context) ([]metrics.Sample, error) {
+			counts, err := count(ctx)
+			if err != nil {
+				return nil, err
+			}
+			samples := make([]metrics.Sample, len(counts))
+			for i, c := range counts {
+				samples[i] = metrics.Sample{Labels: []string{strconv.Itoa(c.TenantID)}, Value: float64(c.Count)}
+			}
+			return samples, nil
+		}
+	}
+
+	metrics.RegisterGaugeFunc("active_keys", "Active keys per tenant.", []string{"tenant_id"}, perTenant(service.CountActiveKeysPerTenant))
+	metrics.RegisterGaugeFunc("active_copies", "Active copies per tenant.", []string{"tenant_id"}, perTenant(service.CountActiveCopiesPerTenant))
+}
+
+// fatal logs err and stops the process
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// printConfig writes the effective configuration with its secrets redacted,
+// followed by the validation errors. It returns the exit code.
+func printConfig(args []string) int {
+	cfg, err := config.Load(args)
+	var invalid *config.ValidationError
+	switch {
+	case errors.Is(err, config.ErrHelp):
+		return 0
+	case err != nil && !errors.As(err, &invalid):
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := config.Print(os.Stdout, cfg); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if invalid != nil {
+		fmt.Fprintln(os.Stderr, invalid)
+		return 1
+	}
+	return 0
 }
 
 func main() {
-	// Load the .env file
-	if err := godotenv.Load(); err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+	// REQUEST EXAMPLE
+	// go run ./cmd/app --server.port :8080 --log.level debug
+	// go run ./cmd/app config print
+
+	if len(os.Args) > 2 && os.Args[1] == "config" && os.Args[2] == "print" {
+		os.Exit(printConfig(os.Args[3:]))
 	}
 
-	// Load configuration
-	cfg := config.LoadConfig()
+	// Defaults, then config.yaml, then PORTIER_* variables, then flags.
+	// Every invalid setting is reported before exiting.
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, config.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// JSON logs, every line written during a request carries its request ID
+	if err := logging.Setup(cfg.Log.Level); err != nil {
+		log.Fatalf("Error setting up logging: %v", err)
+	}
+
+	// Spans for requests and queries, exported as configured
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing)
+	if err != nil {
+		fatal("Error setting up tracing", err)
+	}
+
+	// Opt-in fallback tenant for users created without tenant_id, and creator
+	// of keys and copies created without an API token
+	service.SetDefaultTenantID(cfg.Defaults.TenantID)
+	service.SetDefaultCreatorID(cfg.Defaults.CreatorID)
+	service.SetTimeouts(cfg.Timeouts)
+
+	// Password reset and email verification links, sent by the configured mail backend
+	service.SetAccounts(mailSender(cfg.Mail), service.AccountConfig{
+		Secret:               cfg.Auth.Secret,
+		ResetTokenTTL:        cfg.Auth.ResetTokenTTL,
+		VerificationTokenTTL: cfg.Auth.VerificationTokenTTL,
+		LinkURL:              strings.TrimRight(cfg.Mail.LinkURL, "/"),
+	})
+	service.SetTOTP(service.TOTPConfig{
+		Issuer:        cfg.Auth.TOTPIssuer,
+		RequiredRoles: cfg.Auth.TOTPRequiredRoles,
+	})
+	service.SetLockout(service.LockoutConfig{
+		Threshold:   cfg.Auth.LockoutThreshold,
+		Duration:    cfg.Auth.LockoutDuration,
+		MaxDuration: cfg.Auth.LockoutMaxDuration,
+		IPThreshold: cfg.Auth.IPLockoutThreshold,
+		IPWindow:    cfg.Auth.IPLockoutWindow,
+		Retention:   cfg.Auth.HistoryRetention,
+	})
+
+	// API tokens, sent as "Authorization: Bearer <token>"
+	service.SetTokens(service.TokenConfig{
+		DefaultTTL: cfg.Auth.TokenTTL,
+		MaxTTL:     cfg.Auth.TokenMaxTTL,
+	})
+	http.SetAuth(cfg.Auth.RequireToken)
 
 	// Setup Fiber app
-	app := fiber.New()
+	// Behind a proxy the client IP, used by the logs and the rate limits, is read from its header
+	app := fiber.New(fiber.Config{
+		ProxyHeader:             cfg.Server.ProxyHeader,
+		EnableIPValidation:      cfg.Server.ProxyHeader != "",
+		EnableTrustedProxyCheck: len(cfg.Server.TrustedProxies) > 0,
+		TrustedProxies:          cfg.Server.TrustedProxies,
+	})
+
+	// Request ID first, so every following middleware and handler logs it
+	app.Use(logging.RequestID)
+	app.Use(tracing.Middleware)
+	app.Use(logging.RequestLogger)
+	app.Use(metrics.Middleware)
+
+	// Time and trace every query, the tracers must be known before connecting
+	db.AddTracer(metrics.QueryTracer{})
+	db.AddTracer(tracing.QueryTracer{})
 
 	// Setup PostgreSQL middleware
 	storage.SetupPostgresMiddleware(app, cfg)
 
-	// Enable CORS
-	app.Use(cors.New(cors.Config{
-		AllowOrigins: "*", // Allow all origins for testing purposes
-		AllowMethods: "GET,POST,PUT,DELETE",
-		AllowHeaders: "Content-Type,Authorization",
-	}))
+	// Rate limit counters are kept in the cache storage, shared by every instance
+	ratelimit.Setup(storage.Cache(), cfg.RateLimit)
 
-	// Use the request logger middleware
-	app.Use(requestLogger)
+	// Responses of requests sent with an Idempotency-Key, shared by every instance
+	idempotency.Setup(storage.Cache(), cfg.Idempotency)
+
+	// Single sign-on, the pending logins are kept in the oidc_logins table shared by every instance
+	oidc.Setup(oidc.Config{HTTPTimeout: cfg.OIDC.HTTPTimeout, CacheTTL: cfg.OIDC.CacheTTL})
+	service.SetOIDC(service.OIDCConfig{
+		RedirectURL: cfg.OIDC.RedirectURL,
+		StateTTL:    cfg.OIDC.StateTTL,
+		SessionTTL:  cfg.OIDC.SessionTTL,
+	})
+
+	// Read-through cache of rows and list pages, invalidated by every write
+	var memoryCache *cache.Memory
+	switch cfg.Cache.Backend {
+	case "postgres":
+		service.SetCache(storage.Cache(), cfg.Cache.CacheConfig)
+	case "memory":
+		memoryCache = cache.NewMemory(time.Minute)
+		service.SetCache(memoryCache, cfg.Cache.CacheConfig)
+	}
+	metrics.RegisterPool(db.GetConnection())
+	registerDomainMetrics()
+
+	// Dependencies checked by /readyz
+	health.Register("database", func(ctx context.Context) error { return db.GetConnection().Ping(ctx) })
+	health.Register("migrations", func(ctx context.Context) error { return service.CheckMigrations(ctx, cfg.Health.MigrationsDir) })
+	health.Register("cache", storage.Ping)
+
+	// Setup background jobs (imports and exports)
+	if err := jobs.Setup(jobs.Config{Dir: cfg.Jobs.Dir, Instance: cfg.Jobs.Instance, Retention: cfg.Jobs.Retention}); err != nil {
+		fatal("Error setting up jobs", err)
+	}
+
+	// Security headers and CORS of the configured origins, before every route
+	app.Use(securityHeaders(cfg.Security))
+	app.Use(corsMiddleware(cfg.CORS))
+
+	// Metrics are served on the admin address, or by the API behind a token
+	var metricsServer *metrics.Server
+	var metricsHandler fiber.Handler
+	switch {
+	case cfg.Metrics.Listen != "":
+		metricsServer = metrics.NewServer(cfg.Metrics.Listen, cfg.Metrics.Token)
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != nil {
+				fatal("Error starting the metrics server", err)
+			}
+		}()
+	case cfg.Metrics.Token != "":
+		metricsHandler = metrics.FiberHandler(cfg.Metrics.Token)
+	default:
+		slog.Warn("Metrics are disabled, set metrics.listen or metrics.token")
+	}
 
 	// Register routes
-	http.RegisterRoutes(app)
+	http.RegisterRoutes(app, cfg.Features, metricsHandler)
 
-	// Start the server in a goroutine
+	// HTTPS with a certificate reloaded on change, and a plain HTTP listener redirecting to it
+	var tlsConfig *tls.Config
+	var certReloader *certs.Reloader
+	var redirectServer *certs.RedirectServer
+	if cfg.Server.TLS.Enabled() {
+		if tlsConfig, certReloader, err = serverTLS(cfg.Server.TLS); err != nil {
+			fatal("Error setting up TLS", err)
+		}
+		if cfg.Server.TLS.RedirectListen != "" {
+			_, httpsPort, _ := net.SplitHostPort(cfg.Server.Port)
+			redirectServer = certs.NewRedirectServer(cfg.Server.TLS.RedirectListen, httpsPort)
+			go func() {
+				if err := redirectServer.ListenAndServe(); err != nil {
+					fatal("Error starting the HTTPS redirect server", err)
+				}
+			}()
+		}
+	}
+
+	// Start the server in a goroutine, Listen returns once the server is shut down
+	serverErr := make(chan error, 1)
 	go func() {
-		if err := app.Listen(cfg.ServerPort); err != nil {
-			log.Fatalf("Error starting the server: %v", err)
+		if tlsConfig == nil {
+			serverErr <- app.Listen(cfg.Server.Port)
+			return
+		}
+		ln, err := net.Listen(app.Config().Network, cfg.Server.Port)
+		if err != nil {
+			serverErr <- err
+			return
 		}
+		serverErr <- app.Listener(tls.NewListener(ln, tlsConfig))
 	}()
 
 	// Graceful shutdown logic: handle interrupt signal (e.g., CTRL+C)
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit // Block until a signal is received
 
-	// Perform cleanup tasks before shutting down
-	log.Println("Shutting down gracefully...")
-	db.Close() // Close the PostgreSQL connection
-	log.Println("Database connection closed.")
-	log.Println("Server stopped.")
+	failed := false
+	select {
+	case sig := <-quit:
+		slog.Info("Shutting down gracefully", "signal", sig.String(), "timeout", cfg.Shutdown.Timeout.String())
+
+		// Fail readiness first, so load balancers stop sending requests before the server stops
+		health.SetDraining()
+		drain(cfg.Shutdown.DrainDelay, quit)
+	case err := <-serverErr:
+		// Nothing was served, release what was set up and exit with an error
+		slog.Error("Error starting the server", "error", err)
+		failed = true
+	}
+
+	// Stop accepting connections and wait for the running requests first
+	steps := []shutdownStep{{"http server", app.ShutdownWithContext}}
+	if redirectServer != nil {
+		steps = append(steps, shutdownStep{"https redirect server", redirectServer.Shutdown})
+	}
+	if certReloader != nil {
+		steps = append(steps, shutdownStep{"certificate watcher", func(context.Context) error { return certReloader.Close() }})
+	}
+	if metricsServer != nil {
+		steps = append(steps, shutdownStep{"metrics server", metricsServer.Shutdown})
+	}
+	if memoryCache != nil {
+		steps = append(steps, shutdownStep{"memory cache", func(context.Context) error { return memoryCache.Close() }})
+	}
+	steps = append(steps,
+		shutdownStep{"background jobs", jobs.Shutdown},
+		shutdownStep{"telemetry", shutdownTracing},
+		shutdownStep{"cache storage", func(context.Context) error { return storage.Close() }},
+		shutdownStep{"database pool", db.CloseWithContext},
+	)
+
+	if !shutdown(cfg.Shutdown.Timeout, steps) || failed {
+		slog.Error("Server stopped with errors")
+		os.Exit(1)
+	}
+	slog.Info("Server stopped")
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"portier/internal/config"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/cors"
+	"github.com/gofiber/fiber/v2/middleware/helmet"
+)
+
+// corsMiddleware answers preflight requests and sets the CORS headers of the allowed origins
+func corsMiddleware(cfg config.CORSConfig) fiber.Handler {
+	return cors.New(cors.Config{
+		AllowOrigins:     strings.Join(cfg.AllowOrigins, ","),
+		AllowMethods:     strings.Join(cfg.AllowMethods, ","),
+		AllowHeaders:     strings.Join(cfg.AllowHeaders, ","),
+		ExposeHeaders:    strings.Join(cfg.ExposeHeaders, ","),
+		AllowCredentials: cfg.AllowCredentials,
+		MaxAge:           int(cfg.MaxAge.Seconds()),
+	})
+}
+
+// securityHeaders sets HSTS, Content-Security-Policy, X-Content-Type-Options,
+// X-Frame-Options and the other headers of helmet on every response.
+// HSTS is only sent over HTTPS, a proxy terminating TLS must set X-Forwarded-Proto.
+func securityHeaders(cfg config.SecurityConfig) fiber.Handler {
+	return helmet.New(helmet.Config{
+		HSTSMaxAge:            int(cfg.HSTSMaxAge.Seconds()),
+		HSTSExcludeSubdomains: !cfg.HSTSIncludeSubdomains,
+		HSTSPreloadEnabled:    cfg.HSTSPreload,
+		ContentSecurityPolicy: cfg.ContentSecurityPolicy,
+		XFrameOptions:         cfg.FrameOptions,
+		ReferrerPolicy:        cfg.ReferrerPolicy,
+		ContentTypeNosniff:    "nosniff",
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// shutdownStep releases one resource, steps run in order
+type shutdownStep struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// drain waits delay so load balancers notice the failing readiness probe.
+// A second signal on quit ends the wait early.
+func drain(delay time.Duration, quit <-chan os.Signal) {
+	slog.Info("Draining", "delay", delay.String())
+	select {
+	case <-time.After(delay):
+	case sig := <-quit:
+		slog.Warn("Drain interrupted", "signal", sig.String())
+	}
+}
+
+// shutdown runs every step within timeout and reports whether all of them succeeded.
+// A failing step does not prevent the next ones, resources are always released.
+func shutdown(timeout time.Duration, steps []shutdownStep) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ok := true
+	for _, step := range steps {
+		start := time.Now()
+		if err := step.stop(ctx); err != nil {
+			slog.Error("Shutdown step failed", "step", step.name, "error", err)
+			ok = false
+			continue
+		}
+		slog.Info("Shutdown step completed", "step", step.name, "duration_ms", time.Since(start).Milliseconds())
+	}
+	return ok
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/tls"
+	"portier/internal/config"
+	"portier/pkg/certs"
+)
+
+// serverTLS returns the TLS configuration of the API. The certificate is read
+// through the reloader, which must be closed on shutdown.
+// fasthttp only speaks HTTP/1.1, so ALPN never offers h2.
+func serverTLS(cfg config.TLSConfig) (*tls.Config, *certs.Reloader, error) {
+	reloader, err := certs.NewReloader(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if cfg.MinVersion == "1.3" {
+		tlsConfig.MinVersion = tls.VersionTLS13
+	}
+
+	// Service-to-service clients authenticate with a certificate of the client CA
+	if cfg.ClientAuth != "none" {
+		if tlsConfig.ClientCAs, err = certs.ClientCAs(cfg.ClientCAFile); err != nil {
+			reloader.Close()
+			return nil, nil, err
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.ClientAuth == "require" {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, reloader, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"portier/internal/config"
+	"portier/pkg/db"
+	"text/tabwriter"
+	"time"
+)
+
+// Before explicit parent references were required, CreateUser attached users
+// without tenant_id to the first tenant (lowest id) and CreateCopy attached copies
+// without key_id to the first key. This command reports rows that match that
+// pattern so they can be reviewed by hand. It never modifies data.
+//
+// Keys and copies also recorded created_by 1 until creates required an API
+// token. They now belong to the tenant of their creator, so those rows count
+// for, and are only reached by tokens of, the tenant of user 1.
+
+// Users whose tenant is the lowest-id tenant that existed when they were created
+const suspectUsersQuery = `SELECT u.id, u.username, u.email, u.tenant_id, u.created_at
+	FROM users u
+	WHERE u.tenant_id = (
+		SELECT t.id FROM tenants t WHERE t.created_at <= u.created_at ORDER BY t.id LIMIT 1
+	)
+	ORDER BY u.id`
+
+// Copies whose key is the lowest-id key that existed when they were created
+const suspectCopiesQuery = `SELECT c.id, c.name, c.key_id, c.created_at
+	FROM copies c
+	WHERE c.key_id = (
+		SELECT k.id FROM keys k WHERE k.created_at <= c.created_at ORDER BY k.id LIMIT 1
+	)
+	ORDER BY c.id`
+
+// Keys and copies recorded with the hardcoded creator, with the tenant they now belong to
+const suspectCreatorsQuery = `SELECT 'key', k.id, k.name, COALESCE(u.tenant_id, 0), k.created_at
+	FROM keys k LEFT JOIN users u ON u.id = k.created_by
+	WHERE k.created_by = 1
+	UNION ALL
+	SELECT 'copy', c.id, c.name, COALESCE(u.tenant_id, 0), c.created_at
+	FROM copies c LEFT JOIN users u ON u.id = c.created_by
+	WHERE c.created_by = 1
+	ORDER BY 1 DESC, 2`
+
+func main() {
+	// REQUEST EXAMPLE
+	// go run ./cmd/datafix -entity all
+
+	entity := flag.String("entity", "all", "Entity to check: users, copies, creators (keys and copies of user 1) or all")
+	flag.Parse()
+
+	// Same configuration as the API, .env and config.yaml are optional.
+	// Only the database settings are used, e.g. auth.secret may be unset.
+	cfg, err := config.Load(nil)
+	var invalid *config.ValidationError
+	if errors.As(err, &invalid) {
+		err = invalid.Only("database")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	db.ConnectPostgres(cfg.Database.DSN, cfg.Database.Pool())
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	if *entity == "all" || *entity == "users" {
+		if err := reportUsers(ctx, w); err != nil {
+			log.Fatalf("Error reporting users: %v", err)
+		}
+	}
+
+	if *entity == "all" || *entity == "copies" {
+		if err := reportCopies(ctx, w); err != nil {
+			log.Fatalf("Error reporting copies: %v", err)
+		}
+	}
+
+	if *entity == "all" || *entity == "creators" {
+		if err := reportCreators(ctx, w); err != nil {
+			log.Fatalf("Error reporting creators: %v", err)
+		}
+	}
+}
+
+// reportUsers prints users that were probably assigned by the tenant fallback
+func reportUsers(ctx context.Context, w *tabwriter.Writer) error {
+	rows, err := db.GetConnection().Query(ctx, suspectUsersQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fmt.Fprintln(w, "USERS POSSIBLY ASSIGNED TO THE FALLBACK TENANT")
+	fmt.Fprintln(w, "ID\tUSERNAME\tEMAIL\tTENANT_ID\tCREATED_AT")
+
+	count := 0
+	for rows.Next() {
+		var (
+			id, tenantID    int
+			username, email string
+			createdAt       time.Time
+		)
+		if err := rows.Scan(&id, &username, &email, &tenantID, &createdAt); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\n", id, username, email, tenantID, createdAt.Format(time.RFC3339))
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d user(s) to review\n\n", count)
+	return nil
+}
+
+// reportCopies prints copies that were probably assigned by the key fallback
+func reportCopies(ctx context.Context, w *tabwriter.Writer) error {
+	rows, err := db.GetConnection().Query(ctx, suspectCopiesQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fmt.Fprintln(w, "COPIES POSSIBLY ASSIGNED TO THE FALLBACK KEY")
+	fmt.Fprintln(w, "ID\tNAME\tKEY_ID\tCREATED_AT")
+
+	count := 0
+	for rows.Next() {
+		var (
+			id, keyID int
+			name      string
+			createdAt time.Time
+		)
+		if err := rows.Scan(&id, &name, &keyID, &createdAt); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\n", id, name, keyID, createdAt.Format(time.RFC3339))
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d copy(ies) to review\n\n", count)
+	return nil
+}
+
+// reportCreators prints keys and copies that were probably recorded with the hardcoded creator
+func reportCreators(ctx context.Context, w *tabwriter.Writer) error {
+	rows, err := db.GetConnection().Query(ctx, suspectCreatorsQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	fmt.Fprintln(w, "KEYS AND COPIES POSSIBLY RECORDED WITH CREATED_BY 1")
+	fmt.Fprintln(w, "ENTITY\tID\tNAME\tTENANT_ID\tCREATED_AT")
+
+	count := 0
+	for rows.Next() {
+		var (
+			kind, name   string
+			id, tenantID int
+			createdAt    time.Time
+		)
+		if err := rows.Scan(&kind, &id, &name, &tenantID, &createdAt); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\n", kind, id, name, tenantID, createdAt.Format(time.RFC3339))
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d key(s) and copy(ies) to review\n\n", count)
+	return nil
+}
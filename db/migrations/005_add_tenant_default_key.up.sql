@@ -0,0 +1,2 @@
+-- NOTE: Optional per-tenant default key, used for copies created without key_id. NULL = no fallback (admin opt-in)
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS default_key_id INT NULL REFERENCES keys (id);
\ No newline at end of file
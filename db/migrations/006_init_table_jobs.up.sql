@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS jobs (
+    id SERIAL PRIMARY KEY,
+    kind VARCHAR(20) NOT NULL, -- NOTE: import or export
+    entity VARCHAR(20) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- NOTE: pending, running, completed or failed
+    file_name TEXT,
+    total_rows INT DEFAULT 0,
+    processed_rows INT DEFAULT 0,
+    failed_rows INT DEFAULT 0,
+    error TEXT,
+    result_path TEXT, -- NOTE: rejected rows file for imports, generated file for exports
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP NULL
+);
\ No newline at end of file
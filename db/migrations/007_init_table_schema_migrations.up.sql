@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version VARCHAR(255) PRIMARY KEY, -- NOTE: file name of the migration, recorded by make migrate-up
+    applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
\ No newline at end of file
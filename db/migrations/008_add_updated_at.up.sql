@@ -0,0 +1,32 @@
+-- NOTE: Last change of a row, sent as Last-Modified and part of the ETag. Existing rows start at their creation time
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NULL;
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NULL;
+ALTER TABLE copies ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP NULL;
+
+UPDATE tenants SET updated_at = COALESCE(created_at, CURRENT_TIMESTAMP) WHERE updated_at IS NULL;
+UPDATE users SET updated_at = COALESCE(created_at, CURRENT_TIMESTAMP) WHERE updated_at IS NULL;
+UPDATE keys SET updated_at = COALESCE(created_at, CURRENT_TIMESTAMP) WHERE updated_at IS NULL;
+UPDATE copies SET updated_at = COALESCE(created_at, CURRENT_TIMESTAMP) WHERE updated_at IS NULL;
+
+ALTER TABLE tenants ALTER COLUMN updated_at SET DEFAULT CURRENT_TIMESTAMP, ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE users ALTER COLUMN updated_at SET DEFAULT CURRENT_TIMESTAMP, ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE keys ALTER COLUMN updated_at SET DEFAULT CURRENT_TIMESTAMP, ALTER COLUMN updated_at SET NOT NULL;
+ALTER TABLE copies ALTER COLUMN updated_at SET DEFAULT CURRENT_TIMESTAMP, ALTER COLUMN updated_at SET NOT NULL;
+
+-- NOTE: Every UPDATE refreshes updated_at, the application never writes it
+CREATE OR REPLACE FUNCTION set_updated_at() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.updated_at = clock_timestamp();
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS tenants_set_updated_at ON tenants;
+CREATE TRIGGER tenants_set_updated_at BEFORE UPDATE ON tenants FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+DROP TRIGGER IF EXISTS users_set_updated_at ON users;
+CREATE TRIGGER users_set_updated_at BEFORE UPDATE ON users FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+DROP TRIGGER IF EXISTS keys_set_updated_at ON keys;
+CREATE TRIGGER keys_set_updated_at BEFORE UPDATE ON keys FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+DROP TRIGGER IF EXISTS copies_set_updated_at ON copies;
+CREATE TRIGGER copies_set_updated_at BEFORE UPDATE ON copies FOR EACH ROW EXECUTE FUNCTION set_updated_at();
\ No newline at end of file
@@ -0,0 +1,5 @@
+-- NOTE: Optimistic locking, every update sends the version it read and increments it. A different version is a conflict (409)
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE copies ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
\ No newline at end of file
@@ -0,0 +1,15 @@
+-- NOTE: NULL until the user opens the link sent to the address, reset when the email changes
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP NULL;
+
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    purpose VARCHAR(20) NOT NULL, -- NOTE: password_reset or email_verification
+    token_hash CHAR(64) UNIQUE NOT NULL, -- NOTE: HMAC-SHA256 of the token with auth.secret, the token itself is only sent by email
+    email VARCHAR(150) NOT NULL, -- NOTE: address the token was sent to, a verification is only valid for this address
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL, -- NOTE: single use, set when the token is consumed
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS user_tokens_user_id_idx ON user_tokens (user_id, purpose);
\ No newline at end of file
@@ -0,0 +1,20 @@
+-- NOTE: admin, manager or user, auth.totp_required_roles lists the roles that must enroll a second factor
+ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(20) NOT NULL DEFAULT 'user' CHECK (role IN ('admin', 'manager', 'user'));
+
+-- NOTE: secrets are AES-GCM encrypted with a key derived from auth.secret, changing the secret disables every enrollment
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret TEXT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_pending_secret TEXT NULL; -- NOTE: set by an enrollment until its first code is confirmed
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NULL; -- NOTE: time step of the last accepted code, a code is never accepted twice
+
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS require_totp BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    code_hash CHAR(64) UNIQUE NOT NULL, -- NOTE: HMAC-SHA256 of the code with auth.secret, the codes are only shown once
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS user_recovery_codes_user_id_idx ON user_recovery_codes (user_id);
\ No newline at end of file
@@ -0,0 +1,18 @@
+-- NOTE: service accounts have no password, they call the API with the tokens an admin of their tenant creates for them
+ALTER TABLE users ADD COLUMN IF NOT EXISTS service_account BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    prefix VARCHAR(12) NOT NULL, -- NOTE: first characters of the token, shown in lists to recognize it
+    token_hash CHAR(64) UNIQUE NOT NULL, -- NOTE: HMAC-SHA256 of the token with auth.secret, the token itself is only returned by the create
+    scopes TEXT[] NOT NULL, -- NOTE: read, write, tokens and scim
+    expires_at TIMESTAMP NOT NULL,
+    last_used_at TIMESTAMP NULL, -- NOTE: updated at most once a minute
+    last_used_ip VARCHAR(45) NULL,
+    revoked_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS api_tokens_user_id_idx ON api_tokens (user_id);
\ No newline at end of file
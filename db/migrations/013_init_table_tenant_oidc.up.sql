@@ -0,0 +1,22 @@
+CREATE TABLE IF NOT EXISTS tenant_oidc (
+    tenant_id INT PRIMARY KEY REFERENCES tenants (id) ON DELETE CASCADE,
+    issuer TEXT NOT NULL, -- NOTE: discovered at <issuer>/.well-known/openid-configuration
+    client_id TEXT NOT NULL,
+    client_secret TEXT NULL, -- NOTE: AES-GCM encrypted with a key derived from auth.secret, NULL for a public client
+    scopes TEXT[] NOT NULL DEFAULT '{email,profile}', -- NOTE: openid is always requested
+    groups_claim VARCHAR(100) NOT NULL DEFAULT 'groups',
+    role_mapping JSONB NOT NULL DEFAULT '{}', -- NOTE: IdP group to role, the highest role of the groups of the user wins
+    default_role VARCHAR(20) NOT NULL DEFAULT 'user' CHECK (default_role IN ('admin', 'manager', 'user')),
+    jit_provisioning BOOLEAN NOT NULL DEFAULT TRUE, -- NOTE: create the users logging in for the first time
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+DROP TRIGGER IF EXISTS tenant_oidc_set_updated_at ON tenant_oidc;
+CREATE TRIGGER tenant_oidc_set_updated_at BEFORE UPDATE ON tenant_oidc FOR EACH ROW EXECUTE FUNCTION set_updated_at();
+
+-- NOTE: identity of the users logging in with OpenID Connect, set on their first login
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_issuer TEXT NULL;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject TEXT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_oidc_identity_idx ON users (oidc_issuer, oidc_subject);
\ No newline at end of file
@@ -0,0 +1,6 @@
+-- NOTE: id of the user in the client provisioning it with SCIM (an HR system or an identity provider), unique in its tenant
+ALTER TABLE users ADD COLUMN IF NOT EXISTS scim_external_id TEXT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS users_scim_external_id_idx ON users (tenant_id, scim_external_id);
+
+-- NOTE: SCIM clients look users up by userName, case insensitive
+CREATE INDEX IF NOT EXISTS users_tenant_username_idx ON users (tenant_id, LOWER(username));
\ No newline at end of file
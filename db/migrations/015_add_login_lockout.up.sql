@@ -0,0 +1,19 @@
+-- NOTE: failed checks of the password or code in a row, reset by a success or an unlock, auth.lockout_threshold of them lock the user
+ALTER TABLE users ADD COLUMN IF NOT EXISTS failed_logins INT NOT NULL DEFAULT 0;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP NULL;
+
+-- NOTE: every credential check, attempts older than auth.login_history_retention are deleted as new ones are recorded
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INT NULL REFERENCES users (id) ON DELETE CASCADE, -- NOTE: NULL when the login matches no user
+    login VARCHAR(255) NOT NULL,
+    ip VARCHAR(45) NOT NULL,
+    user_agent VARCHAR(255) NOT NULL,
+    success BOOLEAN NOT NULL,
+    reason VARCHAR(30) NOT NULL DEFAULT '', -- NOTE: why the attempt failed, empty for a success
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS login_attempts_user_id_idx ON login_attempts (user_id, id);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_created_at_idx ON login_attempts (created_at);
\ No newline at end of file
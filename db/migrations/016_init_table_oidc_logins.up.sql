@@ -0,0 +1,11 @@
+-- NOTE: single sign-ons started at a provider, deleted by the callback that completes them
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    state_hash CHAR(64) PRIMARY KEY, -- NOTE: HMAC-SHA256 of the state with auth.secret, the state itself is only sent to the browser
+    tenant_id INT NOT NULL REFERENCES tenants (id) ON DELETE CASCADE,
+    nonce TEXT NOT NULL,
+    verifier TEXT NOT NULL, -- NOTE: PKCE code verifier, sent with the code to the token endpoint
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS oidc_logins_expires_at_idx ON oidc_logins (expires_at);
\ No newline at end of file
@@ -0,0 +1,3 @@
+-- NOTE: user and tenant of the API token creating the job, NULL without a token; only the user and the admins of the tenant read the job
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS created_by INT NULL REFERENCES users (id) ON DELETE SET NULL;
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS tenant_id INT NULL;
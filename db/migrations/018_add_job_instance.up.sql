@@ -0,0 +1,5 @@
+-- NOTE: jobs.instance of the process running the job, only that instance fails it after a restart and holds its file; empty for the jobs created before
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS instance VARCHAR(255) NOT NULL DEFAULT '';
+
+-- NOTE: finished jobs older than jobs.retention are deleted with their files
+CREATE INDEX IF NOT EXISTS jobs_instance_finished_at_idx ON jobs (instance, finished_at);
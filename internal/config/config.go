@@ -1,37 +1,394 @@
 package config
 
 import (
-	"log"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
+	"portier/internal/service"
+	"portier/pkg/db"
+	"portier/pkg/idempotency"
+	"portier/pkg/mail"
+	"portier/pkg/ratelimit"
+	"portier/pkg/tracing"
+	"reflect"
+	"strings"
+	"time"
 
+	"github.com/joho/godotenv"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 )
 
+// EnvPrefix prefixes the environment variables overriding a setting,
+// e.g. PORTIER_SERVER_PORT overrides server.port
+const EnvPrefix = "PORTIER"
+
+// ErrHelp is returned by Load when the flags ask for the usage, which is already printed
+var ErrHelp = pflag.ErrHelp
+
+// Config is the effective configuration of the application.
+// String values may reference environment variables as ${NAME}, they are
+// expanded after loading. Settings tagged redact are hidden by Print.
 type Config struct {
-	ServerPort  string
-	PostgresDSN string
+	Server      ServerConfig       `mapstructure:"server" yaml:"server"`
+	Database    DatabaseConfig     `mapstructure:"database" yaml:"database"`
+	CORS        CORSConfig         `mapstructure:"cors" yaml:"cors"`
+	Security    SecurityConfig     `mapstructure:"security" yaml:"security"`
+	RateLimit   ratelimit.Config   `mapstructure:"ratelimit" yaml:"ratelimit"`
+	Idempotency idempotency.Config `mapstructure:"idempotency" yaml:"idempotency"`
+	Auth        AuthConfig         `mapstructure:"auth" yaml:"auth"`
+	Mail        MailConfig         `mapstructure:"mail" yaml:"mail"`
+	OIDC        OIDCConfig         `mapstructure:"oidc" yaml:"oidc"`
+	Log         LogConfig          `mapstructure:"log" yaml:"log"`
+	Metrics     MetricsConfig      `mapstructure:"metrics" yaml:"metrics"`
+	Tracing     tracing.Config     `mapstructure:"tracing" yaml:"tracing"`
+	Health      HealthConfig       `mapstructure:"health" yaml:"health"`
+	Shutdown    ShutdownConfig     `mapstructure:"shutdown" yaml:"shutdown"`
+	Timeouts    service.Timeouts   `mapstructure:"timeouts" yaml:"timeouts"`
+	Cache       CacheConfig        `mapstructure:"cache" yaml:"cache"`
+	Jobs        JobsConfig         `mapstructure:"jobs" yaml:"jobs"`
+	Defaults    DefaultsConfig     `mapstructure:"defaults" yaml:"defaults"`
+	Features    Features           `mapstructure:"features" yaml:"features"`
+}
+
+type ServerConfig struct {
+	Port           string    `mapstructure:"port" yaml:"port"`                       // Address the API listens on, e.g. ":4000"
+	ProxyHeader    string    `mapstructure:"proxy_header" yaml:"proxy_header"`       // Header holding the client IP behind a proxy, e.g. X-Forwarded-For
+	TrustedProxies []string  `mapstructure:"trusted_proxies" yaml:"trusted_proxies"` // Proxies allowed to set ProxyHeader, required with it
+	TLS            TLSConfig `mapstructure:"tls" yaml:"tls"`
 }
 
-func LoadConfig() Config {
-	viper.SetConfigName("config")
-	viper.SetConfigType("yaml")
-	viper.AddConfigPath(".")
+// TLSConfig serves the API over HTTPS when CertFile and KeyFile are set
+type TLSConfig struct {
+	CertFile       string `mapstructure:"cert_file" yaml:"cert_file"` // PEM certificate chain, reloaded when it changes
+	KeyFile        string `mapstructure:"key_file" yaml:"key_file"`
+	MinVersion     string `mapstructure:"min_version" yaml:"min_version"`         // 1.2 or 1.3
+	ClientCAFile   string `mapstructure:"client_ca_file" yaml:"client_ca_file"`   // PEM authorities signing client certificates
+	ClientAuth     string `mapstructure:"client_auth" yaml:"client_auth"`         // none, optional or require
+	RedirectListen string `mapstructure:"redirect_listen" yaml:"redirect_listen"` // Plain HTTP address redirecting to HTTPS, e.g. ":80"
+}
+
+// Enabled reports whether the API is served over HTTPS
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
 
-	// Automatically read environment variables
-	viper.AutomaticEnv()
+type DatabaseConfig struct {
+	DSN               string        `mapstructure:"dsn" yaml:"dsn" redact:"password"`
+	MaxConns          int           `mapstructure:"max_conns" yaml:"max_conns"`
+	MinConns          int           `mapstructure:"min_conns" yaml:"min_conns"`
+	MaxConnLifetime   time.Duration `mapstructure:"max_conn_lifetime" yaml:"max_conn_lifetime"`
+	MaxConnIdleTime   time.Duration `mapstructure:"max_conn_idle_time" yaml:"max_conn_idle_time"`
+	HealthCheckPeriod time.Duration `mapstructure:"health_check_period" yaml:"health_check_period"`
+}
 
-	// Read the configuration file
-	if err := viper.ReadInConfig(); err != nil {
-		log.Fatalf("Error reading config file: %v", err)
+// Pool returns the sizing of the connection pool
+func (d DatabaseConfig) Pool() db.PoolConfig {
+	return db.PoolConfig{
+		MaxConns:          int32(d.MaxConns),
+		MinConns:          int32(d.MinConns),
+		MaxConnLifetime:   d.MaxConnLifetime,
+		MaxConnIdleTime:   d.MaxConnIdleTime,
+		HealthCheckPeriod: d.HealthCheckPeriod,
 	}
+}
+
+type CORSConfig struct {
+	AllowOrigins     []string      `mapstructure:"allow_origins" yaml:"allow_origins"` // "*" or origins such as https://app.example.com
+	AllowMethods     []string      `mapstructure:"allow_methods" yaml:"allow_methods"`
+	AllowHeaders     []string      `mapstructure:"allow_headers" yaml:"allow_headers"`
+	ExposeHeaders    []string      `mapstructure:"expose_headers" yaml:"expose_headers"`
+	AllowCredentials bool          `mapstructure:"allow_credentials" yaml:"allow_credentials"` // Cookies and Authorization from the browser, requires explicit origins
+	MaxAge           time.Duration `mapstructure:"max_age" yaml:"max_age"`                     // How long browsers cache a preflight response
+}
+
+// SecurityConfig sets the security headers of every response
+type SecurityConfig struct {
+	HSTSMaxAge            time.Duration `mapstructure:"hsts_max_age" yaml:"hsts_max_age"` // Sent over HTTPS only, 0 disables HSTS
+	HSTSIncludeSubdomains bool          `mapstructure:"hsts_include_subdomains" yaml:"hsts_include_subdomains"`
+	HSTSPreload           bool          `mapstructure:"hsts_preload" yaml:"hsts_preload"`
+	ContentSecurityPolicy string        `mapstructure:"content_security_policy" yaml:"content_security_policy"` // /docs uses its own policy to load the Swagger UI
+	FrameOptions          string        `mapstructure:"frame_options" yaml:"frame_options"`                     // DENY or SAMEORIGIN
+	ReferrerPolicy        string        `mapstructure:"referrer_policy" yaml:"referrer_policy"`
+}
+
+type AuthConfig struct {
+	Secret               string        `mapstructure:"secret" yaml:"secret" redact:"true"`                   // Key signing and hashing tokens, at least 32 characters
+	ResetTokenTTL        time.Duration `mapstructure:"reset_token_ttl" yaml:"reset_token_ttl"`               // Validity of a password reset link
+	VerificationTokenTTL time.Duration `mapstructure:"verification_token_ttl" yaml:"verification_token_ttl"` // Validity of an email verification link
+	RequireToken         bool          `mapstructure:"require_token" yaml:"require_token"`                   // Refuse the requests without an API token
+	TokenTTL             time.Duration `mapstructure:"token_ttl" yaml:"token_ttl"`                           // Expiry of an API token created without expires_at
+	TokenMaxTTL          time.Duration `mapstructure:"token_max_ttl" yaml:"token_max_ttl"`                   // Latest expiry of an API token
+	TOTPIssuer           string        `mapstructure:"totp_issuer" yaml:"totp_issuer"`                       // Shown by the authenticator apps
+	TOTPRequiredRoles    []string      `mapstructure:"totp_required_roles" yaml:"totp_required_roles"`       // Roles that must enroll a second factor
+	LockoutThreshold     int           `mapstructure:"lockout_threshold" yaml:"lockout_threshold"`           // Failures in a row locking a user, 0 disables the lock
+	LockoutDuration      time.Duration `mapstructure:"lockout_duration" yaml:"lockout_duration"`             // First lock, doubled by every further failure
+	LockoutMaxDuration   time.Duration `mapstructure:"lockout_max_duration" yaml:"lockout_max_duration"`     // Longest lock
+	IPLockoutThreshold   int           `mapstructure:"ip_lockout_threshold" yaml:"ip_lockout_threshold"`     // Failures within ip_lockout_window refusing an address, 0 disables it
+	IPLockoutWindow      time.Duration `mapstructure:"ip_lockout_window" yaml:"ip_lockout_window"`
+	HistoryRetention     time.Duration `mapstructure:"login_history_retention" yaml:"login_history_retention"` // Age of the oldest login attempts kept
+}
+
+// MailConfig selects how the account emails are sent
+type MailConfig struct {
+	Backend string          `mapstructure:"backend" yaml:"backend"`   // smtp, file, memory or none
+	From    string          `mapstructure:"from" yaml:"from"`         // Sender address, e.g. "Portier <no-reply@example.com>"
+	LinkURL string          `mapstructure:"link_url" yaml:"link_url"` // Frontend base URL of the links sent by email
+	Dir     string          `mapstructure:"dir" yaml:"dir"`           // Directory of the .eml files of the file backend
+	SMTP    mail.SMTPConfig `mapstructure:"smtp" yaml:"smtp"`
+}
+
+// OIDCConfig sets the single sign-on, the providers themselves are set per tenant
+type OIDCConfig struct {
+	RedirectURL string        `mapstructure:"redirect_url" yaml:"redirect_url"` // Redirect URI registered at every provider, <API URL>/oidc/callback
+	StateTTL    time.Duration `mapstructure:"state_ttl" yaml:"state_ttl"`       // Time a user has to log in at the provider
+	SessionTTL  time.Duration `mapstructure:"session_ttl" yaml:"session_ttl"`   // Expiry of the API token returned by a login
+	HTTPTimeout time.Duration `mapstructure:"http_timeout" yaml:"http_timeout"` // Every request to a provider
+	CacheTTL    time.Duration `mapstructure:"cache_ttl" yaml:"cache_ttl"`       // Discovery documents and signing keys
+}
+
+type LogConfig struct {
+	Level string `mapstructure:"level" yaml:"level"` // debug, info, warn or error
+}
 
-	// Get the PostgreSQL DSN and replace environment variables
-	postgresDSN := viper.GetString("database.dsn")
-	postgresDSN = os.ExpandEnv(postgresDSN) // Ensure environment variables are expanded
+type MetricsConfig struct {
+	Listen string `mapstructure:"listen" yaml:"listen"`             // Admin address serving /metrics, empty = served by the API when Token is set
+	Token  string `mapstructure:"token" yaml:"token" redact:"true"` // Bearer token required by /metrics, empty = no token on the admin address
+}
+
+type HealthConfig struct {
+	MigrationsDir string `mapstructure:"migrations_dir" yaml:"migrations_dir"` // Migration files that must be applied before /readyz succeeds
+}
+
+type ShutdownConfig struct {
+	DrainDelay time.Duration `mapstructure:"drain_delay" yaml:"drain_delay"` // Time between failing /readyz and stopping the server
+	Timeout    time.Duration `mapstructure:"timeout" yaml:"timeout"`         // Time allowed to finish requests and jobs and release resources after the drain
+}
+
+// CacheConfig selects the backend of the read-through cache and its TTLs
+type CacheConfig struct {
+	Backend             string `mapstructure:"backend" yaml:"backend"` // postgres, memory or none
+	service.CacheConfig `mapstructure:",squash" yaml:",inline"`
+}
+
+type JobsConfig struct {
+	Dir       string        `mapstructure:"dir" yaml:"dir"`             // Directory for import and export files
+	Instance  string        `mapstructure:"instance" yaml:"instance"`   // Name of this instance in the jobs table, the host name when empty
+	Retention time.Duration `mapstructure:"retention" yaml:"retention"` // Finished jobs older than this are deleted with their files
+}
+
+type DefaultsConfig struct {
+	TenantID  int `mapstructure:"tenant_id" yaml:"tenant_id"`   // 0 = no fallback, users must be created with an explicit tenant_id
+	CreatorID int `mapstructure:"creator_id" yaml:"creator_id"` // 0 = no fallback, keys and copies must be created with an API token
+}
+
+// Features switch optional parts of the API on and off
+type Features struct {
+	Batch   bool `mapstructure:"batch" yaml:"batch"`     // POST /<entity>:batch
+	Imports bool `mapstructure:"imports" yaml:"imports"` // /imports
+	Exports bool `mapstructure:"exports" yaml:"exports"` // /exports and list exports (?format=csv)
+	Docs    bool `mapstructure:"docs" yaml:"docs"`       // /openapi.json and /docs
+	SCIM    bool `mapstructure:"scim" yaml:"scim"`       // /scim/v2
+}
+
+// setting is a configuration key with its default value, which also sets the type of its flag
+type setting struct {
+	key   string
+	value any
+	usage string
+}
+
+var settings = []setting{
+	{"server.port", ":4000", "address the API listens on"},
+	{"server.proxy_header", "", "header holding the client IP behind a proxy, e.g. X-Forwarded-For"},
+	{"server.trusted_proxies", []string{}, "IPs or CIDRs of the proxies allowed to set the proxy header"},
+	{"server.tls.cert_file", "", "PEM certificate chain, enables HTTPS"},
+	{"server.tls.key_file", "", "PEM private key of the certificate"},
+	{"server.tls.min_version", "1.2", "minimum TLS version, 1.2 or 1.3"},
+	{"server.tls.client_ca_file", "", "PEM authorities signing client certificates"},
+	{"server.tls.client_auth", "none", "client certificates: none, optional or require"},
+	{"server.tls.redirect_listen", "", "plain HTTP address redirecting to HTTPS"},
+	{"database.dsn", "postgres://${DB_USER}:${DB_PASS}@${DB_HOST}:${DB_PORT}/${DB_NAME}?sslmode=disable", "PostgreSQL connection string"},
+	{"database.max_conns", 10, "maximum number of pooled connections"},
+	{"database.min_conns", 0, "connections kept open when idle"},
+	{"database.max_conn_lifetime", time.Hour, "connections are replaced after this duration"},
+	{"database.max_conn_idle_time", 30 * time.Minute, "idle connections are closed after this duration"},
+	{"database.health_check_period", time.Minute, "how often idle connections are checked"},
+	{"cors.allow_origins", []string{"*"}, "origins allowed to call the API"},
+	{"cors.allow_methods", []string{"GET", "POST", "PUT", "PATCH", "DELETE", "HEAD", "OPTIONS"}, "methods allowed by CORS"},
+	{"cors.allow_headers", []string{"Content-Type", "Authorization", "X-Request-ID", "traceparent", "tracestate", "If-Match", "If-None-Match", "If-Modified-Since", "Idempotency-Key"}, "request headers allowed by CORS"},
+	{"cors.expose_headers", []string{"X-Request-ID", "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", "ETag", "Last-Modified", "Idempotent-Replayed", "WWW-Authenticate"}, "response headers readable by the browser"},
+	{"cors.allow_credentials", false, "allow cookies and credentials, requires explicit origins"},
+	{"cors.max_age", 10 * time.Minute, "how long browsers cache a preflight response"},
+	{"security.hsts_max_age", 365 * 24 * time.Hour, "Strict-Transport-Security max-age, sent over HTTPS only, 0 disables it"},
+	{"security.hsts_include_subdomains", false, "apply HSTS to every subdomain"},
+	{"security.hsts_preload", false, "allow the HSTS preload list, requires hsts_include_subdomains"},
+	{"security.content_security_policy", "default-src 'none'; frame-ancestors 'none'", "Content-Security-Policy of the API responses"},
+	{"security.frame_options", "DENY", "X-Frame-Options, DENY or SAMEORIGIN"},
+	{"security.referrer_policy", "no-referrer", "Referrer-Policy"},
+	{"ratelimit.enabled", true, "limit the requests of every IP, user and tenant"},
+	{"ratelimit.window", time.Minute, "duration of a rate limit window"},
+	{"ratelimit.read.ip", 300, "reads per window and IP"},
+	{"ratelimit.read.user", 600, "reads per window and user"},
+	{"ratelimit.read.tenant", 6000, "reads per window and tenant"},
+	{"ratelimit.write.ip", 60, "writes per window and IP"},
+	{"ratelimit.write.user", 120, "writes per window and user"},
+	{"ratelimit.write.tenant", 1200, "writes per window and tenant"},
+	{"ratelimit.credential.ip", 10, "credential requests per window and IP"},
+	{"ratelimit.credential.user", 10, "credential requests per window and user"},
+	{"ratelimit.credential.tenant", 100, "credential requests per window and tenant"},
+	{"idempotency.enabled", true, "replay the response of a POST retried with the same Idempotency-Key"},
+	{"idempotency.window", 24 * time.Hour, "how long the response of an Idempotency-Key is kept"},
+	{"idempotency.in_flight_ttl", time.Minute, "a key whose request never finished is released after this duration"},
+	{"idempotency.max_key_length", 255, "longest Idempotency-Key accepted"},
+	{"auth.secret", "${AUTH_SECRET}", "key signing and hashing tokens, required, at least 32 characters"},
+	{"auth.reset_token_ttl", time.Hour, "validity of a password reset link"},
+	{"auth.verification_token_ttl", 48 * time.Hour, "validity of an email verification link"},
+	{"auth.require_token", false, "refuse the requests without an API token"},
+	{"auth.token_ttl", 90 * 24 * time.Hour, "expiry of an API token created without expires_at"},
+	{"auth.token_max_ttl", 365 * 24 * time.Hour, "latest expiry of an API token"},
+	{"auth.totp_issuer", "Portier", "issuer shown by the authenticator apps"},
+	{"auth.totp_required_roles", []string{}, "roles that must enroll a TOTP second factor"},
+	{"auth.lockout_threshold", 5, "failed logins in a row locking a user, 0 disables the lock"},
+	{"auth.lockout_duration", time.Minute, "first lock of a user, doubled by every further failure"},
+	{"auth.lockout_max_duration", time.Hour, "longest lock of a user"},
+	{"auth.ip_lockout_threshold", 50, "failed logins within auth.ip_lockout_window refusing an address, 0 disables it"},
+	{"auth.ip_lockout_window", 15 * time.Minute, "window of the failed logins of an address"},
+	{"auth.login_history_retention", 90 * 24 * time.Hour, "age of the oldest login attempts kept"},
+	{"mail.backend", "file", "account emails: smtp, file (mail.dir), memory or none"},
+	{"mail.from", "Portier <no-reply@localhost>", "sender of the account emails"},
+	{"mail.link_url", "http://localhost:3000", "frontend base URL of the links sent by email"},
+	{"mail.dir", "data/mail", "directory of the .eml files of the file backend"},
+	{"mail.smtp.host", "", "SMTP server"},
+	{"mail.smtp.port", 587, "SMTP port, 587 (STARTTLS) or 465 (TLS)"},
+	{"mail.smtp.username", "", "SMTP user, empty sends without authentication"},
+	{"mail.smtp.password", "${SMTP_PASSWORD}", "SMTP password"},
+	{"oidc.redirect_url", "http://localhost:4000/oidc/callback", "redirect URI registered at the OpenID Connect providers"},
+	{"oidc.state_ttl", 10 * time.Minute, "time a user has to log in at the provider"},
+	{"oidc.session_ttl", 8 * time.Hour, "expiry of the API token returned by a single sign-on"},
+	{"oidc.http_timeout", 10 * time.Second, "timeout of the requests to the providers"},
+	{"oidc.cache_ttl", time.Hour, "lifetime of the cached discovery documents and signing keys"},
+	{"log.level", "info", "debug, info, warn or error"},
+	{"metrics.listen", ":9091", "admin address serving /metrics, empty serves it on the API"},
+	{"metrics.token", "${METRICS_TOKEN}", "bearer token required by /metrics"},
+	{"tracing.exporter", tracing.ExporterNone, "none, stdout or otlp"},
+	{"tracing.endpoint", "", "OTLP/HTTP collector host:port"},
+	{"tracing.insecure", true, "send OTLP without TLS"},
+	{"tracing.sample_ratio", 1.0, "share of new traces recorded"},
+	{"tracing.service_name", "portier", "service.name of the spans"},
+	{"health.migrations_dir", "db/migrations", "migrations that must be applied before /readyz succeeds"},
+	{"shutdown.drain_delay", 5 * time.Second, "time /readyz reports draining before the server stops"},
+	{"shutdown.timeout", 30 * time.Second, "time allowed to release resources after the drain"},
+	{"timeouts.read", 5 * time.Second, "database time of a read"},
+	{"timeouts.write", 5 * time.Second, "database time of a write"},
+	{"timeouts.batch", 60 * time.Second, "database time of a batch or an import chunk"},
+	{"timeouts.export", 10 * time.Minute, "database time of an export"},
+	{"cache.backend", "postgres", "read-through cache: postgres (cache table), memory or none"},
+	{"cache.item_ttl", time.Minute, "how long a row read by id stays cached, 0 disables it"},
+	{"cache.list_ttl", 15 * time.Second, "how long a list page stays cached, 0 disables it"},
+	{"cache.max_list_offset", 100, "list pages with a larger offset are not cached"},
+	{"jobs.dir", "data/jobs", "directory of import and export files"},
+	{"jobs.instance", "", "name of this instance in the jobs table, the host name when empty"},
+	{"jobs.retention", 7 * 24 * time.Hour, "age of the oldest finished jobs kept with their files"},
+	{"defaults.tenant_id", 0, "tenant of users created without tenant_id, 0 disables the fallback"},
+	{"defaults.creator_id", 0, "creator of keys and copies created without an API token, 0 disables the fallback"},
+	{"features.batch", true, "enable the batch endpoints"},
+	{"features.imports", true, "enable imports"},
+	{"features.exports", true, "enable exports"},
+	{"features.docs", true, "serve /openapi.json and /docs"},
+	{"features.scim", true, "enable the SCIM provisioning endpoints"},
+}
+
+// Load reads the configuration in order of precedence: defaults, then the
+// config file, then PORTIER_* environment variables, then the flags of args.
+// The .env file and config.yaml are optional. The returned Config is filled
+// even when it is invalid, the error is then a *ValidationError.
+func Load(args []string) (Config, error) {
+	// Variables already set in the environment win over .env
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Config{}, fmt.Errorf("failed to load .env: %w", err)
+	}
+
+	v := viper.New()
+	flags := pflag.NewFlagSet("portier", pflag.ContinueOnError)
+	configFile := flags.String("config", "", "config file, default ./config.yaml when it exists")
+	for _, s := range settings {
+		v.SetDefault(s.key, s.value)
+		addFlag(flags, s)
+	}
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	// An explicit config file must exist, the default one may be missing
+	if *configFile != "" {
+		v.SetConfigFile(*configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return Config{}, fmt.Errorf("failed to read %s: %w", *configFile, err)
+		}
+	} else {
+		v.SetConfigName("config")
+		v.SetConfigType("yaml")
+		v.AddConfigPath(".")
+		var notFound viper.ConfigFileNotFoundError
+		if err := v.ReadInConfig(); err != nil && !errors.As(err, &notFound) {
+			return Config{}, fmt.Errorf("failed to read config.yaml: %w", err)
+		}
+	}
+
+	v.SetEnvPrefix(EnvPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	v.AutomaticEnv()
+
+	// Only flags given on the command line override the other sources
+	for _, s := range settings {
+		if err := v.BindPFlag(s.key, flags.Lookup(s.key)); err != nil {
+			return Config{}, err
+		}
+	}
+
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return Config{}, fmt.Errorf("failed to decode the configuration: %w", err)
+	}
+	expandEnv(reflect.ValueOf(&cfg).Elem())
+
+	return cfg, cfg.Validate()
+}
+
+// addFlag registers the flag of a setting, e.g. --server.port
+func addFlag(flags *pflag.FlagSet, s setting) {
+	switch value := s.value.(type) {
+	case string:
+		flags.String(s.key, value, s.usage)
+	case int:
+		flags.Int(s.key, value, s.usage)
+	case bool:
+		flags.Bool(s.key, value, s.usage)
+	case float64:
+		flags.Float64(s.key, value, s.usage)
+	case time.Duration:
+		flags.Duration(s.key, value, s.usage)
+	case []string:
+		flags.StringSlice(s.key, value, s.usage)
+	default:
+		panic(fmt.Sprintf("unsupported type %T for setting %s", value, s.key))
+	}
+}
 
-	// Return the config struct with updated values
-	return Config{
-		ServerPort:  viper.GetString("server.port"),
-		PostgresDSN: postgresDSN,
+// expandEnv replaces ${NAME} by the environment variable in every string of v
+func expandEnv(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			expandEnv(v.Field(i))
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			expandEnv(v.Index(i))
+		}
+	case reflect.String:
+		v.SetString(os.ExpandEnv(v.String()))
 	}
 }
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"io"
+	"net/url"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redacted replaces secret values in the output of Print
+const redacted = "REDACTED"
+
+// Print writes cfg as YAML, in the format of config.yaml, with secrets redacted.
+// Settings tagged redact:"true" are hidden, redact:"password" only hides the
+// password of a connection string.
+func Print(w io.Writer, cfg Config) error {
+	redact(reflect.ValueOf(&cfg).Elem())
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+func redact(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.Struct:
+			redact(field)
+		case reflect.String:
+			if field.String() == "" {
+				continue
+			}
+			switch v.Type().Field(i).Tag.Get("redact") {
+			case "true":
+				field.SetString(redacted)
+			case "password":
+				field.SetString(redactPassword(field.String()))
+			}
+		}
+	}
+}
+
+// redactPassword hides the password of a URL, other connection strings are hidden entirely
+func redactPassword(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err != nil || u.Scheme == "" {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
@@ -0,0 +1,336 @@
+package config
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	netmail "net/mail"
+	"net/url"
+	"os"
+	"portier/internal/service"
+	"portier/pkg/ratelimit"
+	"portier/pkg/tracing"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ValidationError lists every invalid setting, so they can all be fixed at once
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid configuration:\n  - " + strings.Join(e.Problems, "\n  - ")
+}
+
+// Only returns the problems of the given sections, such as "database", nil when
+// there is none. Tools needing a few sections ignore the others.
+func (e *ValidationError) Only(sections ...string) error {
+	var problems []string
+	for _, problem := range e.Problems {
+		for _, section := range sections {
+			if strings.HasPrefix(problem, section+".") || strings.HasPrefix(problem, section+":") {
+				problems = append(problems, problem)
+				break
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationError{Problems: problems}
+}
+
+// Validate checks every setting and returns a *ValidationError listing the invalid ones
+func (cfg Config) Validate() error {
+	var problems []string
+	addf := func(key, format string, args ...any) {
+		problems = append(problems, key+": "+fmt.Sprintf(format, args...))
+	}
+	address := func(key, value string) {
+		_, port, err := net.SplitHostPort(value)
+		if err != nil {
+			addf(key, "%q is not an address such as :4000", value)
+			return
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+			addf(key, "invalid port %q in %q", port, value)
+		}
+	}
+	file := func(key, path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			addf(key, "%v", err)
+		}
+	}
+	positive := func(key string, d time.Duration) {
+		if d <= 0 {
+			addf(key, "must be greater than 0, got %s", d)
+		}
+	}
+
+	// Server
+	address("server.port", cfg.Server.Port)
+
+	// Without trusted proxies any client could set the header, and pick the IP of the rate limits and lockouts
+	if cfg.Server.ProxyHeader != "" && len(cfg.Server.TrustedProxies) == 0 {
+		addf("server.trusted_proxies", "is required when server.proxy_header is set")
+	}
+	for _, proxy := range cfg.Server.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				addf("server.trusted_proxies", "%q is not an IP address or a CIDR range", proxy)
+			}
+		}
+	}
+
+	// TLS, the files are only checked to exist, they are loaded at startup
+	if tls := cfg.Server.TLS; tls.Enabled() {
+		if tls.CertFile == "" || tls.KeyFile == "" {
+			addf("server.tls", "cert_file and key_file must be set together")
+		}
+		file("server.tls.cert_file", tls.CertFile)
+		file("server.tls.key_file", tls.KeyFile)
+		if tls.MinVersion != "1.2" && tls.MinVersion != "1.3" {
+			addf("server.tls.min_version", "%q is not 1.2 or 1.3", tls.MinVersion)
+		}
+		switch tls.ClientAuth {
+		case "none":
+		case "optional", "require":
+			if tls.ClientCAFile == "" {
+				addf("server.tls.client_ca_file", "is required when client_auth is %s", tls.ClientAuth)
+			}
+		default:
+			addf("server.tls.client_auth", "%q is not one of none, optional or require", tls.ClientAuth)
+		}
+		file("server.tls.client_ca_file", tls.ClientCAFile)
+		if tls.RedirectListen != "" {
+			address("server.tls.redirect_listen", tls.RedirectListen)
+		}
+	} else if cfg.Server.TLS.RedirectListen != "" || cfg.Server.TLS.ClientCAFile != "" {
+		addf("server.tls", "redirect_listen and client_ca_file require cert_file and key_file")
+	}
+
+	// Database, the connection string is checked without connecting
+	if cfg.Database.DSN == "" {
+		addf("database.dsn", "is required")
+	} else if _, err := pgxpool.ParseConfig(cfg.Database.DSN); err != nil {
+		addf("database.dsn", "%v", err)
+	}
+	if cfg.Database.MaxConns < 1 {
+		addf("database.max_conns", "must be at least 1, got %d", cfg.Database.MaxConns)
+	}
+	if cfg.Database.MinConns < 0 || cfg.Database.MinConns > cfg.Database.MaxConns {
+		addf("database.min_conns", "must be between 0 and database.max_conns (%d), got %d", cfg.Database.MaxConns, cfg.Database.MinConns)
+	}
+	positive("database.max_conn_lifetime", cfg.Database.MaxConnLifetime)
+	positive("database.max_conn_idle_time", cfg.Database.MaxConnIdleTime)
+	positive("database.health_check_period", cfg.Database.HealthCheckPeriod)
+
+	// CORS
+	if len(cfg.CORS.AllowOrigins) == 0 {
+		addf("cors.allow_origins", "at least one origin is required, use \"*\" to allow all")
+	}
+	for _, origin := range cfg.CORS.AllowOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			addf("cors.allow_origins", "%q is not an origin such as https://app.example.com", origin)
+		}
+	}
+
+	for _, method := range cfg.CORS.AllowMethods {
+		switch method {
+		case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+		default:
+			addf("cors.allow_methods", "%q is not an HTTP method in upper case", method)
+		}
+	}
+	if cfg.CORS.AllowCredentials && slices.Contains(cfg.CORS.AllowOrigins, "*") {
+		addf("cors.allow_credentials", "requires explicit origins, browsers reject credentials with \"*\"")
+	}
+	if cfg.CORS.MaxAge < 0 {
+		addf("cors.max_age", "must not be negative, got %s", cfg.CORS.MaxAge)
+	}
+
+	// Security headers
+	if cfg.Security.HSTSMaxAge < 0 {
+		addf("security.hsts_max_age", "must not be negative, got %s", cfg.Security.HSTSMaxAge)
+	}
+	if cfg.Security.HSTSPreload && (!cfg.Security.HSTSIncludeSubdomains || cfg.Security.HSTSMaxAge < 365*24*time.Hour) {
+		addf("security.hsts_preload", "requires hsts_include_subdomains and an hsts_max_age of at least 8760h")
+	}
+	if cfg.Security.FrameOptions != "DENY" && cfg.Security.FrameOptions != "SAMEORIGIN" {
+		addf("security.frame_options", "%q is not DENY or SAMEORIGIN", cfg.Security.FrameOptions)
+	}
+
+	// Rate limits
+	if cfg.RateLimit.Enabled && cfg.RateLimit.Window < time.Second {
+		addf("ratelimit.window", "must be at least 1s, got %s", cfg.RateLimit.Window)
+	}
+	budgets := []struct {
+		class  string
+		budget ratelimit.Budget
+	}{{"read", cfg.RateLimit.Read}, {"write", cfg.RateLimit.Write}, {"credential", cfg.RateLimit.Credential}}
+	for _, b := range budgets {
+		if b.budget.IP < 0 || b.budget.User < 0 || b.budget.Tenant < 0 {
+			addf("ratelimit."+b.class, "budgets must not be negative, use 0 to disable one")
+		}
+	}
+
+	// Idempotency keys
+	if cfg.Idempotency.Enabled {
+		positive("idempotency.window", cfg.Idempotency.Window)
+		positive("idempotency.in_flight_ttl", cfg.Idempotency.InFlightTTL)
+		if cfg.Idempotency.MaxKeyLength <= 0 {
+			addf("idempotency.max_key_length", "must be positive, got %d", cfg.Idempotency.MaxKeyLength)
+		}
+	}
+
+	// Auth
+	if len(cfg.Auth.Secret) < 32 {
+		addf("auth.secret", "is required, at least 32 characters long, generate one with: openssl rand -hex 32")
+	}
+
+	positive("auth.reset_token_ttl", cfg.Auth.ResetTokenTTL)
+	positive("auth.verification_token_ttl", cfg.Auth.VerificationTokenTTL)
+	positive("auth.token_ttl", cfg.Auth.TokenTTL)
+	positive("auth.token_max_ttl", cfg.Auth.TokenMaxTTL)
+	if cfg.Auth.TokenTTL > cfg.Auth.TokenMaxTTL {
+		addf("auth.token_ttl", "must not be longer than auth.token_max_ttl (%s)", cfg.Auth.TokenMaxTTL)
+	}
+	if cfg.Auth.TOTPIssuer == "" || strings.Contains(cfg.Auth.TOTPIssuer, ":") {
+		addf("auth.totp_issuer", "must not be empty nor contain a colon")
+	}
+	for _, role := range cfg.Auth.TOTPRequiredRoles {
+		if !service.ValidRole(role) {
+			addf("auth.totp_required_roles", "%q is not one of %s", role, strings.Join(service.Roles, ", "))
+		}
+	}
+	if cfg.Auth.LockoutThreshold < 0 {
+		addf("auth.lockout_threshold", "must not be negative, got %d", cfg.Auth.LockoutThreshold)
+	}
+	if cfg.Auth.LockoutThreshold > 0 {
+		positive("auth.lockout_duration", cfg.Auth.LockoutDuration)
+		if cfg.Auth.LockoutDuration > cfg.Auth.LockoutMaxDuration {
+			addf("auth.lockout_duration", "must not be longer than auth.lockout_max_duration (%s)", cfg.Auth.LockoutMaxDuration)
+		}
+	}
+	if cfg.Auth.IPLockoutThreshold < 0 {
+		addf("auth.ip_lockout_threshold", "must not be negative, got %d", cfg.Auth.IPLockoutThreshold)
+	}
+	if cfg.Auth.IPLockoutThreshold > 0 {
+		positive("auth.ip_lockout_window", cfg.Auth.IPLockoutWindow)
+	}
+	positive("auth.login_history_retention", cfg.Auth.HistoryRetention)
+
+	// Mail
+	switch cfg.Mail.Backend {
+	case "smtp":
+		if cfg.Mail.SMTP.Host == "" {
+			addf("mail.smtp.host", "is required by the smtp backend")
+		}
+		if cfg.Mail.SMTP.Port <= 0 || cfg.Mail.SMTP.Port > 65535 {
+			addf("mail.smtp.port", "%d is not a valid port", cfg.Mail.SMTP.Port)
+		}
+	case "file":
+		if cfg.Mail.Dir == "" {
+			addf("mail.dir", "is required by the file backend")
+		}
+	case "memory", "none":
+	default:
+		addf("mail.backend", "%q is not one of smtp, file, memory or none", cfg.Mail.Backend)
+	}
+	if cfg.Mail.Backend != "none" {
+		if _, err := netmail.ParseAddress(cfg.Mail.From); err != nil {
+			addf("mail.from", "%q is not an email address", cfg.Mail.From)
+		}
+		if u, err := url.Parse(cfg.Mail.LinkURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			addf("mail.link_url", "%q is not an http or https URL", cfg.Mail.LinkURL)
+		}
+	}
+
+	// Single sign-on
+	if u, err := url.Parse(cfg.OIDC.RedirectURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		addf("oidc.redirect_url", "%q is not an http or https URL", cfg.OIDC.RedirectURL)
+	}
+	positive("oidc.state_ttl", cfg.OIDC.StateTTL)
+	positive("oidc.session_ttl", cfg.OIDC.SessionTTL)
+	positive("oidc.http_timeout", cfg.OIDC.HTTPTimeout)
+	positive("oidc.cache_ttl", cfg.OIDC.CacheTTL)
+	if cfg.OIDC.SessionTTL > cfg.Auth.TokenMaxTTL {
+		addf("oidc.session_ttl", "must not be longer than auth.token_max_ttl (%s)", cfg.Auth.TokenMaxTTL)
+	}
+
+	// Logging
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Log.Level)); err != nil {
+		addf("log.level", "%q is not one of debug, info, warn or error", cfg.Log.Level)
+	}
+
+	// Metrics
+	if cfg.Metrics.Listen != "" {
+		address("metrics.listen", cfg.Metrics.Listen)
+	}
+
+	// Tracing
+	switch cfg.Tracing.Exporter {
+	case tracing.ExporterNone, tracing.ExporterStdout, tracing.ExporterOTLP:
+	default:
+		addf("tracing.exporter", "%q is not one of none, stdout or otlp", cfg.Tracing.Exporter)
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		addf("tracing.sample_ratio", "must be between 0 and 1, got %v", cfg.Tracing.SampleRatio)
+	}
+
+	// Health, shutdown and timeouts
+	if cfg.Health.MigrationsDir == "" {
+		addf("health.migrations_dir", "is required")
+	}
+	if cfg.Shutdown.DrainDelay < 0 {
+		addf("shutdown.drain_delay", "must not be negative, got %s", cfg.Shutdown.DrainDelay)
+	}
+	positive("shutdown.timeout", cfg.Shutdown.Timeout)
+	positive("timeouts.read", cfg.Timeouts.Read)
+	positive("timeouts.write", cfg.Timeouts.Write)
+	positive("timeouts.batch", cfg.Timeouts.Batch)
+	positive("timeouts.export", cfg.Timeouts.Export)
+
+	// Cache
+	switch cfg.Cache.Backend {
+	case "postgres", "memory", "none":
+	default:
+		addf("cache.backend", "%q is not one of postgres, memory or none", cfg.Cache.Backend)
+	}
+	if cfg.Cache.ItemTTL < 0 || cfg.Cache.ListTTL < 0 {
+		addf("cache", "item_ttl and list_ttl must not be negative, use 0 to disable one")
+	}
+	if cfg.Cache.MaxListOffset < 0 {
+		addf("cache.max_list_offset", "must not be negative, got %d", cfg.Cache.MaxListOffset)
+	}
+
+	// Jobs and defaults
+	if cfg.Jobs.Dir == "" {
+		addf("jobs.dir", "is required")
+	}
+	positive("jobs.retention", cfg.Jobs.Retention)
+	if cfg.Defaults.TenantID < 0 {
+		addf("defaults.tenant_id", "must not be negative, got %d", cfg.Defaults.TenantID)
+	}
+	if cfg.Defaults.CreatorID < 0 {
+		addf("defaults.creator_id", "must not be negative, got %d", cfg.Defaults.CreatorID)
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(*Config)
+		want   string // setting of the only problem, empty when valid
+	}{
+		{"defaults", func(*Config) {}, ""},
+		{"secret missing", func(c *Config) { c.Auth.Secret = "" }, "auth.secret"},
+		{"secret too short", func(c *Config) { c.Auth.Secret = testSecret[:31] }, "auth.secret"},
+		{"secret of 32 characters", func(c *Config) { c.Auth.Secret = testSecret[:32] }, ""},
+		{"proxy header without trusted proxies", func(c *Config) { c.Server.ProxyHeader = "X-Forwarded-For" }, "server.trusted_proxies"},
+		{"proxy header with trusted proxies", func(c *Config) {
+			c.Server.ProxyHeader = "X-Forwarded-For"
+			c.Server.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.10"}
+		}, ""},
+		{"invalid trusted proxy", func(c *Config) {
+			c.Server.ProxyHeader = "X-Forwarded-For"
+			c.Server.TrustedProxies = []string{"proxy.local"}
+		}, "server.trusted_proxies"},
+		{"negative default creator", func(c *Config) { c.Defaults.CreatorID = -1 }, "defaults.creator_id"},
+		{"no job retention", func(c *Config) { c.Jobs.Retention = 0 }, "jobs.retention"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, nil)
+			if err != nil {
+				t.Fatalf("Load = %v", err)
+			}
+			tt.change(&cfg)
+
+			err = cfg.Validate()
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("Validate = %v, want nil", err)
+				}
+				return
+			}
+			var invalid *ValidationError
+			if !errors.As(err, &invalid) || len(invalid.Problems) != 1 || !strings.HasPrefix(invalid.Problems[0], tt.want+":") {
+				t.Errorf("Validate = %v, want one problem of %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidationErrorOnly(t *testing.T) {
+	err := &ValidationError{Problems: []string{
+		"auth.secret: is required",
+		"database.dsn: is required",
+		"databases.other: not a section of database",
+		"mail.from: is not an email address",
+	}}
+
+	var invalid *ValidationError
+	if !errors.As(err.Only("database"), &invalid) || len(invalid.Problems) != 1 || invalid.Problems[0] != "database.dsn: is required" {
+		t.Errorf("Only(database) = %v, want the database.dsn problem", invalid)
+	}
+	if only := err.Only("cors", "log"); only != nil {
+		t.Errorf("Only(cors, log) = %v, want nil", only)
+	}
+}
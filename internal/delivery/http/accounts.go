@@ -0,0 +1,161 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"portier/internal/jobs"
+	"portier/internal/service"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// passwordResetRequest is the body of POST /password-reset
+type passwordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// passwordResetConfirm is the body of POST /password-reset/confirm
+type passwordResetConfirm struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// emailVerificationConfirm is the body of POST /verify-email/confirm
+type emailVerificationConfirm struct {
+	Token string `json:"token"`
+}
+
+// messageResponse is the body of the accepted account requests
+type messageResponse struct {
+	Message string `json:"message"`
+}
+
+/*** ACCOUNT HANDLERS ***/
+
+func requestPasswordReset(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X POST http://localhost:4000/password-reset \
+	// -H "Content-Type: application/json" \
+	// -d '{"email": "ahmadamri.id@gmail.com"}'
+
+	var req passwordResetRequest
+	if err := c.BodyParser(&req); err != nil || req.Email == "" {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "email is required",
+		})
+	}
+
+	// The lookup and the email run in the background, so the time of the answer
+	// does not reveal which addresses have an account either
+	email := req.Email
+	jobs.Go(c.UserContext(), func(ctx context.Context) {
+		if err := service.RequestPasswordReset(ctx, email); err != nil {
+			slog.ErrorContext(ctx, "Error requesting password reset", "error", err)
+		}
+	})
+
+	// The same answer for every address, it must not reveal which ones have an account
+	return c.Status(fiber.StatusAccepted).JSON(messageResponse{
+		Message: "If the address is the verified one of an active user, a reset link was sent to it",
+	})
+}
+
+func confirmPasswordReset(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X POST http://localhost:4000/password-reset/confirm \
+	// -H "Content-Type: application/json" \
+	// -d '{"token": "<token from the email>", "password": "newsecurepassword"}'
+
+	var req passwordResetConfirm
+	if err := c.BodyParser(&req); err != nil || req.Token == "" {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "token and password are required",
+		})
+	}
+
+	if err := service.ResetPassword(c.UserContext(), req.Token, req.Password); err != nil {
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return serverError(c, err, "Error resetting password")
+	}
+
+	return c.Status(fiber.StatusNoContent).SendString("")
+}
+
+func sendEmailVerification(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (a new link, the previous ones stay valid until they expire)
+	// curl -X POST http://localhost:4000/users/1/verify-email -H "Authorization: Bearer ptk_..."
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	// Only the user and the admins of its tenant ask for a link, it must not become a mail relay
+	caller := callerFrom(c)
+	if caller == nil {
+		return unauthorized(c, "An API token of the user or of an admin of its tenant is required")
+	}
+	user, err := service.GetUserByIDUncached(c.UserContext(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return serverError(c, err, "Error fetching user")
+	}
+	if caller.UserID != user.ID && (caller.Role != service.RoleAdmin || caller.TenantID != user.TenantID) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the user and the admins of its tenant ask for a verification link",
+		})
+	}
+
+	if err := service.SendEmailVerification(c.UserContext(), id, true); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return serverError(c, err, "Error sending email verification")
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(messageResponse{
+		Message: "A verification link was sent, unless the address is already verified",
+	})
+}
+
+func confirmEmailVerification(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X POST http://localhost:4000/verify-email/confirm \
+	// -H "Content-Type: application/json" \
+	// -d '{"token": "<token from the email>"}'
+
+	var req emailVerificationConfirm
+	if err := c.BodyParser(&req); err != nil || req.Token == "" {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "token is required",
+		})
+	}
+
+	if err := service.VerifyEmail(c.UserContext(), req.Token); err != nil {
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return serverError(c, err, "Error verifying email")
+	}
+
+	return c.Status(fiber.StatusNoContent).SendString("")
+}
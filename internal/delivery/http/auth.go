@@ -0,0 +1,254 @@
+package http
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"portier/internal/service"
+	"portier/pkg/logging"
+	"regexp"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// requireToken refuses the requests without a token, except to publicRoutes
+var requireToken bool
+
+// publicRoutes are reached without a token, their body carries the credentials
+var publicRoutes = map[string]bool{
+	"/password-reset":         true,
+	"/password-reset/confirm": true,
+	"/verify-email/confirm":   true,
+	"/auth/verify":            true,
+	"/oidc/callback":          true,
+}
+
+// oidcLoginRoute starts a single sign-on, it is public too
+var oidcLoginRoute = regexp.MustCompile(`^/tenants/[^/]+/oidc/login$`)
+
+// tokenRoutes need the tokens scope
+var tokenRoutes = regexp.MustCompile(`^/users/[^/]+/tokens(/|$)`)
+
+// scimRoutes need the scim scope
+var scimRoutes = regexp.MustCompile(`^/scim/v2(/|$)`)
+
+// callerKey is the Locals key of the *service.Caller of the request
+const callerKey = "caller"
+
+// SetAuth makes a token required on every route but the probes, the documentation and publicRoutes
+func SetAuth(require bool) {
+	requireToken = require
+}
+
+// authenticate identifies the caller of a request sent with an
+// "Authorization: Bearer <token>" header, before the rate limits so the user
+// and tenant budgets apply. The token must have the scope of the method.
+func authenticate(c *fiber.Ctx) error {
+	header := c.Get(fiber.HeaderAuthorization)
+	if header == "" {
+		if requireToken && !publicRoutes[c.Path()] && !oidcLoginRoute.MatchString(c.Path()) {
+			return unauthorized(c, "An API token is required")
+		}
+		return c.Next()
+	}
+
+	scheme, token, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return unauthorized(c, "Authorization must be a Bearer token")
+	}
+	caller, err := service.AuthenticateToken(c.UserContext(), strings.TrimSpace(token), c.IP())
+	if err != nil {
+		if service.IsAuthError(err) {
+			return unauthorized(c, err.Error())
+		}
+		return serverErrorJSON(c, err, "Error checking API token", "Error checking API token")
+	}
+
+	scope := service.ScopeWrite
+	switch {
+	case tokenRoutes.MatchString(c.Path()):
+		scope = service.ScopeTokens
+	case scimRoutes.MatchString(c.Path()):
+		scope = service.ScopeSCIM
+	case c.Method() == fiber.MethodGet || c.Method() == fiber.MethodHead || c.Method() == fiber.MethodOptions:
+		scope = service.ScopeRead
+	}
+	if !caller.Allows(scope) {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer error="insufficient_scope", scope="`+scope+`"`)
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "The token does not have the " + scope + " scope",
+		})
+	}
+
+	c.Locals(callerKey, &caller)
+	logging.SetCaller(c.UserContext(), caller.UserID, caller.TenantID)
+	return c.Next()
+}
+
+// callerFrom returns the caller authenticated by authenticate, nil without a token
+func callerFrom(c *fiber.Ctx) *service.Caller {
+	caller, _ := c.Locals(callerKey).(*service.Caller)
+	return caller
+}
+
+// callerUserID returns the user of the token of the request, 0 without a token
+func callerUserID(c *fiber.Ctx) int {
+	if caller := callerFrom(c); caller != nil {
+		return caller.UserID
+	}
+	return 0
+}
+
+// callerTenantID returns the tenant of the token of the request, 0 without a
+// token, which lists and exports the rows of every tenant
+func callerTenantID(c *fiber.Ctx) int {
+	if caller := callerFrom(c); caller != nil {
+		return caller.TenantID
+	}
+	return 0
+}
+
+// inCallerTenant answers 404 Not Found when the row id of entity belongs to
+// another tenant than the token of the request, which must not learn that it
+// exists. When ok is false the response is already written and err must be returned.
+func inCallerTenant(c *fiber.Ctx, entity string, id int) (ok bool, err error) {
+	if err := checkRowTenant(c.UserContext(), callerFrom(c), entity, id); err != nil {
+		if errors.Is(err, service.ErrNotFound) {
+			return false, c.Status(fiber.StatusNotFound).SendString("Not Found")
+		}
+		return false, serverError(c, err, "Error checking tenant")
+	}
+	return true, nil
+}
+
+// checkRowTenant refuses the row id of entity when it is outside the tenant of
+// caller with service.ErrNotFound, the error of a missing row
+func checkRowTenant(ctx context.Context, caller *service.Caller, entity string, id int) error {
+	if caller == nil {
+		return nil
+	}
+	ok, err := service.InTenant(ctx, entity, id, caller.TenantID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return service.ErrNotFound
+	}
+	return nil
+}
+
+func unauthorized(c *fiber.Ctx, msg string) error {
+	c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="portier"`)
+	return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		"error": msg,
+	})
+}
+
+// errRoleForbidden refuses a role given or changed by a caller that is not an admin of the tenant
+var errRoleForbidden = errors.New("only an admin of the tenant gives a role other than user or changes a role")
+
+// checkRoleChange refuses to create user with a role other than user, or to
+// change the role of current, or move it to another tenant while it has such
+// a role, unless caller is an admin of every tenant involved. current is nil
+// on a create, which then defaults to the tenant of the admin.
+func checkRoleChange(caller *service.Caller, user *service.User, current *service.User) error {
+	var tenants []int
+	if current == nil {
+		if user.Role == "" || user.Role == service.RoleUser {
+			return nil
+		}
+		if caller != nil && user.TenantID == 0 {
+			user.TenantID = caller.TenantID
+		}
+		tenants = []int{user.TenantID}
+	} else {
+		role := cmp.Or(user.Role, current.Role)
+		moved := user.TenantID != 0 && user.TenantID != current.TenantID && role != service.RoleUser
+		if role == current.Role && !moved {
+			return nil
+		}
+		tenants = []int{current.TenantID, cmp.Or(user.TenantID, current.TenantID)}
+	}
+
+	if caller == nil || caller.Role != service.RoleAdmin {
+		return errRoleForbidden
+	}
+	for _, tenantID := range tenants {
+		if tenantID != caller.TenantID {
+			return errRoleForbidden
+		}
+	}
+	return nil
+}
+
+// errTenantForbidden refuses a user created in or moved to another tenant than the one of the token
+var errTenantForbidden = errors.New("a token only manages the users of its tenant")
+
+// checkUserTenant keeps user in the tenant of caller. A create without
+// tenant_id gets that tenant, an update must send it like without a token.
+func checkUserTenant(caller *service.Caller, user *service.User, current *service.User) error {
+	if caller == nil {
+		return nil
+	}
+	if current == nil && user.TenantID == 0 {
+		user.TenantID = caller.TenantID
+	}
+	if user.TenantID != 0 && user.TenantID != caller.TenantID {
+		return errTenantForbidden
+	}
+	return nil
+}
+
+// roleForbidden answers a refused checkRoleChange, checkUserTenant or checkTenantPolicyChange, 401 without a token
+func roleForbidden(c *fiber.Ctx, err error) error {
+	if callerFrom(c) == nil {
+		return unauthorized(c, err.Error())
+	}
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
+
+// errTenantPolicyForbidden refuses a change of the second factor policy or of the default key of a tenant
+var errTenantPolicyForbidden = errors.New("only an admin of the tenant changes require_totp or default_key_id")
+
+// checkTenantPolicyChange refuses to change require_totp or default_key_id of
+// current unless caller is an admin of the tenant. An update without
+// require_totp keeps it, one without default_key_id removes it.
+func checkTenantPolicyChange(caller *service.Caller, tenant *service.Tenant, current *service.Tenant) error {
+	totpChanged := tenant.RequireTOTP != nil && (current.RequireTOTP == nil || *tenant.RequireTOTP != *current.RequireTOTP)
+	keyChanged := (tenant.DefaultKeyID == nil) != (current.DefaultKeyID == nil) ||
+		(tenant.DefaultKeyID != nil && *tenant.DefaultKeyID != *current.DefaultKeyID)
+	if !totpChanged && !keyChanged {
+		return nil
+	}
+	if caller == nil || caller.Role != service.RoleAdmin || caller.TenantID != current.ID {
+		return errTenantPolicyForbidden
+	}
+	return nil
+}
+
+var (
+	errSCIMScopeForbidden  = errors.New("only the admins of the tenant create tokens with the scim scope")
+	errTokenScopeForbidden = errors.New("a token only grants the scopes of the token creating it")
+)
+
+// checkTokenScopes refuses the scopes of a new token of user that the caller
+// does not hold itself, a tokens scope alone must not mint read or write tokens.
+// A scim token provisions every user of the tenant, only its admins create one.
+// Without a caller, the password of the user authorized every other scope.
+func checkTokenScopes(caller *service.Caller, user *service.User, scopes []string) error {
+	for _, scope := range scopes {
+		if scope == service.ScopeSCIM {
+			if caller == nil || caller.Role != service.RoleAdmin || caller.TenantID != user.TenantID {
+				return errSCIMScopeForbidden
+			}
+			continue
+		}
+		if caller != nil && !caller.Allows(scope) {
+			return errTokenScopeForbidden
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package http
+
+import (
+	"portier/internal/service"
+	"testing"
+)
+
+func TestCheckRoleChange(t *testing.T) {
+	admin := &service.Caller{UserID: 1, TenantID: 1, Role: service.RoleAdmin}
+	manager := &service.Caller{UserID: 2, TenantID: 1, Role: service.RoleManager}
+	otherAdmin := &service.Caller{UserID: 3, TenantID: 2, Role: service.RoleAdmin}
+	current := &service.User{ID: 4, TenantID: 1, Role: service.RoleManager}
+
+	tests := []struct {
+		name    string
+		caller  *service.Caller
+		user    service.User
+		current *service.User
+		allowed bool
+	}{
+		{"create user without token", nil, service.User{TenantID: 1}, nil, true},
+		{"create user role without token", nil, service.User{TenantID: 1, Role: service.RoleUser}, nil, true},
+		{"create admin without token", nil, service.User{TenantID: 1, Role: service.RoleAdmin}, nil, false},
+		{"create manager by a manager", manager, service.User{TenantID: 1, Role: service.RoleManager}, nil, false},
+		{"create admin by an admin", admin, service.User{TenantID: 1, Role: service.RoleAdmin}, nil, true},
+		{"create admin in the default tenant", admin, service.User{Role: service.RoleAdmin}, nil, true},
+		{"create admin in another tenant", otherAdmin, service.User{TenantID: 1, Role: service.RoleAdmin}, nil, false},
+		{"update without role", nil, service.User{TenantID: 1}, current, true},
+		{"update with the same role", manager, service.User{TenantID: 1, Role: service.RoleManager}, current, true},
+		{"promote without token", nil, service.User{TenantID: 1, Role: service.RoleAdmin}, current, false},
+		{"promote by a manager", manager, service.User{TenantID: 1, Role: service.RoleAdmin}, current, false},
+		{"demote by a manager", manager, service.User{TenantID: 1, Role: service.RoleUser}, current, false},
+		{"promote by an admin", admin, service.User{TenantID: 1, Role: service.RoleAdmin}, current, true},
+		{"promote by the admin of another tenant", otherAdmin, service.User{TenantID: 1, Role: service.RoleAdmin}, current, false},
+		{"move a manager by the admin of the target", otherAdmin, service.User{TenantID: 2}, current, false},
+		{"move a manager by the admin of the source", admin, service.User{TenantID: 2}, current, false},
+		{"move a user", nil, service.User{TenantID: 2}, &service.User{TenantID: 1, Role: service.RoleUser}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRoleChange(tt.caller, &tt.user, tt.current)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("checkRoleChange = %v, want allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckUserTenant(t *testing.T) {
+	member := &service.Caller{UserID: 1, TenantID: 1, Role: service.RoleUser}
+	current := &service.User{ID: 4, TenantID: 1}
+
+	tests := []struct {
+		name       string
+		caller     *service.Caller
+		user       service.User
+		current    *service.User
+		allowed    bool
+		wantTenant int
+	}{
+		{"create without token", nil, service.User{TenantID: 2}, nil, true, 2},
+		{"create without tenant", member, service.User{}, nil, true, 1},
+		{"create in the tenant", member, service.User{TenantID: 1}, nil, true, 1},
+		{"create in another tenant", member, service.User{TenantID: 2}, nil, false, 2},
+		{"update in the tenant", member, service.User{TenantID: 1}, current, true, 1},
+		{"update without tenant", member, service.User{}, current, true, 0},
+		{"move to another tenant", member, service.User{TenantID: 2}, current, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkUserTenant(tt.caller, &tt.user, tt.current)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("checkUserTenant = %v, want allowed %v", err, tt.allowed)
+			}
+			if tt.user.TenantID != tt.wantTenant {
+				t.Errorf("tenant_id = %d, want %d", tt.user.TenantID, tt.wantTenant)
+			}
+		})
+	}
+}
+
+func TestCheckTenantPolicyChange(t *testing.T) {
+	admin := &service.Caller{UserID: 1, TenantID: 1, Role: service.RoleAdmin}
+	manager := &service.Caller{UserID: 2, TenantID: 1, Role: service.RoleManager}
+	otherAdmin := &service.Caller{UserID: 3, TenantID: 2, Role: service.RoleAdmin}
+	yes, no := true, false
+	key, otherKey := 7, 8
+	current := &service.Tenant{ID: 1, RequireTOTP: &yes, DefaultKeyID: &key}
+
+	tests := []struct {
+		name    string
+		caller  *service.Caller
+		tenant  service.Tenant
+		allowed bool
+	}{
+		{"same values without token", nil, service.Tenant{RequireTOTP: &yes, DefaultKeyID: &key}, true},
+		{"require_totp left out", nil, service.Tenant{DefaultKeyID: &key}, true},
+		{"disable require_totp without token", nil, service.Tenant{RequireTOTP: &no, DefaultKeyID: &key}, false},
+		{"disable require_totp by a manager", manager, service.Tenant{RequireTOTP: &no, DefaultKeyID: &key}, false},
+		{"disable require_totp by the admin of another tenant", otherAdmin, service.Tenant{RequireTOTP: &no, DefaultKeyID: &key}, false},
+		{"disable require_totp by an admin", admin, service.Tenant{RequireTOTP: &no, DefaultKeyID: &key}, true},
+		{"change the default key by a manager", manager, service.Tenant{DefaultKeyID: &otherKey}, false},
+		{"remove the default key without token", nil, service.Tenant{}, false},
+		{"change the default key by an admin", admin, service.Tenant{DefaultKeyID: &otherKey}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTenantPolicyChange(tt.caller, &tt.tenant, current)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("checkTenantPolicyChange = %v, want allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestCheckTokenScopes(t *testing.T) {
+	user := &service.User{ID: 5, TenantID: 1}
+	tests := []struct {
+		name    string
+		caller  *service.Caller
+		scopes  []string
+		allowed bool
+	}{
+		{"password of the user", nil, []string{"read", "write", "tokens"}, true},
+		{"scim with a password", nil, []string{"scim"}, false},
+		{"tokens only mints read", &service.Caller{Role: service.RoleUser, TenantID: 1, Scopes: []string{"tokens"}}, []string{"read"}, false},
+		{"tokens only mints tokens", &service.Caller{Role: service.RoleUser, TenantID: 1, Scopes: []string{"tokens"}}, []string{"tokens"}, true},
+		{"write includes read", &service.Caller{Role: service.RoleUser, TenantID: 1, Scopes: []string{"write", "tokens"}}, []string{"read", "write"}, true},
+		{"read does not include write", &service.Caller{Role: service.RoleUser, TenantID: 1, Scopes: []string{"read", "tokens"}}, []string{"write"}, false},
+		{"scim by an admin of the tenant", &service.Caller{Role: service.RoleAdmin, TenantID: 1, Scopes: []string{"tokens"}}, []string{"scim"}, true},
+		{"scim by an admin of another tenant", &service.Caller{Role: service.RoleAdmin, TenantID: 2, Scopes: []string{"tokens", "scim"}}, []string{"scim"}, false},
+		{"admins hold no other scope", &service.Caller{Role: service.RoleAdmin, TenantID: 1, Scopes: []string{"tokens"}}, []string{"scim", "write"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTokenScopes(tt.caller, user, tt.scopes)
+			if allowed := err == nil; allowed != tt.allowed {
+				t.Errorf("checkTokenScopes = %v, want allowed %v", err, tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"portier/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// batchRequest is the body accepted by every batch endpoint
+type batchRequest[T any] struct {
+	Mode  service.BatchMode      `json:"mode"`
+	Items []service.BatchItem[T] `json:"items"`
+}
+
+// batchResponse is returned by every batch endpoint
+type batchResponse struct {
+	Mode      service.BatchMode     `json:"mode"`
+	Succeeded int                   `json:"succeeded"`
+	Failed    int                   `json:"failed"`
+	Results   []service.BatchResult `json:"results"`
+}
+
+/*** BATCH HANDLERS ***/
+
+func batchUsers(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X POST http://localhost:4000/users:batch \
+	// -H "Content-Type: application/json" \
+	// -d '{"mode": "transaction", "items": [{"op": "create", "data": {"username": "ahmad", "email": "ahmad@example.com", "password": "securepassword123", "name": "ahmad", "gender": "1", "tenant_id": 1}}, {"op": "delete", "id": 3}]}'
+
+	caller := callerFrom(c)
+	return handleBatch(c, "users", func(item *service.BatchItem[service.User]) error {
+		// Same validation as createUser, updateUser and deleteUser
+		if err := checkBatchTenant(c, caller, "users", item.Op, item.ID); err != nil {
+			return err
+		}
+		switch item.Op {
+		case service.BatchCreate:
+			if err := item.Data.ConvertGender(); err != nil {
+				return err
+			}
+			if err := checkUserTenant(caller, &item.Data, nil); err != nil {
+				return err
+			}
+			return checkRoleChange(caller, &item.Data, nil)
+		case service.BatchUpdate:
+			current, err := service.GetUserByIDUncached(c.UserContext(), item.ID)
+			if errors.Is(err, pgx.ErrNoRows) {
+				// The update reports the missing user
+				return nil
+			}
+			if err != nil {
+				slog.ErrorContext(c.UserContext(), "Error fetching user", "error", err)
+				return errors.New("the role of the user could not be checked")
+			}
+			if err := checkUserTenant(caller, &item.Data, &current); err != nil {
+				return err
+			}
+			return checkRoleChange(caller, &item.Data, &current)
+		}
+		return nil
+	}, func(ctx context.Context, mode service.BatchMode, items []service.BatchItem[service.User]) ([]service.BatchResult, error) {
+		return service.BatchUsers(ctx, mode, items, caller, loginClient(c))
+	})
+}
+
+func batchKeys(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X POST http://localhost:4000/keys:batch \
+	// -H "Content-Type: application/json" \
+	// -d '{"mode": "best_effort", "items": [{"op": "create", "data": {"name": "Main door"}}, {"op": "update", "id": 1, "data": {"name": "Back door", "version": 1}}]}'
+
+	caller, createdBy := callerFrom(c), callerUserID(c)
+	return handleBatch(c, "keys", func(item *service.BatchItem[service.Key]) error {
+		return checkBatchTenant(c, caller, "keys", item.Op, item.ID)
+	}, func(ctx context.Context, mode service.BatchMode, items []service.BatchItem[service.Key]) ([]service.BatchResult, error) {
+		return service.BatchKeys(ctx, mode, items, createdBy)
+	})
+}
+
+func batchCopies(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X POST http://localhost:4000/copies:batch \
+	// -H "Content-Type: application/json" \
+	// -d '{"mode": "transaction", "items": [{"op": "create", "data": {"name": "Copy 1", "key_id": 1}}, {"op": "create", "data": {"name": "Copy 2", "key_id": 1}}]}'
+
+	caller, createdBy := callerFrom(c), callerUserID(c)
+	return handleBatch(c, "copies", func(item *service.BatchItem[service.Copy]) error {
+		return checkBatchTenant(c, caller, "copies", item.Op, item.ID)
+	}, func(ctx context.Context, mode service.BatchMode, items []service.BatchItem[service.Copy]) ([]service.BatchResult, error) {
+		return service.BatchCopies(ctx, mode, items, createdBy)
+	})
+}
+
+func batchTenants(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X POST http://localhost:4000/tenants:batch \
+	// -H "Content-Type: application/json" \
+	// -d '{"mode": "transaction", "items": [{"op": "create", "data": {"name": "PT ZIG ZAG", "address": "Jln banyak belok", "status": "Active"}}]}'
+
+	caller := callerFrom(c)
+	return handleBatch(c, "tenants", func(item *service.BatchItem[service.Tenant]) error {
+		// Same validation as updateTenant and deleteTenant
+		if err := checkBatchTenant(c, caller, "tenants", item.Op, item.ID); err != nil {
+			return err
+		}
+		if item.Op != service.BatchUpdate {
+			return nil
+		}
+		current, err := service.GetTenantByIDUncached(c.UserContext(), item.ID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			// The update reports the missing tenant
+			return nil
+		}
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Error fetching tenant", "error", err)
+			return errors.New("the policy of the tenant could not be checked")
+		}
+		return checkTenantPolicyChange(caller, &item.Data, &current)
+	}, service.BatchTenants)
+}
+
+// handleBatch parses and validates a batch request, then runs it with run.
+// validate holds the entity specific checks of the single-item handler, it may be nil.
+//
+// Invalid items are never sent to the database. In transaction mode a single
+// invalid item rejects the whole batch, in the other modes only the valid items run.
+func handleBatch[T any](
+	c *fiber.Ctx,
+	entity string,
+	validate func(item *service.BatchItem[T]) error,
+	run func(context.Context, service.BatchMode, []service.BatchItem[T]) ([]service.BatchResult, error),
+) error {
+	var req batchRequest[T]
+	if err := c.BodyParser(&req); err != nil {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	if req.Mode == "" {
+		req.Mode = service.BatchTransaction
+	}
+	if req.Mode != service.BatchTransaction && req.Mode != service.BatchBestEffort && req.Mode != service.BatchDryRun {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid 'mode' parameter, expected 'transaction', 'best_effort' or 'dry_run'",
+		})
+	}
+	if len(req.Items) == 0 || len(req.Items) > service.MaxBatchSize {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("A batch must contain between 1 and %d items", service.MaxBatchSize),
+		})
+	}
+
+	// Validate every item before touching the database
+	results := make([]service.BatchResult, len(req.Items))
+	var validItems []service.BatchItem[T]
+	var validIndexes []int
+	for i := range req.Items {
+		item := &req.Items[i]
+		results[i] = service.BatchResult{Index: i, Op: item.Op, ID: item.ID}
+
+		err := validateBatchItem(item)
+		if err == nil && validate != nil {
+			err = validate(item)
+		}
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+
+		validItems = append(validItems, *item)
+		validIndexes = append(validIndexes, i)
+	}
+
+	if len(validItems) < len(req.Items) && req.Mode == service.BatchTransaction {
+		for i := range results {
+			if results[i].Error == "" {
+				results[i].Error = "not executed, the batch contains invalid items"
+			}
+		}
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(newBatchResponse(req.Mode, results))
+	}
+
+	if len(validItems) > 0 {
+		batchResults, err := run(c.UserContext(), req.Mode, validItems)
+		if err != nil && !errors.Is(err, service.ErrBatchRolledBack) {
+			return serverError(c, err, "Error running "+entity+" batch")
+		}
+
+		// Map the results back to the position of the item in the request
+		for i, result := range batchResults {
+			result.Index = validIndexes[i]
+			results[validIndexes[i]] = result
+		}
+
+		if errors.Is(err, service.ErrBatchRolledBack) {
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(newBatchResponse(req.Mode, results))
+		}
+	}
+
+	response := newBatchResponse(req.Mode, results)
+	if response.Failed > 0 {
+		return c.Status(fiber.StatusMultiStatus).JSON(response)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// checkBatchTenant refuses to update or delete a row of entity outside the
+// tenant of caller, reported like a missing row as the single-item handlers do
+func checkBatchTenant(c *fiber.Ctx, caller *service.Caller, entity, op string, id int) error {
+	if op == service.BatchCreate {
+		return nil
+	}
+	err := checkRowTenant(c.UserContext(), caller, entity, id)
+	if err != nil && !errors.Is(err, service.ErrNotFound) {
+		slog.ErrorContext(c.UserContext(), "Error checking tenant", "error", err)
+		return errors.New("the tenant of the row could not be checked")
+	}
+	return err
+}
+
+// validateBatchItem checks the fields every batch operation needs
+func validateBatchItem[T any](item *service.BatchItem[T]) error {
+	switch item.Op {
+	case service.BatchCreate:
+		return nil
+	case service.BatchUpdate, service.BatchDelete:
+		if item.ID <= 0 {
+			return fmt.Errorf("'id' is required for %s", item.Op)
+		}
+		return nil
+	}
+	return fmt.Errorf("invalid 'op' %q, expected create, update or delete", item.Op)
+}
+
+// newBatchResponse counts the successful and failed results
+func newBatchResponse(mode service.BatchMode, results []service.BatchResult) batchResponse {
+	response := batchResponse{Mode: mode, Results: results}
+	for _, result := range results {
+		if result.Success {
+			response.Succeeded++
+		} else {
+			response.Failed++
+		}
+	}
+	return response
+}
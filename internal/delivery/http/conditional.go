@@ -0,0 +1,112 @@
+package http
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// etag is the strong entity tag of a JSON body, it changes with any byte of the body
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// sendJSON answers 200 with v as JSON, its ETag and, when modified is set, its
+// Last-Modified. It answers 304 Not Modified when the client copy is current:
+// If-None-Match matches the ETag, or, without If-None-Match, nothing changed
+// since If-Modified-Since. Lists have no Last-Modified, a deleted row does not
+// change the updated_at of the remaining ones.
+func sendJSON(c *fiber.Ctx, v any, modified time.Time) error {
+	body, err := c.App().Config().JSONEncoder(v)
+	if err != nil {
+		return err
+	}
+
+	tag := etag(body)
+	c.Set(fiber.HeaderETag, tag)
+	if !modified.IsZero() {
+		c.Set(fiber.HeaderLastModified, modified.UTC().Format(http.TimeFormat))
+	}
+
+	if noneMatch := c.Get(fiber.HeaderIfNoneMatch); noneMatch != "" {
+		if matchETag(noneMatch, tag, false) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+	} else if since, err := http.ParseTime(c.Get(fiber.HeaderIfModifiedSince)); err == nil && !modified.IsZero() {
+		// Last-Modified has a precision of one second
+		if !modified.Truncate(time.Second).After(since) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(fiber.StatusOK).Send(body)
+}
+
+// checkIfMatch is the optimistic concurrency of the update and delete handlers,
+// the client sends the ETag of the version it read. It answers 412 Precondition
+// Failed when the request has an If-Match header that does not match the ETag of
+// the current row returned by load, or when the row does not exist. done reports
+// that the response is sent and the handler must return err. Requests without
+// If-Match are unconditional.
+//
+// The check and the write are two statements, a concurrent write between them
+// is not detected.
+func checkIfMatch[T any](c *fiber.Ctx, load func() (T, error)) (done bool, err error) {
+	ifMatch := c.Get(fiber.HeaderIfMatch)
+	if ifMatch == "" {
+		return false, nil
+	}
+
+	current, err := load()
+	if errors.Is(err, pgx.ErrNoRows) {
+		return true, preconditionFailed(c)
+	}
+	if err != nil {
+		return true, serverError(c, err, "Error checking If-Match")
+	}
+
+	body, err := c.App().Config().JSONEncoder(current)
+	if err != nil {
+		return true, err
+	}
+	if !matchETag(ifMatch, etag(body), true) {
+		return true, preconditionFailed(c)
+	}
+	return false, nil
+}
+
+func preconditionFailed(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusPreconditionFailed).JSON(fiber.Map{
+		"error": "The resource was modified, fetch it again and retry with its ETag",
+	})
+}
+
+// matchETag reports whether the comma-separated list of entity tags in header
+// contains tag or is "*". The strong comparison of If-Match never matches weak
+// tags, the weak comparison of If-None-Match ignores the W/ prefix.
+func matchETag(header, tag string, strong bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak, ok := strings.CutPrefix(candidate, "W/"); ok {
+			if strong {
+				continue
+			}
+			candidate = weak
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
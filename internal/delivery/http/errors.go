@@ -0,0 +1,50 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"portier/internal/service"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// serverError logs a failed service call and answers 500 "Internal Server Error".
+// Timed out operations are answered with 504.
+func serverError(c *fiber.Ctx, err error, msg string) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return timeoutError(c, err, msg)
+	}
+
+	slog.ErrorContext(c.UserContext(), msg, "error", err)
+	return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+}
+
+// serverErrorJSON is serverError for the routes answering 500 with a JSON error message
+func serverErrorJSON(c *fiber.Ctx, err error, msg, errorMessage string) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return timeoutError(c, err, msg)
+	}
+
+	slog.ErrorContext(c.UserContext(), msg, "error", err)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": errorMessage,
+	})
+}
+
+// versionConflict answers 409 Conflict with the row as stored, the client
+// merges its changes and retries with the current version
+func versionConflict(c *fiber.Ctx, conflict *service.ConflictError) error {
+	return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+		"error":   conflict.Error(),
+		"current": conflict.Current,
+	})
+}
+
+// timeoutError answers 504 when a timeout of the timeouts section expired
+func timeoutError(c *fiber.Ctx, err error, msg string) error {
+	slog.WarnContext(c.UserContext(), msg, "error", err, "status", fiber.StatusGatewayTimeout)
+	return c.Status(fiber.StatusGatewayTimeout).JSON(fiber.Map{
+		"error": "The operation timed out",
+	})
+}
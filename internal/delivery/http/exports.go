@@ -0,0 +1,157 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"portier/internal/exporter"
+	"portier/internal/service"
+	"portier/pkg/logging"
+	"portier/pkg/tracing"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// exportRequest is the body accepted by POST /exports
+type exportRequest struct {
+	Entity  string          `json:"entity"`
+	Format  string          `json:"format"`
+	Filters exporter.Filter `json:"filters"`
+}
+
+/*** EXPORTS HANDLERS ***/
+
+func createExport(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X POST http://localhost:4000/exports \
+	// -H "Content-Type: application/json" \
+	// -d '{"entity": "users", "format": "xlsx", "filters": {"name": "John"}}'
+
+	var req exportRequest
+	if err := c.BodyParser(&req); err != nil {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	if !exporter.IsEntity(req.Entity) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid 'entity' parameter, expected users, keys or copies",
+		})
+	}
+	format, ok := exporter.ParseFormat(req.Format)
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid 'format' parameter, expected csv, jsonl or xlsx",
+		})
+	}
+
+	// A token exports the rows of its tenant only
+	req.Filters.TenantID = callerTenantID(c)
+	job, err := exporter.Start(c.UserContext(), req.Entity, format, req.Filters, callerFrom(c))
+	if err != nil {
+		return serverError(c, err, "Error starting export")
+	}
+
+	c.Location("/exports/" + strconv.Itoa(job.ID))
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+func getExportById(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/exports/1
+
+	job, ok, err := getJob(c, service.JobExport)
+	if !ok {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(job)
+}
+
+func downloadExport(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -OJ http://localhost:4000/exports/1/download
+
+	job, ok, err := getJob(c, service.JobExport)
+	if !ok {
+		return err
+	}
+
+	if job.Status == service.JobFailed {
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "The export failed: " + job.Error,
+		})
+	}
+	if job.Status != service.JobCompleted {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The export is still running",
+		})
+	}
+
+	return c.Download(job.ResultPath, job.FileName)
+}
+
+// errExportsDisabled answers an export format asked while exports are disabled
+var errExportsDisabled = errors.New("exports are disabled")
+
+// exportFormat returns the export format requested with the 'format' query
+// parameter or the Accept header. ok is false for a regular JSON page, which
+// is always the case when exports are disabled.
+func exportFormat(c *fiber.Ctx) (format exporter.Format, ok bool, err error) {
+	if name := c.Query("format"); name != "" && name != "json" {
+		if !features.Exports {
+			return "", false, errExportsDisabled
+		}
+		format, ok = exporter.ParseFormat(name)
+		if !ok {
+			return "", false, fmt.Errorf("invalid 'format' parameter, expected json, csv, jsonl or xlsx")
+		}
+		return format, true, nil
+	}
+
+	if !features.Exports {
+		return "", false, nil
+	}
+
+	// JSON stays the default, also for clients sending */*
+	accepted := c.Accepts(fiber.MIMEApplicationJSON,
+		exporter.ContentTypes[exporter.FormatCSV],
+		exporter.ContentTypes[exporter.FormatJSONLines],
+		exporter.ContentTypes[exporter.FormatXLSX])
+	for format, contentType := range exporter.ContentTypes {
+		if accepted == contentType {
+			return format, true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+// streamExport writes every row of entity matching filter to the response.
+// Rows go from the database cursor to the client without being collected in memory.
+func streamExport(c *fiber.Ctx, entity string, format exporter.Format, filter exporter.Filter) error {
+	c.Attachment(exporter.FileName(entity, format))
+	c.Set(fiber.HeaderContentType, exporter.ContentTypes[format])
+
+	// The stream writer runs after the handler returned, it must not use c
+	requestCtx := c.UserContext()
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// The export timeout of the service applies, the request context ended with the handler
+		ctx := tracing.CopySpan(logging.CopyRequest(context.Background(), requestCtx), requestCtx)
+
+		count, err := exporter.Write(ctx, w, entity, format, filter, nil)
+		if err != nil {
+			// The status is already sent, the client sees a truncated file
+			slog.ErrorContext(ctx, "Error exporting", "entity", entity, "rows", count, "error", err)
+			return
+		}
+		if err := w.Flush(); err != nil {
+			slog.ErrorContext(ctx, "Error exporting", "entity", entity, "error", err)
+		}
+	})
+
+	return nil
+}
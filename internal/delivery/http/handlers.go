@@ -1,46 +1,153 @@
 package http
 
 import (
-	"log"
+	"errors"
+	"log/slog"
+	"portier/internal/config"
+	"portier/internal/exporter"
 	"portier/internal/service"
+	"portier/pkg/idempotency"
+	"portier/pkg/ratelimit"
 	"strconv"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
 )
 
-func RegisterRoutes(app *fiber.App) {
+// features are the optional parts of the API enabled in the configuration
+var features config.Features
+
+func RegisterRoutes(app *fiber.App, enabled config.Features, metricsHandler fiber.Handler) {
+	features = enabled
+
 	// Add a route for the root ("/") that returns "Hello, world"
 	app.Get("/", func(c *fiber.Ctx) error {
 		return c.SendString("Hello, world")
 	})
 
-	// USER routes
+	// Liveness and readiness probes
+	app.Get("/healthz", getHealthz)
+	app.Get("/readyz", getReadyz)
+
+	// API documentation, every route below must be described in apiOperations
+	if features.Docs {
+		app.Get("/openapi.json", getOpenAPISpec)
+		app.Get("/docs", getDocs)
+	}
+
+	// Prometheus metrics when they are served by the API, nil otherwise. The
+	// handler checks the metrics token itself, which is not an API token.
+	if metricsHandler != nil {
+		app.Get("/metrics", metricsHandler)
+	}
+
+	// Every route below accepts an API token and is rate limited, the probes, the documentation and the metrics above do not.
+	// The IP budget applies before authenticate, so invalid tokens are counted too,
+	// the user and tenant budgets once the caller is known.
+	app.Use(ratelimit.Middleware)
+	app.Use(authenticate)
+	app.Use(ratelimit.Callers)
+
+	// USER routes, the ones accepting a password have the stricter credential budget.
+	// Creates and batches of every entity are safe to retry with an Idempotency-Key header.
 	app.Get("/users", getUsers)
 	app.Get("/users/:id", getUsersById)
-	app.Post("/users", createUser)
-	app.Put("/users/:id", updateUser)
+	app.Post("/users", ratelimit.Credentials, idempotency.Middleware, createUser)
+	app.Put("/users/:id", ratelimit.Credentials, updateUser)
 	app.Delete("/users/:id", deleteUser)
+	if features.Batch {
+		app.Post("/users\\:batch", ratelimit.Credentials, idempotency.Middleware, batchUsers)
+	}
+
+	// ACCOUNT routes, links sent by email to reset a password and verify an address
+	app.Post("/password-reset", ratelimit.Credentials, requestPasswordReset)
+	app.Post("/password-reset/confirm", ratelimit.Credentials, confirmPasswordReset)
+	app.Post("/users/:id/verify-email", ratelimit.Credentials, sendEmailVerification)
+	app.Post("/verify-email/confirm", ratelimit.Credentials, confirmEmailVerification)
+
+	// TOTP routes, the second factor of the users and the check of password plus code
+	app.Post("/users/:id/totp", ratelimit.Credentials, beginTOTPEnrollment)
+	app.Post("/users/:id/totp/confirm", ratelimit.Credentials, confirmTOTPEnrollment)
+	app.Delete("/users/:id/totp", ratelimit.Credentials, disableTOTP)
+	app.Post("/users/:id/recovery-codes", ratelimit.Credentials, regenerateRecoveryCodes)
+	app.Post("/auth/verify", ratelimit.Credentials, verifyCredentials)
+
+	// LOCKOUT routes, the login history of a user and the unlock of its failed logins
+	app.Get("/users/:id/login-attempts", getLoginAttempts)
+	app.Post("/users/:id/unlock", unlockUser)
+
+	// API TOKEN routes, of users and of service accounts
+	app.Get("/users/:id/tokens", getTokens)
+	app.Post("/users/:id/tokens", ratelimit.Credentials, createToken)
+	app.Delete("/users/:id/tokens/:tokenId", revokeToken)
+
+	// SINGLE SIGN-ON routes, the OpenID Connect provider of each tenant
+	app.Get("/tenants/:id/oidc", getTenantOIDC)
+	app.Put("/tenants/:id/oidc", updateTenantOIDC)
+	app.Delete("/tenants/:id/oidc", deleteTenantOIDC)
+	app.Get("/tenants/:id/oidc/login", ratelimit.Credentials, beginOIDCLogin)
+	app.Get("/oidc/callback", ratelimit.Credentials, completeOIDCLogin)
+
+	// SCIM routes, the users and roles of the tenant of a scim token
+	if features.SCIM {
+		app.Get("/scim/v2/ServiceProviderConfig", getSCIMServiceProviderConfig)
+		app.Get("/scim/v2/ResourceTypes", getSCIMResourceTypes)
+		app.Get("/scim/v2/Users", getSCIMUsers)
+		app.Get("/scim/v2/Users/:id", getSCIMUser)
+		app.Post("/scim/v2/Users", createSCIMUser)
+		app.Put("/scim/v2/Users/:id", replaceSCIMUser)
+		app.Patch("/scim/v2/Users/:id", patchSCIMUser)
+		app.Delete("/scim/v2/Users/:id", deleteSCIMUser)
+		app.Get("/scim/v2/Groups", getSCIMGroups)
+		app.Get("/scim/v2/Groups/:id", getSCIMGroup)
+		app.Put("/scim/v2/Groups/:id", replaceSCIMGroup)
+		app.Patch("/scim/v2/Groups/:id", patchSCIMGroup)
+	}
 
 	// KEYS routes
 	app.Get("/keys", getKeys)
 	app.Get("/keys/:id", getKeysById)
-	app.Post("/keys", createKey)
+	app.Post("/keys", idempotency.Middleware, createKey)
 	app.Put("/keys/:id", updateKey)
 	app.Delete("/keys/:id", deleteKey)
+	if features.Batch {
+		app.Post("/keys\\:batch", idempotency.Middleware, batchKeys)
+	}
 
 	// COPIES routes
 	app.Get("/copies", getCopies)
 	app.Get("/copies/:id", getCopiesById)
-	app.Post("/copies", createCopy)
+	app.Post("/copies", idempotency.Middleware, createCopy)
 	app.Put("/copies/:id", updateCopy)
 	app.Delete("/copies/:id", deleteCopy)
+	if features.Batch {
+		app.Post("/copies\\:batch", idempotency.Middleware, batchCopies)
+	}
 
 	// TENANT routes
 	app.Get("/tenants", getTenants)
 	app.Get("/tenants/:id", getTenantById)
-	app.Post("/tenants", createTenant)
+	app.Post("/tenants", idempotency.Middleware, createTenant)
 	app.Put("/tenants/:id", updateTenant)
 	app.Delete("/tenants/:id", deleteTenant)
+	if features.Batch {
+		app.Post("/tenants\\:batch", idempotency.Middleware, batchTenants)
+	}
+
+	// IMPORT routes
+	if features.Imports {
+		app.Post("/imports", createImport)
+		app.Get("/imports/:id", getImportById)
+		app.Get("/imports/:id/errors", getImportErrors)
+	}
+
+	// EXPORT routes
+	if features.Exports {
+		app.Post("/exports", createExport)
+		app.Get("/exports/:id", getExportById)
+		app.Get("/exports/:id/download", downloadExport)
+	}
 }
 
 /*** USERS HANDLERS ***/
@@ -48,6 +155,25 @@ func RegisterRoutes(app *fiber.App) {
 func getUsers(c *fiber.Ctx) error {
 	// REQUEST EXAMPLE
 	// curl "http://localhost:4000/users?limit=10&offset=0&name=John&idnumber=123"
+	//
+	// EXPORT EXAMPLE (every matching user, limit and offset are ignored)
+	// curl -H "Accept: text/csv" "http://localhost:4000/users?name=John" -o users.csv
+
+	// Stream every matching row instead of a page when an export format is requested
+	format, export, err := exportFormat(c)
+	if errors.Is(err, errExportsDisabled) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Exports are disabled",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if export {
+		return streamExport(c, "users", format, exporter.Filter{Name: c.Query("name"), IDNumber: c.Query("idnumber"), TenantID: callerTenantID(c)})
+	}
 
 	// Parse limit and offset from query parameters
 	limitStr := c.Query("limit", "10")  // Default limit is 10
@@ -72,34 +198,37 @@ func getUsers(c *fiber.Ctx) error {
 	idNumber := c.Query("idnumber", "")
 
 	// Call the service to get paginated users with optional search/filter parameters
-	response, err := service.GetAllUsers(limit, offset, name, idNumber)
+	response, err := service.GetAllUsers(c.UserContext(), limit, offset, name, idNumber, callerTenantID(c))
 	if err != nil {
-		log.Printf("Error getting users: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch users",
-		})
+		return serverErrorJSON(c, err, "Error getting users", "Failed to fetch users")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(response)
+	return sendJSON(c, response, time.Time{})
 }
 
 func getUsersById(c *fiber.Ctx) error {
 	// REQUEST EXAMPLE
 	// curl http://localhost:4000/users/1
+	//
+	// CONDITIONAL EXAMPLE (304 Not Modified while the ETag is current)
+	// curl -H 'If-None-Match: "<etag>"' http://localhost:4000/users/1
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error getting id: %v", err)
+		slog.WarnContext(c.UserContext(), "Error getting id", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
 	}
 
-	user, err := service.GetUserByID(id)
+	if ok, err := inCallerTenant(c, "users", id); !ok {
+		return err
+	}
+
+	user, err := service.GetUserByID(c.UserContext(), id)
 	if err != nil {
-		log.Printf("Error getting user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return serverError(c, err, "Error getting user")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(user)
+	return sendJSON(c, user, user.UpdatedAt)
 }
 
 func createUser(c *fiber.Ctx) error {
@@ -108,23 +237,33 @@ func createUser(c *fiber.Ctx) error {
 	// -H "Content-Type: application/json" \
 	// -d '{"username": "ahmad", "email": "ahmadamri.id@gmail.com", "password": "securepassword123", "name": "ahmad amri sanusi", "gender": "1", "id_number": "123456789", "user_image": "http://example.com/image.jpg", "tenant_id": 1}'
 
-
 	var user service.User
 	if err := c.BodyParser(&user); err != nil {
-		log.Printf("Error parsing body: %v", err)
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
 	// Convert the GenderStr to a boolean
 	if err := user.ConvertGender(); err != nil {
-		log.Printf("Error converting gender: %v", err)
+		slog.WarnContext(c.UserContext(), "Error converting gender", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Invalid gender value")
 	}
 
-	createdUser, err := service.CreateUser(user)
+	if err := checkUserTenant(callerFrom(c), &user, nil); err != nil {
+		return roleForbidden(c, err)
+	}
+	if err := checkRoleChange(callerFrom(c), &user, nil); err != nil {
+		return roleForbidden(c, err)
+	}
+
+	createdUser, err := service.CreateUser(c.UserContext(), user)
 	if err != nil {
-		log.Printf("Error creating user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return serverError(c, err, "Error creating user")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(createdUser)
@@ -134,24 +273,65 @@ func updateUser(c *fiber.Ctx) error {
 	// REQUEST EXAMPLE
 	// curl -X PUT http://localhost:4000/users/1 \
 	// -H "Content-Type: application/json" \
-	// -d '{"username": "newusername", "email": "newemail@example.com", "password": "newpassword", "name": "New Name", "gender": "1", "id_number": "123456789", "user_image": "http://example.com/image.jpg", "tenant_id": 1, "is_active": true}'
+	// -d '{"username": "newusername", "email": "newemail@example.com", "password": "newpassword", "current_password": "securepassword123", "name": "New Name", "gender": "1", "id_number": "123456789", "user_image": "http://example.com/image.jpg", "tenant_id": 1, "is_active": true, "version": 1}'
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error converting ID to integer: %v", err)
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
+	if ok, err := inCallerTenant(c, "users", id); !ok {
+		return err
+	}
+
+	if done, err := checkIfMatch(c, func() (service.User, error) {
+		return service.GetUserByIDUncached(c.UserContext(), id)
+	}); done {
+		return err
+	}
+
 	var updatedUser service.User
 	if err := c.BodyParser(&updatedUser); err != nil {
-		log.Printf("Error parsing body: %v", err)
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	updatedUser, err = service.UpdateUser(id, updatedUser)
+	current, err := service.GetUserByIDUncached(c.UserContext(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
 	if err != nil {
-		log.Printf("Error updating user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return serverError(c, err, "Error fetching user")
+	}
+	if err := checkUserTenant(callerFrom(c), &updatedUser, &current); err != nil {
+		return roleForbidden(c, err)
+	}
+	if err := checkRoleChange(callerFrom(c), &updatedUser, &current); err != nil {
+		return roleForbidden(c, err)
+	}
+
+	updatedUser, err = service.UpdateUser(c.UserContext(), id, updatedUser, callerFrom(c), loginClient(c))
+	if err != nil {
+		if locked, ok := service.AsLocked(err); ok {
+			return sendLocked(c, locked)
+		}
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		if conflict, ok := service.AsConflict(err); ok {
+			return versionConflict(c, conflict)
+		}
+		return serverError(c, err, "Error updating user")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(updatedUser)
@@ -163,14 +343,28 @@ func deleteUser(c *fiber.Ctx) error {
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error converting ID to integer: %v", err)
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	err = service.DeleteUser(id)
+	if ok, err := inCallerTenant(c, "users", id); !ok {
+		return err
+	}
+
+	if done, err := checkIfMatch(c, func() (service.User, error) {
+		return service.GetUserByIDUncached(c.UserContext(), id)
+	}); done {
+		return err
+	}
+
+	err = service.DeleteUser(c.UserContext(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
 	if err != nil {
-		log.Printf("Error deleting user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return serverError(c, err, "Error deleting user")
 	}
 
 	return c.Status(fiber.StatusNoContent).SendString("")
@@ -181,6 +375,25 @@ func deleteUser(c *fiber.Ctx) error {
 func getKeys(c *fiber.Ctx) error {
 	// REQUEST EXAMPLE
 	// curl "http://localhost:4000/keys?limit=10&offset=0"
+	//
+	// EXPORT EXAMPLE (every key, limit and offset are ignored)
+	// curl "http://localhost:4000/keys?format=xlsx" -o keys.xlsx
+
+	// Stream every matching row instead of a page when an export format is requested
+	format, export, err := exportFormat(c)
+	if errors.Is(err, errExportsDisabled) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Exports are disabled",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if export {
+		return streamExport(c, "keys", format, exporter.Filter{TenantID: callerTenantID(c)})
+	}
 
 	// Parse limit and offset from query parameters
 	limitStr := c.Query("limit", "10")  // Default limit is 10
@@ -201,15 +414,12 @@ func getKeys(c *fiber.Ctx) error {
 	}
 
 	// Call the service to get paginated keys
-	response, err := service.GetAllKeys(limit, offset)
+	response, err := service.GetAllKeys(c.UserContext(), limit, offset, callerTenantID(c))
 	if err != nil {
-		log.Printf("Error getting keys: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch keys",
-		})
+		return serverErrorJSON(c, err, "Error getting keys", "Failed to fetch keys")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(response)
+	return sendJSON(c, response, time.Time{})
 }
 
 func getKeysById(c *fiber.Ctx) error {
@@ -218,35 +428,41 @@ func getKeysById(c *fiber.Ctx) error {
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error getting id: %v", err)
+		slog.WarnContext(c.UserContext(), "Error getting id", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
 	}
 
-	user, err := service.GetKeysByID(id)
+	if ok, err := inCallerTenant(c, "keys", id); !ok {
+		return err
+	}
+
+	key, err := service.GetKeysByID(c.UserContext(), id)
 	if err != nil {
-		log.Printf("Error getting user: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return serverError(c, err, "Error getting key")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(user)
+	return sendJSON(c, key, key.UpdatedAt)
 }
 
 func createKey(c *fiber.Ctx) error {
 	// REQUEST EXAMPLE
 	// curl -X POST http://localhost:4000/keys \
 	// -H "Content-Type: application/json" \
+	// -H "Idempotency-Key: 7c4a8d09-ca37-4a1b-9f2e-3f1d1c2b5e6a" \
 	// -d '{"name": "TEST Key"}'
 
 	var key service.Key
 	if err := c.BodyParser(&key); err != nil {
-		log.Printf("Error parsing body: %v", err)
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	createdKey, err := service.CreateKey(key)
+	createdKey, err := service.CreateKey(c.UserContext(), key, callerUserID(c))
 	if err != nil {
-		log.Printf("Error creating key: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		if service.IsAuthError(err) {
+			return unauthorized(c, err.Error())
+		}
+		return serverError(c, err, "Error creating key")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(createdKey)
@@ -255,25 +471,48 @@ func createKey(c *fiber.Ctx) error {
 func updateKey(c *fiber.Ctx) error {
 	// REQUEST EXAMPLE
 	// curl -X PUT http://localhost:4000/keys/1 \
+	// -H 'If-Match: "<etag>"' \
 	// -H "Content-Type: application/json" \
-	// -d '{"name": "Updated Key Name", "is_active": false}'
+	// -d '{"name": "Updated Key Name", "is_active": false, "version": 1}'
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error converting ID to integer: %v", err)
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
+	if ok, err := inCallerTenant(c, "keys", id); !ok {
+		return err
+	}
+
+	if done, err := checkIfMatch(c, func() (service.Key, error) {
+		return service.GetKeysByIDUncached(c.UserContext(), id)
+	}); done {
+		return err
+	}
+
 	var key service.Key
 	if err := c.BodyParser(&key); err != nil {
-		log.Printf("Error parsing body: %v", err)
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	updatedKey, err := service.UpdateKey(id, key)
+	updatedKey, err := service.UpdateKey(c.UserContext(), id, key)
 	if err != nil {
-		log.Printf("Error updating key: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Key not found",
+			})
+		}
+		if conflict, ok := service.AsConflict(err); ok {
+			return versionConflict(c, conflict)
+		}
+		return serverError(c, err, "Error updating key")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(updatedKey)
@@ -285,14 +524,28 @@ func deleteKey(c *fiber.Ctx) error {
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error converting ID to integer: %v", err)
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	err = service.DeleteKey(id)
+	if ok, err := inCallerTenant(c, "keys", id); !ok {
+		return err
+	}
+
+	if done, err := checkIfMatch(c, func() (service.Key, error) {
+		return service.GetKeysByIDUncached(c.UserContext(), id)
+	}); done {
+		return err
+	}
+
+	err = service.DeleteKey(c.UserContext(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Key not found",
+		})
+	}
 	if err != nil {
-		log.Printf("Error deleting key: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return serverError(c, err, "Error deleting key")
 	}
 
 	return c.Status(fiber.StatusNoContent).SendString("")
@@ -303,6 +556,25 @@ func deleteKey(c *fiber.Ctx) error {
 func getCopies(c *fiber.Ctx) error {
 	// REQUEST EXAMPLE
 	// curl "http://localhost:4000/copies?limit=10&offset=0"
+	//
+	// EXPORT EXAMPLE (every copy, limit and offset are ignored)
+	// curl -H "Accept: application/x-ndjson" http://localhost:4000/copies -o copies.jsonl
+
+	// Stream every matching row instead of a page when an export format is requested
+	format, export, err := exportFormat(c)
+	if errors.Is(err, errExportsDisabled) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Exports are disabled",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if export {
+		return streamExport(c, "copies", format, exporter.Filter{TenantID: callerTenantID(c)})
+	}
 
 	// Parse limit and offset from query parameters
 	limitStr := c.Query("limit", "10")  // Default limit is 10
@@ -323,15 +595,12 @@ func getCopies(c *fiber.Ctx) error {
 	}
 
 	// Call the service to get paginated copies
-	response, err := service.GetAllCopies(limit, offset)
+	response, err := service.GetAllCopies(c.UserContext(), limit, offset, callerTenantID(c))
 	if err != nil {
-		log.Printf("Error getting copies: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch copies",
-		})
+		return serverErrorJSON(c, err, "Error getting copies", "Failed to fetch copies")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(response)
+	return sendJSON(c, response, time.Time{})
 }
 
 func getCopiesById(c *fiber.Ctx) error {
@@ -340,35 +609,45 @@ func getCopiesById(c *fiber.Ctx) error {
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error getting id: %v", err)
+		slog.WarnContext(c.UserContext(), "Error getting id", "error", err)
 		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
 	}
 
-	copy, err := service.GetCopyByID(id)
+	if ok, err := inCallerTenant(c, "copies", id); !ok {
+		return err
+	}
+
+	copy, err := service.GetCopyByID(c.UserContext(), id)
 	if err != nil {
-		log.Printf("Error getting copy: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return serverError(c, err, "Error getting copy")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(copy)
+	return sendJSON(c, copy, copy.UpdatedAt)
 }
 
 func createCopy(c *fiber.Ctx) error {
 	// REQUEST EXAMPLE
 	// curl -X POST http://localhost:4000/copies \
 	// -H "Content-Type: application/json" \
-	// -d '{"name": "TEST Copy"}'
+	// -d '{"name": "TEST Copy", "key_id": 1}'
 
 	var copy service.Copy
 	if err := c.BodyParser(&copy); err != nil {
-		log.Printf("Error parsing body: %v", err)
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	createdCopy, err := service.CreateCopy(copy)
+	createdCopy, err := service.CreateCopy(c.UserContext(), copy, callerUserID(c))
 	if err != nil {
-		log.Printf("Error creating copy: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		if service.IsAuthError(err) {
+			return unauthorized(c, err.Error())
+		}
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return serverError(c, err, "Error creating copy")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(createdCopy)
@@ -378,24 +657,46 @@ func updateCopy(c *fiber.Ctx) error {
 	// REQUEST EXAMPLE
 	// curl -X PUT http://localhost:4000/copies/1 \
 	// -H "Content-Type: application/json" \
-	// -d '{"name": "Updated Copy Name", "is_active": true}'
+	// -d '{"name": "Updated Copy Name", "is_active": true, "version": 1}'
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error converting ID to integer: %v", err)
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
+	if ok, err := inCallerTenant(c, "copies", id); !ok {
+		return err
+	}
+
+	if done, err := checkIfMatch(c, func() (service.Copy, error) {
+		return service.GetCopyByIDUncached(c.UserContext(), id)
+	}); done {
+		return err
+	}
+
 	var copy service.Copy
 	if err := c.BodyParser(&copy); err != nil {
-		log.Printf("Error parsing body: %v", err)
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	updatedCopy, err := service.UpdateCopy(id, copy)
+	updatedCopy, err := service.UpdateCopy(c.UserContext(), id, copy)
 	if err != nil {
-		log.Printf("Error updating copy: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Copy not found",
+			})
+		}
+		if conflict, ok := service.AsConflict(err); ok {
+			return versionConflict(c, conflict)
+		}
+		return serverError(c, err, "Error updating copy")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(updatedCopy)
@@ -408,14 +709,28 @@ func deleteCopy(c *fiber.Ctx) error {
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error converting ID to integer: %v", err)
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	err = service.DeleteCopy(id)
+	if ok, err := inCallerTenant(c, "copies", id); !ok {
+		return err
+	}
+
+	if done, err := checkIfMatch(c, func() (service.Copy, error) {
+		return service.GetCopyByIDUncached(c.UserContext(), id)
+	}); done {
+		return err
+	}
+
+	err = service.DeleteCopy(c.UserContext(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Copy not found",
+		})
+	}
 	if err != nil {
-		log.Printf("Error deleting copy: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return serverError(c, err, "Error deleting copy")
 	}
 
 	return c.Status(fiber.StatusNoContent).SendString("")
@@ -446,15 +761,12 @@ func getTenants(c *fiber.Ctx) error {
 	}
 
 	// Call the service to get paginated tenants
-	response, err := service.GetAllTenants(limit, offset)
+	response, err := service.GetAllTenants(c.UserContext(), limit, offset, callerTenantID(c))
 	if err != nil {
-		log.Printf("Error getting tenants: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch tenants",
-		})
+		return serverErrorJSON(c, err, "Error getting tenants", "Failed to fetch tenants")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(response)
+	return sendJSON(c, response, time.Time{})
 }
 
 func getTenantById(c *fiber.Ctx) error {
@@ -463,17 +775,20 @@ func getTenantById(c *fiber.Ctx) error {
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error converting ID to integer: %v", err)
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	tenant, err := service.GetTenantByID(id)
+	if ok, err := inCallerTenant(c, "tenants", id); !ok {
+		return err
+	}
+
+	tenant, err := service.GetTenantByID(c.UserContext(), id)
 	if err != nil {
-		log.Printf("Error getting tenant: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return serverError(c, err, "Error getting tenant")
 	}
 
-	return c.Status(fiber.StatusOK).JSON(tenant)
+	return sendJSON(c, tenant, tenant.UpdatedAt)
 }
 
 func createTenant(c *fiber.Ctx) error {
@@ -484,14 +799,18 @@ func createTenant(c *fiber.Ctx) error {
 
 	var tenant service.Tenant
 	if err := c.BodyParser(&tenant); err != nil {
-		log.Printf("Error parsing body: %v", err)
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	createdTenant, err := service.CreateTenant(tenant)
+	createdTenant, err := service.CreateTenant(c.UserContext(), tenant)
 	if err != nil {
-		log.Printf("Error creating tenant: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return serverError(c, err, "Error creating tenant")
 	}
 
 	return c.Status(fiber.StatusCreated).JSON(createdTenant)
@@ -501,24 +820,59 @@ func updateTenant(c *fiber.Ctx) error {
 	// REQUEST EXAMPLE
 	// curl -X PUT http://localhost:4000/tenants/1 \
 	// -H "Content-Type: application/json" \
-	// -d '{"name": "Updated Name", "address": "Updated Address", "status": "active"}'
+	// -d '{"name": "Updated Name", "address": "Updated Address", "status": "active", "version": 1}'
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error converting ID to integer: %v", err)
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
+	if ok, err := inCallerTenant(c, "tenants", id); !ok {
+		return err
+	}
+
+	if done, err := checkIfMatch(c, func() (service.Tenant, error) {
+		return service.GetTenantByIDUncached(c.UserContext(), id)
+	}); done {
+		return err
+	}
+
 	var tenant service.Tenant
 	if err := c.BodyParser(&tenant); err != nil {
-		log.Printf("Error parsing body: %v", err)
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	updatedTenant, err := service.UpdateTenant(id, tenant)
+	current, err := service.GetTenantByIDUncached(c.UserContext(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Tenant not found",
+		})
+	}
 	if err != nil {
-		log.Printf("Error updating tenant: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return serverError(c, err, "Error fetching tenant")
+	}
+	if err := checkTenantPolicyChange(callerFrom(c), &tenant, &current); err != nil {
+		return roleForbidden(c, err)
+	}
+
+	updatedTenant, err := service.UpdateTenant(c.UserContext(), id, tenant)
+	if err != nil {
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Tenant not found",
+			})
+		}
+		if conflict, ok := service.AsConflict(err); ok {
+			return versionConflict(c, conflict)
+		}
+		return serverError(c, err, "Error updating tenant")
 	}
 
 	return c.Status(fiber.StatusOK).JSON(updatedTenant)
@@ -531,14 +885,28 @@ func deleteTenant(c *fiber.Ctx) error {
 
 	id, err := strconv.Atoi(c.Params("id"))
 	if err != nil {
-		log.Printf("Error converting ID to integer: %v", err)
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
 		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
 	}
 
-	err = service.DeleteTenant(id)
+	if ok, err := inCallerTenant(c, "tenants", id); !ok {
+		return err
+	}
+
+	if done, err := checkIfMatch(c, func() (service.Tenant, error) {
+		return service.GetTenantByIDUncached(c.UserContext(), id)
+	}); done {
+		return err
+	}
+
+	err = service.DeleteTenant(c.UserContext(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Tenant not found",
+		})
+	}
 	if err != nil {
-		log.Printf("Error deleting tenant: %v", err)
-		return c.Status(fiber.StatusInternalServerError).SendString("Internal Server Error")
+		return serverError(c, err, "Error deleting tenant")
 	}
 
 	return c.Status(fiber.StatusNoContent).SendString("Tenant deleted successfully")
@@ -0,0 +1,44 @@
+package http
+
+import (
+	"net/http/httptest"
+	"portier/internal/config"
+	"portier/pkg/metrics"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestScrapeMetricsWithTheMetricsToken(t *testing.T) {
+	app := fiber.New()
+	RegisterRoutes(app, config.Features{}, metrics.FiberHandler("metrics-secret"))
+
+	// The metrics token is not an API token, authenticate must not see it
+	SetAuth(true)
+	defer SetAuth(false)
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"metrics token", "Bearer metrics-secret", fiber.StatusOK},
+		{"no token", "", fiber.StatusUnauthorized},
+		{"other token", "Bearer ptk_other", fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(fiber.MethodGet, "/metrics", nil)
+			if tt.header != "" {
+				req.Header.Set(fiber.HeaderAuthorization, tt.header)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Errorf("GET /metrics = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package http
+
+import (
+	"portier/internal/health"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+/*** HEALTH HANDLERS ***/
+
+func getHealthz(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/healthz
+
+	return c.Status(fiber.StatusOK).JSON(health.Live())
+}
+
+func getReadyz(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/readyz
+
+	report, ok := health.Ready(c.UserContext())
+	if !ok {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(report)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(report)
+}
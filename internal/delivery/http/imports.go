@@ -0,0 +1,155 @@
+package http
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"portier/internal/importer"
+	"portier/internal/service"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+/*** IMPORTS HANDLERS ***/
+
+func createImport(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (dry run, nothing is stored)
+	// curl -X POST "http://localhost:4000/imports?dry_run=true" \
+	// -F "entity=keys" \
+	// -F "file=@keys.xlsx" \
+	// -F 'mapping={"Key name": "name"}'
+	//
+	// REQUEST EXAMPLE (commit in the background)
+	// curl -X POST http://localhost:4000/imports \
+	// -F "entity=keys" \
+	// -F "file=@keys.csv"
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Missing 'file' field",
+		})
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error opening uploaded file", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error reading uploaded file", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	// The mapping is optional, columns named after a field are mapped automatically
+	var mapping map[string]string
+	if raw := c.FormValue("mapping"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &mapping); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid 'mapping' field, expected a JSON object of column to field",
+			})
+		}
+	}
+
+	imp, err := importer.Parse(c.FormValue("entity"), fileHeader.Filename, data, mapping)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Imported users, keys and copies belong to the tenant of the caller, see createUser and createKey
+	imp.Caller = callerFrom(c)
+	if imp.Entity != "users" {
+		imp.CreatedBy, err = service.ResolveCreatorID(callerUserID(c))
+		if err != nil {
+			return unauthorized(c, err.Error())
+		}
+	}
+
+	if c.QueryBool("dry_run") {
+		report, err := imp.DryRun(c.UserContext())
+		if err != nil {
+			return serverError(c, err, "Error validating import")
+		}
+		return c.Status(fiber.StatusOK).JSON(report)
+	}
+
+	job, err := imp.Start(c.UserContext())
+	if err != nil {
+		return serverError(c, err, "Error starting import")
+	}
+
+	c.Location("/imports/" + strconv.Itoa(job.ID))
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+func getImportById(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/imports/1
+
+	job, ok, err := getJob(c, service.JobImport)
+	if !ok {
+		return err
+	}
+
+	return c.Status(fiber.StatusOK).JSON(job)
+}
+
+func getImportErrors(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -OJ http://localhost:4000/imports/1/errors
+
+	job, ok, err := getJob(c, service.JobImport)
+	if !ok {
+		return err
+	}
+
+	if job.Status != service.JobCompleted && job.Status != service.JobFailed {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The import is still running",
+		})
+	}
+	if job.ResultPath == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "The import has no rejected rows",
+		})
+	}
+
+	return c.Download(job.ResultPath, "import-"+strconv.Itoa(job.ID)+"-errors.csv")
+}
+
+// getJob loads the job of the :id parameter and checks its kind and that the
+// caller may read it: the user of the token creating it, or an admin of its
+// tenant. A job created without a token may export every tenant, a token never
+// reads it. When ok is false the response has already been written and err must be returned.
+func getJob(c *fiber.Ctx, kind string) (job service.Job, ok bool, err error) {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return job, false, c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	job, err = service.GetJobByID(c.UserContext(), id)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && job.Kind != kind) {
+		return job, false, c.Status(fiber.StatusNotFound).SendString("Not Found")
+	}
+	if err != nil {
+		return job, false, serverError(c, err, "Error getting job")
+	}
+
+	caller := callerFrom(c)
+	if caller != nil && caller.UserID != job.CreatedBy && (caller.Role != service.RoleAdmin || job.TenantID == 0 || caller.TenantID != job.TenantID) {
+		return job, false, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the creator of the job and the admins of its tenant read it",
+		})
+	}
+
+	return job, true, nil
+}
@@ -0,0 +1,116 @@
+package http
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"portier/internal/service"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+/*** LOCKOUT HANDLERS ***/
+
+func getLoginAttempts(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl "http://localhost:4000/users/1/login-attempts?limit=20&offset=0" -H "Authorization: Bearer ptk_..."
+
+	id, ok, err := lockoutUser(c)
+	if !ok {
+		return err
+	}
+	limit, err := strconv.Atoi(c.Query("limit", "10"))
+	if err != nil || limit <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid 'limit' parameter",
+		})
+	}
+	offset, err := strconv.Atoi(c.Query("offset", "0"))
+	if err != nil || offset < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid 'offset' parameter",
+		})
+	}
+
+	history, err := service.GetLoginHistory(c.UserContext(), id, limit, offset)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return serverError(c, err, "Error fetching login attempts")
+	}
+	return c.JSON(history)
+}
+
+func unlockUser(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X POST http://localhost:4000/users/1/unlock -H "Authorization: Bearer ptk_..."
+
+	id, ok, err := lockoutUser(c)
+	if !ok {
+		return err
+	}
+
+	if err := service.UnlockUser(c.UserContext(), id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found",
+			})
+		}
+		return serverError(c, err, "Error unlocking user")
+	}
+
+	return c.Status(fiber.StatusNoContent).SendString("")
+}
+
+// lockoutUser returns the :id parameter when the caller may review and unlock
+// the user: an admin of its tenant. When ok is false the response is already
+// written and err must be returned.
+func lockoutUser(c *fiber.Ctx) (id int, ok bool, err error) {
+	id, err = strconv.Atoi(c.Params("id"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return 0, false, c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	caller := callerFrom(c)
+	if caller == nil {
+		return 0, false, unauthorized(c, "An API token of an admin of the tenant of the user is required")
+	}
+	user, err := service.GetUserByIDUncached(c.UserContext(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, false, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return 0, false, serverError(c, err, "Error fetching user")
+	}
+	if caller.Role != service.RoleAdmin || caller.TenantID != user.TenantID {
+		return 0, false, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the admins of its tenant review and unlock a user",
+		})
+	}
+	return id, true, nil
+}
+
+// loginClient is the client of a credential check, recorded in the login history
+func loginClient(c *fiber.Ctx) service.LoginClient {
+	return service.LoginClient{IP: c.IP(), UserAgent: c.Get(fiber.HeaderUserAgent)}
+}
+
+// sendLocked answers a check refused by a lock: 423 for a user, 429 for an address
+func sendLocked(c *fiber.Ctx, locked *service.LockedError) error {
+	status := fiber.StatusLocked
+	if locked.IP {
+		status = fiber.StatusTooManyRequests
+	}
+	seconds := strconv.Itoa(int(math.Ceil(locked.RetryAfter.Seconds())))
+	c.Set(fiber.HeaderRetryAfter, seconds)
+	return c.Status(status).JSON(fiber.Map{
+		"error": locked.Error() + ", retry in " + seconds + " seconds",
+	})
+}
@@ -0,0 +1,217 @@
+package http
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"portier/internal/service"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+/*** SINGLE SIGN-ON HANDLERS ***/
+
+func getTenantOIDC(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/tenants/1/oidc -H "Authorization: Bearer ptk_..."
+
+	id, ok, err := oidcTenant(c)
+	if !ok {
+		return err
+	}
+
+	cfg, err := service.GetTenantOIDC(c.UserContext(), id)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": service.ErrOIDCNotConfigured.Error(),
+			})
+		}
+		return serverError(c, err, "Error fetching single sign-on configuration")
+	}
+	return sendJSON(c, cfg, cfg.UpdatedAt)
+}
+
+func updateTenantOIDC(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (register <oidc.redirect_url> as the redirect URI at the provider)
+	// curl -X PUT http://localhost:4000/tenants/1/oidc \
+	// -H "Authorization: Bearer ptk_..." \
+	// -H "Content-Type: application/json" \
+	// -d '{"issuer": "https://login.example.com", "client_id": "portier", "client_secret": "secret",
+	//      "role_mapping": {"portier-admins": "admin"}, "jit_provisioning": true, "is_active": true}'
+
+	id, ok, err := oidcTenant(c)
+	if !ok {
+		return err
+	}
+	var cfg service.TenantOIDC
+	if err := c.BodyParser(&cfg); err != nil {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	saved, err := service.SaveTenantOIDC(c.UserContext(), id, cfg)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Tenant not found",
+			})
+		}
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return serverError(c, err, "Error saving single sign-on configuration")
+	}
+	return c.JSON(saved)
+}
+
+func deleteTenantOIDC(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X DELETE http://localhost:4000/tenants/1/oidc -H "Authorization: Bearer ptk_..."
+
+	id, ok, err := oidcTenant(c)
+	if !ok {
+		return err
+	}
+
+	if err := service.DeleteTenantOIDC(c.UserContext(), id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": service.ErrOIDCNotConfigured.Error(),
+			})
+		}
+		return serverError(c, err, "Error deleting single sign-on configuration")
+	}
+	return c.Status(fiber.StatusNoContent).SendString("")
+}
+
+func beginOIDCLogin(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (open it in a browser, it redirects to the provider of the tenant)
+	// http://localhost:4000/tenants/1/oidc/login
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	location, state, err := service.BeginOIDCLogin(c.UserContext(), id)
+	if err != nil {
+		return oidcError(c, err, "Error starting single sign-on")
+	}
+	// Only the browser starting the login completes it, a callback URL sent to
+	// another one logs it in nowhere (login CSRF)
+	c.Cookie(&fiber.Cookie{
+		Name:     oidcStateCookie,
+		Value:    stateBinding(state),
+		Path:     "/oidc/callback",
+		Secure:   c.Protocol() == "https",
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	return c.Redirect(location, fiber.StatusFound)
+}
+
+func completeOIDCLogin(c *fiber.Ctx) error {
+	// The provider redirects the browser here with the code and the state of the login,
+	// the answer holds the user and an API token for the following requests
+
+	if reason := c.Query("error"); reason != "" {
+		slog.WarnContext(c.UserContext(), "Single sign-on refused by the provider", "error", reason, "description", c.Query("error_description"))
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "The identity provider refused the login: " + reason,
+		})
+	}
+	if c.Query("code") == "" || c.Query("state") == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "code and state are required",
+		})
+	}
+
+	// The cookie is used once too, it is removed with the path it was set for
+	binding := c.Cookies(oidcStateCookie)
+	c.Cookie(&fiber.Cookie{Name: oidcStateCookie, Path: "/oidc/callback", Expires: time.Unix(0, 0), HTTPOnly: true, SameSite: fiber.CookieSameSiteLaxMode})
+	if subtle.ConstantTimeCompare([]byte(binding), []byte(stateBinding(c.Query("state")))) != 1 {
+		slog.WarnContext(c.UserContext(), "Single sign-on callback without the state cookie of its login")
+		return oidcError(c, service.ErrOIDCLoginInvalid, "Error completing single sign-on")
+	}
+
+	login, err := service.CompleteOIDCLogin(c.UserContext(), c.Query("state"), c.Query("code"))
+	if err != nil {
+		return oidcError(c, err, "Error completing single sign-on")
+	}
+	// The answer holds an API token, it must not be stored nor leak through a referrer
+	c.Set(fiber.HeaderCacheControl, "no-store")
+	c.Set(fiber.HeaderReferrerPolicy, "no-referrer")
+	return c.JSON(login)
+}
+
+// oidcStateCookie binds a login to the browser that started it
+const oidcStateCookie = "portier_oidc_state"
+
+// stateBinding is the value of oidcStateCookie for state
+func stateBinding(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+// oidcTenant parses the tenant of the configuration routes, the caller must be
+// an admin of the tenant. When ok is false the response is already written.
+func oidcTenant(c *fiber.Ctx) (id int, ok bool, err error) {
+	id, err = strconv.Atoi(c.Params("id"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return 0, false, c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	caller := callerFrom(c)
+	if caller == nil {
+		return 0, false, unauthorized(c, "An API token of an admin of the tenant is required")
+	}
+	if caller.Role != service.RoleAdmin || caller.TenantID != id {
+		return 0, false, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the admins of the tenant manage its single sign-on",
+		})
+	}
+	return id, true, nil
+}
+
+// oidcError answers the errors of the login routes
+func oidcError(c *fiber.Ctx, err error, msg string) error {
+	status := 0
+	switch {
+	case service.IsValidationError(err):
+		status = fiber.StatusBadRequest
+	case service.IsAuthError(err):
+		slog.WarnContext(c.UserContext(), msg, "error", err)
+		status = fiber.StatusUnauthorized
+	case errors.Is(err, service.ErrOIDCProvisioningDisabled), errors.Is(err, service.ErrOIDCUserInactive), errors.Is(err, service.ErrOIDCSecondFactorRequired):
+		status = fiber.StatusForbidden
+	case errors.Is(err, service.ErrOIDCNotConfigured):
+		status = fiber.StatusNotFound
+	case errors.Is(err, service.ErrOIDCIdentityTaken):
+		status = fiber.StatusConflict
+	case errors.Is(err, service.ErrOIDCProviderUnavailable):
+		slog.ErrorContext(c.UserContext(), msg, "error", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": service.ErrOIDCProviderUnavailable.Error(),
+		})
+	default:
+		return serverError(c, err, msg)
+	}
+	// The details of a failed login are logged, not sent
+	message := err.Error()
+	if errors.Is(err, service.ErrOIDCLoginFailed) {
+		message = service.ErrOIDCLoginFailed.Error()
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"error": message,
+	})
+}
@@ -0,0 +1,46 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestCompleteOIDCLoginBinding(t *testing.T) {
+	app := fiber.New()
+	app.Get("/oidc/callback", completeOIDCLogin)
+
+	// Every callback below is refused before the state is redeemed, no database is needed
+	tests := []struct {
+		name   string
+		cookie string // value of the state cookie, empty when the browser has none
+	}{
+		{"no cookie", ""},
+		{"cookie of another login", stateBinding("other-state")},
+		{"state itself as cookie", "attacker-state"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(fiber.MethodGet, "/oidc/callback?code=attacker-code&state=attacker-state", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: oidcStateCookie, Value: tt.cookie})
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != fiber.StatusBadRequest {
+				t.Errorf("callback = %d, want 400", resp.StatusCode)
+			}
+			cleared := false
+			for _, cookie := range resp.Cookies() {
+				cleared = cleared || (cookie.Name == oidcStateCookie && cookie.Value == "" && cookie.Path == "/oidc/callback")
+			}
+			if !cleared {
+				t.Errorf("callback did not clear the state cookie: %v", resp.Header.Values(fiber.HeaderSetCookie))
+			}
+		})
+	}
+}
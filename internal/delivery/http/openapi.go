@@ -0,0 +1,423 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/base64"
+	"portier/internal/exporter"
+	"portier/internal/health"
+	"portier/internal/service"
+	"portier/pkg/idempotency"
+	"portier/pkg/openapi"
+	"portier/pkg/scim"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+//go:embed swagger.html
+var swaggerHTML []byte
+
+// docsPolicy lets the Swagger UI of /docs load its assets from unpkg.com and run
+// its inline script, every other response keeps security.content_security_policy
+var docsPolicy = "default-src 'none'; script-src https://unpkg.com '" + inlineScriptHash(swaggerHTML) + "'; " +
+	"style-src https://unpkg.com 'unsafe-inline'; img-src 'self' data:; connect-src 'self'; frame-ancestors 'none'"
+
+// errorResponse is the JSON body returned by most failing requests
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// importForm documents the multipart form of POST /imports
+type importForm struct {
+	Entity  string `json:"entity" doc:"users, keys or copies"`
+	File    string `json:"file" format:"binary" doc:"CSV or XLSX file, the first row is the header"`
+	Mapping string `json:"mapping" doc:"Optional JSON object of column header to field"`
+}
+
+// apiQuery is a documented query parameter
+type apiQuery struct {
+	name        string
+	description string
+}
+
+// apiResponse documents a response other than the success and the shared errors
+type apiResponse struct {
+	status      int
+	description string
+	body        interface{} // JSON body, nil when there is none
+}
+
+// apiOperation documents one route of RegisterRoutes
+type apiOperation struct {
+	method   string
+	route    string // Fiber route, as registered
+	tag      string
+	summary  string
+	query    []apiQuery
+	body     interface{} // JSON request body, nil when there is none
+	form     interface{} // multipart request body, nil when there is none
+	status   int
+	response interface{} // JSON response body, nil when there is none
+	exports  bool        // the route can also answer with an export file
+	retry    bool        // the route accepts an Idempotency-Key header
+	others   []apiResponse
+}
+
+var pageQuery = []apiQuery{
+	{"limit", "Page size, default 10"},
+	{"offset", "Number of rows to skip, default 0"},
+	{"format", "json (default), csv, jsonl or xlsx. Export formats return every matching row"},
+}
+
+// Responses of conditional requests and versioned updates, see conditional.go
+var (
+	notModifiedResponses  = []apiResponse{{304, "not modified, If-None-Match matched the ETag or nothing changed since If-Modified-Since", nil}}
+	preconditionResponses = []apiResponse{{412, "If-Match does not match the ETag of the current row", errorResponse{}}}
+	updateResponses       = []apiResponse{
+		{409, "version conflict, the body holds the current row in 'current'", errorResponse{}},
+		{412, "If-Match does not match the ETag of the current row", errorResponse{}},
+	}
+)
+
+// Responses of the user routes giving or changing a role or a tenant, see checkRoleChange and checkUserTenant
+var roleResponses = []apiResponse{
+	{401, "a role other than user is given or changed without an API token", errorResponse{}},
+	{403, "a role other than user is given or changed by a token that is not one of an admin of the tenant, or tenant_id is not the tenant of the token", errorResponse{}},
+}
+
+// Responses of the tenant routes changing require_totp or default_key_id, see checkTenantPolicyChange
+var tenantPolicyResponses = []apiResponse{
+	{401, "require_totp or default_key_id is changed without an API token", errorResponse{}},
+	{403, "require_totp or default_key_id is changed by a token that is not one of an admin of the tenant", errorResponse{}},
+}
+
+// Responses of the routes creating keys and copies, owned by the tenant of the caller
+var creatorResponses = []apiResponse{{401, "no API token and no defaults.creator_id", errorResponse{}}}
+
+// Responses of the routes of a user reserved to itself and the admins of its tenant
+var ownerResponses = []apiResponse{
+	{401, "no API token", errorResponse{}},
+	{403, "the token is not one of the user nor of an admin of its tenant", errorResponse{}},
+}
+
+// Responses of the import and export job routes, see getJob
+var jobResponses = []apiResponse{{403, "the token is not one of the creator of the job nor of an admin of its tenant", errorResponse{}}}
+
+// Responses of the token management routes, see tokens.go
+var tokenResponses = []apiResponse{
+	{401, "no API token, or for a create the current_password or the code of the user is missing or invalid", errorResponse{}},
+	{403, "the token is not one of the user nor of an admin of its tenant, or the user must enroll a second factor first", errorResponse{}},
+}
+
+// Responses of the single sign-on routes, see oidc.go
+var (
+	oidcAdminResponses = []apiResponse{
+		{401, "no API token", errorResponse{}},
+		{403, "the token is not one of an admin of the tenant", errorResponse{}},
+	}
+	oidcLoginResponses = []apiResponse{
+		{403, "the user is inactive, or is unknown and the tenant does not provision users, or has or requires a second factor the provider did not check", errorResponse{}},
+		{502, "the identity provider is unavailable", errorResponse{}},
+	}
+)
+
+// Responses of the SCIM routes, see scim.go. Their errors are SCIM errors.
+var (
+	scimQuery = []apiQuery{
+		{"filter", "SCIM filter, such as userName eq \"ahmad\""},
+		{"startIndex", "1-based index of the first result, default 1"},
+		{"count", "Page size, default and maximum 200"},
+	}
+	scimResponses = []apiResponse{
+		{400, "invalid filter, path, value or syntax, see scimType", scim.Error{}},
+		{401, "no API token", scim.Error{}},
+	}
+	scimItemResponses   = append([]apiResponse{{404, "not a user of the tenant of the token, or not a role", scim.Error{}}}, scimResponses...)
+	scimUpdateResponses = append([]apiResponse{
+		{409, "userName, email or externalId is taken", scim.Error{}},
+		{412, "If-Match does not match meta.version", scim.Error{}},
+	}, scimItemResponses...)
+)
+
+// Responses of the second factor routes, see totp.go
+var (
+	totpAuthResponses     = []apiResponse{{401, "the password, the code or the recovery code is invalid, or the code is missing", errorResponse{}}}
+	totpConflictResponses = []apiResponse{{409, "the user already has a second factor", errorResponse{}}}
+	totpPolicyResponses   = []apiResponse{{403, "the tenant or the role of the user requires a second factor", errorResponse{}}}
+)
+
+// Responses of the lockout routes and of the credential checks, see lockout.go
+var (
+	lockoutAdminResponses = []apiResponse{
+		{401, "no API token", errorResponse{}},
+		{403, "the token is not one of an admin of the tenant of the user", errorResponse{}},
+	}
+	lockedResponses = []apiResponse{
+		{423, "the user is locked by its failed logins, retry after the Retry-After header", errorResponse{}},
+		{429, "rate limit exceeded, or too many failed logins from the address, retry after the Retry-After header", errorResponse{}},
+	}
+)
+
+// apiOperations lists every route registered by RegisterRoutes.
+// TestEveryRouteIsDocumented fails when a route is missing here.
+var apiOperations = []apiOperation{
+	{method: "GET", route: "/", tag: "misc", summary: "Hello world", status: 200},
+	{method: "GET", route: "/healthz", tag: "health", summary: "Liveness, the process is running", status: 200, response: health.Report{}},
+	{method: "GET", route: "/readyz", tag: "health", summary: "Readiness, database, migrations and cache storage are available", status: 200, response: health.Report{},
+		others: []apiResponse{{503, "not ready or draining", health.Report{}}}},
+	{method: "GET", route: "/openapi.json", tag: "misc", summary: "This OpenAPI document", status: 200},
+	{method: "GET", route: "/docs", tag: "misc", summary: "Swagger UI", status: 200},
+	{method: "GET", route: "/metrics", tag: "misc", summary: "Prometheus metrics, only served here when metrics.listen is empty, requires the metrics token", status: 200},
+
+	// USERS
+	{method: "GET", route: "/users", tag: "users", summary: "List users, those of the tenant of the token with one", query: append([]apiQuery{{"name", "Filter by name"}, {"idnumber", "Filter by id number"}}, pageQuery...), status: 200, response: service.GetAllUsersResponse{}, exports: true, others: notModifiedResponses},
+	{method: "GET", route: "/users/:id", tag: "users", summary: "Get a user", status: 200, response: service.User{}, others: notModifiedResponses},
+	{method: "POST", route: "/users", tag: "users", summary: "Create a user", body: service.User{}, status: 201, response: service.User{}, retry: true, others: roleResponses},
+	{method: "PUT", route: "/users/:id", tag: "users", summary: "Update a user, a new password or email needs current_password unless an admin of the tenant changes the email", body: service.User{}, status: 200, response: service.User{}, others: append(append(append([]apiResponse{{404, "user not found, or of another tenant than the token", errorResponse{}}}, roleResponses...), updateResponses...), lockedResponses...)},
+	{method: "DELETE", route: "/users/:id", tag: "users", summary: "Delete a user", status: 204, others: append([]apiResponse{{404, "user not found, or of another tenant than the token", errorResponse{}}}, preconditionResponses...)},
+	{method: "POST", route: "/users\\:batch", tag: "users", summary: "Create, update and delete users in one request", body: batchRequest[service.User]{}, status: 200, response: batchResponse{}, retry: true},
+
+	// ACCOUNTS
+	{method: "POST", route: "/password-reset", tag: "accounts", summary: "Email a password reset link to a verified address, the answer is the same for unknown addresses", body: passwordResetRequest{}, status: 202, response: messageResponse{}},
+	{method: "POST", route: "/password-reset/confirm", tag: "accounts", summary: "Set a new password with the token of a reset link", body: passwordResetConfirm{}, status: 204},
+	{method: "POST", route: "/users/:id/verify-email", tag: "accounts", summary: "Email a new verification link to the address of a user, requires a token of the user or of an admin of its tenant", status: 202, response: messageResponse{}, others: ownerResponses},
+	{method: "POST", route: "/verify-email/confirm", tag: "accounts", summary: "Verify an address with the token of a verification link", body: emailVerificationConfirm{}, status: 204},
+
+	// TOTP
+	{method: "POST", route: "/users/:id/totp", tag: "totp", summary: "Start a TOTP enrollment, returns the secret and its otpauth:// provisioning URI", body: totpEnrollmentRequest{}, status: 201, response: service.TOTPEnrollment{}, others: append(totpConflictResponses, lockedResponses...)},
+	{method: "POST", route: "/users/:id/totp/confirm", tag: "totp", summary: "Enable the enrollment with the password and a code of the app, returns the recovery codes", body: totpCheckRequest{}, status: 200, response: service.RecoveryCodes{}, others: append(append(totpAuthResponses, totpConflictResponses...), lockedResponses...)},
+	{method: "DELETE", route: "/users/:id/totp", tag: "totp", summary: "Disable the second factor, refused when the tenant or the role requires it", body: totpCheckRequest{}, status: 204, others: append(append(totpAuthResponses, totpPolicyResponses...), lockedResponses...)},
+	{method: "POST", route: "/users/:id/recovery-codes", tag: "totp", summary: "Replace the recovery codes of the user", body: totpCheckRequest{}, status: 200, response: service.RecoveryCodes{}, others: append(totpAuthResponses, lockedResponses...)},
+	{method: "POST", route: "/auth/verify", tag: "totp", summary: "Check a password and the TOTP or recovery code of the user, returns the user", body: verifyCredentialsRequest{}, status: 200, response: service.User{}, others: append(append(totpAuthResponses, totpPolicyResponses...), lockedResponses...)},
+
+	// LOCKOUT
+	{method: "GET", route: "/users/:id/login-attempts", tag: "lockout", summary: "The lock of a user and its login attempts, newest first", query: pageQuery[:2], status: 200, response: service.LoginHistory{}, others: lockoutAdminResponses},
+	{method: "POST", route: "/users/:id/unlock", tag: "lockout", summary: "Clear the failed logins and the lock of a user", status: 204, others: lockoutAdminResponses},
+
+	// API TOKENS
+	{method: "GET", route: "/users/:id/tokens", tag: "tokens", summary: "List the API tokens of a user, requires a token of the user or of an admin of its tenant", status: 200, response: []service.APIToken{}, others: tokenResponses},
+	{method: "POST", route: "/users/:id/tokens", tag: "tokens", summary: "Create an API token, the token is only returned here", body: createTokenRequest{}, status: 201, response: service.APIToken{}, others: append(tokenResponses, lockedResponses...)},
+	{method: "DELETE", route: "/users/:id/tokens/:tokenId", tag: "tokens", summary: "Revoke an API token", status: 204, others: tokenResponses},
+
+	// SINGLE SIGN-ON
+	{method: "GET", route: "/tenants/:id/oidc", tag: "sso", summary: "Get the OpenID Connect provider of a tenant, the client secret is never returned", status: 200, response: service.TenantOIDC{}, others: append(oidcAdminResponses, notModifiedResponses...)},
+	{method: "PUT", route: "/tenants/:id/oidc", tag: "sso", summary: "Set the OpenID Connect provider of a tenant", body: service.TenantOIDC{}, status: 200, response: service.TenantOIDC{}, others: oidcAdminResponses},
+	{method: "DELETE", route: "/tenants/:id/oidc", tag: "sso", summary: "Remove the OpenID Connect provider of a tenant, its users keep their accounts", status: 204, others: oidcAdminResponses},
+	{method: "GET", route: "/tenants/:id/oidc/login", tag: "sso", summary: "Redirect the browser to the provider of the tenant (authorization code with PKCE)", status: 302, others: oidcLoginResponses},
+	{method: "GET", route: "/oidc/callback", tag: "sso", summary: "Redirect URI of the providers, provisions the user and returns it with an API token. Only the browser that started the login, holding its state cookie, completes it", query: []apiQuery{{"code", "Authorization code"}, {"state", "State of the login"}, {"error", "Error of the provider"}}, status: 200, response: service.OIDCLogin{}, others: append([]apiResponse{{401, "the provider refused the login, or its ID token is invalid", errorResponse{}}, {409, "the email of the identity belongs to another user", errorResponse{}}}, oidcLoginResponses...)},
+
+	// SCIM
+	{method: "GET", route: "/scim/v2/ServiceProviderConfig", tag: "scim", summary: "Features of the SCIM service provider", status: 200, response: scim.ServiceProviderConfig{}, others: scimResponses},
+	{method: "GET", route: "/scim/v2/ResourceTypes", tag: "scim", summary: "Resource types of the SCIM service provider, User and Group", status: 200, response: scim.ListResponse[scim.ResourceType]{}, others: scimResponses},
+	{method: "GET", route: "/scim/v2/Users", tag: "scim", summary: "List the users of the tenant of the token, service accounts excluded", query: scimQuery, status: 200, response: scim.ListResponse[service.SCIMUser]{}, others: scimResponses},
+	{method: "GET", route: "/scim/v2/Users/:id", tag: "scim", summary: "Get a user of the tenant", status: 200, response: service.SCIMUser{}, others: scimItemResponses},
+	{method: "POST", route: "/scim/v2/Users", tag: "scim", summary: "Provision a user in the tenant, without password and with the role user", body: service.SCIMUser{}, status: 201, response: service.SCIMUser{}, others: scimUpdateResponses},
+	{method: "PUT", route: "/scim/v2/Users/:id", tag: "scim", summary: "Replace a user, without active or emails the current ones are kept", body: service.SCIMUser{}, status: 200, response: service.SCIMUser{}, others: scimUpdateResponses},
+	{method: "PATCH", route: "/scim/v2/Users/:id", tag: "scim", summary: "Add, replace or remove attributes of a user, active false deactivates it", body: scim.PatchRequest{}, status: 200, response: service.SCIMUser{}, others: scimUpdateResponses},
+	{method: "DELETE", route: "/scim/v2/Users/:id", tag: "scim", summary: "Deactivate a user, it is not deleted", status: 204, others: scimUpdateResponses},
+	{method: "GET", route: "/scim/v2/Groups", tag: "scim", summary: "List the groups, one per role", query: append(scimQuery, apiQuery{"excludedAttributes", "members to leave the members out"}), status: 200, response: scim.ListResponse[service.SCIMGroup]{}, others: scimResponses},
+	{method: "GET", route: "/scim/v2/Groups/:id", tag: "scim", summary: "Get the group of a role with its members", query: []apiQuery{{"excludedAttributes", "members to leave the members out"}}, status: 200, response: service.SCIMGroup{}, others: scimItemResponses},
+	{method: "PUT", route: "/scim/v2/Groups/:id", tag: "scim", summary: "Set the members of a role, the users left out get the role user", body: service.SCIMGroup{}, status: 200, response: service.SCIMGroup{}, others: scimItemResponses},
+	{method: "PATCH", route: "/scim/v2/Groups/:id", tag: "scim", summary: "Add or remove members of a role, removed members get the role user", body: scim.PatchRequest{}, status: 200, response: service.SCIMGroup{}, others: scimItemResponses},
+
+	// KEYS
+	{method: "GET", route: "/keys", tag: "keys", summary: "List keys, those of the tenant of the token with one", query: pageQuery, status: 200, response: service.GetAllKeysResponse{}, exports: true, others: notModifiedResponses},
+	{method: "GET", route: "/keys/:id", tag: "keys", summary: "Get a key", status: 200, response: service.Key{}, others: notModifiedResponses},
+	{method: "POST", route: "/keys", tag: "keys", summary: "Create a key, created_by is the user of the token or defaults.creator_id", body: service.Key{}, status: 201, response: service.Key{}, retry: true, others: creatorResponses},
+	{method: "PUT", route: "/keys/:id", tag: "keys", summary: "Update a key", body: service.Key{}, status: 200, response: service.Key{}, others: append([]apiResponse{{404, "key not found, or of another tenant than the token", errorResponse{}}}, updateResponses...)},
+	{method: "DELETE", route: "/keys/:id", tag: "keys", summary: "Delete a key", status: 204, others: append([]apiResponse{{404, "key not found, or of another tenant than the token", errorResponse{}}}, preconditionResponses...)},
+	{method: "POST", route: "/keys\\:batch", tag: "keys", summary: "Create, update and delete keys in one request", body: batchRequest[service.Key]{}, status: 200, response: batchResponse{}, retry: true},
+
+	// COPIES
+	{method: "GET", route: "/copies", tag: "copies", summary: "List copies, those of the tenant of the token with one", query: pageQuery, status: 200, response: service.GetAllCopiesResponse{}, exports: true, others: notModifiedResponses},
+	{method: "GET", route: "/copies/:id", tag: "copies", summary: "Get a copy", status: 200, response: service.Copy{}, others: notModifiedResponses},
+	{method: "POST", route: "/copies", tag: "copies", summary: "Create a copy, created_by is the user of the token or defaults.creator_id", body: service.Copy{}, status: 201, response: service.Copy{}, retry: true, others: creatorResponses},
+	{method: "PUT", route: "/copies/:id", tag: "copies", summary: "Update a copy", body: service.Copy{}, status: 200, response: service.Copy{}, others: append([]apiResponse{{404, "copy not found, or of another tenant than the token", errorResponse{}}}, updateResponses...)},
+	{method: "DELETE", route: "/copies/:id", tag: "copies", summary: "Delete a copy", status: 204, others: append([]apiResponse{{404, "copy not found, or of another tenant than the token", errorResponse{}}}, preconditionResponses...)},
+	{method: "POST", route: "/copies\\:batch", tag: "copies", summary: "Create, update and delete copies in one request", body: batchRequest[service.Copy]{}, status: 200, response: batchResponse{}, retry: true},
+
+	// TENANTS
+	{method: "GET", route: "/tenants", tag: "tenants", summary: "List tenants, the tenant of the token with one", query: pageQuery[:2], status: 200, response: service.GetAllTenantsResponse{}, others: notModifiedResponses},
+	{method: "GET", route: "/tenants/:id", tag: "tenants", summary: "Get a tenant", status: 200, response: service.Tenant{}, others: notModifiedResponses},
+	{method: "POST", route: "/tenants", tag: "tenants", summary: "Create a tenant", body: service.Tenant{}, status: 201, response: service.Tenant{}, retry: true},
+	{method: "PUT", route: "/tenants/:id", tag: "tenants", summary: "Update a tenant", body: service.Tenant{}, status: 200, response: service.Tenant{}, others: append(append([]apiResponse{{404, "tenant not found, or another tenant than the one of the token", errorResponse{}}}, tenantPolicyResponses...), updateResponses...)},
+	{method: "DELETE", route: "/tenants/:id", tag: "tenants", summary: "Delete a tenant", status: 204, others: append([]apiResponse{{404, "tenant not found, or another tenant than the one of the token", errorResponse{}}}, preconditionResponses...)},
+	{method: "POST", route: "/tenants\\:batch", tag: "tenants", summary: "Create, update and delete tenants in one request", body: batchRequest[service.Tenant]{}, status: 200, response: batchResponse{}, retry: true},
+
+	// IMPORTS
+	{method: "POST", route: "/imports", tag: "imports", summary: "Validate (dry_run=true) or start an import", query: []apiQuery{{"dry_run", "true to only validate the file"}}, form: importForm{}, status: 202, response: service.Job{}, others: []apiResponse{{401, "keys or copies without an API token", errorResponse{}}}},
+	{method: "GET", route: "/imports/:id", tag: "imports", summary: "Get the progress of an import", status: 200, response: service.Job{}, others: jobResponses},
+	{method: "GET", route: "/imports/:id/errors", tag: "imports", summary: "Download the rejected rows of an import as CSV", status: 200, others: jobResponses},
+
+	// EXPORTS
+	{method: "POST", route: "/exports", tag: "exports", summary: "Start an export job, of the rows of the tenant of the token with one", body: exportRequest{}, status: 202, response: service.Job{}},
+	{method: "GET", route: "/exports/:id", tag: "exports", summary: "Get the progress of an export", status: 200, response: service.Job{}, others: jobResponses},
+	{method: "GET", route: "/exports/:id/download", tag: "exports", summary: "Download the file of a completed export", status: 200, others: jobResponses},
+}
+
+var (
+	spec     *openapi.Document
+	specOnce sync.Once
+)
+
+// Spec returns the OpenAPI document of every route in apiOperations
+func Spec() *openapi.Document {
+	specOnce.Do(func() {
+		spec = buildSpec()
+	})
+	return spec
+}
+
+func buildSpec() *openapi.Document {
+	doc := openapi.New("Portier API", "1.0.0", "Management of tenants, users, keys and key copies.")
+	errorSchema := doc.SchemaOf(errorResponse{})
+
+	// Tokens are optional unless auth.require_token is set
+	doc.Components.SecuritySchemes = map[string]*openapi.SecurityScheme{
+		"apiToken": {Type: "http", Scheme: "bearer", Description: "API token created with POST /users/{id}/tokens"},
+	}
+	doc.Security = []openapi.SecurityRequirement{{}, {"apiToken": {}}}
+
+	for _, op := range apiOperations {
+		path := openapi.PathFromRoute(op.route)
+		operation := &openapi.Operation{
+			Tags:        []string{op.tag},
+			Summary:     op.summary,
+			OperationID: operationID(op.method, path),
+			Responses:   map[string]*openapi.Response{},
+		}
+
+		for _, param := range openapi.PathParams(path) {
+			operation.Parameters = append(operation.Parameters, openapi.Parameter{
+				Name: param, In: "path", Required: true, Schema: &openapi.Schema{Type: "integer"},
+			})
+		}
+		for _, query := range op.query {
+			operation.Parameters = append(operation.Parameters, openapi.Parameter{
+				Name: query.name, In: "query", Description: query.description, Schema: &openapi.Schema{Type: "string"},
+			})
+		}
+
+		if op.retry {
+			operation.Parameters = append(operation.Parameters, openapi.Parameter{
+				Name: idempotency.HeaderKey, In: "header", Description: "Unique key of the request, a retry with the same key replays the first response", Schema: &openapi.Schema{Type: "string"},
+			})
+		}
+
+		if op.body != nil {
+			operation.RequestBody = &openapi.RequestBody{
+				Required: true,
+				Content:  map[string]*openapi.MediaType{fiber.MIMEApplicationJSON: {Schema: doc.SchemaOf(op.body)}},
+			}
+		}
+		if op.form != nil {
+			operation.RequestBody = &openapi.RequestBody{
+				Required: true,
+				Content:  map[string]*openapi.MediaType{fiber.MIMEMultipartForm: {Schema: doc.SchemaOf(op.form)}},
+			}
+		}
+
+		success := &openapi.Response{Description: strings.ToLower(utils.StatusMessage(op.status))}
+		if op.response != nil {
+			success.Content = map[string]*openapi.MediaType{fiber.MIMEApplicationJSON: {Schema: doc.SchemaOf(op.response)}}
+		}
+		if op.exports {
+			for _, contentType := range exporter.ContentTypes {
+				success.Content[contentType] = &openapi.MediaType{Schema: &openapi.Schema{Type: "string", Format: "binary"}}
+			}
+		}
+		operation.Responses[strconv.Itoa(op.status)] = success
+
+		// Error responses shared by the routes
+		if op.body != nil || op.form != nil || len(operation.Parameters) > 0 {
+			operation.Responses["400"] = &openapi.Response{Description: "invalid request", Content: jsonContent(errorSchema)}
+		}
+		if len(openapi.PathParams(path)) > 0 {
+			operation.Responses["404"] = &openapi.Response{Description: "not found"}
+		}
+		if op.exports {
+			operation.Responses["404"] = &openapi.Response{Description: "an export format is asked while exports are disabled", Content: jsonContent(errorSchema)}
+		}
+		operation.Responses["500"] = &openapi.Response{Description: "internal server error"}
+		if op.tag != "misc" && op.tag != "health" {
+			operation.Responses["429"] = &openapi.Response{Description: "rate limit exceeded, retry after the Retry-After header", Content: jsonContent(errorSchema)}
+			operation.Responses["504"] = &openapi.Response{Description: "the operation timed out", Content: jsonContent(errorSchema)}
+		}
+		if op.retry {
+			operation.Responses["409"] = &openapi.Response{Description: "a request with the same Idempotency-Key is still running", Content: jsonContent(errorSchema)}
+			operation.Responses["422"] = &openapi.Response{Description: "the Idempotency-Key was used with a different request", Content: jsonContent(errorSchema)}
+		}
+		for _, other := range op.others {
+			response := &openapi.Response{Description: other.description}
+			if other.body != nil {
+				response.Content = jsonContent(doc.SchemaOf(other.body))
+			}
+			operation.Responses[strconv.Itoa(other.status)] = response
+		}
+
+		doc.Add(op.method, path, operation)
+	}
+
+	return doc
+}
+
+// undocumentedRoutes returns the routes registered on app that are missing from the OpenAPI document
+func undocumentedRoutes(app *fiber.App) []string {
+	doc := Spec()
+
+	var missing []string
+	for _, route := range app.GetRoutes(true) {
+		if route.Method == fiber.MethodHead {
+			continue // Fiber adds a HEAD route for every GET route
+		}
+		if !doc.Has(route.Method, openapi.PathFromRoute(route.Path)) {
+			missing = append(missing, route.Method+" "+route.Path)
+		}
+	}
+	return missing
+}
+
+/*** DOCS HANDLERS ***/
+
+func getOpenAPISpec(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/openapi.json
+
+	return c.Status(fiber.StatusOK).JSON(Spec())
+}
+
+func getDocs(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// open http://localhost:4000/docs in a browser
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextHTMLCharsetUTF8)
+	c.Set(fiber.HeaderContentSecurityPolicy, docsPolicy)
+	return c.Status(fiber.StatusOK).Send(swaggerHTML)
+}
+
+// inlineScriptHash returns the CSP source allowing the first inline <script> of page
+func inlineScriptHash(page []byte) string {
+	_, script, _ := bytes.Cut(page, []byte("<script>"))
+	script, _, _ = bytes.Cut(script, []byte("</script>"))
+	sum := sha256.Sum256(script)
+	return "sha256-" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// operationID returns a unique, readable operation id such as "get_users_id"
+func operationID(method, path string) string {
+	if path == "/" {
+		return strings.ToLower(method) + "_root"
+	}
+	id := strings.ToLower(method) + strings.NewReplacer("/", "_", "{", "", "}", "", ":", "_").Replace(path)
+	return strings.TrimSuffix(id, "_")
+}
+
+// jsonContent wraps schema in an application/json media type
+func jsonContent(schema *openapi.Schema) map[string]*openapi.MediaType {
+	return map[string]*openapi.MediaType{fiber.MIMEApplicationJSON: {Schema: schema}}
+}
@@ -0,0 +1,18 @@
+package http
+
+import (
+	"portier/internal/config"
+	"portier/pkg/metrics"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestEveryRouteIsDocumented(t *testing.T) {
+	app := fiber.New()
+	RegisterRoutes(app, config.Features{Batch: true, Imports: true, Exports: true, Docs: true, SCIM: true}, metrics.FiberHandler("metrics-secret"))
+
+	if missing := undocumentedRoutes(app); len(missing) > 0 {
+		t.Errorf("routes missing from apiOperations: %v", missing)
+	}
+}
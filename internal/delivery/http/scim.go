@@ -0,0 +1,367 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"portier/internal/service"
+	"portier/pkg/scim"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+/*** SCIM HANDLERS ***/
+
+// Every SCIM route needs a token with the scim scope, the users and groups are
+// the ones of the tenant of the token. Bodies are SCIM JSON, errors SCIM errors.
+
+func getSCIMServiceProviderConfig(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/scim/v2/ServiceProviderConfig -H "Authorization: Bearer ptk_..."
+
+	if _, ok, err := scimTenant(c); !ok {
+		return err
+	}
+	return c.JSON(scim.ServiceProviderConfig{
+		Schemas:        []string{scim.SchemaServiceProviderConfig},
+		Patch:          scim.Supported{Supported: true},
+		Bulk:           scim.BulkSupport{},
+		Filter:         scim.FilterSupport{Supported: true, MaxResults: service.SCIMMaxResults},
+		ChangePassword: scim.Supported{},
+		Sort:           scim.Supported{},
+		ETag:           scim.Supported{Supported: true},
+		AuthenticationSchemes: []scim.AuthenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "API token",
+			Description: "An API token with the scim scope, created by an admin of the tenant",
+			Primary:     true,
+		}},
+	}, scim.MediaType)
+}
+
+func getSCIMResourceTypes(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/scim/v2/ResourceTypes -H "Authorization: Bearer ptk_..."
+
+	if _, ok, err := scimTenant(c); !ok {
+		return err
+	}
+	types := []scim.ResourceType{
+		{Schemas: []string{scim.SchemaResourceType}, ID: "User", Name: "User", Endpoint: "/Users", Schema: scim.SchemaUser,
+			Meta: scim.Meta{ResourceType: "ResourceType", Location: c.BaseURL() + "/scim/v2/ResourceTypes/User"}},
+		{Schemas: []string{scim.SchemaResourceType}, ID: "Group", Name: "Group", Endpoint: "/Groups", Schema: scim.SchemaGroup,
+			Meta: scim.Meta{ResourceType: "ResourceType", Location: c.BaseURL() + "/scim/v2/ResourceTypes/Group"}},
+	}
+	return c.JSON(scim.NewListResponse(types, 1, len(types)), scim.MediaType)
+}
+
+func getSCIMUsers(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -G http://localhost:4000/scim/v2/Users -H "Authorization: Bearer ptk_..." \
+	// --data-urlencode 'filter=userName eq "ahmad"' -d startIndex=1 -d count=100
+
+	tenantID, ok, err := scimTenant(c)
+	if !ok {
+		return err
+	}
+
+	list, err := service.ListSCIMUsers(c.UserContext(), tenantID, c.Query("filter"), c.QueryInt("startIndex", 1), c.QueryInt("count", service.SCIMMaxResults))
+	if err != nil {
+		return scimError(c, err, "Error listing SCIM users")
+	}
+	for i := range list.Resources {
+		scimUserLinks(c, &list.Resources[i])
+	}
+	return c.JSON(list, scim.MediaType)
+}
+
+func getSCIMUser(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/scim/v2/Users/1 -H "Authorization: Bearer ptk_..."
+
+	tenantID, ok, err := scimTenant(c)
+	if !ok {
+		return err
+	}
+
+	user, err := service.GetSCIMUser(c.UserContext(), tenantID, c.Params("id"))
+	if err != nil {
+		return scimError(c, err, "Error fetching SCIM user")
+	}
+	return sendSCIMUser(c, fiber.StatusOK, user)
+}
+
+func createSCIMUser(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X POST http://localhost:4000/scim/v2/Users -H "Authorization: Bearer ptk_..." \
+	// -H "Content-Type: application/scim+json" \
+	// -d '{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "ahmad", "externalId": "E1024",
+	//      "name": {"givenName": "Ahmad", "familyName": "Amri"}, "emails": [{"value": "ahmadamri.id@gmail.com", "primary": true}], "active": true}'
+
+	tenantID, ok, err := scimTenant(c)
+	if !ok {
+		return err
+	}
+	var user service.SCIMUser
+	if err := parseSCIM(c, &user); err != nil {
+		return scimError(c, err, "Error parsing SCIM user")
+	}
+
+	user, err = service.CreateSCIMUser(c.UserContext(), tenantID, user)
+	if err != nil {
+		return scimError(c, err, "Error creating SCIM user")
+	}
+	slog.InfoContext(c.UserContext(), "User provisioned by SCIM", "user_id", user.ID, "tenant_id", tenantID)
+	return sendSCIMUser(c, fiber.StatusCreated, user)
+}
+
+func replaceSCIMUser(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (the full user, the attributes left out are cleared)
+	// curl -X PUT http://localhost:4000/scim/v2/Users/1 -H "Authorization: Bearer ptk_..." \
+	// -H "Content-Type: application/scim+json" \
+	// -d '{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"], "userName": "ahmad", "name": {"formatted": "Ahmad Amri"}, "active": true}'
+
+	tenantID, ok, err := scimTenant(c)
+	if !ok {
+		return err
+	}
+	version, err := scimVersion(c)
+	if err != nil {
+		return scimError(c, err, "Error parsing If-Match")
+	}
+	var user service.SCIMUser
+	if err := parseSCIM(c, &user); err != nil {
+		return scimError(c, err, "Error parsing SCIM user")
+	}
+
+	user, err = service.ReplaceSCIMUser(c.UserContext(), tenantID, c.Params("id"), version, user)
+	if err != nil {
+		return scimError(c, err, "Error replacing SCIM user")
+	}
+	return sendSCIMUser(c, fiber.StatusOK, user)
+}
+
+func patchSCIMUser(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (deactivate a user)
+	// curl -X PATCH http://localhost:4000/scim/v2/Users/1 -H "Authorization: Bearer ptk_..." \
+	// -H "Content-Type: application/scim+json" \
+	// -d '{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "active", "value": false}]}'
+
+	tenantID, ok, err := scimTenant(c)
+	if !ok {
+		return err
+	}
+	version, err := scimVersion(c)
+	if err != nil {
+		return scimError(c, err, "Error parsing If-Match")
+	}
+	var req scim.PatchRequest
+	if err := parseSCIM(c, &req); err != nil {
+		return scimError(c, err, "Error parsing SCIM patch")
+	}
+
+	user, err := service.PatchSCIMUser(c.UserContext(), tenantID, c.Params("id"), version, req.Operations)
+	if err != nil {
+		return scimError(c, err, "Error patching SCIM user")
+	}
+	return sendSCIMUser(c, fiber.StatusOK, user)
+}
+
+func deleteSCIMUser(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (the user is deactivated, not deleted)
+	// curl -X DELETE http://localhost:4000/scim/v2/Users/1 -H "Authorization: Bearer ptk_..."
+
+	tenantID, ok, err := scimTenant(c)
+	if !ok {
+		return err
+	}
+	version, err := scimVersion(c)
+	if err != nil {
+		return scimError(c, err, "Error parsing If-Match")
+	}
+
+	if err := service.DeactivateSCIMUser(c.UserContext(), tenantID, c.Params("id"), version); err != nil {
+		return scimError(c, err, "Error deactivating SCIM user")
+	}
+	slog.InfoContext(c.UserContext(), "User deactivated by SCIM", "user_id", c.Params("id"), "tenant_id", tenantID)
+	return c.Status(fiber.StatusNoContent).SendString("")
+}
+
+func getSCIMGroups(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -G http://localhost:4000/scim/v2/Groups -H "Authorization: Bearer ptk_..." \
+	// --data-urlencode 'filter=displayName eq "admin"' -d excludedAttributes=members
+
+	tenantID, ok, err := scimTenant(c)
+	if !ok {
+		return err
+	}
+
+	list, err := service.ListSCIMGroups(c.UserContext(), tenantID, c.Query("filter"), c.QueryInt("startIndex", 1), c.QueryInt("count", service.SCIMMaxResults), scimMembers(c))
+	if err != nil {
+		return scimError(c, err, "Error listing SCIM groups")
+	}
+	for i := range list.Resources {
+		scimGroupLinks(c, &list.Resources[i])
+	}
+	return c.JSON(list, scim.MediaType)
+}
+
+func getSCIMGroup(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/scim/v2/Groups/admin -H "Authorization: Bearer ptk_..."
+
+	tenantID, ok, err := scimTenant(c)
+	if !ok {
+		return err
+	}
+
+	group, err := service.GetSCIMGroup(c.UserContext(), tenantID, c.Params("id"), scimMembers(c))
+	if err != nil {
+		return scimError(c, err, "Error fetching SCIM group")
+	}
+	scimGroupLinks(c, &group)
+	return c.JSON(group, scim.MediaType)
+}
+
+func replaceSCIMGroup(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (the members get the role, the users left out get the role user)
+	// curl -X PUT http://localhost:4000/scim/v2/Groups/manager -H "Authorization: Bearer ptk_..." \
+	// -H "Content-Type: application/scim+json" \
+	// -d '{"schemas": ["urn:ietf:params:scim:schemas:core:2.0:Group"], "displayName": "manager", "members": [{"value": "1"}, {"value": "2"}]}'
+
+	tenantID, ok, err := scimTenant(c)
+	if !ok {
+		return err
+	}
+	var group service.SCIMGroup
+	if err := parseSCIM(c, &group); err != nil {
+		return scimError(c, err, "Error parsing SCIM group")
+	}
+
+	group, err = service.ReplaceSCIMGroup(c.UserContext(), tenantID, c.Params("id"), group)
+	if err != nil {
+		return scimError(c, err, "Error replacing SCIM group")
+	}
+	scimGroupLinks(c, &group)
+	return c.JSON(group, scim.MediaType)
+}
+
+func patchSCIMGroup(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (make user 2 an admin)
+	// curl -X PATCH http://localhost:4000/scim/v2/Groups/admin -H "Authorization: Bearer ptk_..." \
+	// -H "Content-Type: application/scim+json" \
+	// -d '{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "add", "path": "members", "value": [{"value": "2"}]}]}'
+
+	tenantID, ok, err := scimTenant(c)
+	if !ok {
+		return err
+	}
+	var req scim.PatchRequest
+	if err := parseSCIM(c, &req); err != nil {
+		return scimError(c, err, "Error parsing SCIM patch")
+	}
+
+	group, err := service.PatchSCIMGroup(c.UserContext(), tenantID, c.Params("id"), req.Operations)
+	if err != nil {
+		return scimError(c, err, "Error patching SCIM group")
+	}
+	scimGroupLinks(c, &group)
+	return c.JSON(group, scim.MediaType)
+}
+
+// scimTenant returns the tenant of the token of the request. When ok is false
+// the response is already written and err must be returned.
+func scimTenant(c *fiber.Ctx) (tenantID int, ok bool, err error) {
+	caller := callerFrom(c)
+	if caller == nil {
+		c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="portier"`)
+		return 0, false, sendSCIMError(c, scim.NewError(fiber.StatusUnauthorized, "", "An API token with the scim scope is required"))
+	}
+	return caller.TenantID, true, nil
+}
+
+// scimVersion returns the version of the If-Match header, W/"3", or 0 without one
+func scimVersion(c *fiber.Ctx) (int, error) {
+	ifMatch := strings.TrimSpace(c.Get(fiber.HeaderIfMatch))
+	if ifMatch == "" || ifMatch == "*" {
+		return 0, nil
+	}
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(ifMatch, "W/"), `"`))
+	if err != nil || version <= 0 {
+		return 0, scim.NewError(fiber.StatusPreconditionFailed, "", "If-Match must be the meta.version of the resource")
+	}
+	return version, nil
+}
+
+// parseSCIM decodes the body, SCIM clients send application/scim+json
+func parseSCIM(c *fiber.Ctx, v interface{}) error {
+	if err := json.Unmarshal(c.Body(), v); err != nil {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return scim.BadRequest(scim.TypeInvalidSyntax, "the body is not valid JSON")
+	}
+	return nil
+}
+
+// scimMembers is false when the client excludes the members, which large groups make expensive
+func scimMembers(c *fiber.Ctx) bool {
+	for _, attr := range strings.Split(c.Query("excludedAttributes"), ",") {
+		if strings.EqualFold(strings.TrimSpace(attr), "members") {
+			return false
+		}
+	}
+	return true
+}
+
+func sendSCIMUser(c *fiber.Ctx, status int, user service.SCIMUser) error {
+	scimUserLinks(c, &user)
+	if status == fiber.StatusCreated {
+		c.Location(user.Meta.Location)
+	}
+	c.Set(fiber.HeaderETag, user.Meta.Version)
+	return c.Status(status).JSON(user, scim.MediaType)
+}
+
+func scimUserLinks(c *fiber.Ctx, user *service.SCIMUser) {
+	user.Meta.Location = c.BaseURL() + "/scim/v2/Users/" + user.ID
+	for i := range user.Groups {
+		user.Groups[i].Ref = c.BaseURL() + "/scim/v2/Groups/" + user.Groups[i].Value
+	}
+}
+
+func scimGroupLinks(c *fiber.Ctx, group *service.SCIMGroup) {
+	group.Meta.Location = c.BaseURL() + "/scim/v2/Groups/" + group.ID
+	for i := range group.Members {
+		group.Members[i].Ref = c.BaseURL() + "/scim/v2/Users/" + group.Members[i].Value
+	}
+}
+
+// scimError answers the errors of the SCIM routes with a SCIM error body
+func scimError(c *fiber.Ctx, err error, msg string) error {
+	var scimErr *scim.Error
+	switch {
+	case errors.As(err, &scimErr):
+		return sendSCIMError(c, scimErr)
+	case errors.Is(err, pgx.ErrNoRows):
+		return sendSCIMError(c, scim.NewError(fiber.StatusNotFound, "", "Resource "+c.Params("id")+" not found"))
+	case service.IsValidationError(err):
+		return sendSCIMError(c, scim.BadRequest(scim.TypeInvalidValue, err.Error()))
+	}
+	if _, ok := service.AsConflict(err); ok {
+		return sendSCIMError(c, scim.NewError(fiber.StatusPreconditionFailed, "", "If-Match does not match the meta.version of the resource"))
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return timeoutError(c, err, msg)
+	}
+
+	slog.ErrorContext(c.UserContext(), msg, "error", err)
+	return sendSCIMError(c, scim.NewError(fiber.StatusInternalServerError, "", "Internal Server Error"))
+}
+
+func sendSCIMError(c *fiber.Ctx, err *scim.Error) error {
+	return c.Status(err.StatusCode()).JSON(err, scim.MediaType)
+}
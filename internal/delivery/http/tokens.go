@@ -0,0 +1,171 @@
+package http
+
+import (
+	"errors"
+	"log/slog"
+	"portier/internal/service"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// createTokenRequest is the body of POST /users/:id/tokens. Without an API token,
+// the current password of the user and its second factor authorize the create.
+type createTokenRequest struct {
+	Name            string     `json:"name"`
+	Scopes          []string   `json:"scopes" doc:"read, write (includes read), tokens and scim (admins only), at most the scopes of the calling token"`
+	ExpiresAt       *time.Time `json:"expires_at" doc:"Optional, defaults to auth.token_ttl from now"`
+	CurrentPassword string     `json:"current_password,omitempty" doc:"Required without an Authorization header"`
+	Code            string     `json:"code,omitempty" doc:"TOTP or recovery code, required without an Authorization header when the user has a second factor"`
+}
+
+/*** API TOKEN HANDLERS ***/
+
+func getTokens(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl http://localhost:4000/users/1/tokens -H "Authorization: Bearer ptk_..."
+
+	user, ok, err := tokenOwner(c)
+	if !ok {
+		return err
+	}
+	if callerFrom(c) == nil {
+		return unauthorized(c, "An API token is required")
+	}
+
+	tokens, err := service.GetAPITokens(c.UserContext(), user.ID)
+	if err != nil {
+		return serverError(c, err, "Error fetching API tokens")
+	}
+	return c.JSON(tokens)
+}
+
+func createToken(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (the first token of a user, with its password and, when it has one, its TOTP code)
+	// curl -X POST http://localhost:4000/users/1/tokens \
+	// -H "Content-Type: application/json" \
+	// -d '{"name": "nightly import", "scopes": ["read", "write"], "current_password": "securepassword", "code": "123456"}'
+
+	user, ok, err := tokenOwner(c)
+	if !ok {
+		return err
+	}
+	var req createTokenRequest
+	if err := c.BodyParser(&req); err != nil {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	// Service accounts have no password, an admin of their tenant creates their tokens
+	if callerFrom(c) == nil {
+		if user.ServiceAccount {
+			return unauthorized(c, "The tokens of a service account are created with the token of an admin of its tenant")
+		}
+		// The same checks as POST /auth/verify, a password alone does not pass a second factor
+		if err := service.CheckCredentials(c.UserContext(), user.ID, req.CurrentPassword, req.Code, loginClient(c)); err != nil {
+			if locked, ok := service.AsLocked(err); ok {
+				return sendLocked(c, locked)
+			}
+			if errors.Is(err, pgx.ErrNoRows) {
+				return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+					"error": "User not found",
+				})
+			}
+			if service.IsValidationError(err) || service.IsAuthError(err) {
+				return unauthorized(c, err.Error())
+			}
+			if errors.Is(err, service.ErrTOTPEnrollmentRequired) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+					"error": err.Error(),
+				})
+			}
+			return serverError(c, err, "Error checking credentials")
+		}
+	}
+
+	if err := checkTokenScopes(callerFrom(c), &user, req.Scopes); err != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	token, err := service.CreateAPIToken(c.UserContext(), user.ID, service.APIToken{
+		Name:      req.Name,
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+	})
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "User not found or inactive",
+			})
+		}
+		if service.IsValidationError(err) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		return serverError(c, err, "Error creating API token")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(token)
+}
+
+func revokeToken(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X DELETE http://localhost:4000/users/1/tokens/3 -H "Authorization: Bearer ptk_..."
+
+	user, ok, err := tokenOwner(c)
+	if !ok {
+		return err
+	}
+	if callerFrom(c) == nil {
+		return unauthorized(c, "An API token is required")
+	}
+	tokenID, err := strconv.Atoi(c.Params("tokenId"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	if err := service.RevokeAPIToken(c.UserContext(), user.ID, tokenID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Token not found or already revoked",
+			})
+		}
+		return serverError(c, err, "Error revoking API token")
+	}
+
+	return c.Status(fiber.StatusNoContent).SendString("")
+}
+
+// tokenOwner loads the user of the :id parameter and checks that the caller
+// may manage its tokens: the user itself, or an admin of its tenant. When ok
+// is false the response is already written and err must be returned.
+func tokenOwner(c *fiber.Ctx) (user service.User, ok bool, err error) {
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return user, false, c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	user, err = service.GetUserByIDUncached(c.UserContext(), id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return user, false, c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err != nil {
+		return user, false, serverError(c, err, "Error fetching user")
+	}
+
+	caller := callerFrom(c)
+	if caller != nil && caller.UserID != user.ID && (caller.Role != service.RoleAdmin || caller.TenantID != user.TenantID) {
+		return user, false, c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Only the user and the admins of its tenant manage its tokens",
+		})
+	}
+	return user, true, nil
+}
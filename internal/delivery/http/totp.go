@@ -0,0 +1,184 @@
+package http
+
+import (
+	"errors"
+	"log/slog"
+	"portier/internal/service"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jackc/pgx/v5"
+)
+
+// totpEnrollmentRequest is the body of POST /users/:id/totp
+type totpEnrollmentRequest struct {
+	CurrentPassword string `json:"current_password"`
+}
+
+// totpCheckRequest is the body of POST /users/:id/totp/confirm, DELETE /users/:id/totp
+// and POST /users/:id/recovery-codes, code is a TOTP code, or a recovery code but
+// for the confirm
+type totpCheckRequest struct {
+	CurrentPassword string `json:"current_password"`
+	Code            string `json:"code"`
+}
+
+// verifyCredentialsRequest is the body of POST /auth/verify, login is a username or an email
+type verifyCredentialsRequest struct {
+	Login    string `json:"login"`
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+/*** TOTP HANDLERS ***/
+
+func beginTOTPEnrollment(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (show the uri as a QR code, then confirm a code of the app)
+	// curl -X POST http://localhost:4000/users/1/totp \
+	// -H "Content-Type: application/json" \
+	// -d '{"current_password": "securepassword"}'
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	var req totpEnrollmentRequest
+	if err := c.BodyParser(&req); err != nil {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	enrollment, err := service.BeginTOTPEnrollment(c.UserContext(), id, req.CurrentPassword, loginClient(c))
+	if err != nil {
+		return totpError(c, err, "Error starting TOTP enrollment")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(enrollment)
+}
+
+func confirmTOTPEnrollment(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (the recovery codes are only shown in this answer)
+	// curl -X POST http://localhost:4000/users/1/totp/confirm \
+	// -H "Content-Type: application/json" \
+	// -d '{"current_password": "securepassword", "code": "123456"}'
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	var req totpCheckRequest
+	if err := c.BodyParser(&req); err != nil || req.Code == "" {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "code is required",
+		})
+	}
+
+	codes, err := service.ConfirmTOTPEnrollment(c.UserContext(), id, req.CurrentPassword, req.Code, loginClient(c))
+	if err != nil {
+		return totpError(c, err, "Error confirming TOTP enrollment")
+	}
+
+	return c.JSON(codes)
+}
+
+func disableTOTP(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE
+	// curl -X DELETE http://localhost:4000/users/1/totp \
+	// -H "Content-Type: application/json" \
+	// -d '{"current_password": "securepassword", "code": "123456"}'
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	var req totpCheckRequest
+	if err := c.BodyParser(&req); err != nil {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	if err := service.DisableTOTP(c.UserContext(), id, req.CurrentPassword, req.Code, loginClient(c)); err != nil {
+		return totpError(c, err, "Error disabling TOTP")
+	}
+
+	return c.Status(fiber.StatusNoContent).SendString("")
+}
+
+func regenerateRecoveryCodes(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (the previous codes stop working)
+	// curl -X POST http://localhost:4000/users/1/recovery-codes \
+	// -H "Content-Type: application/json" \
+	// -d '{"current_password": "securepassword", "code": "123456"}'
+
+	id, err := strconv.Atoi(c.Params("id"))
+	if err != nil {
+		slog.WarnContext(c.UserContext(), "Error converting ID to integer", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+	var req totpCheckRequest
+	if err := c.BodyParser(&req); err != nil {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).SendString("Bad Request")
+	}
+
+	codes, err := service.RegenerateRecoveryCodes(c.UserContext(), id, req.CurrentPassword, req.Code, loginClient(c))
+	if err != nil {
+		return totpError(c, err, "Error generating recovery codes")
+	}
+
+	return c.JSON(codes)
+}
+
+func verifyCredentials(c *fiber.Ctx) error {
+	// REQUEST EXAMPLE (code is required once the user enrolled, a recovery code is accepted too,
+	// too many failures lock the user and the address, see service.LockoutConfig)
+	// curl -X POST http://localhost:4000/auth/verify \
+	// -H "Content-Type: application/json" \
+	// -d '{"login": "ahmadamri", "password": "securepassword", "code": "123456"}'
+
+	var req verifyCredentialsRequest
+	if err := c.BodyParser(&req); err != nil || req.Login == "" || req.Password == "" {
+		slog.WarnContext(c.UserContext(), "Error parsing body", "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "login and password are required",
+		})
+	}
+
+	user, err := service.VerifyCredentials(c.UserContext(), req.Login, req.Password, req.Code, loginClient(c))
+	if err != nil {
+		return totpError(c, err, "Error verifying credentials")
+	}
+
+	return c.JSON(user)
+}
+
+// totpError answers the errors of the second factor routes
+func totpError(c *fiber.Ctx, err error, msg string) error {
+	if locked, ok := service.AsLocked(err); ok {
+		return sendLocked(c, locked)
+	}
+	status := 0
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	case service.IsValidationError(err):
+		status = fiber.StatusBadRequest
+	case service.IsAuthError(err):
+		status = fiber.StatusUnauthorized
+	case errors.Is(err, service.ErrTOTPEnrollmentRequired), errors.Is(err, service.ErrTOTPRequiredByPolicy):
+		status = fiber.StatusForbidden
+	case errors.Is(err, service.ErrTOTPAlreadyEnabled):
+		status = fiber.StatusConflict
+	default:
+		return serverError(c, err, msg)
+	}
+	return c.Status(status).JSON(fiber.Map{
+		"error": err.Error(),
+	})
+}
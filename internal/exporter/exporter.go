@@ -0,0 +1,197 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"portier/internal/jobs"
+	"portier/internal/service"
+	"strconv"
+	"time"
+)
+
+// Format is the file format of an export
+type Format string
+
+const (
+	FormatCSV       Format = "csv"
+	FormatJSONLines Format = "jsonl"
+	FormatXLSX      Format = "xlsx"
+)
+
+// ContentTypes maps every format to the media type used in Accept and Content-Type headers
+var ContentTypes = map[Format]string{
+	FormatCSV:       "text/csv",
+	FormatJSONLines: "application/x-ndjson",
+	FormatXLSX:      "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+// flushEvery is the number of rows written between two flushes of the output
+const flushEvery = 500
+
+// Filter holds the filters of the list endpoints.
+// Only users can be filtered, by name and id number like GET /users.
+// TenantID is set by the server from the API token, 0 exports every tenant.
+type Filter struct {
+	Name     string `json:"name"`
+	IDNumber string `json:"idnumber"`
+	TenantID int    `json:"-"`
+}
+
+// entity describes the columns of an exported entity and how its rows are read
+type entity struct {
+	header []string
+	stream func(ctx context.Context, filter Filter, fn func(record interface{}, values []string) error) error
+}
+
+var entities = map[string]entity{
+	"users": {
+		header: []string{"id", "username", "email", "name", "gender", "id_number", "user_image", "tenant_id", "created_at", "is_active"},
+		stream: func(ctx context.Context, filter Filter, fn func(interface{}, []string) error) error {
+			return service.StreamUsers(ctx, filter.Name, filter.IDNumber, filter.TenantID, func(u service.User) error {
+				u.Password = "" // never selected, cleared to be safe
+				return fn(u, []string{
+					strconv.Itoa(u.ID), u.Username, u.Email, u.Name, u.GenderStr, u.IDNumber, u.UserImage,
+					strconv.Itoa(u.TenantID), u.CreatedAt.Format(time.RFC3339), strconv.FormatBool(u.IsActive),
+				})
+			})
+		},
+	},
+	"keys": {
+		header: []string{"id", "name", "created_at", "created_by", "is_active"},
+		stream: func(ctx context.Context, filter Filter, fn func(interface{}, []string) error) error {
+			return service.StreamKeys(ctx, filter.TenantID, func(k service.Key) error {
+				return fn(k, []string{
+					strconv.Itoa(k.ID), k.Name, k.CreatedAt.Format(time.RFC3339), strconv.Itoa(k.CreatedBy), strconv.FormatBool(k.IsActive),
+				})
+			})
+		},
+	},
+	"copies": {
+		header: []string{"id", "name", "key_id", "created_at", "created_by", "is_active"},
+		stream: func(ctx context.Context, filter Filter, fn func(interface{}, []string) error) error {
+			return service.StreamCopies(ctx, filter.TenantID, func(c service.Copy) error {
+				return fn(c, []string{
+					strconv.Itoa(c.ID), c.Name, strconv.Itoa(c.KeyID), c.CreatedAt.Format(time.RFC3339), strconv.Itoa(c.CreatedBy), strconv.FormatBool(c.IsActive),
+				})
+			})
+		},
+	},
+}
+
+// IsEntity reports whether name can be exported
+func IsEntity(name string) bool {
+	_, ok := entities[name]
+	return ok
+}
+
+// ParseFormat validates a format name
+func ParseFormat(name string) (Format, bool) {
+	format := Format(name)
+	_, ok := ContentTypes[format]
+	return format, ok
+}
+
+// FileName returns the download name of an export
+func FileName(entityName string, format Format) string {
+	return fmt.Sprintf("%s-%s.%s", entityName, time.Now().Format("20060102-150405"), format)
+}
+
+// Write streams every row of entityName matching filter to w and returns the number of rows.
+// progress, when not nil, is called every flushEvery rows with the number of rows written so far.
+func Write(ctx context.Context, w io.Writer, entityName string, format Format, filter Filter, progress func(rows int)) (int, error) {
+	ent, ok := entities[entityName]
+	if !ok {
+		return 0, fmt.Errorf("unknown entity %q", entityName)
+	}
+
+	rw, err := newRowWriter(w, format, ent.header)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = ent.stream(ctx, filter, func(record interface{}, values []string) error {
+		if err := rw.WriteRow(record, values); err != nil {
+			return err
+		}
+		count++
+
+		if count%flushEvery == 0 {
+			if err := rw.Flush(); err != nil {
+				return err
+			}
+			// Push the rows to the client when writing a response
+			if flusher, ok := w.(interface{ Flush() error }); ok {
+				if err := flusher.Flush(); err != nil {
+					return err
+				}
+			}
+			if progress != nil {
+				progress(count)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	return count, rw.Close()
+}
+
+// Start registers an export job of caller and writes the file in the background.
+// The file can be downloaded once the job completed.
+func Start(ctx context.Context, entityName string, format Format, filter Filter, caller *service.Caller) (service.Job, error) {
+	if !IsEntity(entityName) {
+		return service.Job{}, fmt.Errorf("unknown entity %q", entityName)
+	}
+
+	fileName := FileName(entityName, format)
+	job, err := service.CreateJob(ctx, service.JobExport, entityName, fileName, 0, caller)
+	if err != nil {
+		return service.Job{}, err
+	}
+
+	jobs.Go(ctx, func(ctx context.Context) {
+		resultPath := jobs.Path(fmt.Sprintf("export-%d.%s", job.ID, format))
+		err := writeFile(ctx, resultPath, job.ID, entityName, format, filter)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error running export job", "job_id", job.ID, "error", err)
+			os.Remove(resultPath)
+			resultPath = ""
+		}
+		// The outcome is stored even when a shutdown cancelled the job
+		if err := service.FinishJob(context.WithoutCancel(ctx), job.ID, resultPath, err); err != nil {
+			slog.ErrorContext(ctx, "Error finishing export job", "job_id", job.ID, "error", err)
+		}
+	})
+
+	return job, nil
+}
+
+// writeFile writes an export job to path and keeps the job progress up to date
+func writeFile(ctx context.Context, path string, jobID int, entityName string, format Format, filter Filter) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create export file: %v", err)
+	}
+	defer file.Close()
+
+	count, err := Write(ctx, file, entityName, format, filter, func(rows int) {
+		if err := service.UpdateJobProgress(ctx, jobID, rows, rows, 0); err != nil {
+			slog.ErrorContext(ctx, "Error updating export job", "job_id", jobID, "error", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := service.UpdateJobProgress(ctx, jobID, count, count, 0); err != nil {
+		slog.ErrorContext(ctx, "Error updating export job", "job_id", jobID, "error", err)
+	}
+
+	return file.Close()
+}
@@ -0,0 +1,127 @@
+package exporter
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// rowWriter writes the header and the rows of an export in one format
+type rowWriter interface {
+	// WriteRow writes one entity, values are in the same order as the header
+	WriteRow(record interface{}, values []string) error
+	// Flush pushes the buffered rows to the underlying writer
+	Flush() error
+	// Close completes the file, no row can be written afterwards
+	Close() error
+}
+
+func newRowWriter(w io.Writer, format Format, header []string) (rowWriter, error) {
+	switch format {
+	case FormatCSV:
+		return newCSVWriter(w, header)
+	case FormatJSONLines:
+		return &jsonLinesWriter{encoder: json.NewEncoder(w)}, nil
+	case FormatXLSX:
+		return newXLSXWriter(w, header)
+	}
+	return nil, fmt.Errorf("unsupported export format %q", format)
+}
+
+// csvWriter writes comma separated values
+type csvWriter struct {
+	writer *csv.Writer
+}
+
+func newCSVWriter(w io.Writer, header []string) (*csvWriter, error) {
+	cw := &csvWriter{writer: csv.NewWriter(w)}
+	if err := cw.writer.Write(header); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *csvWriter) WriteRow(_ interface{}, values []string) error {
+	return cw.writer.Write(values)
+}
+
+func (cw *csvWriter) Flush() error {
+	cw.writer.Flush()
+	return cw.writer.Error()
+}
+
+func (cw *csvWriter) Close() error {
+	return cw.Flush()
+}
+
+// jsonLinesWriter writes one JSON document per line, using the json tags of the entity
+type jsonLinesWriter struct {
+	encoder *json.Encoder
+}
+
+func (jw *jsonLinesWriter) WriteRow(record interface{}, _ []string) error {
+	return jw.encoder.Encode(record)
+}
+
+func (jw *jsonLinesWriter) Flush() error {
+	return nil // the encoder writes every line directly
+}
+
+func (jw *jsonLinesWriter) Close() error {
+	return nil
+}
+
+// xlsxWriter writes an Excel workbook. The rows are spooled by the excelize
+// stream writer, which moves them to a temporary file once they grow large,
+// the workbook itself can only be written once complete.
+type xlsxWriter struct {
+	out    io.Writer
+	file   *excelize.File
+	stream *excelize.StreamWriter
+	row    int
+}
+
+func newXLSXWriter(w io.Writer, header []string) (*xlsxWriter, error) {
+	file := excelize.NewFile()
+	stream, err := file.NewStreamWriter("Sheet1")
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	xw := &xlsxWriter{out: w, file: file, stream: stream, row: 1}
+	if err := xw.WriteRow(nil, header); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return xw, nil
+}
+
+func (xw *xlsxWriter) WriteRow(_ interface{}, values []string) error {
+	cells := make([]interface{}, len(values))
+	for i, value := range values {
+		cells[i] = value
+	}
+
+	cell, err := excelize.CoordinatesToCellName(1, xw.row)
+	if err != nil {
+		return err
+	}
+	xw.row++
+	return xw.stream.SetRow(cell, cells)
+}
+
+func (xw *xlsxWriter) Flush() error {
+	return nil // the workbook is written on Close
+}
+
+func (xw *xlsxWriter) Close() error {
+	defer xw.file.Close()
+	if err := xw.stream.Flush(); err != nil {
+		return err
+	}
+	return xw.file.Write(xw.out)
+}
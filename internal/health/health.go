@@ -0,0 +1,101 @@
+package health
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// checkTimeout limits every readiness check, probes must answer quickly
+const checkTimeout = 2 * time.Second
+
+// Statuses of a report and of its checks
+const (
+	StatusOK       = "ok"
+	StatusFailed   = "failed"
+	StatusDraining = "draining"
+)
+
+// Check is a dependency the application needs to serve requests
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+}
+
+// CheckResult is the outcome of one check
+type CheckResult struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// Report is the JSON body of the health endpoints
+type Report struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+var (
+	checks   []Check
+	draining atomic.Bool
+)
+
+// Register adds a readiness check, it must be called before the server starts
+func Register(name string, run func(ctx context.Context) error) {
+	checks = append(checks, Check{Name: name, Run: run})
+}
+
+// SetDraining marks the process as shutting down, readiness fails from now on
+// so load balancers stop sending new requests
+func SetDraining() {
+	draining.Store(true)
+}
+
+// Live reports whether the process is running, it does not check dependencies
+func Live() Report {
+	return Report{Status: StatusOK}
+}
+
+// Ready runs every check concurrently. ok is false when a check failed or the
+// process is draining.
+func Ready(ctx context.Context) (report Report, ok bool) {
+	if draining.Load() {
+		return Report{Status: StatusDraining}, false
+	}
+
+	report = Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		wg.Add(1)
+		go func(check Check) {
+			defer wg.Done()
+			result := run(ctx, check)
+
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[check.Name] = result
+			if result.Status != StatusOK {
+				report.Status = StatusFailed
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	return report, report.Status == StatusOK
+}
+
+func run(ctx context.Context, check Check) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Run(ctx)
+	result := CheckResult{Status: StatusOK, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		result.Status = StatusFailed
+		result.Error = err.Error()
+	}
+	return result
+}
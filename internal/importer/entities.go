@@ -0,0 +1,168 @@
+package importer
+
+import (
+	"context"
+	"fmt"
+	"portier/internal/service"
+	"strconv"
+	"strings"
+)
+
+// record holds the mapped values of one data row, keyed by field name
+type record map[string]string
+
+// entity describes how the records of one entity are validated and stored
+type entity struct {
+	// fields that can be mapped, named after the json tags of the service struct
+	fields []string
+	// required fields must be mapped and must not be empty
+	required []string
+	// secret fields are blanked in the rejected rows file
+	secret []string
+	// process stores the records of imp with the given batch mode and returns one error per record
+	process func(ctx context.Context, mode service.BatchMode, records []record, imp *Import) ([]error, error)
+}
+
+var entities = map[string]entity{
+	"users": {
+		fields:   []string{"username", "email", "password", "name", "gender", "id_number", "user_image", "tenant_id"},
+		required: []string{"username", "email", "password", "name", "gender"},
+		secret:   []string{"password"},
+		process: func(ctx context.Context, mode service.BatchMode, records []record, imp *Import) ([]error, error) {
+			// Imports only create users, no current password is checked
+			return processRecords(ctx, mode, records, func(rec record) (service.User, error) {
+				return buildTenantUser(rec, imp.Caller)
+			}, func(ctx context.Context, mode service.BatchMode, items []service.BatchItem[service.User]) ([]service.BatchResult, error) {
+				return service.BatchUsers(ctx, mode, items, nil, service.LoginClient{})
+			})
+		},
+	},
+	"keys": {
+		fields:   []string{"name"},
+		required: []string{"name"},
+		process: func(ctx context.Context, mode service.BatchMode, records []record, imp *Import) ([]error, error) {
+			return processRecords(ctx, mode, records, buildKey, func(ctx context.Context, mode service.BatchMode, items []service.BatchItem[service.Key]) ([]service.BatchResult, error) {
+				return service.BatchKeys(ctx, mode, items, imp.CreatedBy)
+			})
+		},
+	},
+	"copies": {
+		fields:   []string{"name", "key_id"},
+		required: []string{"name"},
+		process: func(ctx context.Context, mode service.BatchMode, records []record, imp *Import) ([]error, error) {
+			return processRecords(ctx, mode, records, buildCopy, func(ctx context.Context, mode service.BatchMode, items []service.BatchItem[service.Copy]) ([]service.BatchResult, error) {
+				return service.BatchCopies(ctx, mode, items, imp.CreatedBy)
+			})
+		},
+	},
+}
+
+// processRecords builds a create operation per record and runs the valid ones as a batch.
+// Records that can not be built never reach the database.
+func processRecords[T any](
+	ctx context.Context,
+	mode service.BatchMode,
+	records []record,
+	build func(record) (T, error),
+	batch func(context.Context, service.BatchMode, []service.BatchItem[T]) ([]service.BatchResult, error),
+) ([]error, error) {
+	errs := make([]error, len(records))
+
+	var items []service.BatchItem[T]
+	var indexes []int
+	for i, rec := range records {
+		data, err := build(rec)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		items = append(items, service.BatchItem[T]{Op: service.BatchCreate, Data: data})
+		indexes = append(indexes, i)
+	}
+
+	if len(items) == 0 {
+		return errs, nil
+	}
+
+	results, err := batch(ctx, mode, items)
+	if err != nil {
+		return nil, err
+	}
+	for i, result := range results {
+		if !result.Success {
+			errs[indexes[i]] = fmt.Errorf("%s", result.Error)
+		}
+	}
+
+	return errs, nil
+}
+
+// buildUser converts a record with the same validation as the createUser handler
+func buildUser(rec record) (service.User, error) {
+	tenantID, err := optionalInt(rec, "tenant_id")
+	if err != nil {
+		return service.User{}, err
+	}
+
+	user := service.User{
+		Username:  rec["username"],
+		Email:     rec["email"],
+		Password:  rec["password"],
+		Name:      rec["name"],
+		GenderStr: rec["gender"],
+		IDNumber:  rec["id_number"],
+		UserImage: rec["user_image"],
+		TenantID:  tenantID,
+	}
+	if err := user.ConvertGender(); err != nil {
+		return service.User{}, fmt.Errorf("gender: expected 1 (male) or 0 (female)")
+	}
+
+	return user, nil
+}
+
+// buildTenantUser converts a record into a user of the tenant of caller, like
+// POST /users a row without tenant_id gets that tenant and another one is refused
+func buildTenantUser(rec record, caller *service.Caller) (service.User, error) {
+	user, err := buildUser(rec)
+	if err != nil || caller == nil {
+		return user, err
+	}
+	if user.TenantID == 0 {
+		user.TenantID = caller.TenantID
+	}
+	if user.TenantID != caller.TenantID {
+		return service.User{}, fmt.Errorf("tenant_id: expected %d, the tenant of the token", caller.TenantID)
+	}
+	return user, nil
+}
+
+// buildKey converts a record into a key
+func buildKey(rec record) (service.Key, error) {
+	return service.Key{Name: rec["name"]}, nil
+}
+
+// buildCopy converts a record into a copy
+func buildCopy(rec record) (service.Copy, error) {
+	keyID, err := optionalInt(rec, "key_id")
+	if err != nil {
+		return service.Copy{}, err
+	}
+
+	return service.Copy{Name: rec["name"], KeyID: keyID}, nil
+}
+
+// optionalInt parses an integer field, an empty value is returned as 0
+func optionalInt(rec record, field string) (int, error) {
+	value := strings.TrimSpace(rec[field])
+	if value == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s: %q is not a valid id", field, value)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,316 @@
+package importer
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"os"
+	"portier/internal/jobs"
+	"portier/internal/service"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// MaxRows is the maximum number of data rows accepted in one file
+const MaxRows = 50000
+
+// commitChunkSize is the number of rows stored between two progress updates
+const commitChunkSize = 100
+
+// Import is an uploaded file whose columns are mapped to the fields of an entity
+type Import struct {
+	Entity    string
+	FileName  string
+	Mapping   map[string]string // column header -> field
+	CreatedBy int               // creator of imported keys and copies, see service.ResolveCreatorID
+	Caller    *service.Caller   // token of the request, nil without one. It owns the job, users are imported into its tenant
+
+	header  []string
+	rows    [][]string
+	lines   []int          // spreadsheet row number of every entry in rows
+	columns map[string]int // field -> column index
+}
+
+// RowError describes why a row was rejected
+type RowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// Report is the result of a dry run
+type Report struct {
+	Entity      string            `json:"entity"`
+	FileName    string            `json:"file_name"`
+	Mapping     map[string]string `json:"mapping"`
+	TotalRows   int               `json:"total_rows"`
+	ValidRows   int               `json:"valid_rows"`
+	InvalidRows int               `json:"invalid_rows"`
+	Errors      []RowError        `json:"errors"`
+}
+
+// Entities returns the names of the entities that can be imported
+func Entities() []string {
+	names := make([]string, 0, len(entities))
+	for name := range entities {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Parse reads a CSV or XLSX file and maps its columns to the fields of entityName.
+// mapping is keyed by column header, when it is empty the columns named after a
+// field are mapped automatically. All errors returned are caused by the input.
+func Parse(entityName, fileName string, data []byte, mapping map[string]string) (*Import, error) {
+	ent, ok := entities[entityName]
+	if !ok {
+		return nil, fmt.Errorf("unknown entity %q, expected one of %s", entityName, strings.Join(Entities(), ", "))
+	}
+
+	rows, err := readRows(fileName, data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("the file is empty")
+	}
+
+	imp := &Import{
+		Entity:   entityName,
+		FileName: fileName,
+		Mapping:  map[string]string{},
+		header:   rows[0],
+		columns:  map[string]int{},
+	}
+
+	// Without an explicit mapping, match the headers against the field names
+	if len(mapping) == 0 {
+		mapping = map[string]string{}
+		for _, column := range imp.header {
+			field := normalize(column)
+			if slices.Contains(ent.fields, field) {
+				mapping[column] = field
+			}
+		}
+	}
+
+	for column, field := range mapping {
+		if !slices.Contains(ent.fields, field) {
+			return nil, fmt.Errorf("column %q is mapped to unknown field %q, expected one of %s", column, field, strings.Join(ent.fields, ", "))
+		}
+		index := slices.IndexFunc(imp.header, func(h string) bool { return strings.TrimSpace(h) == strings.TrimSpace(column) })
+		if index < 0 {
+			return nil, fmt.Errorf("column %q does not exist in the file", column)
+		}
+		if _, duplicate := imp.columns[field]; duplicate {
+			return nil, fmt.Errorf("field %q is mapped more than once", field)
+		}
+		imp.columns[field] = index
+		imp.Mapping[column] = field
+	}
+
+	for _, field := range ent.required {
+		if _, ok := imp.columns[field]; !ok {
+			return nil, fmt.Errorf("required field %q is not mapped to a column", field)
+		}
+	}
+
+	// Keep the data rows that are not blank, with their spreadsheet row number
+	for i, row := range rows[1:] {
+		if strings.TrimSpace(strings.Join(row, "")) == "" {
+			continue
+		}
+		imp.rows = append(imp.rows, row)
+		imp.lines = append(imp.lines, i+2)
+	}
+
+	if len(imp.rows) == 0 {
+		return nil, fmt.Errorf("the file does not contain any data row")
+	}
+	if len(imp.rows) > MaxRows {
+		return nil, fmt.Errorf("the file contains more than %d rows", MaxRows)
+	}
+
+	return imp, nil
+}
+
+// TotalRows returns the number of data rows
+func (imp *Import) TotalRows() int {
+	return len(imp.rows)
+}
+
+// DryRun validates every row against the database without storing anything.
+// Rows are checked in chunks, duplicates spread over two chunks are only
+// detected when the import is committed.
+func (imp *Import) DryRun(ctx context.Context) (Report, error) {
+	report := Report{
+		Entity:    imp.Entity,
+		FileName:  imp.FileName,
+		Mapping:   imp.Mapping,
+		TotalRows: len(imp.rows),
+		Errors:    []RowError{},
+	}
+
+	for start := 0; start < len(imp.rows); start += service.MaxBatchSize {
+		end := min(start+service.MaxBatchSize, len(imp.rows))
+		errs, err := imp.process(ctx, service.BatchDryRun, start, end)
+		if err != nil {
+			return Report{}, err
+		}
+		for i, rowErr := range errs {
+			if rowErr != nil {
+				report.Errors = append(report.Errors, RowError{Row: imp.lines[start+i], Error: rowErr.Error()})
+			}
+		}
+	}
+
+	report.InvalidRows = len(report.Errors)
+	report.ValidRows = report.TotalRows - report.InvalidRows
+	return report, nil
+}
+
+// Start registers an import job and stores the rows in the background.
+// Every row is stored on its own, rejected rows are written to an error file
+// that can be downloaded once the job finished.
+func (imp *Import) Start(ctx context.Context) (service.Job, error) {
+	job, err := service.CreateJob(ctx, service.JobImport, imp.Entity, imp.FileName, len(imp.rows), imp.Caller)
+	if err != nil {
+		return service.Job{}, err
+	}
+
+	jobs.Go(ctx, func(ctx context.Context) {
+		resultPath, err := imp.commit(ctx, job.ID)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error running import job", "job_id", job.ID, "error", err)
+		}
+		// The outcome is stored even when a shutdown cancelled the job
+		if err := service.FinishJob(context.WithoutCancel(ctx), job.ID, resultPath, err); err != nil {
+			slog.ErrorContext(ctx, "Error finishing import job", "job_id", job.ID, "error", err)
+		}
+	})
+
+	return job, nil
+}
+
+// commit stores the rows chunk by chunk and returns the path of the error file, if any
+func (imp *Import) commit(ctx context.Context, jobID int) (string, error) {
+	var errorFile *os.File
+	var errorWriter *csv.Writer
+	resultPath := ""
+	failed := 0
+
+	defer func() {
+		if errorFile != nil {
+			errorWriter.Flush()
+			errorFile.Close()
+		}
+	}()
+
+	for start := 0; start < len(imp.rows); start += commitChunkSize {
+		if ctx.Err() != nil {
+			return resultPath, fmt.Errorf("import cancelled after %d rows: %v", start, ctx.Err())
+		}
+
+		end := min(start+commitChunkSize, len(imp.rows))
+		errs, err := imp.process(ctx, service.BatchBestEffort, start, end)
+		if err != nil {
+			return resultPath, err
+		}
+
+		for i, rowErr := range errs {
+			if rowErr == nil {
+				continue
+			}
+			failed++
+
+			// The error file is only created when the first row is rejected
+			if errorFile == nil {
+				resultPath = jobs.Path(fmt.Sprintf("import-%d-errors.csv", jobID))
+				if errorFile, err = os.Create(resultPath); err != nil {
+					return "", fmt.Errorf("failed to create error file: %v", err)
+				}
+				errorWriter = csv.NewWriter(errorFile)
+				errorWriter.Write(append([]string{"row", "error"}, imp.header...))
+			}
+
+			row := imp.rejectedRow(imp.rows[start+i])
+			errorWriter.Write(append([]string{strconv.Itoa(imp.lines[start+i]), rowErr.Error()}, row...))
+		}
+
+		if err := service.UpdateJobProgress(ctx, jobID, len(imp.rows), end, failed); err != nil {
+			slog.ErrorContext(ctx, "Error updating import job", "job_id", jobID, "error", err)
+		}
+	}
+
+	return resultPath, nil
+}
+
+// rejectedRow returns a copy of row for the error file, with the columns of
+// the secret fields blanked so no password is written to disk
+func (imp *Import) rejectedRow(row []string) []string {
+	row = slices.Clone(row)
+	for _, field := range entities[imp.Entity].secret {
+		if column, ok := imp.columns[field]; ok && column < len(row) {
+			row[column] = ""
+		}
+	}
+	return row
+}
+
+// process validates rows[start:end] and runs them with mode, returning one error per row
+func (imp *Import) process(ctx context.Context, mode service.BatchMode, start, end int) ([]error, error) {
+	ent := entities[imp.Entity]
+
+	errs := make([]error, end-start)
+	var records []record
+	var indexes []int
+	for i, row := range imp.rows[start:end] {
+		rec := record{}
+		for field, column := range imp.columns {
+			if column < len(row) {
+				rec[field] = strings.TrimSpace(row[column])
+			}
+		}
+
+		if missing := missingFields(ent, rec); len(missing) > 0 {
+			errs[i] = fmt.Errorf("missing value for %s", strings.Join(missing, ", "))
+			continue
+		}
+
+		records = append(records, rec)
+		indexes = append(indexes, i)
+	}
+
+	if len(records) == 0 {
+		return errs, nil
+	}
+
+	recordErrs, err := ent.process(ctx, mode, records, imp)
+	if err != nil {
+		return nil, err
+	}
+	for i, recordErr := range recordErrs {
+		errs[indexes[i]] = recordErr
+	}
+
+	return errs, nil
+}
+
+// missingFields returns the required fields that are empty in rec
+func missingFields(ent entity, rec record) []string {
+	var missing []string
+	for _, field := range ent.required {
+		if rec[field] == "" {
+			missing = append(missing, field)
+		}
+	}
+	return missing
+}
+
+// normalize turns a column header such as "ID Number" into a field name such as "id_number"
+func normalize(header string) string {
+	header = strings.ToLower(strings.TrimSpace(header))
+	return strings.NewReplacer(" ", "_", "-", "_").Replace(header)
+}
@@ -0,0 +1,22 @@
+package importer
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRejectedRowBlanksThePassword(t *testing.T) {
+	data := []byte("username,email,password,name,gender\nahmad,ahmad@example.com,secret123,ahmad,1\n")
+	imp, err := Parse("users", "users.csv", data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	row := imp.rejectedRow(imp.rows[0])
+	if want := []string{"ahmad", "ahmad@example.com", "", "ahmad", "1"}; !slices.Equal(row, want) {
+		t.Errorf("rejectedRow = %v, want %v", row, want)
+	}
+	if imp.rows[0][2] != "secret123" {
+		t.Errorf("rejectedRow changed the parsed row: %v", imp.rows[0])
+	}
+}
@@ -0,0 +1,77 @@
+package importer
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// readRows returns the raw rows of a CSV or XLSX file. Rows of empty cells are
+// kept so the row numbers match the ones shown by a spreadsheet application.
+// XLSX files are read from their first sheet.
+func readRows(fileName string, data []byte) ([][]string, error) {
+	var rows [][]string
+	var err error
+
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".csv":
+		rows, err = readCSV(data)
+	case ".xlsx":
+		rows, err = readXLSX(data)
+	default:
+		return nil, fmt.Errorf("unsupported file type, expected .csv or .xlsx")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return rows, nil
+}
+
+// readCSV parses a comma or semicolon separated file
+func readCSV(data []byte) ([][]string, error) {
+	// Excel adds a byte order mark when saving as "CSV UTF-8"
+	data = bytes.TrimPrefix(data, []byte("\xef\xbb\xbf"))
+
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	// Spreadsheets using a comma as decimal separator export with semicolons
+	firstLine, _, _ := strings.Cut(string(data), "\n")
+	if strings.Count(firstLine, ";") > strings.Count(firstLine, ",") {
+		reader.Comma = ';'
+	}
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV file: %v", err)
+	}
+
+	return rows, nil
+}
+
+// readXLSX reads the first sheet of an Excel workbook
+func readXLSX(data []byte) ([][]string, error) {
+	file, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read XLSX file: %v", err)
+	}
+	defer file.Close()
+
+	sheets := file.GetSheetList()
+	if len(sheets) == 0 {
+		return nil, fmt.Errorf("the XLSX file has no sheets")
+	}
+
+	rows, err := file.GetRows(sheets[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read XLSX sheet %q: %v", sheets[0], err)
+	}
+
+	return rows, nil
+}
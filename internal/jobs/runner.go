@@ -0,0 +1,136 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"portier/internal/service"
+	"portier/pkg/logging"
+	"portier/pkg/tracing"
+	"sync"
+	"time"
+)
+
+var (
+	wg     sync.WaitGroup
+	dir    = "data/jobs"
+	ctx    context.Context
+	cancel context.CancelFunc
+)
+
+func init() {
+	ctx, cancel = context.WithCancel(context.Background())
+}
+
+// sweepInterval is the time between two deletions of the expired jobs
+const sweepInterval = time.Hour
+
+// Config holds the settings of the jobs section of config.yaml
+type Config struct {
+	Dir       string        // Directory of the job files
+	Instance  string        // Name of this instance in the jobs table, the host name when empty
+	Retention time.Duration // Age of the oldest finished jobs kept with their files
+}
+
+// Setup prepares the directory holding job files, fails the jobs of this
+// instance that were interrupted by a previous shutdown, they can not be
+// resumed, and deletes the expired jobs now and every sweepInterval
+func Setup(cfg Config) error {
+	if cfg.Dir != "" {
+		dir = cfg.Dir
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return fmt.Errorf("failed to create jobs directory: %v", err)
+	}
+
+	instance := cfg.Instance
+	if instance == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("failed to name the jobs instance, set jobs.instance: %v", err)
+		}
+		instance = hostname
+	}
+	service.SetJobInstance(instance)
+
+	count, err := service.FailInterruptedJobs(context.Background())
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		slog.Info("Marked interrupted jobs as failed", "count", count, "instance", instance)
+	}
+
+	deleteExpired(ctx, cfg.Retention)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				deleteExpired(ctx, cfg.Retention)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// deleteExpired deletes the jobs that finished more than retention ago and their files
+func deleteExpired(ctx context.Context, retention time.Duration) {
+	paths, err := service.DeleteExpiredJobs(ctx, time.Now().Add(-retention))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting expired jobs", "error", err)
+		return
+	}
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.ErrorContext(ctx, "Error deleting job file", "path", path, "error", err)
+		}
+	}
+	if len(paths) > 0 {
+		slog.InfoContext(ctx, "Deleted expired job files", "count", len(paths))
+	}
+}
+
+// Go runs fn in the background. fn must return soon after ctx is cancelled.
+// The request info and span of requestCtx are kept, so the job logs carry the
+// request ID and its queries belong to the trace of the request.
+func Go(requestCtx context.Context, fn func(ctx context.Context)) {
+	jobCtx := tracing.CopySpan(logging.CopyRequest(ctx, requestCtx), requestCtx)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		fn(jobCtx)
+	}()
+}
+
+// Shutdown cancels the running jobs and waits until they returned or shutdownCtx expires
+func Shutdown(shutdownCtx context.Context) error {
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-shutdownCtx.Done():
+		return fmt.Errorf("background jobs did not stop in time: %v", shutdownCtx.Err())
+	}
+}
+
+// Path returns the location of a job file named name
+func Path(name string) string {
+	return filepath.Join(dir, name)
+}
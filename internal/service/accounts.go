@@ -0,0 +1,267 @@
+package service
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"portier/pkg/db"
+	"portier/pkg/mail"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AccountConfig sets the tokens of the password reset and email verification flows
+type AccountConfig struct {
+	Secret               string        // auth.secret, key of the token hashes
+	ResetTokenTTL        time.Duration // validity of a password reset link
+	VerificationTokenTTL time.Duration // validity of an email verification link
+	LinkURL              string        // frontend handling /reset-password?token= and /verify-email?token=
+}
+
+// Purposes of the user_tokens rows
+const (
+	tokenPasswordReset     = "password_reset"
+	tokenEmailVerification = "email_verification"
+)
+
+var (
+	mailer   mail.Sender
+	accounts AccountConfig
+)
+
+// SetAccounts sends the account emails with sender, nil disables them
+func SetAccounts(sender mail.Sender, cfg AccountConfig) {
+	mailer = sender
+	accounts = cfg
+}
+
+// RequestPasswordReset emails a single-use reset link to the active user owning
+// email, once the address is verified. An unknown address is not an error,
+// callers must not reveal which addresses exist, nor by the time they answer.
+func RequestPasswordReset(ctx context.Context, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	var userID int
+	var name string
+	query := `SELECT id, name FROM users WHERE email=$1 AND is_active AND NOT service_account AND email_verified_at IS NOT NULL`
+	err := db.GetConnection().QueryRow(ctx, query, email).Scan(&userID, &name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		slog.InfoContext(ctx, "Password reset requested for an unknown address")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := issueToken(ctx, db.GetConnection(), userID, tokenPasswordReset, email, accounts.ResetTokenTTL)
+	if err != nil {
+		return err
+	}
+	return send(ctx, mail.Message{
+		To:      email,
+		Subject: "Reset your Portier password",
+		Body: fmt.Sprintf("Hello %s,\n\nOpen this link to choose a new password:\n\n%s\n\nThe link can be used once and expires in %s. "+
+			"If you did not ask for it, ignore this email, your password is unchanged.\n",
+			name, link("/reset-password", token), accounts.ResetTokenTTL),
+	})
+}
+
+// ResetPassword sets the password of the user the reset token was issued to.
+// The token is rejected when the user changed the address since. The token and
+// every other pending reset token of the user are consumed, and its API tokens
+// are revoked: whoever knew the old password may have created some.
+func ResetPassword(ctx context.Context, token, password string) error {
+	if len(password) < 8 {
+		return ErrPasswordTooShort
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // no-op once committed
+
+	userID, email, err := consumeToken(ctx, tx, token, tokenPasswordReset)
+	if err != nil {
+		return err
+	}
+	tag, err := tx.Exec(ctx, `UPDATE users SET password=$1, version=version+1 WHERE id=$2 AND email=$3`, string(hashedPassword), userID, email)
+	if err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidToken
+	}
+	query := `UPDATE user_tokens SET used_at=now() WHERE user_id=$1 AND purpose=$2 AND used_at IS NULL`
+	if _, err := tx.Exec(ctx, query, userID, tokenPasswordReset); err != nil {
+		return err
+	}
+	tag, err = tx.Exec(ctx, `UPDATE api_tokens SET revoked_at=now() WHERE user_id=$1 AND revoked_at IS NULL`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke API tokens: %w", err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	invalidate(ctx, "users", userID)
+	slog.InfoContext(ctx, "Password reset", "user_id", userID, "revoked_tokens", tag.RowsAffected())
+	return nil
+}
+
+// SendEmailVerification emails a verification link to the current address of
+// the user. Unless force is set, nothing is sent when the address is already
+// verified or a link sent to it is still valid.
+func SendEmailVerification(ctx context.Context, userID int, force bool) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	var email, name string
+	var verifiedAt *time.Time
+	var pending bool
+	query := `SELECT u.email, u.name, u.email_verified_at,
+					EXISTS (SELECT 1 FROM user_tokens t WHERE t.user_id = u.id AND t.purpose = $2 AND t.email = u.email AND t.used_at IS NULL AND t.expires_at > now())
+				FROM users u WHERE u.id=$1`
+	err := db.GetConnection().QueryRow(ctx, query, userID, tokenEmailVerification).Scan(&email, &name, &verifiedAt, &pending)
+	if err != nil {
+		return err
+	}
+	if verifiedAt != nil || (pending && !force) {
+		return nil
+	}
+
+	token, err := issueToken(ctx, db.GetConnection(), userID, tokenEmailVerification, email, accounts.VerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+	return send(ctx, mail.Message{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hello %s,\n\nOpen this link to confirm that %s is your address:\n\n%s\n\nThe link expires in %s.\n",
+			name, email, link("/verify-email", token), accounts.VerificationTokenTTL),
+	})
+}
+
+// VerifyEmail marks the address the verification token was sent to as verified.
+// The token is rejected when the user changed the address since.
+func VerifyEmail(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // no-op once committed
+
+	userID, email, err := consumeToken(ctx, tx, token, tokenEmailVerification)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE users SET email_verified_at=now(), version=version+1 WHERE id=$1 AND email=$2`
+	tag, err := tx.Exec(ctx, query, userID, email)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrInvalidToken
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	invalidate(ctx, "users", userID)
+	return nil
+}
+
+// revokeResetTokens consumes the pending reset tokens of the user sent to
+// another address than email, after an email change
+func revokeResetTokens(ctx context.Context, q querier, userID int, email string) error {
+	query := `UPDATE user_tokens SET used_at=now() WHERE user_id=$1 AND purpose=$2 AND used_at IS NULL AND email<>$3`
+	if _, err := q.Exec(ctx, query, userID, tokenPasswordReset, email); err != nil {
+		return fmt.Errorf("failed to revoke reset tokens: %w", err)
+	}
+	return nil
+}
+
+// sendVerifications sends the pending verification emails of users after a
+// create or an email change. Failures are logged, the write already succeeded
+// and the user can ask for a new link.
+func sendVerifications(ctx context.Context, userIDs ...int) {
+	for _, id := range userIDs {
+		if err := SendEmailVerification(ctx, id, false); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			slog.WarnContext(ctx, "Verification email not sent", "user_id", id, "error", err)
+		}
+	}
+}
+
+// issueToken stores the hash of a new random token and returns the token
+func issueToken(ctx context.Context, q querier, userID int, purpose, email string, ttl time.Duration) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+
+	query := `INSERT INTO user_tokens (user_id, purpose, token_hash, email, expires_at) VALUES ($1, $2, $3, $4, $5)`
+	if _, err := q.Exec(ctx, query, userID, purpose, tokenHash(token), email, time.Now().Add(ttl)); err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return token, nil
+}
+
+// consumeToken marks a valid token as used and returns its user and address
+func consumeToken(ctx context.Context, q querier, token, purpose string) (int, string, error) {
+	var userID int
+	var email string
+	query := `UPDATE user_tokens SET used_at=now()
+				WHERE token_hash=$1 AND purpose=$2 AND used_at IS NULL AND expires_at > now()
+				RETURNING user_id, email`
+	err := q.QueryRow(ctx, query, tokenHash(token), purpose).Scan(&userID, &email)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, "", ErrInvalidToken
+	}
+	return userID, email, err
+}
+
+// tokenHash is the stored form of a token, keyed with auth.secret so the
+// database alone is not enough to forge one. Changing the secret invalidates
+// the pending tokens.
+func tokenHash(token string) string {
+	mac := hmac.New(sha256.New, []byte(accounts.Secret))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// link is the frontend URL opening path with token
+func link(path, token string) string {
+	return accounts.LinkURL + path + "?token=" + url.QueryEscape(token)
+}
+
+func send(ctx context.Context, msg mail.Message) error {
+	if mailer == nil {
+		slog.WarnContext(ctx, "Email not sent, mail.backend is none", "subject", msg.Subject)
+		return nil
+	}
+	if err := mailer.Send(ctx, msg); err != nil {
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	return nil
+}
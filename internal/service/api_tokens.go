@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"portier/pkg/db"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TokenConfig sets the lifetime of the API tokens
+type TokenConfig struct {
+	DefaultTTL time.Duration // expiry of a token created without expires_at
+	MaxTTL     time.Duration // latest expires_at accepted
+}
+
+// Scopes of the API tokens
+const (
+	ScopeRead   = "read"   // GET, HEAD and OPTIONS
+	ScopeWrite  = "write"  // every method, includes read
+	ScopeTokens = "tokens" // the /users/:id/tokens routes
+	ScopeSCIM   = "scim"   // the /scim/v2 routes, provisioning the users of the tenant of the token
+)
+
+// TokenScopes lists every valid scope
+var TokenScopes = []string{ScopeRead, ScopeWrite, ScopeTokens, ScopeSCIM}
+
+// tokenPrefix starts every API token, secret scanners and logs recognize it
+const tokenPrefix = "ptk_"
+
+// APIToken is a token authenticating the calls of a user or a service account
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"` // First characters of the token, to recognize it
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"` // Defaults to auth.token_ttl from now
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP *string    `json:"last_used_ip"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	Token      string     `json:"token,omitempty"` // Only returned by the create, it cannot be read again
+}
+
+// Caller is the user authenticated by an API token
+type Caller struct {
+	TokenID  int
+	UserID   int
+	TenantID int
+	Role     string
+	Scopes   []string
+}
+
+// Allows reports whether the token of the caller has scope, write includes read
+func (c Caller) Allows(scope string) bool {
+	return slices.Contains(c.Scopes, scope) || (scope == ScopeRead && slices.Contains(c.Scopes, ScopeWrite))
+}
+
+var tokenConfig TokenConfig
+
+// SetTokens sets the lifetime of the API tokens
+func SetTokens(cfg TokenConfig) {
+	tokenConfig = cfg
+}
+
+// GetAPITokens lists the tokens of a user, revoked and expired ones included
+func GetAPITokens(ctx context.Context, userID int) ([]APIToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	query := `SELECT id, user_id, name, prefix, scopes, expires_at, last_used_at, last_used_ip, revoked_at, created_at
+				FROM api_tokens WHERE user_id=$1 ORDER BY id`
+	rows, err := db.GetConnection().Query(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		var t APIToken
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Prefix, &t.Scopes, &t.ExpiresAt, &t.LastUsedAt, &t.LastUsedIP, &t.RevokedAt, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// CreateAPIToken creates a token for the active user userID and returns it with
+// its value, only its hash is stored
+func CreateAPIToken(ctx context.Context, userID int, token APIToken) (APIToken, error) {
+	if token.Name == "" {
+		return APIToken{}, ErrTokenNameRequired
+	}
+	if len(token.Scopes) == 0 {
+		return APIToken{}, ErrInvalidScope
+	}
+	for _, scope := range token.Scopes {
+		if !slices.Contains(TokenScopes, scope) {
+			return APIToken{}, ErrInvalidScope
+		}
+	}
+	now := time.Now()
+	if token.ExpiresAt == nil {
+		expiresAt := now.Add(tokenConfig.DefaultTTL)
+		token.ExpiresAt = &expiresAt
+	}
+	if !token.ExpiresAt.After(now) || token.ExpiresAt.After(now.Add(tokenConfig.MaxTTL)) {
+		return APIToken{}, ErrInvalidTokenExpiry
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return APIToken{}, err
+	}
+	token.Token = tokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	token.Prefix = token.Token[:12]
+	token.UserID = userID
+
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	// No row when the user does not exist or is inactive
+	query := `INSERT INTO api_tokens (user_id, name, prefix, token_hash, scopes, expires_at)
+				SELECT id, $2, $3, $4, $5, $6 FROM users WHERE id=$1 AND is_active
+				RETURNING id, created_at`
+	err := db.GetConnection().QueryRow(ctx, query, userID, token.Name, token.Prefix, tokenHash(token.Token), token.Scopes, *token.ExpiresAt).Scan(&token.ID, &token.CreatedAt)
+	if err != nil {
+		return APIToken{}, err
+	}
+
+	slog.InfoContext(ctx, "API token created", "user_id", userID, "token_id", token.ID, "prefix", token.Prefix)
+	return token, nil
+}
+
+// RevokeAPIToken revokes a token of a user, it stops working at once
+func RevokeAPIToken(ctx context.Context, userID, tokenID int) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	query := `UPDATE api_tokens SET revoked_at=now() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL`
+	tag, err := db.GetConnection().Exec(ctx, query, tokenID, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	slog.InfoContext(ctx, "API token revoked", "user_id", userID, "token_id", tokenID)
+	return nil
+}
+
+// AuthenticateToken returns the caller of a valid token of an active user and
+// records its use from ip. Tokens are not cached, a revocation applies to the next request.
+func AuthenticateToken(ctx context.Context, token, ip string) (Caller, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	var caller Caller
+	query := `SELECT t.id, t.user_id, u.tenant_id, u.role, t.scopes
+				FROM api_tokens t JOIN users u ON u.id = t.user_id
+				WHERE t.token_hash=$1 AND t.revoked_at IS NULL AND t.expires_at > now() AND u.is_active`
+	err := db.GetConnection().QueryRow(ctx, query, tokenHash(token)).Scan(&caller.TokenID, &caller.UserID, &caller.TenantID, &caller.Role, &caller.Scopes)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Caller{}, ErrInvalidAPIToken
+	}
+	if err != nil {
+		return Caller{}, fmt.Errorf("failed to check API token: %w", err)
+	}
+
+	// At most one write a minute per token, a failure does not fail the request
+	query = `UPDATE api_tokens SET last_used_at=now(), last_used_ip=$2
+				WHERE id=$1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute')`
+	if _, err := db.GetConnection().Exec(ctx, query, caller.TokenID, ip); err != nil {
+		slog.WarnContext(ctx, "API token use not recorded", "token_id", caller.TokenID, "error", err)
+	}
+	return caller, nil
+}
@@ -0,0 +1,285 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"portier/pkg/db"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// querier is implemented by the connection pool and by a transaction, so the
+// same query code is used by the single-item functions and by batches
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// checkVersion interprets the error of an UPDATE ... WHERE id AND version.
+// When no row was updated, the row either does not exist, ErrNotFound, or has
+// another version: a *ConflictError with the current row read by load.
+func checkVersion[T any](ctx context.Context, q querier, err error, id int, load func(context.Context, querier, int) (T, error)) error {
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	current, err := load(ctx, q, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return &ConflictError{Current: current}
+}
+
+// BatchMode controls how a batch reacts to a failing operation
+type BatchMode string
+
+const (
+	// BatchTransaction runs every operation in one transaction, any failure rolls back all of them
+	BatchTransaction BatchMode = "transaction"
+	// BatchBestEffort runs every operation on its own, failures do not affect the others
+	BatchBestEffort BatchMode = "best_effort"
+	// BatchDryRun validates every operation against the database and always rolls back
+	BatchDryRun BatchMode = "dry_run"
+)
+
+// Supported batch operations
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// MaxBatchSize is the maximum number of operations accepted in one batch
+const MaxBatchSize = 1000
+
+// ErrBatchRolledBack is returned when a transactional batch was rolled back
+var ErrBatchRolledBack = errors.New("batch rolled back")
+
+// BatchItem is a single operation of a batch request.
+// ID is required for update and delete, Data for create and update.
+type BatchItem[T any] struct {
+	Op   string `json:"op"`
+	ID   int    `json:"id,omitempty"`
+	Data T      `json:"data"`
+}
+
+// BatchResult is the outcome of a single batch operation
+type BatchResult struct {
+	Index   int         `json:"index"`
+	Op      string      `json:"op"`
+	ID      int         `json:"id,omitempty"`
+	Success bool        `json:"success"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// batchFunc executes the operation at index i using q
+type batchFunc func(ctx context.Context, q querier, i int) (int, interface{}, error)
+
+// runBatch executes n operations according to mode.
+// Results are returned in the same order as the operations.
+func runBatch(ctx context.Context, mode BatchMode, ops []string, fn batchFunc) ([]BatchResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Batch)
+	defer cancel()
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = BatchResult{Index: i, Op: op}
+	}
+
+	if mode == BatchBestEffort {
+		dbConn := db.GetConnection()
+		for i := range ops {
+			id, data, err := fn(ctx, dbConn, i)
+			results[i].setOutcome(id, data, err)
+		}
+		return results, nil
+	}
+
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin batch transaction: %w", err)
+	}
+	defer tx.Rollback(ctx) // no-op once committed
+
+	if mode == BatchDryRun {
+		// A savepoint per item keeps a failing item from aborting the others,
+		// successful items stay visible so later items are checked against them
+		for i := range ops {
+			savepoint, err := tx.Begin(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create savepoint: %w", err)
+			}
+			id, data, err := fn(ctx, savepoint, i)
+			results[i].setOutcome(id, data, err)
+			if err != nil {
+				savepoint.Rollback(ctx)
+			} else if err := savepoint.Commit(ctx); err != nil {
+				return nil, fmt.Errorf("failed to release savepoint: %w", err)
+			}
+		}
+		return results, nil
+	}
+
+	for i := range ops {
+		id, data, err := fn(ctx, tx, i)
+		results[i].setOutcome(id, data, err)
+		if err != nil {
+			// Everything before the failure is rolled back, everything after is skipped
+			for j := range results {
+				if j != i {
+					results[j] = BatchResult{Index: j, Op: ops[j], Error: ErrBatchRolledBack.Error()}
+				}
+			}
+			return results, ErrBatchRolledBack
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit batch transaction: %w", err)
+	}
+
+	return results, nil
+}
+
+// setOutcome fills the result of a single operation
+func (r *BatchResult) setOutcome(id int, data interface{}, err error) {
+	if err != nil {
+		r.Error = err.Error()
+		// A version conflict carries the current row, like the 409 of a single update
+		var conflict *ConflictError
+		if errors.As(err, &conflict) {
+			r.Data = conflict.Current
+		}
+		return
+	}
+	r.ID = id
+	r.Data = data
+	r.Success = true
+}
+
+// batchOps returns the operation names of items, used to label the results
+func batchOps[T any](items []BatchItem[T]) []string {
+	ops := make([]string, len(items))
+	for i, item := range items {
+		ops[i] = item.Op
+	}
+	return ops
+}
+
+// BatchUsers creates, updates and deletes users in one request. The updates
+// are checked by checkOwnership for caller and client before the batch runs,
+// in every mode, so a rolled back batch still counts the failures.
+func BatchUsers(ctx context.Context, mode BatchMode, items []BatchItem[User], caller *Caller, client LoginClient) ([]BatchResult, error) {
+	passwordErrs := make([]error, len(items))
+	for i, item := range items {
+		if item.Op == BatchUpdate {
+			passwordErrs[i] = checkOwnership(ctx, item.ID, item.Data, caller, client)
+		}
+	}
+
+	defer invalidateBatch(ctx, "users", mode, items)
+	results, err := runBatch(ctx, mode, batchOps(items), func(ctx context.Context, q querier, i int) (int, interface{}, error) {
+		item := items[i]
+		switch item.Op {
+		case BatchCreate:
+			user, err := createUser(ctx, q, item.Data)
+			return user.ID, user, err
+		case BatchUpdate:
+			if passwordErrs[i] != nil {
+				return item.ID, nil, passwordErrs[i]
+			}
+			user, err := updateUser(ctx, q, item.ID, item.Data)
+			return user.ID, user, err
+		case BatchDelete:
+			return item.ID, nil, deleteUser(ctx, q, item.ID)
+		}
+		return 0, nil, fmt.Errorf("unsupported operation %q", item.Op)
+	})
+
+	// Created users and changed addresses get a verification email once committed
+	if mode != BatchDryRun {
+		var ids []int
+		for _, result := range results {
+			if result.Success && result.Op != BatchDelete {
+				ids = append(ids, result.ID)
+			}
+		}
+		sendVerifications(ctx, ids...)
+	}
+	return results, err
+}
+
+// BatchKeys creates, updates and deletes keys in one request, the created ones of the user createdBy
+func BatchKeys(ctx context.Context, mode BatchMode, items []BatchItem[Key], createdBy int) ([]BatchResult, error) {
+	defer invalidateBatch(ctx, "keys", mode, items)
+	return runBatch(ctx, mode, batchOps(items), func(ctx context.Context, q querier, i int) (int, interface{}, error) {
+		item := items[i]
+		switch item.Op {
+		case BatchCreate:
+			key, err := createKey(ctx, q, item.Data, createdBy)
+			return key.ID, key, err
+		case BatchUpdate:
+			key, err := updateKey(ctx, q, item.ID, item.Data)
+			return key.ID, key, err
+		case BatchDelete:
+			return item.ID, nil, deleteKey(ctx, q, item.ID)
+		}
+		return 0, nil, fmt.Errorf("unsupported operation %q", item.Op)
+	})
+}
+
+// BatchCopies creates, updates and deletes copies in one request, the created ones of the user createdBy
+func BatchCopies(ctx context.Context, mode BatchMode, items []BatchItem[Copy], createdBy int) ([]BatchResult, error) {
+	defer invalidateBatch(ctx, "copies", mode, items)
+	return runBatch(ctx, mode, batchOps(items), func(ctx context.Context, q querier, i int) (int, interface{}, error) {
+		item := items[i]
+		switch item.Op {
+		case BatchCreate:
+			copy, err := createCopy(ctx, q, item.Data, createdBy)
+			return copy.ID, copy, err
+		case BatchUpdate:
+			copy, err := updateCopy(ctx, q, item.ID, item.Data)
+			return copy.ID, copy, err
+		case BatchDelete:
+			return item.ID, nil, deleteCopy(ctx, q, item.ID)
+		}
+		return 0, nil, fmt.Errorf("unsupported operation %q", item.Op)
+	})
+}
+
+// BatchTenants creates, updates and deletes tenants in one request
+func BatchTenants(ctx context.Context, mode BatchMode, items []BatchItem[Tenant]) ([]BatchResult, error) {
+	defer invalidateBatch(ctx, "tenants", mode, items)
+	defer func() {
+		if mode == BatchDryRun {
+			return
+		}
+		var ids []int
+		for _, item := range items {
+			if item.Op == BatchUpdate {
+				ids = append(ids, item.ID)
+			}
+		}
+		invalidateTenantUsers(ctx, ids...)
+	}()
+	return runBatch(ctx, mode, batchOps(items), func(ctx context.Context, q querier, i int) (int, interface{}, error) {
+		item := items[i]
+		switch item.Op {
+		case BatchCreate:
+			tenant, err := createTenant(ctx, q, item.Data)
+			return tenant.ID, tenant, err
+		case BatchUpdate:
+			tenant, err := updateTenant(ctx, q, item.ID, item.Data)
+			return tenant.ID, tenant, err
+		case BatchDelete:
+			return item.ID, nil, deleteTenant(ctx, q, item.ID)
+		}
+		return 0, nil, fmt.Errorf("unsupported operation %q", item.Op)
+	})
+}
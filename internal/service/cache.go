@@ -0,0 +1,137 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"log/slog"
+	"portier/pkg/cache"
+	"strconv"
+	"time"
+)
+
+// CacheConfig sets how long values stay cached, a TTL of 0 disables that cache
+type CacheConfig struct {
+	ItemTTL       time.Duration `mapstructure:"item_ttl" yaml:"item_ttl"`               // GetUserByID, GetKeysByID, GetCopyByID and GetTenantByID
+	ListTTL       time.Duration `mapstructure:"list_ttl" yaml:"list_ttl"`               // list pages
+	MaxListOffset int           `mapstructure:"max_list_offset" yaml:"max_list_offset"` // deeper pages are always read from the database
+}
+
+var (
+	cacheStore  cache.Store
+	cacheConfig CacheConfig
+)
+
+// SetCache enables read-through caching in store, nil disables it
+func SetCache(store cache.Store, cfg CacheConfig) {
+	cacheStore = store
+	cacheConfig = cfg
+}
+
+// cached returns the value of entity stored under key, or loads it and stores
+// it for ttl. Errors are not cached. A failing store is logged and the value is
+// loaded. Values are encoded with gob, which keeps the fields hidden from JSON.
+//
+// The value is not stored when entity was invalidated during the load, it may
+// have been read before the change was committed. Authorization checks read
+// the database anyway, see GetUserByIDUncached.
+func cached[T any](ctx context.Context, entity, key string, ttl time.Duration, load func() (T, error)) (T, error) {
+	if cacheStore == nil || ttl <= 0 {
+		return load()
+	}
+
+	raw, err := cacheStore.Get(key)
+	if err != nil {
+		slog.WarnContext(ctx, "Cache read failed", "key", key, "error", err)
+	} else if raw != nil {
+		var value T
+		if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&value); err == nil {
+			return value, nil
+		}
+		slog.WarnContext(ctx, "Cached value ignored, it cannot be decoded", "key", key, "error", err)
+	}
+
+	before := generation(ctx, entity)
+	value, err := load()
+	if err != nil {
+		return value, err
+	}
+	if !bytes.Equal(generation(ctx, entity), before) {
+		return value, nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+		slog.WarnContext(ctx, "Value not cached", "key", key, "error", err)
+	} else if err := cacheStore.Set(key, buf.Bytes(), ttl); err != nil {
+		slog.WarnContext(ctx, "Cache write failed", "key", key, "error", err)
+	}
+	return value, nil
+}
+
+// itemKey is the cache key of one row
+func itemKey(entity string, id int) string {
+	return "cache:" + entity + ":" + strconv.Itoa(id)
+}
+
+// listKey is the cache key of a list page. It contains the generation of the
+// entity, so bumping the generation invalidates every page at once.
+func listKey(ctx context.Context, entity string, params ...any) string {
+	return fmt.Sprintf("cache:%s:list:%s:%v", entity, generation(ctx, entity), params)
+}
+
+// generation returns the current generation of entity, changed by every invalidate
+func generation(ctx context.Context, entity string) []byte {
+	generation, err := cacheStore.Get(generationKey(entity))
+	if err != nil {
+		slog.WarnContext(ctx, "Cache read failed", "key", generationKey(entity), "error", err)
+	}
+	return generation
+}
+
+func generationKey(entity string) string {
+	return "cache:" + entity + ":generation"
+}
+
+// cachedPage caches the list pages up to cacheConfig.MaxListOffset
+func cachedPage[T any](ctx context.Context, entity string, offset int, params []any, load func() (T, error)) (T, error) {
+	if cacheStore == nil || cacheConfig.ListTTL <= 0 || offset > cacheConfig.MaxListOffset {
+		return load()
+	}
+	return cached(ctx, entity, listKey(ctx, entity, params...), cacheConfig.ListTTL, load)
+}
+
+// invalidate removes the rows ids of entity and every list page of entity from
+// the cache. It must be called once the change is committed.
+func invalidate(ctx context.Context, entity string, ids ...int) {
+	if cacheStore == nil {
+		return
+	}
+	for _, id := range ids {
+		if err := cacheStore.Delete(itemKey(entity, id)); err != nil {
+			slog.WarnContext(ctx, "Cache invalidation failed", "key", itemKey(entity, id), "error", err)
+		}
+	}
+
+	// A new generation, pages of the previous ones are never read again and expire
+	generation := strconv.FormatInt(time.Now().UnixNano(), 36)
+	if err := cacheStore.Set(generationKey(entity), []byte(generation), 0); err != nil {
+		slog.WarnContext(ctx, "Cache invalidation failed", "key", generationKey(entity), "error", err)
+	}
+}
+
+// invalidateBatch invalidates the rows updated or deleted by a batch, and the
+// list pages. Rolled back batches are invalidated too, it is only a cache miss.
+func invalidateBatch[T any](ctx context.Context, entity string, mode BatchMode, items []BatchItem[T]) {
+	if mode == BatchDryRun {
+		return
+	}
+	var ids []int
+	for _, item := range items {
+		if item.Op != BatchCreate && item.ID != 0 {
+			ids = append(ids, item.ID)
+		}
+	}
+	invalidate(ctx, entity, ids...)
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"portier/pkg/cache"
+	"testing"
+	"time"
+)
+
+// useMemoryCache caches in memory for the test
+func useMemoryCache(t *testing.T, cfg CacheConfig) *cache.Memory {
+	t.Helper()
+	store := cache.NewMemory(time.Hour)
+	SetCache(store, cfg)
+	t.Cleanup(func() {
+		SetCache(nil, CacheConfig{})
+		store.Close()
+	})
+	return store
+}
+
+func TestCached(t *testing.T) {
+	useMemoryCache(t, CacheConfig{ItemTTL: time.Minute})
+	ctx := context.Background()
+
+	loads := 0
+	load := func() (User, error) {
+		loads++
+		return User{ID: 1, Name: "ahmad", Role: RoleAdmin}, nil
+	}
+	for range 3 {
+		user, err := cached(ctx, "users", itemKey("users", 1), time.Minute, load)
+		if err != nil || user.Name != "ahmad" || user.Role != RoleAdmin {
+			t.Fatalf("cached() = %+v, %v", user, err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("loaded %d times, want 1", loads)
+	}
+
+	invalidate(ctx, "users", 1)
+	cached(ctx, "users", itemKey("users", 1), time.Minute, load)
+	if loads != 2 {
+		t.Errorf("loaded %d times after invalidate, want 2", loads)
+	}
+}
+
+func TestCachedInvalidatedDuringLoad(t *testing.T) {
+	useMemoryCache(t, CacheConfig{ItemTTL: time.Minute})
+	ctx := context.Background()
+
+	// An update commits and invalidates while the previous row is being loaded
+	role := RoleAdmin
+	stale := func() (User, error) {
+		user := User{ID: 1, Role: role}
+		role = RoleUser
+		invalidate(ctx, "users", 1)
+		return user, nil
+	}
+	if user, _ := cached(ctx, "users", itemKey("users", 1), time.Minute, stale); user.Role != RoleAdmin {
+		t.Fatalf("cached() = %+v, want the loaded row", user)
+	}
+
+	fresh := func() (User, error) {
+		return User{ID: 1, Role: role}, nil
+	}
+	if user, _ := cached(ctx, "users", itemKey("users", 1), time.Minute, fresh); user.Role != RoleUser {
+		t.Errorf("cached() = %+v, the row loaded before the invalidate was cached", user)
+	}
+}
+
+func TestCachedErrorsAreNotCached(t *testing.T) {
+	useMemoryCache(t, CacheConfig{ItemTTL: time.Minute})
+	ctx := context.Background()
+
+	loads := 0
+	failing := func() (User, error) {
+		loads++
+		return User{}, errors.New("database unavailable")
+	}
+	for range 2 {
+		if _, err := cached(ctx, "users", itemKey("users", 1), time.Minute, failing); err == nil {
+			t.Fatal("cached() returned no error")
+		}
+	}
+	if loads != 2 {
+		t.Errorf("loaded %d times, want 2", loads)
+	}
+}
+
+func TestCachedDisabled(t *testing.T) {
+	useMemoryCache(t, CacheConfig{})
+	loads := 0
+	load := func() (int, error) {
+		loads++
+		return loads, nil
+	}
+	cached(context.Background(), "users", "key", 0, load)
+	cached(context.Background(), "users", "key", 0, load)
+	if loads != 2 {
+		t.Errorf("a ttl of 0 loaded %d times, want 2", loads)
+	}
+}
+
+func TestCachedPage(t *testing.T) {
+	useMemoryCache(t, CacheConfig{ListTTL: time.Minute, MaxListOffset: 20})
+	ctx := context.Background()
+
+	loads := 0
+	load := func() (GetAllUsersResponse, error) {
+		loads++
+		return GetAllUsersResponse{TotalPages: loads}, nil
+	}
+	page := func(offset int) int {
+		response, err := cachedPage(ctx, "users", offset, []any{10, offset, "ahmad"}, load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response.TotalPages
+	}
+
+	if page(0) != 1 || page(0) != 1 {
+		t.Errorf("the first page was not cached, %d loads", loads)
+	}
+
+	// Another entity keeps its pages, the invalidated one gets a new generation
+	invalidate(ctx, "keys")
+	if page(0) != 1 {
+		t.Errorf("invalidating keys invalidated the users pages")
+	}
+	invalidate(ctx, "users", 1)
+	if page(0) != 2 {
+		t.Errorf("the page was served from the previous generation")
+	}
+
+	// Pages past max_list_offset are always loaded
+	page(40)
+	page(40)
+	if loads != 4 {
+		t.Errorf("loaded %d times, want 4", loads)
+	}
+}
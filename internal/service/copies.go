@@ -3,7 +3,7 @@ package service
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"portier/pkg/db"
 	"time"
 )
@@ -13,6 +13,8 @@ type Copy struct {
 	Name      string    `json:"name"`
 	KeyID     int       `json:"key_id"`
 	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`           // Maintained by a trigger, sent as Last-Modified
+	Version   int       `json:"version"`              // Incremented by every update, an update must send the version it read
 	CreatedBy int       `json:"created_by,omitempty"` // Optional, nullable field
 	IsActive  bool      `json:"is_active"`
 }
@@ -23,29 +25,36 @@ type GetAllCopiesResponse struct {
 	TotalPages int    `json:"totalPages"`
 }
 
-// GetAllCopies fetches all copies
-func GetAllCopies(limit, offset int) (GetAllCopiesResponse, error) {
+// GetAllCopies fetches all copies of the tenant, of every tenant when it is 0.
+func GetAllCopies(ctx context.Context, limit, offset, tenantID int) (GetAllCopiesResponse, error) {
+	return cachedPage(ctx, "copies", offset, []any{limit, offset, tenantID}, func() (GetAllCopiesResponse, error) {
+		return getAllCopies(ctx, limit, offset, tenantID)
+	})
+}
+
+func getAllCopies(ctx context.Context, limit, offset, tenantID int) (GetAllCopiesResponse, error) {
 	// Get a database connection
 	dbConn := db.GetConnection()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
 	defer cancel()
 
 	// Query to get the total count of copies
 	var totalCount int
-	countQuery := `SELECT COUNT(*) FROM copies`
-	if err := dbConn.QueryRow(ctx, countQuery).Scan(&totalCount); err != nil {
-		return GetAllCopiesResponse{}, fmt.Errorf("failed to get total count: %v", err)
+	countQuery := `SELECT COUNT(*) FROM copies WHERE ` + tenantScope("copies", 1)
+	if err := dbConn.QueryRow(ctx, countQuery, tenantID).Scan(&totalCount); err != nil {
+		return GetAllCopiesResponse{}, fmt.Errorf("failed to get total count: %w", err)
 	}
 
 	// Calculate total pages
 	totalPages := (totalCount + limit - 1) / limit
 
 	// Query to get the paginated copies
-	query := `SELECT id, name, key_id, created_at, created_by, is_active 
+	query := `SELECT id, name, key_id, created_at, created_by, is_active, updated_at, version 
 			  FROM copies 
+			  WHERE ` + tenantScope("copies", 1) + ` 
 			  ORDER BY id 
-			  LIMIT $1 OFFSET $2`
-	rows, err := dbConn.Query(ctx, query, limit, offset)
+			  LIMIT $2 OFFSET $3`
+	rows, err := dbConn.Query(ctx, query, tenantID, limit, offset)
 	if err != nil {
 		return GetAllCopiesResponse{}, err
 	}
@@ -54,7 +63,7 @@ func GetAllCopies(limit, offset int) (GetAllCopiesResponse, error) {
 	var copies []Copy
 	for rows.Next() {
 		var copy Copy
-		if err := rows.Scan(&copy.ID, &copy.Name, &copy.KeyID, &copy.CreatedAt, &copy.CreatedBy, &copy.IsActive); err != nil {
+		if err := rows.Scan(&copy.ID, &copy.Name, &copy.KeyID, &copy.CreatedAt, &copy.CreatedBy, &copy.IsActive, &copy.UpdatedAt, &copy.Version); err != nil {
 			return GetAllCopiesResponse{}, err
 		}
 		copies = append(copies, copy)
@@ -70,16 +79,60 @@ func GetAllCopies(limit, offset int) (GetAllCopiesResponse, error) {
 	}, nil
 }
 
-// GetCopyByID fetches a copy by its ID
-func GetCopyByID(id int) (Copy, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Add context
+// StreamCopies calls fn for every copy of the tenant, ordered by ID like GetAllCopies.
+// Rows are read from the database cursor one at a time.
+func StreamCopies(ctx context.Context, tenantID int, fn func(Copy) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Export)
+	defer cancel()
+
+	query := `SELECT id, name, key_id, created_at, created_by, is_active, updated_at, version 
+			  FROM copies 
+			  WHERE ` + tenantScope("copies", 1) + ` 
+			  ORDER BY id`
+	rows, err := db.GetConnection().Query(ctx, query, tenantID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var copy Copy
+		if err := rows.Scan(&copy.ID, &copy.Name, &copy.KeyID, &copy.CreatedAt, &copy.CreatedBy, &copy.IsActive, &copy.UpdatedAt, &copy.Version); err != nil {
+			return err
+		}
+		if err := fn(copy); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetCopyByID fetches a copy by its ID.
+func GetCopyByID(ctx context.Context, id int) (Copy, error) {
+	return cached(ctx, "copies", itemKey("copies", id), cacheConfig.ItemTTL, func() (Copy, error) {
+		return getCopyByID(ctx, id)
+	})
+}
 
+// GetCopyByIDUncached is GetCopyByID without the cache, for the If-Match checks
+func GetCopyByIDUncached(ctx context.Context, id int) (Copy, error) {
+	return getCopyByID(ctx, id)
+}
+
+func getCopyByID(ctx context.Context, id int) (Copy, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	return selectCopy(ctx, db.GetConnection(), id)
+}
+
+// selectCopy reads a copy with q, which is either the pool or a batch transaction
+func selectCopy(ctx context.Context, q querier, id int) (Copy, error) {
 	var copy Copy
 
-	query := `SELECT id, name, key_id, created_at, created_by, is_active FROM copies WHERE id=$1`
-	err := dbConn.QueryRow(ctx, query, id).Scan(&copy.ID, &copy.Name, &copy.KeyID, &copy.CreatedAt, &copy.CreatedBy, &copy.IsActive)
+	query := `SELECT id, name, key_id, created_at, created_by, is_active, updated_at, version FROM copies WHERE id=$1`
+	err := q.QueryRow(ctx, query, id).Scan(&copy.ID, &copy.Name, &copy.KeyID, &copy.CreatedAt, &copy.CreatedBy, &copy.IsActive, &copy.UpdatedAt, &copy.Version)
 	if err != nil {
 		return Copy{}, err
 	}
@@ -87,40 +140,43 @@ func GetCopyByID(id int) (Copy, error) {
 	return copy, nil
 }
 
-// CreateCopy creates a new copy
-func CreateCopy(copy Copy) (Copy, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
-
-	// If KeyID is not provided, fetch the first available key
-	if copy.KeyID == 0 {
-		response, err := GetAllKeys(1, 0)
-		if err != nil {
-			fmt.Println("Error getting keys:", err)
-			return copy, err
-		}
+// CreateCopy creates a new copy of the user createdBy, see ResolveCreatorID
+func CreateCopy(ctx context.Context, copy Copy, createdBy int) (Copy, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
 
-		if len(response.Keys) > 0 {
-			copy.KeyID = response.Keys[0].ID
-		} else {
-			fmt.Println("No keys found")
-			return copy, fmt.Errorf("no keys found")
-		}
+	created, err := createCopy(ctx, db.GetConnection(), copy, createdBy)
+	if err == nil {
+		invalidate(ctx, "copies")
 	}
+	return created, err
+}
 
+// createCopy inserts a copy with q, which is either the pool or a batch transaction
+func createCopy(ctx context.Context, q querier, copy Copy, createdBy int) (Copy, error) {
 	// Explicitly set the default value for IsActive
 	copy.IsActive = true
-	copy.CreatedBy = 1
+	createdBy, err := ResolveCreatorID(createdBy)
+	if err != nil {
+		return Copy{}, err
+	}
+	copy.CreatedBy = createdBy
+
+	// Validate the key, falling back to the creator's tenant default key only when set
+	keyID, err := resolveKeyID(ctx, q, copy.KeyID, copy.CreatedBy)
+	if err != nil {
+		return Copy{}, err
+	}
+	copy.KeyID = keyID
 
 	query := `INSERT INTO copies (name, key_id, created_at, created_by, is_active) 
-						VALUES ($1, $2, $3, $4, $5) RETURNING id`
+						VALUES ($1, $2, $3, $4, $5) RETURNING id, updated_at, version`
 
 	var id int
-	err := dbConn.QueryRow(ctx, query, copy.Name, copy.KeyID, time.Now(), copy.CreatedBy, copy.IsActive).Scan(&id)
+	err = q.QueryRow(ctx, query, copy.Name, copy.KeyID, time.Now(), copy.CreatedBy, copy.IsActive).Scan(&id, &copy.UpdatedAt, &copy.Version)
 	if err != nil {
-		log.Printf("Error creating copy: %v", err)
-		return Copy{}, fmt.Errorf("failed to create copy: %v", err)
+		slog.ErrorContext(ctx, "Error creating copy", "error", err)
+		return Copy{}, fmt.Errorf("failed to create copy: %w", err)
 	}
 
 	copy.ID = id
@@ -128,17 +184,29 @@ func CreateCopy(copy Copy) (Copy, error) {
 }
 
 // UpdateCopy updates a copy's information
-func UpdateCopy(id int, copy Copy) (Copy, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
+func UpdateCopy(ctx context.Context, id int, copy Copy) (Copy, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	updated, err := updateCopy(ctx, db.GetConnection(), id, copy)
+	if err == nil {
+		invalidate(ctx, "copies", id)
+	}
+	return updated, err
+}
+
+// updateCopy updates a copy with q, which is either the pool or a batch transaction
+func updateCopy(ctx context.Context, q querier, id int, copy Copy) (Copy, error) {
+	if copy.Version == 0 {
+		return Copy{}, ErrVersionRequired
+	}
 
 	// Explicitly set the default value for IsActive
 	copy.IsActive = true
 
-	query := `UPDATE copies SET name=$1, is_active=$2 WHERE id=$3`
-	_, err := dbConn.Exec(ctx, query, copy.Name, copy.IsActive, id)
-	if err != nil {
+	query := `UPDATE copies SET name=$1, is_active=$2, version=version+1 WHERE id=$3 AND version=$4 RETURNING updated_at, version`
+	err := q.QueryRow(ctx, query, copy.Name, copy.IsActive, id, copy.Version).Scan(&copy.UpdatedAt, &copy.Version)
+	if err := checkVersion(ctx, q, err, id, selectCopy); err != nil {
 		return Copy{}, err
 	}
 
@@ -147,16 +215,27 @@ func UpdateCopy(id int, copy Copy) (Copy, error) {
 }
 
 // DeleteCopy deletes a copy
-func DeleteCopy(id int) error {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
+func DeleteCopy(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
 
+	err := deleteCopy(ctx, db.GetConnection(), id)
+	if err == nil {
+		invalidate(ctx, "copies", id)
+	}
+	return err
+}
+
+// deleteCopy deletes a copy with q, which is either the pool or a batch transaction
+func deleteCopy(ctx context.Context, q querier, id int) error {
 	query := `DELETE FROM copies WHERE id=$1`
-	_, err := dbConn.Exec(ctx, query, id)
+	tag, err := q.Exec(ctx, query, id)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
 
 	return nil
 }
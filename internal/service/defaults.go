@@ -0,0 +1,111 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// defaultTenantID is the tenant assigned to new users that are created without
+// a tenant_id. It stays 0 (disabled) unless an admin opts in via config.yaml.
+var defaultTenantID int
+
+// SetDefaultTenantID sets the opt-in fallback tenant for new users, 0 disables it
+func SetDefaultTenantID(id int) {
+	defaultTenantID = id
+}
+
+// defaultCreatorID is the user recorded as the creator of keys and copies that
+// are created without an API token. It stays 0 (disabled) unless an admin opts
+// in via config.yaml.
+var defaultCreatorID int
+
+// SetDefaultCreatorID sets the opt-in fallback creator of keys and copies, 0 disables it
+func SetDefaultCreatorID(id int) {
+	defaultCreatorID = id
+}
+
+// resolveTenantID returns the tenant a user should be attached to.
+// An explicit tenant_id always wins, the configured default is only used when
+// an admin opted in. Either way the tenant must exist and be active.
+func resolveTenantID(ctx context.Context, q querier, tenantID int) (int, error) {
+	if tenantID == 0 {
+		if defaultTenantID == 0 {
+			return 0, ErrTenantRequired
+		}
+		tenantID = defaultTenantID
+	}
+
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM tenants WHERE id=$1 AND is_active)`
+	if err := q.QueryRow(ctx, query, tenantID).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to check tenant: %w", err)
+	}
+	if !exists {
+		return 0, ErrTenantNotFound
+	}
+
+	return tenantID, nil
+}
+
+// ResolveCreatorID returns the creator of a key or a copy, whose tenant decides
+// the default key and the statistics. The caller passes the user of its API
+// token, 0 without one, which falls back to the configured default creator.
+func ResolveCreatorID(createdBy int) (int, error) {
+	if createdBy != 0 {
+		return createdBy, nil
+	}
+	if defaultCreatorID != 0 {
+		return defaultCreatorID, nil
+	}
+	return 0, ErrCreatorRequired
+}
+
+// resolveKeyID returns the key a copy should be attached to.
+// An explicit key_id always wins, otherwise the default key configured on the
+// creator's tenant is used. Either way the key must exist, be active and
+// belong to the creator's tenant.
+func resolveKeyID(ctx context.Context, q querier, keyID, createdBy int) (int, error) {
+	if keyID == 0 {
+		var defaultKeyID *int
+		query := `SELECT t.default_key_id FROM users u JOIN tenants t ON t.id = u.tenant_id WHERE u.id=$1`
+		err := q.QueryRow(ctx, query, createdBy).Scan(&defaultKeyID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return 0, fmt.Errorf("failed to get tenant default key: %w", err)
+		}
+		if defaultKeyID == nil {
+			return 0, ErrKeyRequired
+		}
+		keyID = *defaultKeyID
+	}
+
+	// A copy is attached to a key of its creator's tenant only
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM keys WHERE id=$1 AND is_active AND 
+						created_by IN (SELECT id FROM users WHERE tenant_id = (SELECT tenant_id FROM users WHERE id=$2)))`
+	if err := q.QueryRow(ctx, query, keyID, createdBy).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("failed to check key: %w", err)
+	}
+	if !exists {
+		return 0, ErrKeyNotFound
+	}
+
+	return keyID, nil
+}
+
+// checkDefaultKey refuses a default_key_id of the tenant tenantID that is not
+// an active key created by one of its users, like the key of a copy
+func checkDefaultKey(ctx context.Context, q querier, keyID, tenantID int) error {
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM keys WHERE id=$1 AND is_active AND 
+						created_by IN (SELECT id FROM users WHERE tenant_id=$2))`
+	if err := q.QueryRow(ctx, query, keyID, tenantID).Scan(&exists); err != nil {
+		return fmt.Errorf("failed to check key: %w", err)
+	}
+	if !exists {
+		return ErrKeyNotFound
+	}
+	return nil
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrVersionRequired is returned by an update without the version of the row it changes
+var ErrVersionRequired = errors.New("version is required, send the version of the row you read")
+
+// ErrNotFound is returned by an update of a row that does not exist. It wraps
+// pgx.ErrNoRows, handlers answer 404 like for a read.
+var ErrNotFound = fmt.Errorf("the row does not exist: %w", pgx.ErrNoRows)
+
+// ConflictError is returned by an update whose version is not the current one,
+// the row was changed since the client read it. Current is the row as stored,
+// handlers answer 409 Conflict with it.
+type ConflictError struct {
+	Current interface{}
+}
+
+func (e *ConflictError) Error() string {
+	return "version conflict, the row was modified since it was read"
+}
+
+// AsConflict returns the *ConflictError in the chain of err
+func AsConflict(err error) (*ConflictError, bool) {
+	var conflict *ConflictError
+	ok := errors.As(err, &conflict)
+	return conflict, ok
+}
+
+// LockedError refuses a credential check of a user, or of an address when IP
+// is set, locked by its failed attempts. Handlers answer 423 Locked, or 429 for
+// an address, with a Retry-After header.
+type LockedError struct {
+	RetryAfter time.Duration
+	IP         bool
+}
+
+func (e *LockedError) Error() string {
+	if e.IP {
+		return "too many failed logins from this address"
+	}
+	return "too many failed logins, the account is locked"
+}
+
+// AsLocked returns the *LockedError in the chain of err
+func AsLocked(err error) (*LockedError, bool) {
+	var locked *LockedError
+	ok := errors.As(err, &locked)
+	return locked, ok
+}
+
+// ErrSecretMissing refuses to seal or open the TOTP and OIDC client secrets
+// when auth.secret is not set
+var ErrSecretMissing = errors.New("auth.secret is not set, secrets cannot be encrypted")
+
+// Validation errors returned when a parent reference is missing or invalid.
+// Handlers map these to a 400 Bad Request instead of a 500.
+var (
+	ErrTenantRequired = errors.New("tenant_id is required")
+	ErrTenantNotFound = errors.New("tenant_id does not reference an active tenant")
+	ErrKeyRequired    = errors.New("key_id is required")
+	ErrKeyNotFound    = errors.New("key_id does not reference an active key of the tenant")
+	ErrInvalidRole    = errors.New("role must be admin, manager or user")
+)
+
+// Errors of the password and email verification flows, handlers answer 400
+var (
+	ErrCurrentPasswordRequired = errors.New("current_password is required")
+	ErrCurrentPasswordInvalid  = errors.New("current_password is not the password of the user")
+	ErrInvalidToken            = errors.New("the token is invalid, expired or already used")
+	ErrPasswordTooShort        = errors.New("the password must be at least 8 characters long")
+)
+
+// Errors of the second factor. Handlers answer 400 for the validation ones,
+// 401 for rejected credentials, 403 when the policy refuses and 409 when the
+// enrollment is not in the expected state.
+var (
+	ErrTOTPNotPending         = errors.New("no enrollment to confirm, start one first")
+	ErrTOTPNotEnabled         = errors.New("the user has no second factor")
+	ErrTOTPAlreadyEnabled     = errors.New("the user already has a second factor, disable it first")
+	ErrInvalidCredentials     = errors.New("invalid login or password")
+	ErrTOTPCodeRequired       = errors.New("code is required, the user has a second factor")
+	ErrInvalidTOTPCode        = errors.New("the code is invalid or was already used")
+	ErrTOTPEnrollmentRequired = errors.New("the tenant or role of the user requires a second factor, enroll one first")
+	ErrTOTPRequiredByPolicy   = errors.New("the tenant or role of the user requires a second factor, it cannot be disabled")
+)
+
+// Errors of the API tokens
+var (
+	ErrInvalidAPIToken    = errors.New("the token is invalid, expired or revoked")
+	ErrTokenNameRequired  = errors.New("name is required")
+	ErrInvalidScope       = errors.New("scopes must list one or more of read, write, tokens and scim")
+	ErrInvalidTokenExpiry = errors.New("expires_at must be in the future and within auth.token_max_ttl")
+)
+
+// Errors of the single sign-on. Handlers answer 400 for the validation ones,
+// 401 when the provider or its ID token is refused, 403 when the user may not
+// log in or did not pass the second factor it needs, 404 without a provider,
+// 409 for an identity of another user and 502 when the provider is unreachable.
+var (
+	ErrOIDCIssuerInvalid        = errors.New("issuer must be an https URL")
+	ErrOIDCClientIDRequired     = errors.New("client_id is required")
+	ErrOIDCLoginInvalid         = errors.New("the login is invalid or expired, start it again")
+	ErrOIDCNotConfigured        = errors.New("single sign-on is not configured for this tenant")
+	ErrOIDCProviderUnavailable  = errors.New("the identity provider is unavailable")
+	ErrOIDCLoginFailed          = errors.New("single sign-on failed")
+	ErrOIDCIdentityTaken        = errors.New("the email of the identity belongs to another user, or the identity to another tenant")
+	ErrOIDCProvisioningDisabled = errors.New("the user does not exist and the tenant does not provision users")
+	ErrOIDCUserInactive         = errors.New("the user is inactive")
+	ErrOIDCSecondFactorRequired = errors.New("the user has or requires a second factor, the identity provider did not report a multi-factor login (amr)")
+)
+
+// ErrCreatorRequired refuses to create a key or a copy without an authenticated
+// caller, whose tenant owns it, when defaults.creator_id is not set. Handlers answer 401.
+var ErrCreatorRequired = errors.New("an API token is required to create keys and copies")
+
+// IsAuthError reports whether err rejects the credentials of the request
+func IsAuthError(err error) bool {
+	return errors.Is(err, ErrInvalidCredentials) ||
+		errors.Is(err, ErrTOTPCodeRequired) ||
+		errors.Is(err, ErrInvalidTOTPCode) ||
+		errors.Is(err, ErrInvalidAPIToken) ||
+		errors.Is(err, ErrOIDCLoginFailed) ||
+		errors.Is(err, ErrCreatorRequired)
+}
+
+// IsValidationError reports whether err is caused by invalid input
+func IsValidationError(err error) bool {
+	return errors.Is(err, ErrTenantRequired) ||
+		errors.Is(err, ErrTenantNotFound) ||
+		errors.Is(err, ErrKeyRequired) ||
+		errors.Is(err, ErrKeyNotFound) ||
+		errors.Is(err, ErrInvalidRole) ||
+		errors.Is(err, ErrVersionRequired) ||
+		errors.Is(err, ErrCurrentPasswordRequired) ||
+		errors.Is(err, ErrCurrentPasswordInvalid) ||
+		errors.Is(err, ErrInvalidToken) ||
+		errors.Is(err, ErrPasswordTooShort) ||
+		errors.Is(err, ErrTOTPNotPending) ||
+		errors.Is(err, ErrTOTPNotEnabled) ||
+		errors.Is(err, ErrTokenNameRequired) ||
+		errors.Is(err, ErrInvalidScope) ||
+		errors.Is(err, ErrInvalidTokenExpiry) ||
+		errors.Is(err, ErrOIDCIssuerInvalid) ||
+		errors.Is(err, ErrOIDCClientIDRequired) ||
+		errors.Is(err, ErrOIDCLoginInvalid)
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"portier/pkg/db"
+	"time"
+)
+
+// Job kinds
+const (
+	JobImport = "import"
+	JobExport = "export"
+)
+
+// Job statuses
+const (
+	JobPending   = "pending"
+	JobRunning   = "running"
+	JobCompleted = "completed"
+	JobFailed    = "failed"
+)
+
+// jobInstance names this process in the jobs it creates, see SetJobInstance
+var jobInstance string
+
+// SetJobInstance sets the name of this instance. Its files are in its own jobs
+// directory, so it only fails and deletes its own jobs, and those created
+// before jobs had an instance.
+func SetJobInstance(name string) {
+	jobInstance = name
+}
+
+// Job tracks the progress of a background import or export
+type Job struct {
+	ID            int        `json:"id"`
+	Kind          string     `json:"kind"`
+	Entity        string     `json:"entity"`
+	Status        string     `json:"status"`
+	FileName      string     `json:"file_name"`
+	TotalRows     int        `json:"total_rows"`
+	ProcessedRows int        `json:"processed_rows"`
+	FailedRows    int        `json:"failed_rows"`
+	Error         string     `json:"error,omitempty"`
+	ResultPath    string     `json:"-"`          // Server side path, only exposed through the download endpoints
+	CreatedBy     int        `json:"created_by"` // User of the API token creating the job, 0 without a token
+	TenantID      int        `json:"tenant_id"`  // Tenant of that token, its admins read the job too
+	CreatedAt     time.Time  `json:"created_at"`
+	FinishedAt    *time.Time `json:"finished_at"`
+}
+
+// CreateJob registers a new pending job owned by caller, nil without a token
+func CreateJob(ctx context.Context, kind, entity, fileName string, totalRows int, caller *Caller) (Job, error) {
+	// Get a database connection
+	dbConn := db.GetConnection()
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	job := Job{
+		Kind:      kind,
+		Entity:    entity,
+		Status:    JobPending,
+		FileName:  fileName,
+		TotalRows: totalRows,
+		CreatedAt: time.Now(),
+	}
+	if caller != nil {
+		job.CreatedBy, job.TenantID = caller.UserID, caller.TenantID
+	}
+
+	query := `INSERT INTO jobs (kind, entity, status, file_name, total_rows, created_at, created_by, tenant_id, instance)
+						VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, 0), NULLIF($8, 0), $9) RETURNING id`
+	err := dbConn.QueryRow(ctx, query, job.Kind, job.Entity, job.Status, job.FileName, job.TotalRows, job.CreatedAt, job.CreatedBy, job.TenantID, jobInstance).Scan(&job.ID)
+	if err != nil {
+		return Job{}, fmt.Errorf("failed to create job: %w", err)
+	}
+
+	return job, nil
+}
+
+// GetJobByID fetches a job by its ID
+func GetJobByID(ctx context.Context, id int) (Job, error) {
+	// Get a database connection
+	dbConn := db.GetConnection()
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	var job Job
+
+	query := `SELECT id, kind, entity, status, COALESCE(file_name, ''), total_rows, processed_rows, failed_rows,
+						COALESCE(error, ''), COALESCE(result_path, ''), created_at, finished_at, COALESCE(created_by, 0), COALESCE(tenant_id, 0)
+						FROM jobs WHERE id=$1`
+	err := dbConn.QueryRow(ctx, query, id).Scan(&job.ID, &job.Kind, &job.Entity, &job.Status, &job.FileName, &job.TotalRows, &job.ProcessedRows, &job.FailedRows, &job.Error, &job.ResultPath, &job.CreatedAt, &job.FinishedAt, &job.CreatedBy, &job.TenantID)
+	if err != nil {
+		return Job{}, err
+	}
+
+	return job, nil
+}
+
+// UpdateJobProgress marks a job as running and stores its progress
+func UpdateJobProgress(ctx context.Context, id, totalRows, processedRows, failedRows int) error {
+	// Get a database connection
+	dbConn := db.GetConnection()
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	query := `UPDATE jobs SET status=$1, total_rows=$2, processed_rows=$3, failed_rows=$4 WHERE id=$5`
+	_, err := dbConn.Exec(ctx, query, JobRunning, totalRows, processedRows, failedRows, id)
+	if err != nil {
+		return fmt.Errorf("failed to update job progress: %w", err)
+	}
+
+	return nil
+}
+
+// FinishJob stores the final state of a job.
+// A non-nil jobErr marks the job as failed.
+func FinishJob(ctx context.Context, id int, resultPath string, jobErr error) error {
+	// Get a database connection
+	dbConn := db.GetConnection()
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	status, errMsg := JobCompleted, ""
+	if jobErr != nil {
+		status, errMsg = JobFailed, jobErr.Error()
+	}
+
+	query := `UPDATE jobs SET status=$1, error=NULLIF($2, ''), result_path=NULLIF($3, ''), finished_at=$4 WHERE id=$5`
+	_, err := dbConn.Exec(ctx, query, status, errMsg, resultPath, time.Now(), id)
+	if err != nil {
+		return fmt.Errorf("failed to finish job: %w", err)
+	}
+
+	return nil
+}
+
+// FailInterruptedJobs marks jobs left pending or running by a previous process
+// of this instance as failed, the other instances may still be running theirs
+func FailInterruptedJobs(ctx context.Context) (int, error) {
+	// Get a database connection
+	dbConn := db.GetConnection()
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	query := `UPDATE jobs SET status=$1, error='interrupted by a server restart', finished_at=$2 WHERE status IN ($3, $4) AND instance IN ($5, '')`
+	tag, err := dbConn.Exec(ctx, query, JobFailed, time.Now(), JobPending, JobRunning, jobInstance)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update interrupted jobs: %w", err)
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+// DeleteExpiredJobs deletes the jobs of this instance that finished before
+// before and returns the paths of their files, which the caller removes
+func DeleteExpiredJobs(ctx context.Context, before time.Time) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	query := `DELETE FROM jobs WHERE status IN ($1, $2) AND finished_at < $3 AND instance IN ($4, '') RETURNING COALESCE(result_path, '')`
+	rows, err := db.GetConnection().Query(ctx, query, JobCompleted, JobFailed, before, jobInstance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete expired jobs: %w", err)
+	}
+	defer rows.Close()
+
+	var paths []string
+	for rows.Next() {
+		var path string
+		if err := rows.Scan(&path); err != nil {
+			return nil, err
+		}
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths, rows.Err()
+}
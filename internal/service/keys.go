@@ -11,6 +11,8 @@ type Key struct {
 	ID        int       `json:"id"`
 	Name      string    `json:"name"`
 	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`           // Maintained by a trigger, sent as Last-Modified
+	Version   int       `json:"version"`              // Incremented by every update, an update must send the version it read
 	CreatedBy int       `json:"created_by,omitempty"` // Optional, nullable field
 	IsActive  bool      `json:"is_active"`
 }
@@ -21,29 +23,36 @@ type GetAllKeysResponse struct {
 	TotalPages int   `json:"totalPages"`
 }
 
-// GetAllKeys fetches all keys
-func GetAllKeys(limit, offset int) (GetAllKeysResponse, error) {
+// GetAllKeys fetches all keys of the tenant, of every tenant when it is 0.
+func GetAllKeys(ctx context.Context, limit, offset, tenantID int) (GetAllKeysResponse, error) {
+	return cachedPage(ctx, "keys", offset, []any{limit, offset, tenantID}, func() (GetAllKeysResponse, error) {
+		return getAllKeys(ctx, limit, offset, tenantID)
+	})
+}
+
+func getAllKeys(ctx context.Context, limit, offset, tenantID int) (GetAllKeysResponse, error) {
 	// Get a database connection
 	dbConn := db.GetConnection()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
 	defer cancel()
 
 	// Query to get the total count of keys
 	var totalCount int
-	countQuery := `SELECT COUNT(*) FROM keys`
-	if err := dbConn.QueryRow(ctx, countQuery).Scan(&totalCount); err != nil {
-		return GetAllKeysResponse{}, fmt.Errorf("failed to get total count: %v", err)
+	countQuery := `SELECT COUNT(*) FROM keys WHERE ` + tenantScope("keys", 1)
+	if err := dbConn.QueryRow(ctx, countQuery, tenantID).Scan(&totalCount); err != nil {
+		return GetAllKeysResponse{}, fmt.Errorf("failed to get total count: %w", err)
 	}
 
 	// Calculate total pages
 	totalPages := (totalCount + limit - 1) / limit
 
 	// Query to get the paginated keys
-	query := `SELECT id, name, created_at, created_by, is_active 
+	query := `SELECT id, name, created_at, created_by, is_active, updated_at, version 
 			  FROM keys 
+			  WHERE ` + tenantScope("keys", 1) + ` 
 			  ORDER BY id 
-			  LIMIT $1 OFFSET $2`
-	rows, err := dbConn.Query(ctx, query, limit, offset)
+			  LIMIT $2 OFFSET $3`
+	rows, err := dbConn.Query(ctx, query, tenantID, limit, offset)
 	if err != nil {
 		return GetAllKeysResponse{}, err
 	}
@@ -52,7 +61,7 @@ func GetAllKeys(limit, offset int) (GetAllKeysResponse, error) {
 	var keys []Key
 	for rows.Next() {
 		var key Key
-		if err := rows.Scan(&key.ID, &key.Name, &key.CreatedAt, &key.CreatedBy, &key.IsActive); err != nil {
+		if err := rows.Scan(&key.ID, &key.Name, &key.CreatedAt, &key.CreatedBy, &key.IsActive, &key.UpdatedAt, &key.Version); err != nil {
 			return GetAllKeysResponse{}, err
 		}
 		keys = append(keys, key)
@@ -68,16 +77,60 @@ func GetAllKeys(limit, offset int) (GetAllKeysResponse, error) {
 	}, nil
 }
 
-// GetKeysByID fetches a key by their ID
-func GetKeysByID(id int) (Key, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Add context
+// StreamKeys calls fn for every key of the tenant, ordered by ID like GetAllKeys.
+// Rows are read from the database cursor one at a time.
+func StreamKeys(ctx context.Context, tenantID int, fn func(Key) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Export)
+	defer cancel()
+
+	query := `SELECT id, name, created_at, created_by, is_active, updated_at, version 
+			  FROM keys 
+			  WHERE ` + tenantScope("keys", 1) + ` 
+			  ORDER BY id`
+	rows, err := db.GetConnection().Query(ctx, query, tenantID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key Key
+		if err := rows.Scan(&key.ID, &key.Name, &key.CreatedAt, &key.CreatedBy, &key.IsActive, &key.UpdatedAt, &key.Version); err != nil {
+			return err
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetKeysByID fetches a key by their ID.
+func GetKeysByID(ctx context.Context, id int) (Key, error) {
+	return cached(ctx, "keys", itemKey("keys", id), cacheConfig.ItemTTL, func() (Key, error) {
+		return getKeyByID(ctx, id)
+	})
+}
+
+// GetKeysByIDUncached is GetKeysByID without the cache, for the If-Match checks
+func GetKeysByIDUncached(ctx context.Context, id int) (Key, error) {
+	return getKeyByID(ctx, id)
+}
+
+func getKeyByID(ctx context.Context, id int) (Key, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	return selectKey(ctx, db.GetConnection(), id)
+}
 
+// selectKey reads a key with q, which is either the pool or a batch transaction
+func selectKey(ctx context.Context, q querier, id int) (Key, error) {
 	var key Key
 
-	query := `SELECT id, name, created_at, created_by, is_active FROM keys WHERE id=$1`
-	err := dbConn.QueryRow(ctx, query, id).Scan(&key.ID, &key.Name, &key.CreatedAt, &key.CreatedBy, &key.IsActive)
+	query := `SELECT id, name, created_at, created_by, is_active, updated_at, version FROM keys WHERE id=$1`
+	err := q.QueryRow(ctx, query, id).Scan(&key.ID, &key.Name, &key.CreatedAt, &key.CreatedBy, &key.IsActive, &key.UpdatedAt, &key.Version)
 	if err != nil {
 		return Key{}, err
 	}
@@ -85,23 +138,35 @@ func GetKeysByID(id int) (Key, error) {
 	return key, nil
 }
 
-// CreateKey creates a new key
-func CreateKey(key Key) (Key, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
+// CreateKey creates a new key of the user createdBy, see ResolveCreatorID
+func CreateKey(ctx context.Context, key Key, createdBy int) (Key, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	created, err := createKey(ctx, db.GetConnection(), key, createdBy)
+	if err == nil {
+		invalidate(ctx, "keys")
+	}
+	return created, err
+}
 
+// createKey inserts a key with q, which is either the pool or a batch transaction
+func createKey(ctx context.Context, q querier, key Key, createdBy int) (Key, error) {
 	// Explicitly set the default value
 	key.IsActive = true
-	key.CreatedBy = 1
+	createdBy, err := ResolveCreatorID(createdBy)
+	if err != nil {
+		return Key{}, err
+	}
+	key.CreatedBy = createdBy
 
 	query := `INSERT INTO keys (name, created_at, is_active, created_by) 
-						VALUES ($1, $2, $3, $4) RETURNING id`
+						VALUES ($1, $2, $3, $4) RETURNING id, updated_at, version`
 
 	var id int
-	err := dbConn.QueryRow(ctx, query, key.Name, time.Now(), key.IsActive, key.CreatedBy).Scan(&id)
+	err = q.QueryRow(ctx, query, key.Name, time.Now(), key.IsActive, key.CreatedBy).Scan(&id, &key.UpdatedAt, &key.Version)
 	if err != nil {
-		return Key{}, fmt.Errorf("failed to create key: %v", err)
+		return Key{}, fmt.Errorf("failed to create key: %w", err)
 	}
 
 	key.ID = id
@@ -109,17 +174,29 @@ func CreateKey(key Key) (Key, error) {
 }
 
 // UpdateKey updates a key's information
-func UpdateKey(id int, key Key) (Key, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
+func UpdateKey(ctx context.Context, id int, key Key) (Key, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	updated, err := updateKey(ctx, db.GetConnection(), id, key)
+	if err == nil {
+		invalidate(ctx, "keys", id)
+	}
+	return updated, err
+}
+
+// updateKey updates a key with q, which is either the pool or a batch transaction
+func updateKey(ctx context.Context, q querier, id int, key Key) (Key, error) {
+	if key.Version == 0 {
+		return Key{}, ErrVersionRequired
+	}
 
 	// Explicitly set the default value
 	key.IsActive = true
 
-	query := `UPDATE keys SET name=$1, is_active=$2 WHERE id=$3`
-	_, err := dbConn.Exec(ctx, query, key.Name, key.IsActive, id)
-	if err != nil {
+	query := `UPDATE keys SET name=$1, is_active=$2, version=version+1 WHERE id=$3 AND version=$4 RETURNING updated_at, version`
+	err := q.QueryRow(ctx, query, key.Name, key.IsActive, id, key.Version).Scan(&key.UpdatedAt, &key.Version)
+	if err := checkVersion(ctx, q, err, id, selectKey); err != nil {
 		return Key{}, err
 	}
 
@@ -128,16 +205,27 @@ func UpdateKey(id int, key Key) (Key, error) {
 }
 
 // DeleteKey deletes a key
-func DeleteKey(id int) error {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
+func DeleteKey(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	err := deleteKey(ctx, db.GetConnection(), id)
+	if err == nil {
+		invalidate(ctx, "keys", id)
+	}
+	return err
+}
 
+// deleteKey deletes a key with q, which is either the pool or a batch transaction
+func deleteKey(ctx context.Context, q querier, id int) error {
 	query := `DELETE FROM keys WHERE id=$1`
-	_, err := dbConn.Exec(ctx, query, id)
+	tag, err := q.Exec(ctx, query, id)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
 
 	return nil
 }
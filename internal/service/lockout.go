@@ -0,0 +1,238 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"portier/pkg/db"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// LockoutConfig protects the credential checks against guessing. A user is
+// locked after Threshold failures in a row, for Duration doubled by every
+// further failure up to MaxDuration. An address is refused after IPThreshold
+// failures within IPWindow. A threshold of 0 disables its lock.
+type LockoutConfig struct {
+	Threshold   int
+	Duration    time.Duration
+	MaxDuration time.Duration
+	IPThreshold int
+	IPWindow    time.Duration
+	Retention   time.Duration // age of the oldest login attempts kept
+}
+
+// LoginClient is the client checking credentials, recorded with the attempt
+type LoginClient struct {
+	IP        string
+	UserAgent string
+}
+
+// Reasons of the failed login attempts
+const (
+	ReasonUnknownLogin       = "unknown_login"
+	ReasonInvalidPassword    = "invalid_password"
+	ReasonInvalidCode        = "invalid_code"
+	ReasonCodeRequired       = "code_required"
+	ReasonEnrollmentRequired = "enrollment_required"
+	ReasonInactive           = "inactive"
+	ReasonLocked             = "locked"
+	ReasonIPBlocked          = "ip_blocked"
+)
+
+// guessReasons are the failures counted by the locks, the refused attempts do not extend them
+var guessReasons = []string{ReasonUnknownLogin, ReasonInvalidPassword, ReasonInvalidCode}
+
+// LoginAttempt is a check of the credentials of a user
+type LoginAttempt struct {
+	ID        int64     `json:"id"`
+	UserID    *int      `json:"user_id"` // Null when the login matches no user
+	Login     string    `json:"login"`   // Username or email sent, the email of the user for a current_password
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason,omitempty" doc:"Why the attempt failed: unknown_login, invalid_password, invalid_code, code_required, enrollment_required, inactive, locked or ip_blocked"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginHistory is the lock of a user and a page of its login attempts, newest first
+type LoginHistory struct {
+	FailedLogins int            `json:"failed_logins"` // Failures in a row since the last success or unlock
+	LockedUntil  *time.Time     `json:"locked_until"`
+	Attempts     []LoginAttempt `json:"attempts"`
+	TotalPages   int            `json:"totalPages"`
+}
+
+var lockoutConfig LockoutConfig
+
+// SetLockout sets the locks of the users and addresses failing their credential checks
+func SetLockout(cfg LockoutConfig) {
+	lockoutConfig = cfg
+}
+
+// GetLoginHistory returns the lock of a user and a page of its login attempts
+func GetLoginHistory(ctx context.Context, userID, limit, offset int) (LoginHistory, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	dbConn := db.GetConnection()
+	history := LoginHistory{Attempts: []LoginAttempt{}}
+	query := `SELECT failed_logins, CASE WHEN locked_until > now() THEN locked_until END FROM users WHERE id=$1`
+	if err := dbConn.QueryRow(ctx, query, userID).Scan(&history.FailedLogins, &history.LockedUntil); err != nil {
+		return LoginHistory{}, err
+	}
+
+	var total int
+	if err := dbConn.QueryRow(ctx, `SELECT count(*) FROM login_attempts WHERE user_id=$1`, userID).Scan(&total); err != nil {
+		return LoginHistory{}, fmt.Errorf("failed to get total count: %w", err)
+	}
+	history.TotalPages = (total + limit - 1) / limit
+
+	query = `SELECT id, user_id, login, ip, user_agent, success, reason, created_at
+				FROM login_attempts WHERE user_id=$1 ORDER BY id DESC LIMIT $2 OFFSET $3`
+	rows, err := dbConn.Query(ctx, query, userID, limit, offset)
+	if err != nil {
+		return LoginHistory{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a LoginAttempt
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Login, &a.IP, &a.UserAgent, &a.Success, &a.Reason, &a.CreatedAt); err != nil {
+			return LoginHistory{}, err
+		}
+		history.Attempts = append(history.Attempts, a)
+	}
+	return history, rows.Err()
+}
+
+// UnlockUser clears the failures and the lock of a user
+func UnlockUser(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	tag, err := db.GetConnection().Exec(ctx, `UPDATE users SET failed_logins=0, locked_until=NULL WHERE id=$1`, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	invalidate(ctx, "users", userID)
+	slog.InfoContext(ctx, "User unlocked", "user_id", userID)
+	return nil
+}
+
+// checkPasswordAttempt refuses a locked address or user, then checks password.
+// found is false for an unknown login. A refusal returns the reason recorded
+// with the attempt, other errors none. A wrong password counts towards the lock.
+func checkPasswordAttempt(ctx context.Context, q querier, state totpState, found bool, password, ip string) (string, error) {
+	retry, err := ipLockout(ctx, q, ip)
+	if err != nil {
+		return "", err
+	}
+	if retry > 0 {
+		return ReasonIPBlocked, &LockedError{RetryAfter: retry, IP: true}
+	}
+	if !found {
+		// Spend the time of a comparison, the answer must not reveal which logins exist
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return ReasonUnknownLogin, ErrInvalidCredentials
+	}
+	if state.LockedFor > 0 {
+		return ReasonLocked, &LockedError{RetryAfter: time.Duration(state.LockedFor) * time.Second}
+	}
+	if bcrypt.CompareHashAndPassword([]byte(state.Password), []byte(password)) != nil {
+		if err := countFailure(ctx, q, state); err != nil {
+			return "", err
+		}
+		return ReasonInvalidPassword, ErrInvalidCredentials
+	}
+	return "", nil
+}
+
+// ipLockout returns how long ip is still refused, 0 when it is not
+func ipLockout(ctx context.Context, q querier, ip string) (time.Duration, error) {
+	if lockoutConfig.IPThreshold <= 0 || ip == "" {
+		return 0, nil
+	}
+	// Refused until the oldest of its last IPThreshold failures leaves the window
+	var count int
+	var seconds float64
+	query := `SELECT count(*), COALESCE(EXTRACT(EPOCH FROM min(created_at) + make_interval(secs => $3::float8) - now()), 0)::float8
+				FROM (SELECT created_at FROM login_attempts
+					WHERE ip=$1 AND reason = ANY($2) AND created_at > now() - make_interval(secs => $3::float8)
+					ORDER BY created_at DESC LIMIT $4) recent`
+	err := q.QueryRow(ctx, query, ip, guessReasons, lockoutConfig.IPWindow.Seconds(), lockoutConfig.IPThreshold).Scan(&count, &seconds)
+	if err != nil {
+		return 0, fmt.Errorf("failed to check address lockout: %w", err)
+	}
+	if count < lockoutConfig.IPThreshold {
+		return 0, nil
+	}
+	return max(time.Duration(math.Ceil(seconds))*time.Second, time.Second), nil
+}
+
+// countFailure adds a failure to the user of state and locks it for lockDuration
+func countFailure(ctx context.Context, q querier, state totpState) error {
+	failures := state.FailedLogins + 1
+	lock := lockDuration(failures)
+
+	query := `UPDATE users SET failed_logins=$2,
+				locked_until=CASE WHEN $3::float8 > 0 THEN now() + make_interval(secs => $3::float8) ELSE locked_until END
+				WHERE id=$1`
+	if _, err := q.Exec(ctx, query, state.ID, failures, lock.Seconds()); err != nil {
+		return fmt.Errorf("failed to count login failure: %w", err)
+	}
+	if lock > 0 {
+		slog.WarnContext(ctx, "User locked after failed logins", "user_id", state.ID, "failures", failures, "duration", lock)
+	}
+	return nil
+}
+
+// lockDuration is the lock after failures in a row: none below Threshold, then
+// Duration doubled by each further failure up to MaxDuration
+func lockDuration(failures int) time.Duration {
+	if lockoutConfig.Threshold <= 0 || failures < lockoutConfig.Threshold {
+		return 0
+	}
+	lock := lockoutConfig.Duration
+	for i := lockoutConfig.Threshold; i < failures && lock < lockoutConfig.MaxDuration; i++ {
+		lock *= 2
+	}
+	return min(lock, lockoutConfig.MaxDuration)
+}
+
+// clearFailures resets the failures of the user of state after a success
+func clearFailures(ctx context.Context, q querier, state totpState) error {
+	query := `UPDATE users SET failed_logins=0, locked_until=NULL WHERE id=$1 AND (failed_logins > 0 OR locked_until IS NOT NULL)`
+	_, err := q.Exec(ctx, query, state.ID)
+	return err
+}
+
+// recordAttempt adds a credential check to the login history, reason is empty
+// for a success. It deletes a few attempts older than Retention, so the table
+// stays bounded without a cleanup job.
+func recordAttempt(ctx context.Context, q querier, userID *int, login string, client LoginClient, reason string) error {
+	query := `INSERT INTO login_attempts (user_id, login, ip, user_agent, success, reason) VALUES ($1, $2, $3, $4, $5, $6)`
+	if _, err := q.Exec(ctx, query, userID, clip(login, 255), client.IP, clip(client.UserAgent, 255), reason == "", reason); err != nil {
+		return fmt.Errorf("failed to record login attempt: %w", err)
+	}
+	query = `DELETE FROM login_attempts WHERE id IN
+				(SELECT id FROM login_attempts WHERE created_at < now() - make_interval(secs => $1) ORDER BY id LIMIT 100)`
+	if _, err := q.Exec(ctx, query, lockoutConfig.Retention.Seconds()); err != nil {
+		return fmt.Errorf("failed to delete old login attempts: %w", err)
+	}
+	return nil
+}
+
+// clip shortens s to n characters
+func clip(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
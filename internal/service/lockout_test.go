@@ -0,0 +1,46 @@
+package service
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockDuration(t *testing.T) {
+	saved := lockoutConfig
+	t.Cleanup(func() { lockoutConfig = saved })
+
+	tests := []struct {
+		name     string
+		cfg      LockoutConfig
+		failures int
+		lock     time.Duration
+	}{
+		{"below the threshold", LockoutConfig{Threshold: 5, Duration: time.Minute, MaxDuration: time.Hour}, 4, 0},
+		{"at the threshold", LockoutConfig{Threshold: 5, Duration: time.Minute, MaxDuration: time.Hour}, 5, time.Minute},
+		{"doubled", LockoutConfig{Threshold: 5, Duration: time.Minute, MaxDuration: time.Hour}, 6, 2 * time.Minute},
+		{"doubled again", LockoutConfig{Threshold: 5, Duration: time.Minute, MaxDuration: time.Hour}, 8, 8 * time.Minute},
+		{"last doubling below the maximum", LockoutConfig{Threshold: 5, Duration: time.Minute, MaxDuration: time.Hour}, 10, 32 * time.Minute},
+		{"capped", LockoutConfig{Threshold: 5, Duration: time.Minute, MaxDuration: time.Hour}, 11, time.Hour},
+		{"capped without overflow", LockoutConfig{Threshold: 5, Duration: time.Minute, MaxDuration: time.Hour}, 1000, time.Hour},
+		{"duration above the maximum", LockoutConfig{Threshold: 1, Duration: 2 * time.Hour, MaxDuration: time.Hour}, 1, time.Hour},
+		{"threshold of one", LockoutConfig{Threshold: 1, Duration: time.Second, MaxDuration: time.Minute}, 3, 4 * time.Second},
+		{"disabled", LockoutConfig{Threshold: 0, Duration: time.Minute, MaxDuration: time.Hour}, 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lockoutConfig = tt.cfg
+			if lock := lockDuration(tt.failures); lock != tt.lock {
+				t.Errorf("lockDuration(%d) = %s, want %s", tt.failures, lock, tt.lock)
+			}
+		})
+	}
+}
+
+func TestClip(t *testing.T) {
+	if got := clip("héllo", 2); got != "hé" {
+		t.Errorf("clip = %q, want the first 2 characters", got)
+	}
+	if got := clip("short", 255); got != "short" {
+		t.Errorf("clip = %q, want the string unchanged", got)
+	}
+}
@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"portier/pkg/db"
+	"strings"
+)
+
+// PendingMigrations returns the migration files of dir that are not recorded
+// in the schema_migrations table, which make migrate-up fills
+func PendingMigrations(ctx context.Context, dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no migration found in %s", dir)
+	}
+
+	rows, err := db.GetConnection().Query(ctx, `SELECT version FROM schema_migrations`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema_migrations, run make migrate-up: %w", err)
+	}
+	defer rows.Close()
+
+	applied := map[string]bool{}
+	for rows.Next() {
+		var version string
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var pending []string
+	for _, file := range files {
+		if name := filepath.Base(file); !applied[name] {
+			pending = append(pending, name)
+		}
+	}
+	return pending, nil
+}
+
+// CheckMigrations returns an error listing the pending migrations of dir
+func CheckMigrations(ctx context.Context, dir string) error {
+	pending, err := PendingMigrations(ctx, dir)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("pending migrations: %s", strings.Join(pending, ", "))
+	}
+	return nil
+}
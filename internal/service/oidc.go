@@ -0,0 +1,383 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"portier/pkg/db"
+	"portier/pkg/oidc"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// OIDCConfig sets the single sign-on through the identity providers of the tenants
+type OIDCConfig struct {
+	RedirectURL string        // callback registered at every provider, <API URL>/oidc/callback
+	StateTTL    time.Duration // time a user has to log in at the provider
+	SessionTTL  time.Duration // expiry of the API token returned by a login
+}
+
+// TenantOIDC is the identity provider of a tenant
+type TenantOIDC struct {
+	TenantID        int               `json:"tenant_id"`
+	Issuer          string            `json:"issuer"` // https URL, discovered at /.well-known/openid-configuration
+	ClientID        string            `json:"client_id"`
+	ClientSecret    string            `json:"client_secret,omitempty"` // Write only, an update without it keeps the stored one
+	HasClientSecret bool              `json:"has_client_secret"`       // Read only
+	Scopes          []string          `json:"scopes"`                  // Requested with openid, defaults to email and profile
+	GroupsClaim     string            `json:"groups_claim"`            // Claim listing the groups of the user, defaults to groups
+	RoleMapping     map[string]string `json:"role_mapping"`            // Group to role, the highest role of the groups of the user wins
+	DefaultRole     string            `json:"default_role"`            // Role of the users in no mapped group, defaults to user
+	JITProvisioning bool              `json:"jit_provisioning"`        // Create the users logging in for the first time
+	IsActive        bool              `json:"is_active"`
+	UpdatedAt       time.Time         `json:"updated_at"`
+}
+
+// OIDCLogin is the result of a single sign-on, the token authenticates the following requests
+type OIDCLogin struct {
+	User  User     `json:"user"`
+	Token APIToken `json:"token"`
+}
+
+// pendingLogin is kept in oidc_logins under its state until the provider redirects back
+type pendingLogin struct {
+	TenantID int
+	Nonce    string
+	Verifier string
+}
+
+// roleRank orders the roles mapped from the groups
+var roleRank = map[string]int{RoleUser: 0, RoleManager: 1, RoleAdmin: 2}
+
+// multiFactorMethods are the amr values (RFC 8176) of a login with a second factor at the provider
+var multiFactorMethods = []string{"mfa", "otp", "hwk", "sc"}
+
+var oidcConfig OIDCConfig
+
+// SetOIDC sets the redirect URI and the lifetimes of the single sign-on
+func SetOIDC(cfg OIDCConfig) {
+	oidcConfig = cfg
+}
+
+// GetTenantOIDC returns the identity provider of a tenant, pgx.ErrNoRows when it has none
+func GetTenantOIDC(ctx context.Context, tenantID int) (TenantOIDC, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	cfg, _, err := selectTenantOIDC(ctx, tenantID)
+	return cfg, err
+}
+
+// SaveTenantOIDC creates or replaces the identity provider of a tenant
+func SaveTenantOIDC(ctx context.Context, tenantID int, cfg TenantOIDC) (TenantOIDC, error) {
+	issuer, err := url.Parse(cfg.Issuer)
+	if err != nil || issuer.Host == "" || (issuer.Scheme != "https" && !(issuer.Scheme == "http" && issuer.Hostname() == "localhost")) {
+		return TenantOIDC{}, ErrOIDCIssuerInvalid
+	}
+	if cfg.ClientID == "" {
+		return TenantOIDC{}, ErrOIDCClientIDRequired
+	}
+	if cfg.DefaultRole == "" {
+		cfg.DefaultRole = RoleUser
+	}
+	if !ValidRole(cfg.DefaultRole) {
+		return TenantOIDC{}, ErrInvalidRole
+	}
+	for _, role := range cfg.RoleMapping {
+		if !ValidRole(role) {
+			return TenantOIDC{}, ErrInvalidRole
+		}
+	}
+	if cfg.RoleMapping == nil {
+		cfg.RoleMapping = map[string]string{}
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"email", "profile"}
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+
+	// The secret is read back to call the token endpoint, it is encrypted like the TOTP secrets
+	var sealed *string
+	if cfg.ClientSecret != "" {
+		s, err := sealSecret(cfg.ClientSecret)
+		if err != nil {
+			return TenantOIDC{}, err
+		}
+		sealed = &s
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	// No row when the tenant does not exist
+	query := `INSERT INTO tenant_oidc (tenant_id, issuer, client_id, client_secret, scopes, groups_claim, role_mapping, default_role, jit_provisioning, is_active)
+				SELECT id, $2, $3, $4, $5::text[], $6, $7::jsonb, $8, $9, $10 FROM tenants WHERE id=$1
+				ON CONFLICT (tenant_id) DO UPDATE SET issuer=EXCLUDED.issuer, client_id=EXCLUDED.client_id,
+					client_secret=COALESCE(EXCLUDED.client_secret, tenant_oidc.client_secret), scopes=EXCLUDED.scopes,
+					groups_claim=EXCLUDED.groups_claim, role_mapping=EXCLUDED.role_mapping, default_role=EXCLUDED.default_role,
+					jit_provisioning=EXCLUDED.jit_provisioning, is_active=EXCLUDED.is_active
+				RETURNING updated_at, client_secret IS NOT NULL`
+	err = db.GetConnection().QueryRow(ctx, query, tenantID, cfg.Issuer, cfg.ClientID, sealed, cfg.Scopes, cfg.GroupsClaim,
+		cfg.RoleMapping, cfg.DefaultRole, cfg.JITProvisioning, cfg.IsActive).Scan(&cfg.UpdatedAt, &cfg.HasClientSecret)
+	if err != nil {
+		return TenantOIDC{}, err
+	}
+
+	cfg.TenantID = tenantID
+	cfg.ClientSecret = ""
+	return cfg, nil
+}
+
+// DeleteTenantOIDC removes the identity provider of a tenant, its users keep their accounts
+func DeleteTenantOIDC(ctx context.Context, tenantID int) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	tag, err := db.GetConnection().Exec(ctx, `DELETE FROM tenant_oidc WHERE tenant_id=$1`, tenantID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// BeginOIDCLogin returns the URL of the provider of the tenant the browser is
+// redirected to, and the state of the login. The state, nonce and PKCE verifier
+// wait for the callback, the caller binds the state to the browser.
+func BeginOIDCLogin(ctx context.Context, tenantID int) (location, state string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	cfg, secret, err := activeTenantOIDC(ctx, tenantID)
+	if err != nil {
+		return "", "", err
+	}
+	provider, err := oidc.Discover(ctx, cfg.Issuer)
+	if err != nil {
+		return "", "", fmt.Errorf("%w: %v", ErrOIDCProviderUnavailable, err)
+	}
+
+	login := pendingLogin{TenantID: tenantID}
+	if state, err = oidc.NewVerifier(); err != nil {
+		return "", "", err
+	}
+	if login.Nonce, err = oidc.NewVerifier(); err != nil {
+		return "", "", err
+	}
+	if login.Verifier, err = oidc.NewVerifier(); err != nil {
+		return "", "", err
+	}
+	// The logins never completed are deleted as new ones start
+	query := `WITH expired AS (DELETE FROM oidc_logins WHERE expires_at <= now())
+				INSERT INTO oidc_logins (state_hash, tenant_id, nonce, verifier, expires_at) VALUES ($1, $2, $3, $4, $5)`
+	if _, err := db.GetConnection().Exec(ctx, query, tokenHash(state), tenantID, login.Nonce, login.Verifier, time.Now().Add(oidcConfig.StateTTL)); err != nil {
+		return "", "", fmt.Errorf("failed to store login state: %w", err)
+	}
+
+	return provider.AuthCodeURL(oidcClient(cfg, secret), state, login.Nonce, login.Verifier), state, nil
+}
+
+// CompleteOIDCLogin exchanges the code of the callback, verifies the ID token,
+// provisions its user and returns it with an API token valid for the session
+func CompleteOIDCLogin(ctx context.Context, state, code string) (OIDCLogin, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	// A state is used once, of two concurrent callbacks only one deletes it
+	var login pendingLogin
+	var valid bool
+	query := `DELETE FROM oidc_logins WHERE state_hash=$1 RETURNING tenant_id, nonce, verifier, expires_at > now()`
+	err := db.GetConnection().QueryRow(ctx, query, tokenHash(state)).Scan(&login.TenantID, &login.Nonce, &login.Verifier, &valid)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && (!valid || state == "")) {
+		return OIDCLogin{}, ErrOIDCLoginInvalid
+	}
+	if err != nil {
+		return OIDCLogin{}, fmt.Errorf("failed to read login state: %w", err)
+	}
+
+	cfg, secret, err := activeTenantOIDC(ctx, login.TenantID)
+	if err != nil {
+		return OIDCLogin{}, err
+	}
+	provider, err := oidc.Discover(ctx, cfg.Issuer)
+	if err != nil {
+		return OIDCLogin{}, fmt.Errorf("%w: %v", ErrOIDCProviderUnavailable, err)
+	}
+	tokens, err := provider.Exchange(ctx, oidcClient(cfg, secret), code, login.Verifier)
+	if err != nil {
+		return OIDCLogin{}, fmt.Errorf("%w: %v", ErrOIDCLoginFailed, err)
+	}
+	claims, err := provider.Verify(ctx, tokens.IDToken, cfg.ClientID, login.Nonce)
+	if err != nil {
+		return OIDCLogin{}, fmt.Errorf("%w: %v", ErrOIDCLoginFailed, err)
+	}
+
+	user, err := provisionOIDCUser(ctx, cfg, claims, mapRole(cfg, claims.Strings(cfg.GroupsClaim)))
+	if err != nil {
+		return OIDCLogin{}, err
+	}
+	invalidate(ctx, "users", user.ID)
+
+	expiresAt := time.Now().Add(oidcConfig.SessionTTL)
+	token, err := CreateAPIToken(ctx, user.ID, APIToken{
+		Name:      "single sign-on",
+		Scopes:    []string{ScopeRead, ScopeWrite},
+		ExpiresAt: &expiresAt,
+	})
+	if err != nil {
+		return OIDCLogin{}, err
+	}
+
+	slog.InfoContext(ctx, "Single sign-on", "user_id", user.ID, "tenant_id", login.TenantID, "role", user.Role)
+	return OIDCLogin{User: user, Token: token}, nil
+}
+
+// provisionOIDCUser returns the user of the identity: the one already linked to
+// it, else the user of the tenant with its verified email, which gets linked,
+// else a new user when the tenant allows it. The role follows the groups on every login.
+func provisionOIDCUser(ctx context.Context, cfg TenantOIDC, claims oidc.Claims, role string) (User, error) {
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback(ctx) // no-op once committed
+
+	var id, tenantID int
+	var isActive bool
+	var subject *string
+	query := `SELECT id, tenant_id, is_active FROM users WHERE oidc_issuer=$1 AND oidc_subject=$2 FOR UPDATE`
+	err = tx.QueryRow(ctx, query, claims.Issuer, claims.Subject).Scan(&id, &tenantID, &isActive)
+	switch {
+	case err == nil:
+		if tenantID != cfg.TenantID {
+			return User{}, ErrOIDCIdentityTaken
+		}
+		query = `UPDATE users SET role=$1, version=version+1 WHERE id=$2 AND role<>$1`
+		if _, err := tx.Exec(ctx, query, role, id); err != nil {
+			return User{}, err
+		}
+
+	case errors.Is(err, pgx.ErrNoRows):
+		if claims.Email == "" {
+			return User{}, fmt.Errorf("%w: the ID token has no email claim", ErrOIDCLoginFailed)
+		}
+		query = `SELECT id, tenant_id, is_active, oidc_subject FROM users WHERE email=$1 FOR UPDATE`
+		err = tx.QueryRow(ctx, query, claims.Email).Scan(&id, &tenantID, &isActive, &subject)
+		switch {
+		case err == nil:
+			// Only a verified address links an existing user, anyone may claim an unverified one
+			if tenantID != cfg.TenantID || subject != nil || !claims.EmailVerified {
+				return User{}, ErrOIDCIdentityTaken
+			}
+			query = `UPDATE users SET oidc_issuer=$1, oidc_subject=$2, role=$3, email_verified_at=COALESCE(email_verified_at, now()), version=version+1 WHERE id=$4`
+			if _, err := tx.Exec(ctx, query, claims.Issuer, claims.Subject, role, id); err != nil {
+				return User{}, err
+			}
+
+		case errors.Is(err, pgx.ErrNoRows):
+			if !cfg.JITProvisioning {
+				return User{}, ErrOIDCProvisioningDisabled
+			}
+			username := claims.PreferredUsername
+			if username == "" {
+				username = claims.Email
+			}
+			name := claims.Name
+			if name == "" {
+				name = username
+			}
+			var verifiedAt *time.Time
+			if claims.EmailVerified {
+				now := time.Now()
+				verifiedAt = &now
+			}
+			isActive = true
+			// SSO users have no password, like the service accounts
+			query = `INSERT INTO users (username, email, password, name, gender, id_number, user_image, tenant_id, created_at, is_active, role, email_verified_at, oidc_issuer, oidc_subject)
+						VALUES ($1, $2, $3, $4, FALSE, '', '', $5, $6, TRUE, $7, $8, $9, $10) RETURNING id`
+			err = tx.QueryRow(ctx, query, username, claims.Email, noPassword, name, cfg.TenantID, time.Now(), role, verifiedAt, claims.Issuer, claims.Subject).Scan(&id)
+			if err != nil {
+				return User{}, fmt.Errorf("failed to provision user: %w", err)
+			}
+			slog.InfoContext(ctx, "User provisioned by single sign-on", "user_id", id, "tenant_id", cfg.TenantID)
+
+		default:
+			return User{}, err
+		}
+
+	default:
+		return User{}, err
+	}
+
+	if !isActive {
+		return User{}, ErrOIDCUserInactive
+	}
+	// The provider checks the second factor the user has, or the policy requires, in place of a TOTP code
+	state, err := selectTOTPState(ctx, tx, `u.id=$1`, id)
+	if err != nil {
+		return User{}, err
+	}
+	if (state.Secret != nil || state.required()) && !multiFactorLogin(claims) {
+		return User{}, ErrOIDCSecondFactorRequired
+	}
+	user, err := selectUser(ctx, tx, id)
+	if err != nil {
+		return User{}, err
+	}
+	return user, tx.Commit(ctx)
+}
+
+// mapRole returns the highest role mapped from groups, or the default role
+func mapRole(cfg TenantOIDC, groups []string) string {
+	role, matched := cfg.DefaultRole, false
+	for _, group := range groups {
+		mapped, ok := cfg.RoleMapping[group]
+		if ok && (!matched || roleRank[mapped] > roleRank[role]) {
+			role, matched = mapped, true
+		}
+	}
+	return role
+}
+
+// multiFactorLogin reports whether the amr claim of the ID token lists a second factor
+func multiFactorLogin(claims oidc.Claims) bool {
+	return slices.ContainsFunc(claims.Strings("amr"), func(method string) bool {
+		return slices.Contains(multiFactorMethods, method)
+	})
+}
+
+func selectTenantOIDC(ctx context.Context, tenantID int) (TenantOIDC, *string, error) {
+	cfg := TenantOIDC{TenantID: tenantID}
+	var secret *string
+	query := `SELECT issuer, client_id, client_secret, scopes, groups_claim, role_mapping, default_role, jit_provisioning, is_active, updated_at
+				FROM tenant_oidc WHERE tenant_id=$1`
+	err := db.GetConnection().QueryRow(ctx, query, tenantID).Scan(&cfg.Issuer, &cfg.ClientID, &secret, &cfg.Scopes, &cfg.GroupsClaim,
+		&cfg.RoleMapping, &cfg.DefaultRole, &cfg.JITProvisioning, &cfg.IsActive, &cfg.UpdatedAt)
+	cfg.HasClientSecret = secret != nil
+	return cfg, secret, err
+}
+
+// activeTenantOIDC returns the provider of a tenant with its decrypted client secret
+func activeTenantOIDC(ctx context.Context, tenantID int) (TenantOIDC, string, error) {
+	cfg, sealed, err := selectTenantOIDC(ctx, tenantID)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !cfg.IsActive) {
+		return TenantOIDC{}, "", ErrOIDCNotConfigured
+	}
+	if err != nil || sealed == nil {
+		return cfg, "", err
+	}
+	secret, err := openSecret(*sealed)
+	return cfg, secret, err
+}
+
+func oidcClient(cfg TenantOIDC, secret string) oidc.Client {
+	return oidc.Client{ID: cfg.ClientID, Secret: secret, RedirectURL: oidcConfig.RedirectURL, Scopes: cfg.Scopes}
+}
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"portier/pkg/oidc"
+	"testing"
+)
+
+func TestMapRole(t *testing.T) {
+	cfg := TenantOIDC{
+		GroupsClaim: "groups",
+		RoleMapping: map[string]string{"portier-admins": RoleAdmin, "facility": RoleManager, "staff": RoleUser},
+		DefaultRole: RoleManager,
+	}
+
+	tests := []struct {
+		name   string
+		groups interface{} // the groups claim of the ID token, nil when missing
+		role   string
+	}{
+		{"no groups claim", nil, RoleManager},
+		{"unmapped groups", []interface{}{"sales", "it"}, RoleManager},
+		{"one mapped group", []interface{}{"sales", "facility"}, RoleManager},
+		{"mapped below the default role", []interface{}{"staff"}, RoleUser},
+		{"highest role wins", []interface{}{"staff", "portier-admins", "facility"}, RoleAdmin},
+		{"single string claim", "portier-admins", RoleAdmin},
+		{"group names are case sensitive", []interface{}{"Portier-Admins"}, RoleManager},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := oidc.Claims{Raw: map[string]interface{}{}}
+			if tt.groups != nil {
+				claims.Raw["groups"] = tt.groups
+			}
+			if role := mapRole(cfg, claims.Strings(cfg.GroupsClaim)); role != tt.role {
+				t.Errorf("mapRole = %s, want %s", role, tt.role)
+			}
+		})
+	}
+}
+
+func TestMultiFactorLogin(t *testing.T) {
+	tests := []struct {
+		name string
+		amr  interface{} // the amr claim of the ID token, nil when missing
+		want bool
+	}{
+		{"no amr claim", nil, false},
+		{"password only", []interface{}{"pwd"}, false},
+		{"password and code", []interface{}{"pwd", "otp"}, true},
+		{"multiple factors", []interface{}{"mfa"}, true},
+		{"hardware key", []interface{}{"hwk", "user"}, true},
+		{"single string claim", "mfa", true},
+		{"methods are case sensitive", []interface{}{"MFA"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := oidc.Claims{Raw: map[string]interface{}{}}
+			if tt.amr != nil {
+				claims.Raw["amr"] = tt.amr
+			}
+			if got := multiFactorLogin(claims); got != tt.want {
+				t.Errorf("multiFactorLogin = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,18 @@
+package service
+
+import "slices"
+
+// Roles of the users, stored in users.role
+const (
+	RoleAdmin   = "admin"
+	RoleManager = "manager" // manages keys and copies
+	RoleUser    = "user"
+)
+
+// Roles lists every valid role
+var Roles = []string{RoleAdmin, RoleManager, RoleUser}
+
+// ValidRole reports whether role is one of Roles
+func ValidRole(role string) bool {
+	return slices.Contains(Roles, role)
+}
@@ -0,0 +1,938 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"portier/pkg/db"
+	"portier/pkg/scim"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// SCIMMaxResults is the largest page of a SCIM query
+const SCIMMaxResults = 200
+
+// SCIMUser is a user of a tenant as a SCIM resource (RFC 7643 4.1). Service
+// accounts are not provisioned and never listed.
+type SCIMUser struct {
+	Schemas     []string    `json:"schemas"`
+	ID          string      `json:"id"`
+	ExternalID  string      `json:"externalId,omitempty"` // Id of the user in the provisioning client, unique in the tenant
+	UserName    string      `json:"userName"`
+	Name        SCIMName    `json:"name"`
+	DisplayName string      `json:"displayName,omitempty"`
+	Emails      []SCIMEmail `json:"emails"` // The primary one, or the first, is the email of the user
+	Active      *bool       `json:"active"` // A create without it makes an active user
+	Groups      []SCIMRef   `json:"groups,omitempty" doc:"Read only, the group of the role of the user"`
+	Meta        *scim.Meta  `json:"meta,omitempty"`
+}
+
+// SCIMName is stored as the name of the user, split at its first space
+type SCIMName struct {
+	Formatted  string `json:"formatted,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+}
+
+type SCIMEmail struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+}
+
+// SCIMGroup is a role as a SCIM group (RFC 7643 4.2), its id and displayName
+// are the role. Groups cannot be created, renamed or deleted.
+type SCIMGroup struct {
+	Schemas     []string   `json:"schemas"`
+	ID          string     `json:"id"`
+	DisplayName string     `json:"displayName"`
+	Members     []SCIMRef  `json:"members,omitempty"`
+	Meta        *scim.Meta `json:"meta,omitempty"`
+}
+
+// SCIMRef references a user from a group, or a group from a user
+type SCIMRef struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// scimColumn is the SQL expression of a filterable attribute, kind is text, bool or time
+type scimColumn struct {
+	expr string
+	kind string
+}
+
+// scimUserColumns maps the attributes a filter of the users may use
+var scimUserColumns = map[string]scimColumn{
+	"id":                {"id::text", "text"},
+	"externalid":        {"scim_external_id", "text"},
+	"username":          {"username", "text"},
+	"displayname":       {"name", "text"},
+	"name.formatted":    {"name", "text"},
+	"name.givenname":    {"split_part(name, ' ', 1)", "text"},
+	"emails":            {"email", "text"},
+	"emails.value":      {"email", "text"},
+	"emails.type":       {"'work'", "text"},
+	"emails.primary":    {"TRUE", "bool"},
+	"active":            {"is_active", "bool"},
+	"groups":            {"role", "text"},
+	"groups.value":      {"role", "text"},
+	"groups.display":    {"role", "text"},
+	"meta.created":      {"created_at", "time"},
+	"meta.lastmodified": {"updated_at", "time"},
+}
+
+const scimUserQuery = `SELECT id, username, email, name, gender, id_number, user_image, tenant_id, created_at, is_active, updated_at, version, email_verified_at, role, totp_enabled_at IS NOT NULL, service_account, scim_external_id
+						FROM users WHERE tenant_id=$1 AND NOT service_account`
+
+/*** USERS ***/
+
+// ListSCIMUsers returns the users of a tenant matching filter, startIndex is 1-based
+func ListSCIMUsers(ctx context.Context, tenantID int, filter string, startIndex, count int) (scim.ListResponse[SCIMUser], error) {
+	startIndex, count = scimPage(startIndex, count)
+	args := []interface{}{tenantID}
+	where := "TRUE"
+	if filter != "" {
+		e, err := scim.ParseFilter(filter)
+		if err != nil {
+			return scim.ListResponse[SCIMUser]{}, err
+		}
+		if where, err = scimWhere(e, scimUserColumns, "", &args); err != nil {
+			return scim.ListResponse[SCIMUser]{}, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM users WHERE tenant_id=$1 AND NOT service_account AND (` + where + `)`
+	if err := db.GetConnection().QueryRow(ctx, countQuery, args...).Scan(&total); err != nil {
+		return scim.ListResponse[SCIMUser]{}, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	query := scimUserQuery + ` AND (` + where + `) ORDER BY id LIMIT $` + strconv.Itoa(len(args)+1) + ` OFFSET $` + strconv.Itoa(len(args)+2)
+	rows, err := db.GetConnection().Query(ctx, query, append(args, count, startIndex-1)...)
+	if err != nil {
+		return scim.ListResponse[SCIMUser]{}, err
+	}
+	defer rows.Close()
+
+	var users []SCIMUser
+	for rows.Next() {
+		user, externalID, err := scanSCIMUser(rows)
+		if err != nil {
+			return scim.ListResponse[SCIMUser]{}, err
+		}
+		users = append(users, toSCIMUser(user, externalID))
+	}
+	if err := rows.Err(); err != nil {
+		return scim.ListResponse[SCIMUser]{}, err
+	}
+	return scim.NewListResponse(users, startIndex, total), nil
+}
+
+// GetSCIMUser returns a user of the tenant, pgx.ErrNoRows when it has none with this id
+func GetSCIMUser(ctx context.Context, tenantID int, id string) (SCIMUser, error) {
+	userID, err := scimUserID(id)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	user, externalID, err := selectSCIMUser(ctx, db.GetConnection(), tenantID, userID, false)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	return toSCIMUser(user, externalID), nil
+}
+
+// CreateSCIMUser creates a user in the tenant with the role user. It has no
+// password, it logs in with the single sign-on of the tenant.
+func CreateSCIMUser(ctx context.Context, tenantID int, s SCIMUser) (SCIMUser, error) {
+	user := User{TenantID: tenantID, Role: RoleUser}
+	if err := s.apply(&user); err != nil {
+		return SCIMUser{}, err
+	}
+	active := s.Active == nil || *s.Active
+
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	defer tx.Rollback(ctx) // no-op once committed
+
+	if err := checkSCIMUnique(ctx, tx, tenantID, 0, user.Username, user.Email, s.ExternalID); err != nil {
+		return SCIMUser{}, err
+	}
+	created, err := createUser(ctx, tx, user)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	query := `UPDATE users SET scim_external_id=NULLIF($2, ''), is_active=$3 WHERE id=$1`
+	if _, err := tx.Exec(ctx, query, created.ID, s.ExternalID, active); err != nil {
+		return SCIMUser{}, err
+	}
+	user, externalID, err := selectSCIMUser(ctx, tx, tenantID, created.ID, false)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return SCIMUser{}, err
+	}
+
+	invalidate(ctx, "users")
+	sendVerifications(ctx, created.ID)
+	return toSCIMUser(user, externalID), nil
+}
+
+// ReplaceSCIMUser replaces the attributes of a user. Without active or emails
+// the current ones are kept. version is the one of If-Match, 0 without.
+func ReplaceSCIMUser(ctx context.Context, tenantID int, id string, version int, s SCIMUser) (SCIMUser, error) {
+	return updateSCIMUser(ctx, tenantID, id, version, func(u *SCIMUser) error {
+		if s.Active == nil {
+			s.Active = u.Active
+		}
+		if len(s.Emails) == 0 {
+			s.Emails = u.Emails
+		}
+		*u = s
+		return nil
+	})
+}
+
+// PatchSCIMUser applies the operations of a PATCH to a user, version is the one of If-Match, 0 without.
+// Attributes Portier does not store are ignored.
+func PatchSCIMUser(ctx context.Context, tenantID int, id string, version int, ops []scim.PatchOperation) (SCIMUser, error) {
+	return updateSCIMUser(ctx, tenantID, id, version, func(u *SCIMUser) error {
+		return applyPatch(ops, func(op string, path scim.Path, value json.RawMessage) error {
+			return u.set(op, path, value)
+		})
+	})
+}
+
+// DeactivateSCIMUser answers the DELETE of a user: it is deactivated, not deleted,
+// so its rows and history are kept. Its API tokens stop working.
+func DeactivateSCIMUser(ctx context.Context, tenantID int, id string, version int) error {
+	_, err := updateSCIMUser(ctx, tenantID, id, version, func(u *SCIMUser) error {
+		inactive := false
+		u.Active = &inactive
+		return nil
+	})
+	return err
+}
+
+// updateSCIMUser locks a user of the tenant, lets change modify its resource and saves it
+func updateSCIMUser(ctx context.Context, tenantID int, id string, version int, change func(*SCIMUser) error) (SCIMUser, error) {
+	userID, err := scimUserID(id)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	defer tx.Rollback(ctx) // no-op once committed
+
+	user, externalID, err := selectSCIMUser(ctx, tx, tenantID, userID, true)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	if version != 0 && version != user.Version {
+		return SCIMUser{}, &ConflictError{Current: toSCIMUser(user, externalID)}
+	}
+
+	s := toSCIMUser(user, externalID)
+	if err := change(&s); err != nil {
+		return SCIMUser{}, err
+	}
+	before := user
+	if err := s.apply(&user); err != nil {
+		return SCIMUser{}, err
+	}
+
+	// Only the changed values are checked, older users may share a username
+	var username, email, external string
+	if !strings.EqualFold(user.Username, before.Username) {
+		username = user.Username
+	}
+	if !strings.EqualFold(user.Email, before.Email) {
+		email = user.Email
+	}
+	if externalID == nil || s.ExternalID != *externalID {
+		external = s.ExternalID
+	}
+	if err := checkSCIMUnique(ctx, tx, tenantID, userID, username, email, external); err != nil {
+		return SCIMUser{}, err
+	}
+
+	if _, err := updateUser(ctx, tx, userID, user); err != nil {
+		return SCIMUser{}, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE users SET scim_external_id=NULLIF($2, '') WHERE id=$1`, userID, s.ExternalID); err != nil {
+		return SCIMUser{}, err
+	}
+	user, externalID, err = selectSCIMUser(ctx, tx, tenantID, userID, false)
+	if err != nil {
+		return SCIMUser{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return SCIMUser{}, err
+	}
+
+	invalidate(ctx, "users", userID)
+	// A changed address lost its verification
+	sendVerifications(ctx, userID)
+	return toSCIMUser(user, externalID), nil
+}
+
+// checkSCIMUnique answers 409 when a non-empty username or external id is taken
+// in the tenant, or the email by any user
+func checkSCIMUnique(ctx context.Context, q querier, tenantID, id int, username, email, externalID string) error {
+	var usernameTaken, emailTaken, externalIDTaken bool
+	query := `SELECT
+				$3 <> '' AND EXISTS(SELECT 1 FROM users WHERE tenant_id=$1 AND LOWER(username)=LOWER($3) AND id<>$2),
+				$4 <> '' AND EXISTS(SELECT 1 FROM users WHERE LOWER(email)=LOWER($4) AND id<>$2),
+				$5 <> '' AND EXISTS(SELECT 1 FROM users WHERE tenant_id=$1 AND scim_external_id=$5 AND id<>$2)`
+	if err := q.QueryRow(ctx, query, tenantID, id, username, email, externalID).Scan(&usernameTaken, &emailTaken, &externalIDTaken); err != nil {
+		return err
+	}
+	switch {
+	case usernameTaken:
+		return scim.NewError(http.StatusConflict, scim.TypeUniqueness, "userName is taken by another user of the tenant")
+	case emailTaken:
+		return scim.NewError(http.StatusConflict, scim.TypeUniqueness, "the email is taken by another user")
+	case externalIDTaken:
+		return scim.NewError(http.StatusConflict, scim.TypeUniqueness, "externalId is taken by another user of the tenant")
+	}
+	return nil
+}
+
+func selectSCIMUser(ctx context.Context, q querier, tenantID, id int, lock bool) (User, *string, error) {
+	query := scimUserQuery + ` AND id=$2`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	return scanSCIMUser(q.QueryRow(ctx, query, tenantID, id))
+}
+
+func scanSCIMUser(row pgx.Row) (User, *string, error) {
+	var user User
+	var externalID *string
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Name, &user.Gender, &user.IDNumber, &user.UserImage, &user.TenantID, &user.CreatedAt, &user.IsActive, &user.UpdatedAt, &user.Version, &user.EmailVerifiedAt, &user.Role, &user.TOTPEnabled, &user.ServiceAccount, &externalID)
+	if err != nil {
+		return User{}, nil, err
+	}
+	user.GenderStr = user.ConvertGenderToStr()
+	return user, externalID, nil
+}
+
+// scimUserID parses the id of a user resource, an id that is not a number matches no user
+func scimUserID(id string) (int, error) {
+	userID, err := strconv.Atoi(id)
+	if err != nil {
+		return 0, pgx.ErrNoRows
+	}
+	return userID, nil
+}
+
+func toSCIMUser(u User, externalID *string) SCIMUser {
+	s := SCIMUser{
+		Schemas:  []string{scim.SchemaUser},
+		ID:       strconv.Itoa(u.ID),
+		UserName: u.Username,
+		Emails:   []SCIMEmail{{Value: u.Email, Type: "work", Primary: true}},
+		Active:   &u.IsActive,
+		Groups:   []SCIMRef{{Value: u.Role, Display: u.Role}},
+		Meta: &scim.Meta{
+			ResourceType: "User",
+			Created:      &u.CreatedAt,
+			LastModified: &u.UpdatedAt,
+			Version:      `W/"` + strconv.Itoa(u.Version) + `"`,
+		},
+	}
+	if externalID != nil {
+		s.ExternalID = *externalID
+	}
+	s.setName(u.Name)
+	return s
+}
+
+// setName sets the name and the display name, the given name is the first word
+func (s *SCIMUser) setName(name string) {
+	given, family, _ := strings.Cut(strings.TrimSpace(name), " ")
+	s.Name = SCIMName{Formatted: name, GivenName: given, FamilyName: strings.TrimSpace(family)}
+	s.DisplayName = name
+}
+
+// apply copies the attributes of the resource stored by Portier onto u
+func (s SCIMUser) apply(u *User) error {
+	if strings.TrimSpace(s.UserName) == "" {
+		return scim.BadRequest(scim.TypeInvalidValue, "userName is required")
+	}
+	u.Username = strings.TrimSpace(s.UserName)
+
+	u.Email = ""
+	for _, email := range s.Emails {
+		if u.Email == "" || email.Primary {
+			u.Email = strings.TrimSpace(email.Value)
+		}
+	}
+	if u.Email == "" && strings.Contains(u.Username, "@") {
+		u.Email = u.Username
+	}
+	if u.Email == "" {
+		return scim.BadRequest(scim.TypeInvalidValue, "emails is required, the user needs an email")
+	}
+
+	switch {
+	case s.Name.Formatted != "":
+		u.Name = s.Name.Formatted
+	case s.Name.GivenName != "" || s.Name.FamilyName != "":
+		u.Name = strings.TrimSpace(s.Name.GivenName + " " + s.Name.FamilyName)
+	case s.DisplayName != "":
+		u.Name = s.DisplayName
+	default:
+		u.Name = u.Username
+	}
+
+	if s.Active != nil {
+		u.IsActive = *s.Active
+	}
+	return nil
+}
+
+// set applies one operation of a PATCH to the attribute path of the resource
+func (s *SCIMUser) set(op string, path scim.Path, value json.RawMessage) error {
+	remove := op == "remove"
+	switch path.Attr {
+	case "username":
+		if remove {
+			return scim.BadRequest(scim.TypeInvalidValue, "userName is required")
+		}
+		return decodeSCIM(value, &s.UserName)
+
+	case "externalid":
+		if remove {
+			s.ExternalID = ""
+			return nil
+		}
+		return decodeSCIM(value, &s.ExternalID)
+
+	case "displayname":
+		if remove {
+			return nil
+		}
+		var name string
+		if err := decodeSCIM(value, &name); err != nil {
+			return err
+		}
+		s.setName(name)
+
+	case "name":
+		var name struct {
+			Formatted  *string `json:"formatted"`
+			GivenName  *string `json:"givenName"`
+			FamilyName *string `json:"familyName"`
+		}
+		switch {
+		case remove:
+			return nil
+		case path.Sub == "":
+			if err := decodeSCIM(value, &name); err != nil {
+				return err
+			}
+		case path.Sub == "formatted":
+			name.Formatted = new(string)
+			if err := decodeSCIM(value, name.Formatted); err != nil {
+				return err
+			}
+		case path.Sub == "givenname":
+			name.GivenName = new(string)
+			if err := decodeSCIM(value, name.GivenName); err != nil {
+				return err
+			}
+		case path.Sub == "familyname":
+			name.FamilyName = new(string)
+			if err := decodeSCIM(value, name.FamilyName); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+		if name.Formatted != nil && *name.Formatted != "" {
+			s.setName(*name.Formatted)
+			return nil
+		}
+		given, family := s.Name.GivenName, s.Name.FamilyName
+		if name.GivenName != nil {
+			given = *name.GivenName
+		}
+		if name.FamilyName != nil {
+			family = *name.FamilyName
+		}
+		s.setName(strings.TrimSpace(given + " " + family))
+
+	case "emails":
+		// The single address of the user is its primary, work one
+		if path.Filter != nil && !scim.Match(path.Filter, func(attr string) []interface{} {
+			return map[string][]interface{}{"value": {s.Emails[0].Value}, "type": {"work"}, "primary": {true}}[attr]
+		}) {
+			return nil
+		}
+		if remove {
+			return scim.BadRequest(scim.TypeInvalidValue, "emails is required, the user needs an email")
+		}
+		switch {
+		case path.Sub == "value":
+			var email string
+			if err := decodeSCIM(value, &email); err != nil {
+				return err
+			}
+			s.Emails = []SCIMEmail{{Value: email, Type: "work", Primary: true}}
+		case path.Sub == "" && path.Filter != nil:
+			var email SCIMEmail
+			if err := decodeSCIM(value, &email); err != nil {
+				return err
+			}
+			s.Emails = []SCIMEmail{email}
+		case path.Sub == "":
+			var emails []SCIMEmail
+			if err := decodeSCIM(value, &emails); err != nil {
+				return err
+			}
+			if len(emails) > 0 {
+				s.Emails = emails
+			}
+		}
+
+	case "active":
+		if remove {
+			return scim.BadRequest(scim.TypeInvalidValue, "active cannot be removed")
+		}
+		active, err := scim.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		s.Active = &active
+
+	case "id", "groups", "meta":
+		return scim.BadRequest(scim.TypeMutability, path.Attr+" is read only")
+	}
+	return nil
+}
+
+/*** GROUPS ***/
+
+// ListSCIMGroups returns the groups of the roles matching filter, with their
+// members unless members is false
+func ListSCIMGroups(ctx context.Context, tenantID int, filter string, startIndex, count int, members bool) (scim.ListResponse[SCIMGroup], error) {
+	startIndex, count = scimPage(startIndex, count)
+	var e scim.Expr
+	if filter != "" {
+		var err error
+		if e, err = scim.ParseFilter(filter); err != nil {
+			return scim.ListResponse[SCIMGroup]{}, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	var groups []SCIMGroup
+	for _, role := range Roles {
+		group, err := selectSCIMGroup(ctx, db.GetConnection(), tenantID, role, members || e != nil, false)
+		if err != nil {
+			return scim.ListResponse[SCIMGroup]{}, err
+		}
+		if e == nil || scim.Match(e, group.values) {
+			if !members {
+				group.Members = nil
+			}
+			groups = append(groups, group)
+		}
+	}
+
+	total := len(groups)
+	groups = groups[min(startIndex-1, total):min(startIndex-1+count, total)]
+	return scim.NewListResponse(groups, startIndex, total), nil
+}
+
+// GetSCIMGroup returns the group of a role, pgx.ErrNoRows when id is not a role
+func GetSCIMGroup(ctx context.Context, tenantID int, id string, members bool) (SCIMGroup, error) {
+	if !ValidRole(id) {
+		return SCIMGroup{}, pgx.ErrNoRows
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	return selectSCIMGroup(ctx, db.GetConnection(), tenantID, id, members, false)
+}
+
+// ReplaceSCIMGroup sets the members of a group: they get its role, the users
+// left out get the role user
+func ReplaceSCIMGroup(ctx context.Context, tenantID int, id string, g SCIMGroup) (SCIMGroup, error) {
+	return updateSCIMGroup(ctx, tenantID, id, func(group *SCIMGroup) error {
+		if g.DisplayName != "" && !strings.EqualFold(g.DisplayName, group.DisplayName) {
+			return errSCIMGroupRenamed
+		}
+		group.Members = g.Members
+		return nil
+	})
+}
+
+// PatchSCIMGroup adds and removes members of a group
+func PatchSCIMGroup(ctx context.Context, tenantID int, id string, ops []scim.PatchOperation) (SCIMGroup, error) {
+	return updateSCIMGroup(ctx, tenantID, id, func(group *SCIMGroup) error {
+		return applyPatch(ops, func(op string, path scim.Path, value json.RawMessage) error {
+			return group.set(op, path, value)
+		})
+	})
+}
+
+var errSCIMGroupRenamed = scim.BadRequest(scim.TypeMutability, "the groups are the roles, they cannot be renamed")
+
+// updateSCIMGroup locks the members of a group, lets change modify them and
+// moves the users added and removed to their new role
+func updateSCIMGroup(ctx context.Context, tenantID int, id string, change func(*SCIMGroup) error) (SCIMGroup, error) {
+	if !ValidRole(id) {
+		return SCIMGroup{}, pgx.ErrNoRows
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return SCIMGroup{}, err
+	}
+	defer tx.Rollback(ctx) // no-op once committed
+
+	group, err := selectSCIMGroup(ctx, tx, tenantID, id, true, true)
+	if err != nil {
+		return SCIMGroup{}, err
+	}
+	before := group.memberIDs()
+	if err := change(&group); err != nil {
+		return SCIMGroup{}, err
+	}
+	after := map[int]bool{}
+	for _, member := range group.Members {
+		userID, err := strconv.Atoi(member.Value)
+		if err != nil {
+			return SCIMGroup{}, scim.BadRequest(scim.TypeInvalidValue, fmt.Sprintf("member %q is not a user id", member.Value))
+		}
+		after[userID] = true
+	}
+
+	var added, removed []int
+	for userID := range after {
+		if !before[userID] {
+			added = append(added, userID)
+		}
+	}
+	for userID := range before {
+		if !after[userID] {
+			removed = append(removed, userID)
+		}
+	}
+	if len(removed) > 0 && id == RoleUser {
+		return SCIMGroup{}, scim.BadRequest(scim.TypeMutability, "every user without another role is a member of the user group, add it to another group instead")
+	}
+
+	if len(added) > 0 {
+		query := `UPDATE users SET role=$1, version=version+1 WHERE tenant_id=$2 AND id=ANY($3) AND NOT service_account`
+		tag, err := tx.Exec(ctx, query, id, tenantID, added)
+		if err != nil {
+			return SCIMGroup{}, err
+		}
+		if int(tag.RowsAffected()) != len(added) {
+			return SCIMGroup{}, scim.BadRequest(scim.TypeInvalidValue, "the members must be users of the tenant")
+		}
+	}
+	if len(removed) > 0 {
+		query := `UPDATE users SET role=$1, version=version+1 WHERE tenant_id=$2 AND id=ANY($3) AND role=$4`
+		if _, err := tx.Exec(ctx, query, RoleUser, tenantID, removed, id); err != nil {
+			return SCIMGroup{}, err
+		}
+	}
+	if group, err = selectSCIMGroup(ctx, tx, tenantID, id, true, false); err != nil {
+		return SCIMGroup{}, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return SCIMGroup{}, err
+	}
+
+	invalidate(ctx, "users", append(added, removed...)...)
+	return group, nil
+}
+
+// selectSCIMGroup reads the group of role, with its members when members is true
+func selectSCIMGroup(ctx context.Context, q querier, tenantID int, role string, members, lock bool) (SCIMGroup, error) {
+	group := SCIMGroup{
+		Schemas:     []string{scim.SchemaGroup},
+		ID:          role,
+		DisplayName: role,
+		Members:     []SCIMRef{},
+		Meta:        &scim.Meta{ResourceType: "Group"},
+	}
+	if !members {
+		return group, nil
+	}
+
+	query := `SELECT id, name FROM users WHERE tenant_id=$1 AND role=$2 AND NOT service_account ORDER BY id`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	rows, err := q.Query(ctx, query, tenantID, role)
+	if err != nil {
+		return SCIMGroup{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return SCIMGroup{}, err
+		}
+		group.Members = append(group.Members, SCIMRef{Value: strconv.Itoa(id), Display: name})
+	}
+	return group, rows.Err()
+}
+
+func (g SCIMGroup) memberIDs() map[int]bool {
+	ids := map[int]bool{}
+	for _, member := range g.Members {
+		if id, err := strconv.Atoi(member.Value); err == nil {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// values returns the values of an attribute of the group, for scim.Match
+func (g SCIMGroup) values(attr string) []interface{} {
+	switch attr {
+	case "id", "displayname":
+		return []interface{}{g.ID}
+	case "members", "members.value":
+		var ids []interface{}
+		for _, member := range g.Members {
+			ids = append(ids, member.Value)
+		}
+		return ids
+	case "members.display":
+		var names []interface{}
+		for _, member := range g.Members {
+			names = append(names, member.Display)
+		}
+		return names
+	}
+	return nil
+}
+
+// set applies one operation of a PATCH to the attribute path of the group
+func (g *SCIMGroup) set(op string, path scim.Path, value json.RawMessage) error {
+	switch path.Attr {
+	case "displayname":
+		var name string
+		if op == "remove" || decodeSCIM(value, &name) != nil || !strings.EqualFold(name, g.DisplayName) {
+			return errSCIMGroupRenamed
+		}
+
+	case "members":
+		// A filter selects the members to remove or replace, "members[value eq "2"]"
+		if path.Filter != nil || op != "add" {
+			g.Members = slices.DeleteFunc(g.Members, func(member SCIMRef) bool {
+				if path.Filter != nil {
+					return scim.Match(path.Filter, func(attr string) []interface{} {
+						return map[string][]interface{}{"value": {member.Value}, "display": {member.Display}}[attr]
+					})
+				}
+				return op == "replace" || len(value) == 0
+			})
+		}
+		if len(value) == 0 {
+			return nil
+		}
+		var members []SCIMRef
+		if err := decodeSCIM(value, &members); err != nil {
+			return err
+		}
+		if op == "remove" {
+			// Some clients list the members to remove in the value
+			g.Members = slices.DeleteFunc(g.Members, func(member SCIMRef) bool {
+				return slices.ContainsFunc(members, func(m SCIMRef) bool { return m.Value == member.Value })
+			})
+			return nil
+		}
+		g.Members = append(g.Members, members...)
+	}
+	return nil
+}
+
+/*** HELPERS ***/
+
+// applyPatch calls set for every attribute changed by ops, an operation without path
+// changes every attribute of its value
+func applyPatch(ops []scim.PatchOperation, set func(op string, path scim.Path, value json.RawMessage) error) error {
+	if len(ops) == 0 {
+		return scim.BadRequest(scim.TypeInvalidSyntax, "Operations is required")
+	}
+	for _, operation := range ops {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return scim.BadRequest(scim.TypeInvalidSyntax, fmt.Sprintf("op must be add, replace or remove, got %q", operation.Op))
+		}
+
+		if operation.Path != "" {
+			path, err := scim.ParsePath(operation.Path)
+			if err != nil {
+				return err
+			}
+			if err := set(op, path, operation.Value); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if op == "remove" {
+			return scim.BadRequest(scim.TypeNoTarget, "remove requires a path")
+		}
+		var attrs map[string]json.RawMessage
+		if err := json.Unmarshal(operation.Value, &attrs); err != nil {
+			return scim.BadRequest(scim.TypeInvalidSyntax, "the value of an operation without path must be an object")
+		}
+		for name, value := range attrs {
+			path, err := scim.ParsePath(name)
+			if err != nil {
+				return err
+			}
+			if err := set(op, path, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func decodeSCIM(value json.RawMessage, v interface{}) error {
+	if err := json.Unmarshal(value, v); err != nil {
+		return scim.BadRequest(scim.TypeInvalidValue, "invalid value "+string(value))
+	}
+	return nil
+}
+
+// scimPage bounds startIndex and count, count defaults to SCIMMaxResults
+func scimPage(startIndex, count int) (int, int) {
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	if count < 0 || count > SCIMMaxResults {
+		count = SCIMMaxResults
+	}
+	return startIndex, count
+}
+
+// scimWhere translates a filter to an SQL condition, its values are appended to args
+func scimWhere(e scim.Expr, columns map[string]scimColumn, prefix string, args *[]interface{}) (string, error) {
+	switch e := e.(type) {
+	case scim.Logical:
+		left, err := scimWhere(e.Left, columns, prefix, args)
+		if err != nil {
+			return "", err
+		}
+		right, err := scimWhere(e.Right, columns, prefix, args)
+		if err != nil {
+			return "", err
+		}
+		return "(" + left + " " + strings.ToUpper(e.Op) + " " + right + ")", nil
+
+	case scim.Not:
+		inner, err := scimWhere(e.Expr, columns, prefix, args)
+		if err != nil {
+			return "", err
+		}
+		return "NOT COALESCE(" + inner + ", FALSE)", nil
+
+	case scim.ValuePath:
+		return scimWhere(e.Filter, columns, prefix+e.Attr+".", args)
+
+	case scim.Compare:
+		column, ok := columns[prefix+e.Path]
+		if !ok {
+			return "", scim.BadRequest(scim.TypeInvalidFilter, fmt.Sprintf("invalid filter: %s cannot be filtered", prefix+e.Path))
+		}
+		col := column.expr
+		switch {
+		case e.Op == "pr" && column.kind == "text":
+			return "(" + col + " IS NOT NULL AND " + col + " <> '')", nil
+		case e.Op == "pr":
+			return col + " IS NOT NULL", nil
+		case e.Value == nil && e.Op == "eq":
+			return col + " IS NULL", nil
+		case e.Value == nil && e.Op == "ne":
+			return col + " IS NOT NULL", nil
+		}
+
+		invalid := scim.BadRequest(scim.TypeInvalidFilter, fmt.Sprintf("invalid filter: %s %s %v", prefix+e.Path, e.Op, e.Value))
+		placeholder := func(v interface{}) string {
+			*args = append(*args, v)
+			return "$" + strconv.Itoa(len(*args))
+		}
+		switch column.kind {
+		case "bool":
+			b, ok := e.Value.(bool)
+			if !ok || (e.Op != "eq" && e.Op != "ne") {
+				return "", invalid
+			}
+			if e.Op == "ne" {
+				return col + " IS DISTINCT FROM " + placeholder(b), nil
+			}
+			return col + " = " + placeholder(b), nil
+
+		case "time":
+			s, ok := e.Value.(string)
+			sql, known := map[string]string{"eq": "=", "ne": "<>", "gt": ">", "ge": ">=", "lt": "<", "le": "<="}[e.Op]
+			if !ok || !known {
+				return "", invalid
+			}
+			return col + " " + sql + " " + placeholder(s) + "::timestamp", nil
+
+		default:
+			s, ok := e.Value.(string)
+			if !ok {
+				return "", invalid
+			}
+			like := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+			switch e.Op {
+			case "eq":
+				return "LOWER(" + col + ") = LOWER(" + placeholder(s) + ")", nil
+			case "ne":
+				return "(" + col + " IS NULL OR LOWER(" + col + ") <> LOWER(" + placeholder(s) + "))", nil
+			case "co":
+				return col + " ILIKE " + placeholder("%"+like+"%"), nil
+			case "sw":
+				return col + " ILIKE " + placeholder(like+"%"), nil
+			case "ew":
+				return col + " ILIKE " + placeholder("%"+like), nil
+			}
+			sql := map[string]string{"gt": ">", "ge": ">=", "lt": "<", "le": "<="}[e.Op]
+			return "LOWER(" + col + ") " + sql + " LOWER(" + placeholder(s) + ")", nil
+		}
+	}
+	return "", errors.New("unknown filter expression")
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"portier/pkg/db"
+)
+
+// tenantScopes keep the rows of an entity to the tenant passed as the query
+// parameter they are formatted with. Keys and copies belong to the tenant of
+// the user who created them.
+var tenantScopes = map[string]string{
+	"users":   `tenant_id = $%[1]d`,
+	"tenants": `id = $%[1]d`,
+	"keys":    `created_by IN (SELECT id FROM users WHERE tenant_id = $%[1]d)`,
+	"copies":  `created_by IN (SELECT id FROM users WHERE tenant_id = $%[1]d)`,
+}
+
+// tenantScope returns the condition keeping the rows of entity to the tenant
+// passed as parameter $n. A tenant of 0, a request without an API token,
+// matches every row.
+func tenantScope(entity string, n int) string {
+	return fmt.Sprintf("($%[1]d = 0 OR "+tenantScopes[entity]+")", n)
+}
+
+// InTenant reports whether the row id of entity belongs to the tenant tenantID,
+// always true for a tenant of 0. A missing row belongs to no tenant.
+// It reads the database, a cached row may have moved to another tenant.
+func InTenant(ctx context.Context, entity string, id, tenantID int) (bool, error) {
+	if tenantID == 0 {
+		return true, nil
+	}
+	if _, ok := tenantScopes[entity]; !ok {
+		return false, fmt.Errorf("no tenant scope for %s", entity)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	var exists bool
+	query := `SELECT EXISTS (SELECT 1 FROM ` + entity + ` WHERE id=$1 AND ` + tenantScope(entity, 2) + `)`
+	if err := db.GetConnection().QueryRow(ctx, query, id, tenantID).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check the tenant of %s %d: %w", entity, id, err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,53 @@
+package service
+
+import (
+	"context"
+	"portier/pkg/db"
+)
+
+// TenantCount is a number of rows belonging to a tenant
+type TenantCount struct {
+	TenantID int
+	Count    int
+}
+
+// CountActiveKeysPerTenant counts the active keys of every tenant.
+// Keys belong to the tenant of the user who created them, the caller of POST /keys.
+func CountActiveKeysPerTenant(ctx context.Context) ([]TenantCount, error) {
+	query := `SELECT t.id, COUNT(k.id)
+						FROM tenants t
+						LEFT JOIN users u ON u.tenant_id = t.id
+						LEFT JOIN keys k ON k.created_by = u.id AND k.is_active
+						GROUP BY t.id ORDER BY t.id`
+	return countPerTenant(ctx, query)
+}
+
+// CountActiveCopiesPerTenant counts the active copies of every tenant.
+// Copies belong to the tenant of the user who created them, the caller of POST /copies.
+func CountActiveCopiesPerTenant(ctx context.Context) ([]TenantCount, error) {
+	query := `SELECT t.id, COUNT(c.id)
+						FROM tenants t
+						LEFT JOIN users u ON u.tenant_id = t.id
+						LEFT JOIN copies c ON c.created_by = u.id AND c.is_active
+						GROUP BY t.id ORDER BY t.id`
+	return countPerTenant(ctx, query)
+}
+
+func countPerTenant(ctx context.Context, query string) ([]TenantCount, error) {
+	rows, err := db.GetConnection().Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []TenantCount
+	for rows.Next() {
+		var count TenantCount
+		if err := rows.Scan(&count.TenantID, &count.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+
+	return counts, rows.Err()
+}
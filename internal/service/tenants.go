@@ -3,18 +3,22 @@ package service
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"portier/pkg/db"
 	"time"
 )
 
 type Tenant struct {
-	ID        int       `json:"id"`
-	Name      string    `json:"name"`
-	Address   string    `json:"address"`
-	Status    string    `json:"status"`
-	CreatedAt time.Time `json:"created_at"`
-	IsActive  bool      `json:"is_active"`
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	Address      string    `json:"address"`
+	Status       string    `json:"status"`
+	DefaultKeyID *int      `json:"default_key_id"` // Optional, key used for copies created without key_id, only an admin of the tenant changes it
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`   // Maintained by a trigger, sent as Last-Modified
+	Version      int       `json:"version"`      // Incremented by every update, an update must send the version it read
+	RequireTOTP  *bool     `json:"require_totp"` // Every user of the tenant must enroll a TOTP second factor, only an admin of the tenant changes it, an update without it keeps it
+	IsActive     bool      `json:"is_active"`
 }
 
 // GetAllTenantsResponse represents the response structure for GetAllTenants
@@ -23,29 +27,36 @@ type GetAllTenantsResponse struct {
 	TotalPages int      `json:"totalPages"`
 }
 
-// GetAllTenants fetches all tenants
-func GetAllTenants(limit, offset int) (GetAllTenantsResponse, error) {
+// GetAllTenants fetches all tenants, only the given one when it is not 0.
+func GetAllTenants(ctx context.Context, limit, offset, tenantID int) (GetAllTenantsResponse, error) {
+	return cachedPage(ctx, "tenants", offset, []any{limit, offset, tenantID}, func() (GetAllTenantsResponse, error) {
+		return getAllTenants(ctx, limit, offset, tenantID)
+	})
+}
+
+func getAllTenants(ctx context.Context, limit, offset, tenantID int) (GetAllTenantsResponse, error) {
 	// Get a database connection
 	dbConn := db.GetConnection()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
 	defer cancel()
 
 	// Query to get the total count of tenants
 	var totalCount int
-	countQuery := `SELECT COUNT(*) FROM tenants`
-	if err := dbConn.QueryRow(ctx, countQuery).Scan(&totalCount); err != nil {
-		return GetAllTenantsResponse{}, fmt.Errorf("failed to get total count: %v", err)
+	countQuery := `SELECT COUNT(*) FROM tenants WHERE ` + tenantScope("tenants", 1)
+	if err := dbConn.QueryRow(ctx, countQuery, tenantID).Scan(&totalCount); err != nil {
+		return GetAllTenantsResponse{}, fmt.Errorf("failed to get total count: %w", err)
 	}
 
 	// Calculate total pages
 	totalPages := (totalCount + limit - 1) / limit
 
 	// Query to get the paginated tenants
-	query := `SELECT id, name, address, status, created_at, is_active
+	query := `SELECT id, name, address, status, default_key_id, created_at, is_active, updated_at, version, require_totp
 						FROM tenants 
+						WHERE ` + tenantScope("tenants", 1) + ` 
 						ORDER BY id 
-						LIMIT $1 OFFSET $2`
-	rows, err := dbConn.Query(ctx, query, limit, offset)
+						LIMIT $2 OFFSET $3`
+	rows, err := dbConn.Query(ctx, query, tenantID, limit, offset)
 	if err != nil {
 		return GetAllTenantsResponse{}, err
 	}
@@ -54,7 +65,7 @@ func GetAllTenants(limit, offset int) (GetAllTenantsResponse, error) {
 	var tenants []Tenant
 	for rows.Next() {
 		var tenant Tenant
-		if err := rows.Scan(&tenant.ID, &tenant.Name, &tenant.Address, &tenant.Status, &tenant.CreatedAt, &tenant.IsActive); err != nil {
+		if err := rows.Scan(&tenant.ID, &tenant.Name, &tenant.Address, &tenant.Status, &tenant.DefaultKeyID, &tenant.CreatedAt, &tenant.IsActive, &tenant.UpdatedAt, &tenant.Version, &tenant.RequireTOTP); err != nil {
 			return GetAllTenantsResponse{}, err
 		}
 		tenants = append(tenants, tenant)
@@ -70,16 +81,32 @@ func GetAllTenants(limit, offset int) (GetAllTenantsResponse, error) {
 	}, nil
 }
 
-// GetTenantByID fetches a tenant by their ID
-func GetTenantByID(id int) (Tenant, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background()
+// GetTenantByID fetches a tenant by their ID.
+func GetTenantByID(ctx context.Context, id int) (Tenant, error) {
+	return cached(ctx, "tenants", itemKey("tenants", id), cacheConfig.ItemTTL, func() (Tenant, error) {
+		return getTenantByID(ctx, id)
+	})
+}
+
+// GetTenantByIDUncached is GetTenantByID read from the database, for the
+// policy and If-Match checks of the updates
+func GetTenantByIDUncached(ctx context.Context, id int) (Tenant, error) {
+	return getTenantByID(ctx, id)
+}
 
+func getTenantByID(ctx context.Context, id int) (Tenant, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	return selectTenant(ctx, db.GetConnection(), id)
+}
+
+// selectTenant reads a tenant with q, which is either the pool or a batch transaction
+func selectTenant(ctx context.Context, q querier, id int) (Tenant, error) {
 	var tenant Tenant
 
-	query := `SELECT id, name, address, status, created_at, is_active FROM tenants WHERE id=$1`
-	err := dbConn.QueryRow(ctx, query, id).Scan(&tenant.ID, &tenant.Name, &tenant.Address, &tenant.Status, &tenant.CreatedAt, &tenant.IsActive)
+	query := `SELECT id, name, address, status, default_key_id, created_at, is_active, updated_at, version, require_totp FROM tenants WHERE id=$1`
+	err := q.QueryRow(ctx, query, id).Scan(&tenant.ID, &tenant.Name, &tenant.Address, &tenant.Status, &tenant.DefaultKeyID, &tenant.CreatedAt, &tenant.IsActive, &tenant.UpdatedAt, &tenant.Version, &tenant.RequireTOTP)
 	if err != nil {
 		return Tenant{}, err
 	}
@@ -88,22 +115,35 @@ func GetTenantByID(id int) (Tenant, error) {
 }
 
 // CreateTenant creates a new tenant in the database
-func CreateTenant(tenant Tenant) (Tenant, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
+func CreateTenant(ctx context.Context, tenant Tenant) (Tenant, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	created, err := createTenant(ctx, db.GetConnection(), tenant)
+	if err == nil {
+		invalidate(ctx, "tenants")
+	}
+	return created, err
+}
 
+// createTenant inserts a tenant with q, which is either the pool or a batch transaction
+func createTenant(ctx context.Context, q querier, tenant Tenant) (Tenant, error) {
 	// Explicitly set the default value for IsActive
 	tenant.IsActive = true
 
-	query := `INSERT INTO tenants (name, address, status, created_at, is_active) 
-						VALUES ($1, $2, $3, $4, $5) RETURNING id`
+	// The default key must be a key of the tenant, a new tenant has no users and so no keys
+	if tenant.DefaultKeyID != nil {
+		return Tenant{}, ErrKeyNotFound
+	}
+
+	query := `INSERT INTO tenants (name, address, status, default_key_id, created_at, is_active, require_totp) 
+						VALUES ($1, $2, $3, $4, $5, $6, COALESCE($7, FALSE)) RETURNING id, updated_at, version, require_totp`
 
 	var id int
-	err := dbConn.QueryRow(ctx, query, tenant.Name, tenant.Address, tenant.Status, time.Now(), tenant.IsActive).Scan(&id)
+	err := q.QueryRow(ctx, query, tenant.Name, tenant.Address, tenant.Status, tenant.DefaultKeyID, time.Now(), tenant.IsActive, tenant.RequireTOTP).Scan(&id, &tenant.UpdatedAt, &tenant.Version, &tenant.RequireTOTP)
 	if err != nil {
-		log.Printf("Error creating tenant: %v", err)
-		return Tenant{}, fmt.Errorf("failed to create tenant: %v", err)
+		slog.ErrorContext(ctx, "Error creating tenant", "error", err)
+		return Tenant{}, fmt.Errorf("failed to create tenant: %w", err)
 	}
 
 	tenant.ID = id
@@ -111,14 +151,66 @@ func CreateTenant(tenant Tenant) (Tenant, error) {
 }
 
 // UpdateTenant updates a tenant in the database
-func UpdateTenant(id int, tenant Tenant) (Tenant, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
+func UpdateTenant(ctx context.Context, id int, tenant Tenant) (Tenant, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	updated, err := updateTenant(ctx, db.GetConnection(), id, tenant)
+	if err == nil {
+		invalidate(ctx, "tenants", id)
+		invalidateTenantUsers(ctx, id)
+	}
+	return updated, err
+}
 
-	query := `UPDATE tenants SET name=$1, address=$2, status=$3, is_active=$4 WHERE id=$5`
-	_, err := dbConn.Exec(ctx, query, tenant.Name, tenant.Address, tenant.Status, tenant.IsActive, id)
+// invalidateTenantUsers drops the cached users of the tenants and the user list
+// pages, their reads must follow the require_totp and default key of the tenant
+func invalidateTenantUsers(ctx context.Context, tenantIDs ...int) {
+	if cacheStore == nil || len(tenantIDs) == 0 {
+		return
+	}
+	ids, err := tenantUserIDs(ctx, tenantIDs)
 	if err != nil {
+		slog.WarnContext(ctx, "Cache invalidation failed", "entity", "users", "error", err)
+	}
+	invalidate(ctx, "users", ids...)
+}
+
+func tenantUserIDs(ctx context.Context, tenantIDs []int) ([]int, error) {
+	rows, err := db.GetConnection().Query(ctx, `SELECT id FROM users WHERE tenant_id = ANY($1)`, tenantIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// updateTenant updates a tenant with q, which is either the pool or a batch
+// transaction. The caller checks who changes require_totp and default_key_id.
+func updateTenant(ctx context.Context, q querier, id int, tenant Tenant) (Tenant, error) {
+	if tenant.Version == 0 {
+		return Tenant{}, ErrVersionRequired
+	}
+
+	// The default key is an admin opt-in, validate it when provided
+	if tenant.DefaultKeyID != nil {
+		if err := checkDefaultKey(ctx, q, *tenant.DefaultKeyID, id); err != nil {
+			return Tenant{}, err
+		}
+	}
+
+	query := `UPDATE tenants SET name=$1, address=$2, status=$3, default_key_id=$4, is_active=$5, require_totp=COALESCE($8, require_totp), version=version+1 WHERE id=$6 AND version=$7 RETURNING updated_at, version, require_totp`
+	err := q.QueryRow(ctx, query, tenant.Name, tenant.Address, tenant.Status, tenant.DefaultKeyID, tenant.IsActive, id, tenant.Version, tenant.RequireTOTP).Scan(&tenant.UpdatedAt, &tenant.Version, &tenant.RequireTOTP)
+	if err := checkVersion(ctx, q, err, id, selectTenant); err != nil {
 		return Tenant{}, err
 	}
 
@@ -127,16 +219,27 @@ func UpdateTenant(id int, tenant Tenant) (Tenant, error) {
 }
 
 // DeleteTenant deletes a tenant from the database
-func DeleteTenant(id int) error {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
+func DeleteTenant(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	err := deleteTenant(ctx, db.GetConnection(), id)
+	if err == nil {
+		invalidate(ctx, "tenants", id)
+	}
+	return err
+}
 
+// deleteTenant deletes a tenant with q, which is either the pool or a batch transaction
+func deleteTenant(ctx context.Context, q querier, id int) error {
 	query := `DELETE FROM tenants WHERE id=$1`
-	_, err := dbConn.Exec(ctx, query, id)
+	tag, err := q.Exec(ctx, query, id)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
 
 	return nil
 }
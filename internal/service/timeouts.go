@@ -0,0 +1,35 @@
+package service
+
+import "time"
+
+// Timeouts limit how long a service function may run its queries.
+// The deadline of the caller's context applies as well, the earliest one wins.
+type Timeouts struct {
+	Read   time.Duration `mapstructure:"read" yaml:"read"`     // single rows and list pages
+	Write  time.Duration `mapstructure:"write" yaml:"write"`   // create, update and delete of a single row
+	Batch  time.Duration `mapstructure:"batch" yaml:"batch"`   // a whole batch request, or one chunk of an import
+	Export time.Duration `mapstructure:"export" yaml:"export"` // reading every row of an export, it holds a connection meanwhile
+}
+
+var timeouts = Timeouts{
+	Read:   5 * time.Second,
+	Write:  5 * time.Second,
+	Batch:  60 * time.Second,
+	Export: 10 * time.Minute,
+}
+
+// SetTimeouts replaces the operation timeouts, zero values keep the default
+func SetTimeouts(t Timeouts) {
+	if t.Read > 0 {
+		timeouts.Read = t.Read
+	}
+	if t.Write > 0 {
+		timeouts.Write = t.Write
+	}
+	if t.Batch > 0 {
+		timeouts.Batch = t.Batch
+	}
+	if t.Export > 0 {
+		timeouts.Export = t.Export
+	}
+}
@@ -0,0 +1,462 @@
+package service
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"portier/pkg/db"
+	"portier/pkg/totp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TOTPConfig sets the second factor of the users
+type TOTPConfig struct {
+	Issuer        string   // shown by the authenticator apps next to the account
+	RequiredRoles []string // roles that must enroll, in addition to the tenants with require_totp
+}
+
+// TOTPEnrollment is a started enrollment, the secret is shown once as a QR code
+// of URI and becomes active when a code generated from it is confirmed
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// RecoveryCodes replace a TOTP code once each, they are only returned when generated
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// recoveryCodeCount is the number of codes of a user, generating new ones revokes the previous ones
+const recoveryCodeCount = 10
+
+var totpConfig TOTPConfig
+
+// SetTOTP sets the issuer and the role policy of the second factor
+func SetTOTP(cfg TOTPConfig) {
+	totpConfig = cfg
+}
+
+// totpState is the second factor of a user with what its checks and its lock need
+type totpState struct {
+	ID            int
+	Password      string
+	Email         string
+	Role          string
+	IsActive      bool
+	TenantRequire bool
+	Secret        *string
+	PendingSecret *string
+	LastStep      *int64
+	FailedLogins  int
+	LockedFor     int // seconds the user is still locked, 0 when it is not
+}
+
+// required reports whether the tenant or the role of the user enforces a second factor
+func (s totpState) required() bool {
+	return s.TenantRequire || slices.Contains(totpConfig.RequiredRoles, s.Role)
+}
+
+// BeginTOTPEnrollment stores a new pending secret for the user, password must be
+// the current one, checked by CheckPassword for client. A previous pending
+// enrollment is replaced.
+func BeginTOTPEnrollment(ctx context.Context, userID int, password string, client LoginClient) (TOTPEnrollment, error) {
+	if err := CheckPassword(ctx, userID, password, client); err != nil {
+		return TOTPEnrollment{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	state, err := selectTOTPState(ctx, db.GetConnection(), `u.id=$1`, userID)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if state.Secret != nil {
+		return TOTPEnrollment{}, ErrTOTPAlreadyEnabled
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	sealed, err := sealSecret(secret)
+	if err != nil {
+		return TOTPEnrollment{}, err
+	}
+	if _, err := db.GetConnection().Exec(ctx, `UPDATE users SET totp_pending_secret=$1 WHERE id=$2`, sealed, userID); err != nil {
+		return TOTPEnrollment{}, fmt.Errorf("failed to store TOTP secret: %w", err)
+	}
+	invalidate(ctx, "users", userID)
+
+	return TOTPEnrollment{
+		Secret: secret,
+		URI:    totp.ProvisioningURI(totpConfig.Issuer, state.Email, secret),
+	}, nil
+}
+
+// ConfirmTOTPEnrollment enables the pending secret of the user when code was
+// generated from it, and returns the first recovery codes. It needs the
+// password, both are checked as an attempt of client: a wrong code counts
+// towards the lock like a wrong password.
+func ConfirmTOTPEnrollment(ctx context.Context, userID int, password, code string, client LoginClient) (RecoveryCodes, error) {
+	if password == "" {
+		return RecoveryCodes{}, ErrCurrentPasswordRequired
+	}
+	var codes RecoveryCodes
+	err := checkUserAttempt(ctx, userID, client, func(q querier, state totpState) (string, error) {
+		if reason, err := checkPasswordAttempt(ctx, q, state, true, password, client.IP); err != nil {
+			if errors.Is(err, ErrInvalidCredentials) {
+				return reason, ErrCurrentPasswordInvalid
+			}
+			return reason, err
+		}
+		if state.Secret != nil {
+			return "", ErrTOTPAlreadyEnabled
+		}
+		if state.PendingSecret == nil {
+			return "", ErrTOTPNotPending
+		}
+		secret, err := openSecret(*state.PendingSecret)
+		if err != nil {
+			return "", err
+		}
+		step, ok := totp.Validate(secret, code, time.Now())
+		if !ok {
+			if err := countFailure(ctx, q, state); err != nil {
+				return "", err
+			}
+			return ReasonInvalidCode, ErrInvalidTOTPCode
+		}
+
+		query := `UPDATE users SET totp_secret=totp_pending_secret, totp_pending_secret=NULL, totp_enabled_at=now(), totp_last_step=$1, version=version+1 WHERE id=$2`
+		if _, err := q.Exec(ctx, query, step, userID); err != nil {
+			return "", fmt.Errorf("failed to enable TOTP: %w", err)
+		}
+		if err := clearFailures(ctx, q, state); err != nil {
+			return "", err
+		}
+		codes, err = replaceRecoveryCodes(ctx, q, userID)
+		return "", err
+	})
+	if err != nil {
+		return RecoveryCodes{}, err
+	}
+
+	slog.InfoContext(ctx, "TOTP enabled", "user_id", userID)
+	return codes, nil
+}
+
+// DisableTOTP removes the second factor and the recovery codes of the user.
+// It needs the password and a code, checked as an attempt of client, and is
+// refused when the policy enforces TOTP.
+func DisableTOTP(ctx context.Context, userID int, password, code string, client LoginClient) error {
+	if password == "" {
+		return ErrCurrentPasswordRequired
+	}
+	err := checkUserAttempt(ctx, userID, client, func(q querier, state totpState) (string, error) {
+		if reason, err := checkEnrolled(ctx, q, state, password, code, client.IP); err != nil {
+			return reason, err
+		}
+		if state.required() {
+			return "", ErrTOTPRequiredByPolicy
+		}
+
+		query := `UPDATE users SET totp_secret=NULL, totp_pending_secret=NULL, totp_enabled_at=NULL, totp_last_step=NULL, version=version+1 WHERE id=$1`
+		if _, err := q.Exec(ctx, query, userID); err != nil {
+			return "", fmt.Errorf("failed to disable TOTP: %w", err)
+		}
+		_, err := q.Exec(ctx, `DELETE FROM user_recovery_codes WHERE user_id=$1`, userID)
+		return "", err
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "TOTP disabled", "user_id", userID)
+	return nil
+}
+
+// RegenerateRecoveryCodes revokes the recovery codes of the user and returns
+// new ones. It needs the password and a code, checked as an attempt of client.
+func RegenerateRecoveryCodes(ctx context.Context, userID int, password, code string, client LoginClient) (RecoveryCodes, error) {
+	if password == "" {
+		return RecoveryCodes{}, ErrCurrentPasswordRequired
+	}
+	var codes RecoveryCodes
+	err := checkUserAttempt(ctx, userID, client, func(q querier, state totpState) (string, error) {
+		if reason, err := checkEnrolled(ctx, q, state, password, code, client.IP); err != nil {
+			return reason, err
+		}
+		var err error
+		codes, err = replaceRecoveryCodes(ctx, q, userID)
+		return "", err
+	})
+	if err != nil {
+		return RecoveryCodes{}, err
+	}
+	return codes, nil
+}
+
+// VerifyCredentials checks the password of the active user whose email or
+// username is login, see selectLoginState, and its second factor: a TOTP code
+// or an unused recovery code.
+// Users the policy requires a second factor of must have enrolled one. Every
+// check is recorded in the login history, see LockoutConfig for the locks.
+func VerifyCredentials(ctx context.Context, login, password, code string, client LoginClient) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback(ctx) // no-op once committed
+
+	state, found, err := selectLoginState(ctx, tx, login)
+	if err != nil {
+		return User{}, err
+	}
+	reason, err := checkLogin(ctx, tx, state, found, password, code, client.IP)
+	if err != nil && reason == "" {
+		return User{}, err
+	}
+
+	// A refused attempt is committed too, with the failure it counts
+	var userID *int
+	if found {
+		userID = &state.ID
+	}
+	if err := recordAttempt(ctx, tx, userID, login, client, reason); err != nil {
+		return User{}, err
+	}
+	var user User
+	if reason == "" {
+		if user, err = selectUser(ctx, tx, state.ID); err != nil {
+			return User{}, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return User{}, err
+	}
+	if found {
+		invalidate(ctx, "users", state.ID)
+	}
+	return user, err
+}
+
+// CheckCredentials is VerifyCredentials for the user id, it authorizes an
+// action without an API token: the password, then the second factor the user
+// has or the policy requires.
+func CheckCredentials(ctx context.Context, id int, password, code string, client LoginClient) error {
+	if password == "" {
+		return ErrCurrentPasswordRequired
+	}
+	return checkUserAttempt(ctx, id, client, func(q querier, state totpState) (string, error) {
+		return checkLogin(ctx, q, state, true, password, code, client.IP)
+	})
+}
+
+// checkLogin checks the credentials of VerifyCredentials. A refusal returns
+// the reason recorded with the attempt, other errors none.
+func checkLogin(ctx context.Context, q querier, state totpState, found bool, password, code, ip string) (string, error) {
+	if reason, err := checkPasswordAttempt(ctx, q, state, found, password, ip); err != nil {
+		return reason, err
+	}
+	if !state.IsActive {
+		return ReasonInactive, ErrInvalidCredentials
+	}
+
+	switch {
+	case state.Secret != nil:
+		if reason, err := checkCodeAttempt(ctx, q, state, code); err != nil {
+			return reason, err
+		}
+	case state.required():
+		return ReasonEnrollmentRequired, ErrTOTPEnrollmentRequired
+	}
+	return "", clearFailures(ctx, q, state)
+}
+
+// checkCodeAttempt checks the second factor of an enrolled user, a wrong code
+// counts towards the lock. A refusal returns the reason recorded with the attempt.
+func checkCodeAttempt(ctx context.Context, q querier, state totpState, code string) (string, error) {
+	if code == "" {
+		return ReasonCodeRequired, ErrTOTPCodeRequired
+	}
+	if err := checkSecondFactor(ctx, q, state, code); err != nil {
+		if !errors.Is(err, ErrInvalidTOTPCode) {
+			return "", err
+		}
+		if err := countFailure(ctx, q, state); err != nil {
+			return "", err
+		}
+		return ReasonInvalidCode, err
+	}
+	return "", nil
+}
+
+// dummyHash is compared with the password of an unknown login
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("portier"), bcrypt.DefaultCost)
+	return hash
+})
+
+// selectLoginState locks the user whose email is login, or else the only user
+// whose username is login. Usernames are not unique and may be the email of
+// another user: a username shared by several users matches none of them, so
+// the checks and the failures never go to an arbitrary one.
+func selectLoginState(ctx context.Context, q querier, login string) (totpState, bool, error) {
+	state, err := selectTOTPState(ctx, q, `u.email=$1 FOR UPDATE OF u`, login)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return state, err == nil, err
+	}
+	state, err = selectTOTPState(ctx, q, `u.username=$1 AND (SELECT count(*) FROM users WHERE username=$1) = 1 FOR UPDATE OF u`, login)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return totpState{}, false, nil
+	}
+	return state, err == nil, err
+}
+
+func selectTOTPState(ctx context.Context, q querier, where string, arg interface{}) (totpState, error) {
+	var s totpState
+	query := `SELECT u.id, u.password, u.email, u.role, u.is_active, COALESCE(t.require_totp, FALSE), u.totp_secret, u.totp_pending_secret, u.totp_last_step,
+				u.failed_logins, COALESCE(CEIL(EXTRACT(EPOCH FROM u.locked_until - now())), 0)::int
+				FROM users u LEFT JOIN tenants t ON t.id = u.tenant_id WHERE ` + where
+	err := q.QueryRow(ctx, query, arg).Scan(&s.ID, &s.Password, &s.Email, &s.Role, &s.IsActive, &s.TenantRequire, &s.Secret, &s.PendingSecret, &s.LastStep, &s.FailedLogins, &s.LockedFor)
+	return s, err
+}
+
+// checkEnrolled checks the password and the second factor of an enrolled
+// user, as checkLogin. A refusal returns the reason recorded with the attempt.
+func checkEnrolled(ctx context.Context, q querier, state totpState, password, code, ip string) (string, error) {
+	if reason, err := checkPasswordAttempt(ctx, q, state, true, password, ip); err != nil {
+		if errors.Is(err, ErrInvalidCredentials) {
+			return reason, ErrCurrentPasswordInvalid
+		}
+		return reason, err
+	}
+	if state.Secret == nil {
+		return "", ErrTOTPNotEnabled
+	}
+	if reason, err := checkCodeAttempt(ctx, q, state, code); err != nil {
+		return reason, err
+	}
+	return "", clearFailures(ctx, q, state)
+}
+
+// checkSecondFactor accepts a TOTP code newer than the last accepted one, or
+// consumes an unused recovery code
+func checkSecondFactor(ctx context.Context, q querier, state totpState, code string) error {
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) != totp.Digits {
+		query := `UPDATE user_recovery_codes SET used_at=now() WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL`
+		tag, err := q.Exec(ctx, query, state.ID, tokenHash(normalizeRecoveryCode(code)))
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return ErrInvalidTOTPCode
+		}
+		slog.InfoContext(ctx, "Recovery code used", "user_id", state.ID)
+		return nil
+	}
+
+	secret, err := openSecret(*state.Secret)
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok || (state.LastStep != nil && step <= *state.LastStep) {
+		return ErrInvalidTOTPCode
+	}
+	_, err = q.Exec(ctx, `UPDATE users SET totp_last_step=$1 WHERE id=$2`, step, state.ID)
+	return err
+}
+
+// replaceRecoveryCodes deletes the recovery codes of the user and stores the hashes of new ones
+func replaceRecoveryCodes(ctx context.Context, q querier, userID int) (RecoveryCodes, error) {
+	if _, err := q.Exec(ctx, `DELETE FROM user_recovery_codes WHERE user_id=$1`, userID); err != nil {
+		return RecoveryCodes{}, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return RecoveryCodes{}, err
+		}
+		// 16 base32 characters, shown as xxxx-xxxx-xxxx-xxxx
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(raw))
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+
+		query := `INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)`
+		if _, err := q.Exec(ctx, query, userID, tokenHash(normalizeRecoveryCode(code))); err != nil {
+			return RecoveryCodes{}, fmt.Errorf("failed to store recovery code: %w", err)
+		}
+	}
+	return RecoveryCodes{Codes: codes}, nil
+}
+
+// normalizeRecoveryCode ignores the case and the separators typed by the user
+func normalizeRecoveryCode(code string) string {
+	return "recovery:" + strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+// sealSecret encrypts a TOTP secret with a key derived from auth.secret,
+// unlike the tokens it must be read back to compute the codes
+func sealSecret(secret string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openSecret(sealed string) (string, error) {
+	gcm, err := secretCipher()
+	if err != nil {
+		return "", err
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil || len(raw) < gcm.NonceSize() {
+		return "", errors.New("malformed TOTP secret")
+	}
+	secret, err := gcm.Open(nil, raw[:gcm.NonceSize()], raw[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt TOTP secret, was auth.secret changed? %w", err)
+	}
+	return string(secret), nil
+}
+
+// secretCipher refuses to work without auth.secret, the key would be derived
+// from a public constant
+func secretCipher() (cipher.AEAD, error) {
+	if accounts.Secret == "" {
+		return nil, ErrSecretMissing
+	}
+	key := sha256.Sum256([]byte("totp:" + accounts.Secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
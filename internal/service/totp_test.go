@@ -0,0 +1,275 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"portier/pkg/totp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// execRecorder is a querier recording its Exec calls, each affecting rows rows
+type execRecorder struct {
+	rows  int
+	execs [][]any
+}
+
+func (r *execRecorder) Exec(_ context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	r.execs = append(r.execs, append([]any{sql}, args...))
+	return pgconn.NewCommandTag(fmt.Sprintf("UPDATE %d", r.rows)), nil
+}
+
+func (r *execRecorder) Query(context.Context, string, ...any) (pgx.Rows, error) {
+	panic("unexpected Query")
+}
+
+func (r *execRecorder) QueryRow(context.Context, string, ...any) pgx.Row {
+	panic("unexpected QueryRow")
+}
+
+func TestSealSecret(t *testing.T) {
+	saved := accounts
+	t.Cleanup(func() { accounts = saved })
+
+	accounts.Secret = ""
+	if _, err := sealSecret("JBSWY3DPEHPK3PXP"); !errors.Is(err, ErrSecretMissing) {
+		t.Fatalf("sealSecret without auth.secret = %v, want ErrSecretMissing", err)
+	}
+
+	accounts.Secret = "0123456789abcdef0123456789abcdef"
+	sealed, err := sealSecret("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret, err := openSecret(sealed); err != nil || secret != "JBSWY3DPEHPK3PXP" {
+		t.Fatalf("openSecret = %q, %v", secret, err)
+	}
+
+	accounts.Secret = "fedcba9876543210fedcba9876543210"
+	if _, err := openSecret(sealed); err == nil {
+		t.Fatal("openSecret with another auth.secret succeeded")
+	}
+}
+
+func TestCheckSecondFactor(t *testing.T) {
+	saved := accounts
+	t.Cleanup(func() { accounts = saved })
+	accounts.Secret = "0123456789abcdef0123456789abcdef"
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sealSecret(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := totp.Step(time.Now())
+	code, _ := totp.Code(secret, current)
+	previous, _ := totp.Code(secret, current-1)
+	step := func(s int64) *int64 { return &s }
+
+	tests := []struct {
+		name     string
+		code     string
+		lastStep *int64
+		rows     int
+		err      error
+	}{
+		{"first code", code, nil, 1, nil},
+		{"later step", code, step(current - 1), 1, nil},
+		{"same step reused", code, step(current), 1, ErrInvalidTOTPCode},
+		{"older step after a newer one", previous, step(current), 1, ErrInvalidTOTPCode},
+		{"wrong code", "000000", nil, 1, ErrInvalidTOTPCode},
+		{"recovery code", "abcd-efgh-ijkl-mnop", nil, 1, nil},
+		{"recovery code used or unknown", "abcd-efgh-ijkl-mnop", nil, 0, ErrInvalidTOTPCode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &execRecorder{rows: tt.rows}
+			state := totpState{ID: 7, Secret: &sealed, LastStep: tt.lastStep}
+			err := checkSecondFactor(context.Background(), q, state, tt.code)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("checkSecondFactor = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && len(tt.code) == totp.Digits {
+				// The accepted step is stored, a later code of it is refused
+				if len(q.execs) != 1 || q.execs[0][1] != current {
+					t.Errorf("execs = %v, want totp_last_step set to %d", q.execs, current)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckLogin(t *testing.T) {
+	saved, savedTOTP := accounts, totpConfig
+	t.Cleanup(func() { accounts, totpConfig = saved, savedTOTP })
+	accounts.Secret = "0123456789abcdef0123456789abcdef"
+	totpConfig.RequiredRoles = []string{RoleAdmin}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("securepassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := totp.GenerateSecret()
+	sealed, _ := sealSecret(secret)
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+
+	user := totpState{ID: 7, Password: string(hash), Role: RoleUser, IsActive: true}
+	enrolled := user
+	enrolled.Secret = &sealed
+	admin := user
+	admin.Role = RoleAdmin
+	inactive := user
+	inactive.IsActive = false
+
+	tests := []struct {
+		name     string
+		state    totpState
+		password string
+		code     string
+		reason   string
+		err      error
+	}{
+		{"password", user, "securepassword", "", "", nil},
+		{"wrong password", user, "wrong", "", ReasonInvalidPassword, ErrInvalidCredentials},
+		{"inactive", inactive, "securepassword", "", ReasonInactive, ErrInvalidCredentials},
+		{"second factor without code", enrolled, "securepassword", "", ReasonCodeRequired, ErrTOTPCodeRequired},
+		{"second factor with a wrong code", enrolled, "securepassword", "000000", ReasonInvalidCode, ErrInvalidTOTPCode},
+		{"second factor with its code", enrolled, "securepassword", code, "", nil},
+		{"role requiring a second factor", admin, "securepassword", "", ReasonEnrollmentRequired, ErrTOTPEnrollmentRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, err := checkLogin(context.Background(), &execRecorder{rows: 1}, tt.state, true, tt.password, tt.code, "")
+			if reason != tt.reason || !errors.Is(err, tt.err) {
+				t.Errorf("checkLogin = %q, %v, want %q, %v", reason, err, tt.reason, tt.err)
+			}
+		})
+	}
+}
+
+// loginQuerier answers the QueryRow of selectTOTPState with the id of the user
+// of a lookup by email or by username, pgx.ErrNoRows when the id is 0
+type loginQuerier struct {
+	execRecorder
+	byEmail, byUsername int
+	queries             []string
+}
+
+func (q *loginQuerier) QueryRow(_ context.Context, sql string, _ ...any) pgx.Row {
+	q.queries = append(q.queries, sql)
+	id := q.byUsername
+	if strings.Contains(sql, "u.email=$1") {
+		id = q.byEmail
+	}
+	return loginRow(id)
+}
+
+type loginRow int
+
+func (r loginRow) Scan(dest ...any) error {
+	if r == 0 {
+		return pgx.ErrNoRows
+	}
+	*dest[0].(*int) = int(r)
+	return nil
+}
+
+func TestSelectLoginState(t *testing.T) {
+	tests := []struct {
+		name                string
+		byEmail, byUsername int
+		want                int // id of the user found, 0 for none
+		queries             int
+	}{
+		{"email", 3, 0, 3, 1},
+		{"email before a username", 3, 5, 3, 1},
+		{"only user of a username", 0, 5, 5, 2},
+		{"unknown or shared username", 0, 0, 0, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &loginQuerier{byEmail: tt.byEmail, byUsername: tt.byUsername}
+			state, found, err := selectLoginState(context.Background(), q, "ahmad")
+			if err != nil || found != (tt.want != 0) || state.ID != tt.want {
+				t.Errorf("selectLoginState = %d, %v, %v, want %d", state.ID, found, err, tt.want)
+			}
+			if len(q.queries) != tt.queries {
+				t.Errorf("queries = %d, want %d", len(q.queries), tt.queries)
+			}
+			// A username matches a single user, never the first of several
+			if len(q.queries) == 2 && !strings.Contains(q.queries[1], "count(*)") {
+				t.Errorf("username lookup %q does not refuse a shared username", q.queries[1])
+			}
+		})
+	}
+}
+
+func TestCheckEnrolled(t *testing.T) {
+	saved, savedLockout := accounts, lockoutConfig
+	t.Cleanup(func() { accounts, lockoutConfig = saved, savedLockout })
+	accounts.Secret = "0123456789abcdef0123456789abcdef"
+	lockoutConfig = LockoutConfig{Threshold: 5, Duration: time.Minute, MaxDuration: time.Hour}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("securepassword"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _ := totp.GenerateSecret()
+	sealed, _ := sealSecret(secret)
+	code, _ := totp.Code(secret, totp.Step(time.Now()))
+
+	enrolled := totpState{ID: 7, Password: string(hash), IsActive: true, Secret: &sealed}
+	locked := enrolled
+	locked.LockedFor = 60
+	notEnrolled := enrolled
+	notEnrolled.Secret = nil
+
+	tests := []struct {
+		name     string
+		state    totpState
+		password string
+		code     string
+		reason   string
+		err      error
+		counted  bool // the refusal counts towards the lock
+	}{
+		{"password and code", enrolled, "securepassword", code, "", nil, false},
+		{"wrong password", enrolled, "wrong", code, ReasonInvalidPassword, ErrCurrentPasswordInvalid, true},
+		{"wrong code", enrolled, "securepassword", "000000", ReasonInvalidCode, ErrInvalidTOTPCode, true},
+		{"missing code", enrolled, "securepassword", "", ReasonCodeRequired, ErrTOTPCodeRequired, false},
+		{"locked user", locked, "securepassword", code, ReasonLocked, &LockedError{}, false},
+		{"no second factor", notEnrolled, "securepassword", code, "", ErrTOTPNotEnabled, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := &execRecorder{rows: 1}
+			reason, err := checkEnrolled(context.Background(), q, tt.state, tt.password, tt.code, "")
+			if reason != tt.reason {
+				t.Errorf("reason = %q, want %q", reason, tt.reason)
+			}
+			if _, isLocked := tt.err.(*LockedError); isLocked {
+				if _, ok := AsLocked(err); !ok {
+					t.Errorf("err = %v, want a *LockedError", err)
+				}
+			} else if !errors.Is(err, tt.err) {
+				t.Errorf("err = %v, want %v", err, tt.err)
+			}
+			counted := false
+			for _, exec := range q.execs {
+				counted = counted || strings.HasPrefix(exec[0].(string), "UPDATE users SET failed_logins=$2")
+			}
+			if counted != tt.counted {
+				t.Errorf("failure counted = %v, want %v", counted, tt.counted)
+			}
+		})
+	}
+}
@@ -2,27 +2,36 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"portier/pkg/db"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	ID        int       `json:"id"`
-	Username  string    `json:"username"`
-	Email     string    `json:"email"`
-	Password  string    `json:"password"`
-	Name      string    `json:"name"`
-	GenderStr string    `json:"gender"` // Temporary field to hold the string value
-	Gender    bool      `json:"-"`      // true = male, false = female. This is to make the gender always flexible in the Frontend
-	IDNumber  string    `json:"id_number"`
-	UserImage string    `json:"user_image"`
-	TenantID  int       `json:"tenant_id"`
-	CreatedAt time.Time `json:"created_at"`
-	IsActive  bool      `json:"is_active"`
+	ID              int        `json:"id"`
+	Username        string     `json:"username"`
+	Email           string     `json:"email"`
+	Password        string     `json:"password"`
+	Name            string     `json:"name"`
+	GenderStr       string     `json:"gender"` // Temporary field to hold the string value
+	Gender          bool       `json:"-"`      // true = male, false = female. This is to make the gender always flexible in the Frontend
+	IDNumber        string     `json:"id_number"`
+	UserImage       string     `json:"user_image"`
+	TenantID        int        `json:"tenant_id"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`                 // Maintained by a trigger, sent as Last-Modified
+	Version         int        `json:"version"`                    // Incremented by every update, an update must send the version it read
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`          // nil until the address is verified, reset when it changes
+	CurrentPassword string     `json:"current_password,omitempty"` // Required by an update changing the password or the email, never returned
+	Role            string     `json:"role"`                       // admin, manager or user (default), an update without role keeps it
+	ServiceAccount  bool       `json:"service_account"`            // Set on create only, authenticates with API tokens and has no password
+	TOTPEnabled     bool       `json:"totp_enabled"`               // Read only, see the /users/:id/totp routes
+	IsActive        bool       `json:"is_active"`
 }
 
 // GetAllUsersResponse represents the response structure for GetAllUsers
@@ -51,34 +60,40 @@ func (u *User) ConvertGenderToStr() string {
 	return "0"
 }
 
-// GetAllUsers fetches all users
-func GetAllUsers(limit, offset int, name, idNumber string) (GetAllUsersResponse, error) {
+// userFilter is the search condition shared by the users list, its count and the export
+var userFilter = `name ILIKE $1 AND id_number ILIKE $2 AND ` + tenantScope("users", 3)
+
+// userFilterArgs returns the arguments of userFilter, empty values and a tenant of 0 match every user
+func userFilterArgs(name, idNumber string, tenantID int) []interface{} {
+	return []interface{}{"%" + name + "%", "%" + idNumber + "%", tenantID}
+}
+
+// GetAllUsers fetches all users of the tenant, of every tenant when it is 0.
+func GetAllUsers(ctx context.Context, limit, offset int, name, idNumber string, tenantID int) (GetAllUsersResponse, error) {
+	return cachedPage(ctx, "users", offset, []any{limit, offset, name, idNumber, tenantID}, func() (GetAllUsersResponse, error) {
+		return getAllUsers(ctx, limit, offset, name, idNumber, tenantID)
+	})
+}
+
+func getAllUsers(ctx context.Context, limit, offset int, name, idNumber string, tenantID int) (GetAllUsersResponse, error) {
 	dbConn := db.GetConnection()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
 	defer cancel()
 
-	// Set default values for name and idNumber if they are empty
-	if name == "" {
-		name = "%"
-	}
-	if idNumber == "" {
-		idNumber = "%"
-	}
-
 	// Build the query with optional search/filter parameters
-	query := `SELECT id, username, email, name, gender, id_number, user_image, tenant_id, created_at, is_active 
+	query := `SELECT id, username, email, name, gender, id_number, user_image, tenant_id, created_at, is_active, updated_at, version, email_verified_at, role, totp_enabled_at IS NOT NULL, service_account 
 						FROM users 
-						WHERE name ILIKE $1 AND id_number ILIKE $2 
-						ORDER BY id LIMIT $3 OFFSET $4`
-	args := []interface{}{"%" + name + "%", "%" + idNumber + "%", limit, offset}
+						WHERE ` + userFilter + ` 
+						ORDER BY id LIMIT $4 OFFSET $5`
+	args := append(userFilterArgs(name, idNumber, tenantID), limit, offset)
 
 	// Query to get the total count of users with the same filters
-	countQuery := `SELECT COUNT(*) FROM users WHERE name ILIKE $1 AND id_number ILIKE $2`
-	countArgs := []interface{}{"%" + name + "%", "%" + idNumber + "%"}
+	countQuery := `SELECT COUNT(*) FROM users WHERE ` + userFilter
+	countArgs := userFilterArgs(name, idNumber, tenantID)
 
 	var totalCount int
 	if err := dbConn.QueryRow(ctx, countQuery, countArgs...).Scan(&totalCount); err != nil {
-		return GetAllUsersResponse{}, fmt.Errorf("failed to get total count: %v", err)
+		return GetAllUsersResponse{}, fmt.Errorf("failed to get total count: %w", err)
 	}
 
 	// Calculate total pages
@@ -94,7 +109,7 @@ func GetAllUsers(limit, offset int, name, idNumber string) (GetAllUsersResponse,
 	var users []User
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Name, &user.Gender, &user.IDNumber, &user.UserImage, &user.TenantID, &user.CreatedAt, &user.IsActive); err != nil {
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Name, &user.Gender, &user.IDNumber, &user.UserImage, &user.TenantID, &user.CreatedAt, &user.IsActive, &user.UpdatedAt, &user.Version, &user.EmailVerifiedAt, &user.Role, &user.TOTPEnabled, &user.ServiceAccount); err != nil {
 			return GetAllUsersResponse{}, err
 		}
 		user.GenderStr = user.ConvertGenderToStr()
@@ -111,16 +126,62 @@ func GetAllUsers(limit, offset int, name, idNumber string) (GetAllUsersResponse,
 	}, nil
 }
 
-// GetUserByID fetches a user by their ID
-func GetUserByID(id int) (User, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Add context
+// StreamUsers calls fn for every user matching the filters of GetAllUsers, ordered by ID.
+// Rows are read from the database cursor one at a time and the password is never selected.
+func StreamUsers(ctx context.Context, name, idNumber string, tenantID int, fn func(User) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Export)
+	defer cancel()
+
+	query := `SELECT id, username, email, name, gender, id_number, user_image, tenant_id, created_at, is_active, updated_at, version, email_verified_at, role, totp_enabled_at IS NOT NULL, service_account 
+						FROM users 
+						WHERE ` + userFilter + ` 
+						ORDER BY id`
+	rows, err := db.GetConnection().Query(ctx, query, userFilterArgs(name, idNumber, tenantID)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Name, &user.Gender, &user.IDNumber, &user.UserImage, &user.TenantID, &user.CreatedAt, &user.IsActive, &user.UpdatedAt, &user.Version, &user.EmailVerifiedAt, &user.Role, &user.TOTPEnabled, &user.ServiceAccount); err != nil {
+			return err
+		}
+		user.GenderStr = user.ConvertGenderToStr()
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
 
+// GetUserByID fetches a user by their ID.
+func GetUserByID(ctx context.Context, id int) (User, error) {
+	return cached(ctx, "users", itemKey("users", id), cacheConfig.ItemTTL, func() (User, error) {
+		return getUserByID(ctx, id)
+	})
+}
+
+// GetUserByIDUncached is GetUserByID read from the database. The authorization
+// checks use it, a cached role or tenant may be stale.
+func GetUserByIDUncached(ctx context.Context, id int) (User, error) {
+	return getUserByID(ctx, id)
+}
+
+func getUserByID(ctx context.Context, id int) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Read)
+	defer cancel()
+
+	return selectUser(ctx, db.GetConnection(), id)
+}
+
+// selectUser reads a user with q, which is either the pool or a batch transaction
+func selectUser(ctx context.Context, q querier, id int) (User, error) {
 	var user User
 
-	query := `SELECT id, username, email, name, gender, id_number, user_image, tenant_id, created_at, is_active FROM users WHERE id=$1`
-	err := dbConn.QueryRow(ctx, query, id).Scan(&user.ID, &user.Username, &user.Email, &user.Name, &user.Gender, &user.IDNumber, &user.UserImage, &user.TenantID, &user.CreatedAt, &user.IsActive)
+	query := `SELECT id, username, email, name, gender, id_number, user_image, tenant_id, created_at, is_active, updated_at, version, email_verified_at, role, totp_enabled_at IS NOT NULL, service_account FROM users WHERE id=$1`
+	err := q.QueryRow(ctx, query, id).Scan(&user.ID, &user.Username, &user.Email, &user.Name, &user.Gender, &user.IDNumber, &user.UserImage, &user.TenantID, &user.CreatedAt, &user.IsActive, &user.UpdatedAt, &user.Version, &user.EmailVerifiedAt, &user.Role, &user.TOTPEnabled, &user.ServiceAccount)
 	if err != nil {
 		return User{}, err
 	}
@@ -129,32 +190,43 @@ func GetUserByID(id int) (User, error) {
 }
 
 // CreateUser creates a new user
-func CreateUser(user User) (User, error) {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
-
-	// If TenantID is not provided, fetch the first available tenant
-	if user.TenantID == 0 {
-		response, err := GetAllTenants(1, 0)
-		if err != nil {
-			fmt.Println("Error getting tenants:", err)
-			return user, err
-		}
+func CreateUser(ctx context.Context, user User) (User, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
 
-		if len(response.Tenants) > 0 {
-			user.TenantID = response.Tenants[0].ID
-		} else {
-			fmt.Println("No tenants found")
-			return user, fmt.Errorf("no tenants found")
-		}
+	created, err := createUser(ctx, db.GetConnection(), user)
+	if err == nil {
+		invalidate(ctx, "users")
+		sendVerifications(ctx, created.ID)
 	}
+	return created, err
+}
 
-	// Hash the password before storing it
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+// createUser inserts a user with q, which is either the pool or a batch transaction
+func createUser(ctx context.Context, q querier, user User) (User, error) {
+	// Validate the tenant, falling back to the configured default only when enabled
+	tenantID, err := resolveTenantID(ctx, q, user.TenantID)
 	if err != nil {
 		return User{}, err
 	}
+	user.TenantID = tenantID
+
+	// Hash the password before storing it. A service account, or a user provisioned
+	// without one (SCIM), has none and never matches.
+	hashedPassword := []byte(noPassword)
+	if !user.ServiceAccount && user.Password != "" {
+		hashedPassword, err = bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return User{}, err
+		}
+	}
+
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+	if !ValidRole(user.Role) {
+		return User{}, ErrInvalidRole
+	}
 
 	// Replace the original password with the hashed one
 	user.Password = string(hashedPassword)
@@ -162,70 +234,197 @@ func CreateUser(user User) (User, error) {
 	user.IsActive = true
 
 	// SQL query to insert a new user
-	query := `INSERT INTO users (username, email, password, name, gender, id_number, user_image, tenant_id, created_at, is_active) 
-						VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`
+	query := `INSERT INTO users (username, email, password, name, gender, id_number, user_image, tenant_id, created_at, is_active, role, service_account) 
+						VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id, updated_at, version`
 
 	// Insert user data into the database and retrieve the generated ID
 	var id int
-	err = dbConn.QueryRow(ctx, query, user.Username, user.Email, user.Password, user.Name, user.Gender, user.IDNumber, user.UserImage, user.TenantID, time.Now(), true).Scan(&id)
+	err = q.QueryRow(ctx, query, user.Username, user.Email, user.Password, user.Name, user.Gender, user.IDNumber, user.UserImage, user.TenantID, time.Now(), true, user.Role, user.ServiceAccount).Scan(&id, &user.UpdatedAt, &user.Version)
 	if err != nil {
-		log.Printf("Error creating user: %v", err)
-		return User{}, fmt.Errorf("failed to create user: %v", err) // Wrap the error with more context
+		slog.ErrorContext(ctx, "Error creating user", "error", err)
+		return User{}, fmt.Errorf("failed to create user: %w", err) // Wrap the error with more context
 	}
 
-	user.ID = id     // Set the generated user ID
-	return user, nil // Return the created user
+	user.ID = id       // Set the generated user ID
+	user.Password = "" // remove password from the response
+	return user, nil   // Return the created user
 }
 
-// UpdateUser updates a user's information
-func UpdateUser(id int, updatedUser User) (User, error) {
-	dbConn := db.GetConnection()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+// UpdateUser updates a user's information. A new password, or a new address
+// unless caller is an admin of the tenant, needs the current password, see checkOwnership.
+func UpdateUser(ctx context.Context, id int, updatedUser User, caller *Caller, client LoginClient) (User, error) {
+	if err := checkOwnership(ctx, id, updatedUser, caller, client); err != nil {
+		return User{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
 	defer cancel()
 
+	updated, err := updateUser(ctx, db.GetConnection(), id, updatedUser)
+	if err == nil {
+		invalidate(ctx, "users", id)
+		// A changed address lost its verification
+		sendVerifications(ctx, id)
+	}
+	return updated, err
+}
+
+// updateUser updates a user with q, which is either the pool or a batch
+// transaction. The caller checks the current password of a new one first.
+func updateUser(ctx context.Context, q querier, id int, updatedUser User) (User, error) {
+	if updatedUser.Version == 0 {
+		return User{}, ErrVersionRequired
+	}
+	if updatedUser.Role != "" && !ValidRole(updatedUser.Role) {
+		return User{}, ErrInvalidRole
+	}
+	// An update never falls back to a default tenant, it must be explicit
+	if updatedUser.TenantID == 0 {
+		return User{}, ErrTenantRequired
+	}
+	if _, err := resolveTenantID(ctx, q, updatedUser.TenantID); err != nil {
+		return User{}, err
+	}
+
 	// Check if the password is provided
 	if updatedUser.Password == "" {
-		log.Println("Updating user without password")
+		slog.DebugContext(ctx, "Updating user without password", "user_id", id)
 		// Update user without changing the password
-		updateQuery := `UPDATE users SET username=$1, email=$2, name=$3, gender=$4, id_number=$5, user_image=$6, tenant_id=$7, is_active=$8 WHERE id=$9`
-		_, err := dbConn.Exec(ctx, updateQuery, updatedUser.Username, updatedUser.Email, updatedUser.Name, updatedUser.Gender, updatedUser.IDNumber, updatedUser.UserImage, updatedUser.TenantID, updatedUser.IsActive, id)
-		if err != nil {
-			return User{}, fmt.Errorf("failed to update user: %v", err)
+		updateQuery := `UPDATE users SET username=$1, email=$2, name=$3, gender=$4, id_number=$5, user_image=$6, tenant_id=$7, is_active=$8, role=COALESCE(NULLIF($11, ''), role), email_verified_at=CASE WHEN email=$2 THEN email_verified_at END, version=version+1 WHERE id=$9 AND version=$10 RETURNING updated_at, version, email_verified_at, role, totp_enabled_at IS NOT NULL, service_account`
+		err := q.QueryRow(ctx, updateQuery, updatedUser.Username, updatedUser.Email, updatedUser.Name, updatedUser.Gender, updatedUser.IDNumber, updatedUser.UserImage, updatedUser.TenantID, updatedUser.IsActive, id, updatedUser.Version, updatedUser.Role).Scan(&updatedUser.UpdatedAt, &updatedUser.Version, &updatedUser.EmailVerifiedAt, &updatedUser.Role, &updatedUser.TOTPEnabled, &updatedUser.ServiceAccount)
+		if err := checkVersion(ctx, q, err, id, selectUser); err != nil {
+			return User{}, fmt.Errorf("failed to update user: %w", err)
 		}
 	} else {
-		log.Println("Updating user with password")
+		slog.DebugContext(ctx, "Updating user with password", "user_id", id)
 		// Hash the new password
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(updatedUser.Password), bcrypt.DefaultCost)
 		if err != nil {
-			return User{}, fmt.Errorf("failed to hash password: %v", err)
+			return User{}, fmt.Errorf("failed to hash password: %w", err)
 		}
 		updatedUser.Password = string(hashedPassword)
 
 		// Update user with the new password
-		updateQuery := `UPDATE users SET username=$1, email=$2, password=$3, name=$4, gender=$5, id_number=$6, user_image=$7, tenant_id=$8, is_active=$9 WHERE id=$10`
-		_, err = dbConn.Exec(ctx, updateQuery, updatedUser.Username, updatedUser.Email, updatedUser.Password, updatedUser.Name, updatedUser.Gender, updatedUser.IDNumber, updatedUser.UserImage, updatedUser.TenantID, updatedUser.IsActive, id)
-		if err != nil {
-			return User{}, fmt.Errorf("failed to update user: %v", err)
+		updateQuery := `UPDATE users SET username=$1, email=$2, password=$3, name=$4, gender=$5, id_number=$6, user_image=$7, tenant_id=$8, is_active=$9, role=COALESCE(NULLIF($12, ''), role), email_verified_at=CASE WHEN email=$2 THEN email_verified_at END, version=version+1 WHERE id=$10 AND version=$11 RETURNING updated_at, version, email_verified_at, role, totp_enabled_at IS NOT NULL, service_account`
+		err = q.QueryRow(ctx, updateQuery, updatedUser.Username, updatedUser.Email, updatedUser.Password, updatedUser.Name, updatedUser.Gender, updatedUser.IDNumber, updatedUser.UserImage, updatedUser.TenantID, updatedUser.IsActive, id, updatedUser.Version, updatedUser.Role).Scan(&updatedUser.UpdatedAt, &updatedUser.Version, &updatedUser.EmailVerifiedAt, &updatedUser.Role, &updatedUser.TOTPEnabled, &updatedUser.ServiceAccount)
+		if err := checkVersion(ctx, q, err, id, selectUser); err != nil {
+			return User{}, fmt.Errorf("failed to update user: %w", err)
 		}
 	}
 
+	// The reset links sent to a previous address stop working
+	if err := revokeResetTokens(ctx, q, id, updatedUser.Email); err != nil {
+		return User{}, err
+	}
+
 	// Return the updated user data
 	updatedUser.ID = id
 	updatedUser.Password = "" // remove password from the response
+	updatedUser.CurrentPassword = ""
 	return updatedUser, nil
 }
 
+// checkOwnership checks the current password, with CheckPassword for client,
+// of an update of the user id choosing a new password, see ResetPassword
+// otherwise. A new address receives the password reset links, so it needs the
+// current password too unless caller is an admin of the tenant of the user.
+func checkOwnership(ctx context.Context, id int, user User, caller *Caller, client LoginClient) error {
+	if user.Password == "" {
+		current, err := GetUserByIDUncached(ctx, id)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil // the update reports the missing user
+		}
+		if err != nil {
+			return err
+		}
+		if user.Email == current.Email || (caller != nil && caller.Role == RoleAdmin && caller.TenantID == current.TenantID) {
+			return nil
+		}
+	}
+	return CheckPassword(ctx, id, user.CurrentPassword, client)
+}
+
+// noPassword is the stored password of the users without one, not a bcrypt hash so no password matches it
+const noPassword = "!"
+
+// CheckPassword reports ErrCurrentPasswordInvalid unless password is the one of
+// the user. The check is recorded in the login history and counts towards the
+// lock of the user, a locked user or address gets a *LockedError.
+func CheckPassword(ctx context.Context, id int, password string, client LoginClient) error {
+	if password == "" {
+		return ErrCurrentPasswordRequired
+	}
+	err := checkUserAttempt(ctx, id, client, func(q querier, state totpState) (string, error) {
+		reason, err := checkPasswordAttempt(ctx, q, state, true, password, client.IP)
+		if err == nil {
+			err = clearFailures(ctx, q, state)
+		}
+		return reason, err
+	})
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		return nil // the update or the action that follows is a no-op
+	case errors.Is(err, ErrInvalidCredentials):
+		return ErrCurrentPasswordInvalid
+	}
+	return err
+}
+
+// checkUserAttempt runs check on the locked row of the user id in its own
+// transaction and records the attempt. A refusal, returned with its reason, is
+// committed with the failure it counts. Other errors roll back and are not
+// recorded. check may go on with the action the credentials authorize.
+func checkUserAttempt(ctx context.Context, id int, client LoginClient, check func(q querier, state totpState) (string, error)) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	tx, err := db.GetConnection().Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx) // no-op once committed
+
+	state, err := selectTOTPState(ctx, tx, `u.id=$1 FOR UPDATE OF u`, id)
+	if err != nil {
+		return err
+	}
+	reason, checkErr := check(tx, state)
+	if checkErr != nil && reason == "" {
+		return checkErr
+	}
+	if err := recordAttempt(ctx, tx, &state.ID, state.Email, client, reason); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	// The failures, the lock and the TOTP step bump updated_at, and the ETag with it
+	invalidate(ctx, "users", state.ID)
+	return checkErr
+}
+
 // DeleteUser deletes a user
-func DeleteUser(id int) error {
-	// Get a database connection
-	dbConn := db.GetConnection()
-	ctx := context.Background() // Context for the query
+func DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, timeouts.Write)
+	defer cancel()
+
+	err := deleteUser(ctx, db.GetConnection(), id)
+	if err == nil {
+		invalidate(ctx, "users", id)
+	}
+	return err
+}
 
+// deleteUser deletes a user with q, which is either the pool or a batch transaction
+func deleteUser(ctx context.Context, q querier, id int) error {
 	query := `DELETE FROM users WHERE id=$1`
-	_, err := dbConn.Exec(ctx, query, id)
+	tag, err := q.Exec(ctx, query, id)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
 
 	return nil
 }
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// Store keeps values until they expire. Get returns nil without error for a
+// missing or expired key. fiber.Storage implementations, such as the Postgres
+// storage of pkg/storage, satisfy it.
+type Store interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+	Delete(key string) error
+}
+
+// Memory is a Store kept in the memory of the process, for tests and single instances.
+// A ttl of 0 keeps the value until it is deleted.
+type Memory struct {
+	mu      sync.Mutex
+	entries map[string]entry
+	done    chan struct{}
+	close   sync.Once
+}
+
+type entry struct {
+	value   []byte
+	expires time.Time // zero = never
+}
+
+// NewMemory returns an empty memory store. Expired entries are removed when read
+// and by a sweep every interval, until Close.
+func NewMemory(interval time.Duration) *Memory {
+	m := &Memory{entries: map[string]entry{}, done: make(chan struct{})}
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.sweep()
+			case <-m.done:
+				return
+			}
+		}
+	}()
+	return m
+}
+
+// Close stops the sweep, the entries stay readable. It can be called more than once.
+func (m *Memory) Close() error {
+	m.close.Do(func() { close(m.done) })
+	return nil
+}
+
+func (m *Memory) Get(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(m.entries, key)
+		return nil, nil
+	}
+	return e.value, nil
+}
+
+func (m *Memory) Set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e := entry{value: value}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	m.entries[key] = e
+	return nil
+}
+
+func (m *Memory) Delete(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.entries, key)
+	return nil
+}
+
+func (m *Memory) sweep() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for key, e := range m.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(m.entries, key)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	m := NewMemory(time.Hour)
+	defer m.Close()
+
+	if v, err := m.Get("missing"); v != nil || err != nil {
+		t.Fatalf("Get(missing) = %q, %v, want nil, nil", v, err)
+	}
+
+	m.Set("kept", []byte("a"), 0)
+	m.Set("short", []byte("b"), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	if v, _ := m.Get("kept"); string(v) != "a" {
+		t.Errorf("Get(kept) = %q, want a", v)
+	}
+	if v, _ := m.Get("short"); v != nil {
+		t.Errorf("Get(short) = %q after its ttl, want nil", v)
+	}
+
+	m.Delete("kept")
+	if v, _ := m.Get("kept"); v != nil {
+		t.Errorf("Get(kept) = %q after Delete, want nil", v)
+	}
+}
+
+func TestMemorySweep(t *testing.T) {
+	m := NewMemory(time.Hour)
+	defer m.Close()
+	m.Set("expired", []byte("a"), time.Millisecond)
+	m.Set("kept", []byte("b"), time.Hour)
+	time.Sleep(5 * time.Millisecond)
+
+	m.sweep()
+	if _, ok := m.entries["expired"]; ok {
+		t.Error("sweep kept an expired entry")
+	}
+	if _, ok := m.entries["kept"]; !ok {
+		t.Error("sweep removed an entry before its ttl")
+	}
+}
+
+func TestMemoryClose(t *testing.T) {
+	m := NewMemory(time.Millisecond)
+	m.Set("kept", []byte("a"), 0)
+
+	// The entries stay readable, closing twice is harmless
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := m.Get("kept"); string(v) != "a" {
+		t.Errorf("Get(kept) = %q after Close, want a", v)
+	}
+}
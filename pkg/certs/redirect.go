@@ -0,0 +1,48 @@
+package certs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RedirectServer answers every plain HTTP request with a redirect to HTTPS
+type RedirectServer struct {
+	srv *http.Server
+}
+
+// NewRedirectServer listens on addr and redirects to the same host and path on
+// httpsPort. The port is left out of the location when it is 443.
+func NewRedirectServer(addr, httpsPort string) *RedirectServer {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host // no port in the Host header
+		}
+		if host == "" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		// 308 keeps the method and the body of the request
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	return &RedirectServer{srv: &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}}
+}
+
+// ListenAndServe blocks until the server fails or Shutdown is called
+func (s *RedirectServer) ListenAndServe() error {
+	if err := s.srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops the server, waiting for running requests until ctx expires
+func (s *RedirectServer) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
@@ -2,44 +2,109 @@ package db
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 var (
-	conn *pgx.Conn
-	once sync.Once
+	pool    *pgxpool.Pool
+	once    sync.Once
+	tracers []pgx.QueryTracer
 )
 
-// ConnectPostgres establishes a connection to the PostgreSQL database
-func ConnectPostgres(dsn string) *pgx.Conn {
+// AddTracer registers a tracer called for every query of the pool.
+// It must be called before ConnectPostgres.
+func AddTracer(tracer pgx.QueryTracer) {
+	tracers = append(tracers, tracer)
+}
+
+// PoolConfig sizes the connection pool, zero values keep the pgx defaults
+type PoolConfig struct {
+	MaxConns          int32
+	MinConns          int32
+	MaxConnLifetime   time.Duration // connections are closed and replaced after this duration
+	MaxConnIdleTime   time.Duration // idle connections are closed after this duration
+	HealthCheckPeriod time.Duration // how often idle connections are checked
+}
+
+// ConnectPostgres establishes a connection pool to the PostgreSQL database.
+// A pool is required because requests run concurrently and batch requests
+// hold a connection for the duration of their transaction.
+func ConnectPostgres(dsn string, cfg PoolConfig) *pgxpool.Pool {
 	once.Do(func() {
-		var err error
-		conn, err = pgx.Connect(context.Background(), dsn)
+		poolConfig, err := pgxpool.ParseConfig(dsn)
+		if err != nil {
+			slog.Error("Invalid database DSN", "error", err)
+			os.Exit(1)
+		}
+		if cfg.MaxConns > 0 {
+			poolConfig.MaxConns = cfg.MaxConns
+		}
+		if cfg.MinConns > 0 {
+			poolConfig.MinConns = cfg.MinConns
+		}
+		if cfg.MaxConnLifetime > 0 {
+			poolConfig.MaxConnLifetime = cfg.MaxConnLifetime
+		}
+		if cfg.MaxConnIdleTime > 0 {
+			poolConfig.MaxConnIdleTime = cfg.MaxConnIdleTime
+		}
+		if cfg.HealthCheckPeriod > 0 {
+			poolConfig.HealthCheckPeriod = cfg.HealthCheckPeriod
+		}
+		if len(tracers) > 0 {
+			poolConfig.ConnConfig.Tracer = multiTracer(tracers)
+		}
+
+		pool, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
 		if err != nil {
-			log.Fatalf("Unable to connect to database: %v", err)
+			slog.Error("Unable to connect to database", "error", err)
+			os.Exit(1)
 		}
-		log.Println("Successfully connected to PostgreSQL!")
+		if err = pool.Ping(context.Background()); err != nil {
+			slog.Error("Unable to connect to database", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Successfully connected to PostgreSQL")
 	})
-	return conn
+	return pool
 }
 
-// GetConnection returns the established database connection
-func GetConnection() *pgx.Conn {
-	if conn == nil {
-		log.Fatal("Database connection is not established yet")
+// GetConnection returns the established database connection pool
+func GetConnection() *pgxpool.Pool {
+	if pool == nil {
+		slog.Error("Database connection is not established yet")
+		os.Exit(1)
 	}
-	return conn
+	return pool
 }
 
-// Close the database connection
+// Close the database connection pool
 func Close() {
-	if conn != nil {
-		err := conn.Close(context.Background())
-		if err != nil {
-			log.Fatalf("Failed to close database connection: %v", err)
-		}
+	if pool != nil {
+		pool.Close()
+	}
+}
+
+// CloseWithContext closes the pool like Close. Closing waits for the connections
+// in use, an error is returned when they are not released before ctx expires.
+func CloseWithContext(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("database connections still in use: %v", ctx.Err())
 	}
 }
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// multiTracer calls every registered tracer. The context returned by the last
+// start is passed to every end, it carries the values stored by each tracer.
+type multiTracer []pgx.QueryTracer
+
+func (m multiTracer) TraceQueryStart(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	for _, tracer := range m {
+		ctx = tracer.TraceQueryStart(ctx, conn, data)
+	}
+	return ctx
+}
+
+func (m multiTracer) TraceQueryEnd(ctx context.Context, conn *pgx.Conn, data pgx.TraceQueryEndData) {
+	for i := len(m) - 1; i >= 0; i-- {
+		m[i].TraceQueryEnd(ctx, conn, data)
+	}
+}
+
+// queryTable finds the first table a statement reads from or writes to
+var queryTable = regexp.MustCompile(`(?i)\b(?:FROM|INTO|UPDATE)\s+"?([A-Za-z_][A-Za-z0-9_.]*)`)
+
+// QueryLabel returns a low cardinality name for sql, "SELECT id FROM users WHERE id=$1" becomes "select users"
+func QueryLabel(sql string) string {
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return "unknown"
+	}
+	verb := strings.ToLower(fields[0])
+	if match := queryTable.FindStringSubmatch(sql); match != nil {
+		return verb + " " + strings.ToLower(match[1])
+	}
+	return verb
+}
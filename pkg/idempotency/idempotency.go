@@ -0,0 +1,177 @@
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"portier/pkg/logging"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Config sets how long the responses of idempotent requests are kept
+type Config struct {
+	Enabled      bool          `mapstructure:"enabled" yaml:"enabled"`
+	Window       time.Duration `mapstructure:"window" yaml:"window"`               // a retry within the window replays the response
+	InFlightTTL  time.Duration `mapstructure:"in_flight_ttl" yaml:"in_flight_ttl"` // a key whose request never finished is released after it
+	MaxKeyLength int           `mapstructure:"max_key_length" yaml:"max_key_length"`
+}
+
+// Headers of an idempotent request and of its replayed response
+const (
+	HeaderKey      = "Idempotency-Key"
+	HeaderReplayed = "Idempotent-Replayed"
+)
+
+var (
+	cfg   Config
+	store fiber.Storage
+
+	// A key is read and claimed in two storage calls, requests for the same key
+	// wait for each other. Other instances sharing the storage may still
+	// interleave, like the rate limit counters.
+	locks [64]sync.Mutex
+)
+
+// record is stored under the key, first in flight, then with the response
+type record struct {
+	Fingerprint string `json:"fingerprint"`
+	Done        bool   `json:"done"`
+	Status      int    `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body,omitempty"`
+}
+
+// Setup stores the responses in storage, requests are not deduplicated until it is called
+func Setup(storage fiber.Storage, c Config) {
+	store = storage
+	cfg = c
+}
+
+// Middleware makes a POST safe to retry when it carries an Idempotency-Key header.
+// The first request runs and its response is kept for cfg.Window, a retry with
+// the same key and payload gets the same response without running again.
+// The same key with another payload answers 422, and 409 while the first
+// request is still running. Requests without the header are not affected.
+func Middleware(c *fiber.Ctx) error {
+	key := c.Get(HeaderKey)
+	if !cfg.Enabled || store == nil || key == "" {
+		return c.Next()
+	}
+	if len(key) > cfg.MaxKeyLength {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Idempotency-Key must not be longer than " + strconv.Itoa(cfg.MaxKeyLength) + " characters",
+		})
+	}
+
+	storageKey := storageKey(c, key)
+	fingerprint := fingerprint(c)
+
+	existing, claimed, err := claim(storageKey, fingerprint)
+	if err != nil {
+		// Fail open, the request runs like one without the header
+		slog.WarnContext(c.UserContext(), "Idempotency key not checked", "error", err)
+		return c.Next()
+	}
+	if !claimed {
+		switch {
+		case existing.Fingerprint != fingerprint:
+			return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+				"error": "Idempotency-Key was already used with a different request",
+			})
+		case !existing.Done:
+			c.Set(fiber.HeaderRetryAfter, "1")
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "A request with this Idempotency-Key is still in progress",
+			})
+		}
+		c.Set(HeaderReplayed, "true")
+		c.Set(fiber.HeaderContentType, existing.ContentType)
+		return c.Status(existing.Status).Send(existing.Body)
+	}
+
+	if err := c.Next(); err != nil {
+		release(c, storageKey)
+		return err
+	}
+
+	// Server errors, timeouts and rate limited requests are not kept, a retry runs again
+	status := c.Response().StatusCode()
+	if status >= fiber.StatusInternalServerError || status == fiber.StatusTooManyRequests {
+		release(c, storageKey)
+		return nil
+	}
+	done := record{
+		Fingerprint: fingerprint,
+		Done:        true,
+		Status:      status,
+		ContentType: string(c.Response().Header.ContentType()),
+		Body:        append([]byte(nil), c.Response().Body()...),
+	}
+	if err := save(storageKey, done, cfg.Window); err != nil {
+		slog.WarnContext(c.UserContext(), "Idempotent response not kept", "error", err)
+	}
+	return nil
+}
+
+// storageKey scopes key to the route and to the caller when known, two users
+// choosing the same key never see each other's responses
+func storageKey(c *fiber.Ctx, key string) string {
+	caller := "ip:" + c.IP()
+	if info := logging.RequestFrom(c.UserContext()); info != nil && info.UserID != 0 {
+		caller = "user:" + strconv.Itoa(info.UserID)
+	}
+	sum := sha256.Sum256([]byte(c.Method() + " " + c.Route().Path + " " + caller + " " + key))
+	return "idempotency:" + hex.EncodeToString(sum[:])
+}
+
+// fingerprint identifies the payload of the request
+func fingerprint(c *fiber.Ctx) string {
+	sum := sha256.Sum256(append([]byte(c.OriginalURL()+"\n"), c.Body()...))
+	return hex.EncodeToString(sum[:])
+}
+
+// claim returns the record of key, or stores an in-flight record when there is
+// none and reports that the caller owns the key
+func claim(key, fingerprint string) (record, bool, error) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	lock := &locks[h.Sum32()%uint32(len(locks))]
+	lock.Lock()
+	defer lock.Unlock()
+
+	raw, err := store.Get(key)
+	if err != nil {
+		return record{}, false, err
+	}
+	if raw != nil {
+		var existing record
+		if err := json.Unmarshal(raw, &existing); err == nil {
+			return existing, false, nil
+		}
+	}
+	if err := save(key, record{Fingerprint: fingerprint}, cfg.InFlightTTL); err != nil {
+		return record{}, false, err
+	}
+	return record{}, true, nil
+}
+
+func save(key string, r record, ttl time.Duration) error {
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return store.Set(key, raw, ttl)
+}
+
+// release forgets a key whose request failed, so it can be retried
+func release(c *fiber.Ctx, key string) {
+	if err := store.Delete(key); err != nil {
+		slog.WarnContext(c.UserContext(), "Idempotency key not released", "error", err)
+	}
+}
@@ -0,0 +1,136 @@
+package idempotency
+
+import (
+	"io"
+	"net/http/httptest"
+	"portier/pkg/cache"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// memoryStorage is a fiber.Storage kept in memory
+type memoryStorage struct{ *cache.Memory }
+
+func (memoryStorage) Reset() error { return nil }
+
+// newApp returns an app whose POST /items answers the status of the query
+// parameter status, 201 by default, and counts its runs
+func newApp(t *testing.T, runs *int) *fiber.App {
+	t.Helper()
+	memory := cache.NewMemory(time.Hour)
+	t.Cleanup(func() { memory.Close() })
+	Setup(memoryStorage{memory}, Config{Enabled: true, Window: time.Hour, InFlightTTL: time.Minute, MaxKeyLength: 16})
+	t.Cleanup(func() { Setup(nil, Config{}) })
+
+	app := fiber.New()
+	app.Post("/items", Middleware, func(c *fiber.Ctx) error {
+		*runs++
+		return c.Status(c.QueryInt("status", fiber.StatusCreated)).JSON(fiber.Map{"run": *runs})
+	})
+	return app
+}
+
+func TestMiddleware(t *testing.T) {
+	type request struct {
+		key, target, body string
+		status            int
+		replayed          bool
+		runs              int // handler runs once the request is answered
+	}
+	tests := []struct {
+		name     string
+		requests []request
+	}{
+		{"replay", []request{
+			{"k1", "/items", `{"a":1}`, 201, false, 1},
+			{"k1", "/items", `{"a":1}`, 201, true, 1},
+		}},
+		{"other payload", []request{
+			{"k1", "/items", `{"a":1}`, 201, false, 1},
+			{"k1", "/items", `{"a":2}`, 422, false, 1},
+			{"k1", "/items?x=1", `{"a":1}`, 422, false, 1},
+		}},
+		{"other key", []request{
+			{"k1", "/items", `{"a":1}`, 201, false, 1},
+			{"k2", "/items", `{"a":1}`, 201, false, 2},
+		}},
+		{"client error kept", []request{
+			{"k1", "/items?status=400", `{}`, 400, false, 1},
+			{"k1", "/items?status=400", `{}`, 400, true, 1},
+		}},
+		{"server error released", []request{
+			{"k1", "/items?status=503", `{}`, 503, false, 1},
+			{"k1", "/items?status=503", `{}`, 503, false, 2},
+		}},
+		{"rate limited released", []request{
+			{"k1", "/items?status=429", `{}`, 429, false, 1},
+			{"k1", "/items?status=429", `{}`, 429, false, 2},
+		}},
+		{"no key", []request{
+			{"", "/items", `{}`, 201, false, 1},
+			{"", "/items", `{}`, 201, false, 2},
+		}},
+		{"key too long", []request{
+			{strings.Repeat("k", 17), "/items", `{}`, 400, false, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			app := newApp(t, &runs)
+			var first string
+			for i, r := range tt.requests {
+				req := httptest.NewRequest(fiber.MethodPost, r.target, strings.NewReader(r.body))
+				req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+				if r.key != "" {
+					req.Header.Set(HeaderKey, r.key)
+				}
+				resp, err := app.Test(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				if resp.StatusCode != r.status || runs != r.runs {
+					t.Fatalf("request %d = %d after %d runs, want %d after %d runs", i, resp.StatusCode, runs, r.status, r.runs)
+				}
+				if replayed := resp.Header.Get(HeaderReplayed) == "true"; replayed != r.replayed {
+					t.Errorf("request %d %s = %v, want %v", i, HeaderReplayed, replayed, r.replayed)
+				}
+				if i == 0 {
+					first = string(body)
+				} else if r.replayed && (string(body) != first || resp.Header.Get(fiber.HeaderContentType) != fiber.MIMEApplicationJSON) {
+					t.Errorf("replayed %s %q, want the first response %q", resp.Header.Get(fiber.HeaderContentType), body, first)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareInFlight(t *testing.T) {
+	runs := 0
+	app := newApp(t, &runs)
+
+	// The first request is still running while the retry arrives
+	app.Post("/slow", Middleware, func(c *fiber.Ctx) error {
+		req := httptest.NewRequest(fiber.MethodPost, "/slow", strings.NewReader(`{}`))
+		req.Header.Set(HeaderKey, "k1")
+		resp, err := app.Test(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != fiber.StatusConflict || resp.Header.Get(fiber.HeaderRetryAfter) != "1" {
+			t.Errorf("retry in flight = %d, Retry-After %q, want 409 and 1", resp.StatusCode, resp.Header.Get(fiber.HeaderRetryAfter))
+		}
+		return c.SendStatus(fiber.StatusCreated)
+	})
+
+	req := httptest.NewRequest(fiber.MethodPost, "/slow", strings.NewReader(`{}`))
+	req.Header.Set(HeaderKey, "k1")
+	resp, err := app.Test(req)
+	if err != nil || resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("first request = %v, %v", resp, err)
+	}
+}
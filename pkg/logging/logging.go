@@ -0,0 +1,99 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup installs a JSON logger writing to stdout as the default slog logger.
+// level is debug, info, warn or error, empty means info. Output of the
+// standard log package is sent through the same logger.
+func Setup(level string) error {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(strings.TrimSpace(level))); err != nil {
+			return fmt.Errorf("invalid log level %q, expected debug, info, warn or error", level)
+		}
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: lvl})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	return nil
+}
+
+// RequestInfo identifies the request a log line belongs to.
+// TenantID and UserID are 0 until the caller is known.
+type RequestInfo struct {
+	ID       string
+	TenantID int
+	UserID   int
+}
+
+type requestInfoKey struct{}
+
+// WithRequest returns a copy of ctx carrying info
+func WithRequest(ctx context.Context, info *RequestInfo) context.Context {
+	if info == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestFrom returns the request info stored in ctx, nil when there is none
+func RequestFrom(ctx context.Context) *RequestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info
+}
+
+// SetCaller records the authenticated user and tenant of the request stored in ctx
+func SetCaller(ctx context.Context, userID, tenantID int) {
+	if info := RequestFrom(ctx); info != nil {
+		info.UserID = userID
+		info.TenantID = tenantID
+	}
+}
+
+// CopyRequest returns dst carrying a copy of the request info of src, for
+// work that outlives the request such as background jobs and streamed bodies
+func CopyRequest(dst, src context.Context) context.Context {
+	info := RequestFrom(src)
+	if info == nil {
+		return dst
+	}
+	copied := *info
+	return WithRequest(dst, &copied)
+}
+
+// contextHandler adds the request info and the trace of the context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info := RequestFrom(ctx); info != nil {
+		r.AddAttrs(slog.String("request_id", info.ID))
+		if info.TenantID != 0 {
+			r.AddAttrs(slog.Int("tenant_id", info.TenantID))
+		}
+		if info.UserID != 0 {
+			r.AddAttrs(slog.Int("user_id", info.UserID))
+		}
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		r.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
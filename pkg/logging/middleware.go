@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"errors"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// HeaderRequestID carries the request ID from and to the client
+const HeaderRequestID = "X-Request-ID"
+
+// validRequestID limits the IDs accepted from clients, anything else is replaced
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestID reuses the X-Request-ID header of the request or generates a new ID.
+// The ID is returned in the response header and attached to the user context,
+// so every log line written with that context carries it.
+func RequestID(c *fiber.Ctx) error {
+	id := c.Get(HeaderRequestID)
+	if !validRequestID.MatchString(id) {
+		id = uuid.NewString()
+	}
+
+	c.Set(HeaderRequestID, id)
+	c.SetUserContext(WithRequest(c.UserContext(), &RequestInfo{ID: id}))
+	return c.Next()
+}
+
+// RequestLogger logs one line per request with its status and latency.
+// It must run after RequestID.
+func RequestLogger(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	// A returned error is turned into the response by the error handler, after this middleware
+	status := c.Response().StatusCode()
+	if err != nil {
+		status = fiber.StatusInternalServerError
+		var fiberErr *fiber.Error
+		if errors.As(err, &fiberErr) {
+			status = fiberErr.Code
+		}
+	}
+
+	level := slog.LevelInfo
+	if status >= fiber.StatusInternalServerError {
+		level = slog.LevelError
+	} else if status >= fiber.StatusBadRequest {
+		level = slog.LevelWarn
+	}
+
+	attrs := []slog.Attr{
+		slog.String("method", c.Method()),
+		slog.String("path", c.Path()),
+		slog.String("route", c.Route().Path),
+		slog.Int("status", status),
+		slog.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+		slog.String("ip", c.IP()),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", err.Error()))
+	}
+	slog.LogAttrs(c.UserContext(), level, "request", attrs...)
+
+	return err
+}
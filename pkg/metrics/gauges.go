@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// scrapeTimeout limits the queries run while collecting gauges
+const scrapeTimeout = 5 * time.Second
+
+// Sample is one value of a labelled gauge, Labels are in the order given to RegisterGaugeFunc
+type Sample struct {
+	Labels []string
+	Value  float64
+}
+
+// gaugeFunc is a labelled gauge read by fn on every scrape
+type gaugeFunc struct {
+	desc *prometheus.Desc
+	fn   func(ctx context.Context) ([]Sample, error)
+}
+
+func (g *gaugeFunc) Describe(ch chan<- *prometheus.Desc) {
+	ch <- g.desc
+}
+
+func (g *gaugeFunc) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), scrapeTimeout)
+	defer cancel()
+
+	samples, err := g.fn(ctx)
+	if err != nil {
+		slog.Error("Error collecting metric", "metric", g.desc.String(), "error", err)
+		ch <- prometheus.NewInvalidMetric(g.desc, err)
+		return
+	}
+	for _, sample := range samples {
+		ch <- prometheus.MustNewConstMetric(g.desc, prometheus.GaugeValue, sample.Value, sample.Labels...)
+	}
+}
+
+// RegisterGaugeFunc registers a gauge whose samples are read by fn on every scrape,
+// used for values that live in the database such as the active keys of a tenant
+func RegisterGaugeFunc(name, help string, labels []string, fn func(ctx context.Context) ([]Sample, error)) {
+	Registry.MustRegister(&gaugeFunc{
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, labels, nil),
+		fn:   fn,
+	})
+}
@@ -0,0 +1,209 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config sets how the identity providers are reached and how long their metadata is kept
+type Config struct {
+	HTTPTimeout time.Duration // every request to a provider
+	CacheTTL    time.Duration // discovery documents and signing keys
+}
+
+// Client is the registration of the application at a provider
+type Client struct {
+	ID          string
+	Secret      string // empty for a public client, PKCE still protects the code
+	RedirectURL string
+	Scopes      []string // "openid" is always requested
+}
+
+// Provider is an identity provider known by its discovery document
+type Provider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys *keySet
+}
+
+// TokenResponse is the answer of the token endpoint
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+var (
+	cfg        = Config{HTTPTimeout: 10 * time.Second, CacheTTL: time.Hour}
+	httpClient = &http.Client{Timeout: cfg.HTTPTimeout}
+
+	mu        sync.Mutex
+	providers = map[string]cachedProvider{}
+)
+
+type cachedProvider struct {
+	provider *Provider
+	expires  time.Time
+}
+
+// Setup sets the timeout and the cache lifetime, the defaults are 10s and 1h
+func Setup(c Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	cfg = c
+	httpClient = &http.Client{Timeout: c.HTTPTimeout}
+	providers = map[string]cachedProvider{}
+}
+
+// Discover returns the provider of issuer from its discovery document, cached for cfg.CacheTTL
+func Discover(ctx context.Context, issuer string) (*Provider, error) {
+	issuer = strings.TrimRight(issuer, "/")
+	mu.Lock()
+	cached, ok := providers[issuer]
+	mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.provider, nil
+	}
+
+	var p Provider
+	if err := getJSON(ctx, issuer+"/.well-known/openid-configuration", &p); err != nil {
+		return nil, fmt.Errorf("failed to discover %s: %w", issuer, err)
+	}
+	// The document must describe the issuer it was fetched from (OpenID Connect Discovery 4.3)
+	if strings.TrimRight(p.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("discovery document of %s names issuer %q", issuer, p.Issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, fmt.Errorf("discovery document of %s misses an endpoint", issuer)
+	}
+	p.keys = &keySet{uri: p.JWKSURI}
+
+	mu.Lock()
+	providers[issuer] = cachedProvider{provider: &p, expires: time.Now().Add(cfg.CacheTTL)}
+	mu.Unlock()
+	return &p, nil
+}
+
+// AuthCodeURL is the URL the browser is sent to, with the S256 challenge of the PKCE verifier
+func (p *Provider) AuthCodeURL(client Client, state, nonce, verifier string) string {
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", client.ID)
+	params.Set("redirect_uri", client.RedirectURL)
+	params.Set("scope", strings.Join(scopes(client.Scopes), " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", Challenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return p.AuthorizationEndpoint + sep + params.Encode()
+}
+
+// Exchange trades an authorization code and its PKCE verifier for tokens
+func (p *Provider) Exchange(ctx context.Context, client Client, code, verifier string) (TokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", client.RedirectURL)
+	form.Set("code_verifier", verifier)
+	form.Set("client_id", client.ID)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if client.Secret != "" {
+		// client_secret_basic, the default authentication method of the token endpoint
+		req.SetBasicAuth(url.QueryEscape(client.ID), url.QueryEscape(client.Secret))
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return TokenResponse{}, fmt.Errorf("failed to call the token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		json.Unmarshal(body, &oauthErr)
+		return TokenResponse{}, fmt.Errorf("token endpoint answered %d: %s %s", resp.StatusCode, oauthErr.Error, oauthErr.Description)
+	}
+
+	var tokens TokenResponse
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return TokenResponse{}, fmt.Errorf("malformed token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return TokenResponse{}, errors.New("token response has no id_token")
+	}
+	return tokens, nil
+}
+
+// NewVerifier returns a random value for state, nonce and PKCE verifiers
+func NewVerifier() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// Challenge is the S256 PKCE challenge of verifier (RFC 7636)
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func scopes(extra []string) []string {
+	all := []string{"openid"}
+	for _, s := range extra {
+		if s != "openid" && s != "" {
+			all = append(all, s)
+		}
+	}
+	return all
+}
+
+func getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s answered %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,258 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mockIdP is an identity provider serving its discovery document, its signing
+// keys and a token endpoint answering idToken for the code "good-code"
+type mockIdP struct {
+	*httptest.Server
+	rsaKey  *rsa.PrivateKey
+	ecKey   *ecdsa.PrivateKey
+	idToken string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{rsaKey: rsaKey, ecKey: ecKey}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.URL,
+			"authorization_endpoint": idp.URL + "/authorize",
+			"token_endpoint":         idp.URL + "/token",
+			"jwks_uri":               idp.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		b64 := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kty": "RSA", "kid": "rsa", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "RSA", "kid": "enc", "use": "enc", "n": b64(rsaKey.N.Bytes()), "e": "AQAB"},
+		}})
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		id, secret, _ := r.BasicAuth()
+		if r.FormValue("grant_type") != "authorization_code" || r.FormValue("code") != "good-code" ||
+			r.FormValue("code_verifier") != "verifier" || id != "portier" || secret != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "bad code"})
+			return
+		}
+		json.NewEncoder(w).Encode(TokenResponse{AccessToken: "at", TokenType: "Bearer", IDToken: idp.idToken, ExpiresIn: 300})
+	})
+	idp.Server = httptest.NewServer(mux)
+	t.Cleanup(idp.Close)
+
+	Setup(Config{HTTPTimeout: 5 * time.Second, CacheTTL: time.Hour})
+	return idp
+}
+
+// claims are valid claims of an ID token issued for the client portier
+func (idp *mockIdP) claims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"iss":            idp.URL,
+		"sub":            "user-1",
+		"aud":            "portier",
+		"nonce":          "nonce",
+		"iat":            now.Unix(),
+		"exp":            now.Add(5 * time.Minute).Unix(),
+		"email":          "ahmad@example.com",
+		"email_verified": "true",
+		"groups":         []string{"staff", "portier-admins"},
+	}
+}
+
+// sign returns the token of claims with the header alg and kid, signed by the
+// key of kid for the algorithm
+func (idp *mockIdP) sign(t *testing.T, alg, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, idp.rsaKey, crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, idp.rsaKey, crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, idp.ecKey, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	default:
+		signature = []byte("signature")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestDiscover(t *testing.T) {
+	idp := newMockIdP(t)
+	ctx := context.Background()
+
+	p, err := Discover(ctx, idp.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.TokenEndpoint != idp.URL+"/token" || p.JWKSURI != idp.URL+"/jwks" {
+		t.Errorf("Discover = %+v", p)
+	}
+	if cached, _ := Discover(ctx, idp.URL); cached != p {
+		t.Error("Discover did not return the cached provider")
+	}
+
+	// The document must name the issuer it was fetched from
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": idp.URL, "authorization_endpoint": "a", "token_endpoint": "t", "jwks_uri": "j"})
+	}))
+	defer other.Close()
+	if _, err := Discover(ctx, other.URL); err == nil {
+		t.Error("Discover accepted a document naming another issuer")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	idp := newMockIdP(t)
+	idp.idToken = "id-token"
+	p, err := Discover(context.Background(), idp.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client{ID: "portier", Secret: "secret", RedirectURL: "http://localhost:4000/oidc/callback"}
+
+	tokens, err := p.Exchange(context.Background(), client, "good-code", "verifier")
+	if err != nil || tokens.IDToken != "id-token" {
+		t.Fatalf("Exchange = %+v, %v", tokens, err)
+	}
+	if _, err := p.Exchange(context.Background(), client, "bad-code", "verifier"); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Errorf("Exchange of a bad code = %v, want the invalid_grant error", err)
+	}
+	if _, err := p.Exchange(context.Background(), client, "good-code", "other"); err == nil {
+		t.Error("Exchange accepted a wrong PKCE verifier")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	idp := newMockIdP(t)
+	p, err := Discover(context.Background(), idp.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := idp.claims()
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+	// A token of the right header signed by another key
+	forged := idp.sign(t, "RS256", "rsa", idp.claims())
+	parts := strings.Split(forged, ".")
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	otherSignature, _ := rsa.SignPKCS1v15(rand.Reader, otherKey, crypto.SHA256, digest[:])
+	forged = parts[0] + "." + parts[1] + "." + base64.RawURLEncoding.EncodeToString(otherSignature)
+	// A valid token whose claims were changed after the signature
+	tampered := idp.sign(t, "RS256", "rsa", idp.claims())
+	parts = strings.Split(tampered, ".")
+	payload, _ := json.Marshal(with("sub", "admin"))
+	tampered = parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+
+	tests := []struct {
+		name  string
+		token string
+		error string // empty when the token is valid
+	}{
+		{"RS256", idp.sign(t, "RS256", "rsa", idp.claims()), ""},
+		{"PS256", idp.sign(t, "PS256", "rsa", idp.claims()), ""},
+		{"ES256", idp.sign(t, "ES256", "ec", idp.claims()), ""},
+		{"audience list without azp", idp.sign(t, "RS256", "rsa", with("aud", []string{"portier", "other"})), "authorized for another party"},
+		{"within the clock skew", idp.sign(t, "RS256", "rsa", with("exp", time.Now().Add(-30*time.Second).Unix())), ""},
+		{"signed by another key", forged, "invalid ID token signature"},
+		{"tampered claims", tampered, "invalid ID token signature"},
+		{"alg none", idp.sign(t, "none", "rsa", idp.claims()), "unsupported ID token algorithm"},
+		{"alg HS256", idp.sign(t, "HS256", "rsa", idp.claims()), "does not match its key"},
+		{"RSA alg on an EC key", idp.sign(t, "RS256", "ec", idp.claims()), "does not match its key"},
+		{"unknown key", idp.sign(t, "RS256", "unknown", idp.claims()), "no signing key"},
+		{"encryption key", idp.sign(t, "RS256", "enc", idp.claims()), "no signing key"},
+		{"other issuer", idp.sign(t, "RS256", "rsa", with("iss", "https://evil.example.com")), "expected"},
+		{"other audience", idp.sign(t, "RS256", "rsa", with("aud", "other")), "not issued to this client"},
+		{"expired", idp.sign(t, "RS256", "rsa", with("exp", time.Now().Add(-2*time.Minute).Unix())), "expired"},
+		{"no expiry", idp.sign(t, "RS256", "rsa", with("exp", nil)), "expired"},
+		{"not valid yet", idp.sign(t, "RS256", "rsa", with("nbf", time.Now().Add(5*time.Minute).Unix())), "not valid yet"},
+		{"issued in the future", idp.sign(t, "RS256", "rsa", with("iat", time.Now().Add(5*time.Minute).Unix())), "in the future"},
+		{"other nonce", idp.sign(t, "RS256", "rsa", with("nonce", "replayed")), "nonce"},
+		{"no nonce", idp.sign(t, "RS256", "rsa", with("nonce", nil)), "nonce"},
+		{"no subject", idp.sign(t, "RS256", "rsa", with("sub", nil)), "no subject"},
+		{"malformed", "not.a-token", "malformed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := p.Verify(context.Background(), tt.token, "portier", "nonce")
+			if tt.error == "" {
+				if err != nil {
+					t.Fatalf("Verify = %v", err)
+				}
+				if claims.Subject != "user-1" || claims.Email != "ahmad@example.com" || !claims.EmailVerified {
+					t.Errorf("claims = %+v", claims)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Errorf("Verify = %v, want an error containing %q", err, tt.error)
+			}
+		})
+	}
+}
+
+func TestClaimsStrings(t *testing.T) {
+	claims := Claims{Raw: map[string]interface{}{
+		"groups": []interface{}{"staff", 7, "admins"},
+		"role":   "admin",
+	}}
+	if got := claims.Strings("groups"); strings.Join(got, ",") != "staff,admins" {
+		t.Errorf("Strings(groups) = %v", got)
+	}
+	if got := claims.Strings("role"); len(got) != 1 || got[0] != "admin" {
+		t.Errorf("Strings(role) = %v", got)
+	}
+	if got := claims.Strings("missing"); got != nil {
+		t.Errorf("Strings(missing) = %v", got)
+	}
+}
@@ -0,0 +1,197 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// clockSkew is tolerated on exp, iat and nbf
+const clockSkew = time.Minute
+
+// Claims are the claims of a verified ID token. Raw keeps every claim, such as
+// the groups, whose name depends on the provider.
+type Claims struct {
+	Issuer            string `json:"iss"`
+	Subject           string `json:"sub"`
+	Nonce             string `json:"nonce"`
+	AuthorizedParty   string `json:"azp"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"-"`
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+
+	Audience  []string  `json:"-"`
+	Expiry    time.Time `json:"-"`
+	IssuedAt  time.Time `json:"-"`
+	NotBefore time.Time `json:"-"`
+
+	Raw map[string]interface{} `json:"-"`
+}
+
+// Strings returns the claim name as a list, a single string becomes a list of one
+func (c Claims) Strings(name string) []string {
+	switch v := c.Raw[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Verify checks the signature of an ID token with the keys of the provider, its
+// issuer, audience, lifetime and nonce (OpenID Connect Core 3.1.3.7), and returns its claims
+func (p *Provider) Verify(ctx context.Context, rawToken, clientID, nonce string) (Claims, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return Claims{}, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Claims{}, fmt.Errorf("malformed ID token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, fmt.Errorf("malformed ID token signature: %w", err)
+	}
+	key, err := p.keys.key(ctx, header.Kid)
+	if err != nil {
+		return Claims{}, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return Claims{}, err
+	}
+
+	claims, err := parseClaims(parts[1])
+	if err != nil {
+		return Claims{}, err
+	}
+	now := time.Now()
+	switch {
+	case claims.Issuer != p.Issuer:
+		return Claims{}, fmt.Errorf("ID token issued by %q, expected %q", claims.Issuer, p.Issuer)
+	case !slices.Contains(claims.Audience, clientID):
+		return Claims{}, errors.New("ID token is not issued to this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != clientID:
+		return Claims{}, errors.New("ID token is authorized for another party")
+	case claims.Expiry.IsZero() || now.After(claims.Expiry.Add(clockSkew)):
+		return Claims{}, errors.New("ID token expired")
+	case !claims.NotBefore.IsZero() && now.Add(clockSkew).Before(claims.NotBefore):
+		return Claims{}, errors.New("ID token is not valid yet")
+	case claims.IssuedAt.After(now.Add(clockSkew)):
+		return Claims{}, errors.New("ID token issued in the future")
+	case claims.Nonce != nonce:
+		return Claims{}, errors.New("ID token nonce does not match the login")
+	case claims.Subject == "":
+		return Claims{}, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	if len(alg) == 5 {
+		switch alg[2:] {
+		case "256":
+			hash = crypto.SHA256
+		case "384":
+			hash = crypto.SHA384
+		case "512":
+			hash = crypto.SHA512
+		}
+	}
+	if hash == 0 {
+		return fmt.Errorf("unsupported ID token algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	// "none" and HMAC algorithms are never accepted, the key type must match the algorithm
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return wrapSignature(rsa.VerifyPKCS1v15(k, hash, digest, signature))
+		case "PS":
+			return wrapSignature(rsa.VerifyPSS(k, hash, digest, signature, nil))
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] == "ES" {
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if len(signature) != 2*size {
+				return errors.New("invalid ID token signature")
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if !ecdsa.Verify(k, digest, r, s) {
+				return errors.New("invalid ID token signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("ID token algorithm %q does not match its key", alg)
+}
+
+func wrapSignature(err error) error {
+	if err != nil {
+		return errors.New("invalid ID token signature")
+	}
+	return nil
+}
+
+func parseClaims(segment string) (Claims, error) {
+	var claims Claims
+	if err := decodeSegment(segment, &claims); err != nil {
+		return Claims{}, fmt.Errorf("malformed ID token claims: %w", err)
+	}
+	if err := decodeSegment(segment, &claims.Raw); err != nil {
+		return Claims{}, fmt.Errorf("malformed ID token claims: %w", err)
+	}
+	claims.Audience = claims.Strings("aud")
+	claims.Expiry = numericDate(claims.Raw["exp"])
+	claims.IssuedAt = numericDate(claims.Raw["iat"])
+	claims.NotBefore = numericDate(claims.Raw["nbf"])
+	// Some providers send email_verified as a string
+	switch v := claims.Raw["email_verified"].(type) {
+	case bool:
+		claims.EmailVerified = v
+	case string:
+		claims.EmailVerified = v == "true"
+	}
+	return claims, nil
+}
+
+func numericDate(v interface{}) time.Time {
+	if seconds, ok := v.(float64); ok {
+		return time.Unix(int64(seconds), 0)
+	}
+	return time.Time{}
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,256 @@
+package openapi
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Document is an OpenAPI 3 document, only the parts used by this project are modelled
+type Document struct {
+	OpenAPI    string                `json:"openapi"`
+	Info       Info                  `json:"info"`
+	Paths      map[string]*PathItem  `json:"paths"`
+	Components Components            `json:"components"`
+	Security   []SecurityRequirement `json:"security,omitempty"`
+}
+
+type Info struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type Components struct {
+	Schemas         map[string]*Schema         `json:"schemas"`
+	SecuritySchemes map[string]*SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type SecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// SecurityRequirement names the schemes of a request, an empty one allows anonymous requests
+type SecurityRequirement map[string][]string
+
+// PathItem holds the operations of one path, keyed by lower case HTTP method
+type PathItem map[string]*Operation
+
+type Operation struct {
+	Tags        []string             `json:"tags,omitempty"`
+	Summary     string               `json:"summary"`
+	OperationID string               `json:"operationId"`
+	Parameters  []Parameter          `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Required    bool    `json:"required,omitempty"`
+	Description string  `json:"description,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+type RequestBody struct {
+	Required bool                  `json:"required"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+type Response struct {
+	Description string                `json:"description"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+}
+
+// New returns an empty document
+func New(title, version, description string) *Document {
+	return &Document{
+		OpenAPI: "3.0.3",
+		Info:    Info{Title: title, Version: version, Description: description},
+		Paths:   map[string]*PathItem{},
+		Components: Components{
+			Schemas: map[string]*Schema{},
+		},
+	}
+}
+
+// fiberParam matches the parameters of a Fiber route such as /users/:id
+var fiberParam = regexp.MustCompile(`:([A-Za-z0-9_]+)`)
+
+// PathFromRoute converts a Fiber route path into an OpenAPI path.
+// "/users/:id" becomes "/users/{id}" and "/keys\:batch" becomes "/keys:batch".
+func PathFromRoute(route string) string {
+	escaped := strings.ReplaceAll(route, `\:`, "\x00")
+	path := fiberParam.ReplaceAllString(escaped, "{$1}")
+	return strings.ReplaceAll(path, "\x00", ":")
+}
+
+// PathParams returns the names of the parameters of an OpenAPI path
+func PathParams(path string) []string {
+	var params []string
+	for _, part := range strings.Split(path, "/") {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			params = append(params, strings.Trim(part, "{}"))
+		}
+	}
+	return params
+}
+
+// Add registers op for method and path
+func (d *Document) Add(method, path string, op *Operation) {
+	item, ok := d.Paths[path]
+	if !ok {
+		item = &PathItem{}
+		d.Paths[path] = item
+	}
+	(*item)[strings.ToLower(method)] = op
+}
+
+// Has reports whether the document describes method and path
+func (d *Document) Has(method, path string) bool {
+	item, ok := d.Paths[path]
+	if !ok {
+		return false
+	}
+	_, ok = (*item)[strings.ToLower(method)]
+	return ok
+}
+
+// Operations returns "METHOD path" for every documented operation, sorted
+func (d *Document) Operations() []string {
+	var ops []string
+	for path, item := range d.Paths {
+		for method := range *item {
+			ops = append(ops, strings.ToUpper(method)+" "+path)
+		}
+	}
+	sort.Strings(ops)
+	return ops
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// genericArgs matches the type arguments in the name of a generic type
+var genericArgs = regexp.MustCompile(`\[(?:[^\]]*\.)?([^\].]+)\]`)
+
+// SchemaOf returns the schema of the Go value v. Named structs are stored as
+// components and referenced, their properties are derived from the json tags.
+func (d *Document) SchemaOf(v interface{}) *Schema {
+	if v == nil {
+		return &Schema{}
+	}
+	return d.schemaOfType(reflect.TypeOf(v))
+}
+
+func (d *Document) schemaOfType(t reflect.Type) *Schema {
+	if t.Kind() == reflect.Pointer {
+		schema := d.schemaOfType(t.Elem())
+		if schema.Ref != "" {
+			return schema // nullable can not be combined with $ref in OpenAPI 3.0
+		}
+		schema.Nullable = true
+		return schema
+	}
+
+	if t == timeType {
+		return &Schema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: d.schemaOfType(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: d.schemaOfType(t.Elem())}
+	case reflect.Interface:
+		return &Schema{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return d.structSchema(t)
+		}
+		name := componentName(t)
+		if _, ok := d.Components.Schemas[name]; !ok {
+			d.Components.Schemas[name] = &Schema{Type: "object"} // placeholder for recursive types
+			d.Components.Schemas[name] = d.structSchema(t)
+		}
+		return &Schema{Ref: "#/components/schemas/" + name}
+	}
+
+	return &Schema{}
+}
+
+// structSchema builds an object schema from the exported, json visible fields of t
+func (d *Document) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: map[string]*Schema{}}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if field.Anonymous && name == "" {
+			embedded := d.structSchema(field.Type)
+			for key, prop := range embedded.Properties {
+				schema.Properties[key] = prop
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		// The optional doc and format tags complete the derived schema
+		prop := d.schemaOfType(field.Type)
+		if prop.Ref == "" {
+			prop.Description = field.Tag.Get("doc")
+			if format := field.Tag.Get("format"); format != "" {
+				prop.Format = format
+			}
+		}
+		schema.Properties[name] = prop
+	}
+	return schema
+}
+
+// componentName returns a readable schema name, "BatchItem[portier/internal/service.User]" becomes "BatchItem_User"
+func componentName(t reflect.Type) string {
+	name := genericArgs.ReplaceAllString(t.Name(), "_$1")
+	return strings.ToUpper(name[:1]) + name[1:]
+}
@@ -0,0 +1,179 @@
+package ratelimit
+
+import (
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"portier/pkg/logging"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Budget is the number of requests allowed per window to one IP address, one
+// user and one tenant. 0 disables the budget of that kind.
+type Budget struct {
+	IP     int `mapstructure:"ip" yaml:"ip"`
+	User   int `mapstructure:"user" yaml:"user"`
+	Tenant int `mapstructure:"tenant" yaml:"tenant"`
+}
+
+// Config sets the budgets of every class of request
+type Config struct {
+	Enabled    bool          `mapstructure:"enabled" yaml:"enabled"`
+	Window     time.Duration `mapstructure:"window" yaml:"window"`
+	Read       Budget        `mapstructure:"read" yaml:"read"`             // GET, HEAD and OPTIONS
+	Write      Budget        `mapstructure:"write" yaml:"write"`           // every other method
+	Credential Budget        `mapstructure:"credential" yaml:"credential"` // routes accepting passwords or tokens, in addition to Write
+}
+
+// Response headers, the RateLimit ones describe the tightest budget of the request
+const (
+	HeaderLimit     = "RateLimit-Limit"
+	HeaderRemaining = "RateLimit-Remaining"
+	HeaderReset     = "RateLimit-Reset"
+)
+
+var (
+	cfg   Config
+	store fiber.Storage
+
+	// Counters are read and written in two storage calls, requests for the same
+	// key wait for each other. Other instances sharing the storage may still
+	// interleave, budgets are approximate across instances.
+	locks [64]sync.Mutex
+)
+
+// Setup stores the counters in storage, the limiter stays disabled until it is called
+func Setup(storage fiber.Storage, c Config) {
+	store = storage
+	cfg = c
+}
+
+// Middleware applies the IP budget of the read class to safe methods and the
+// one of the write class to the others. It runs before the caller is
+// authenticated, so requests refused for their credentials are counted too.
+func Middleware(c *fiber.Ctx) error {
+	class, budget := classOf(c)
+	return limit(c, class, Budget{IP: budget.IP})
+}
+
+// Callers applies the user and tenant budgets of the class, add it once the
+// caller is known, see logging.SetCaller
+func Callers(c *fiber.Ctx) error {
+	class, budget := classOf(c)
+	return limit(c, class, Budget{User: budget.User, Tenant: budget.Tenant})
+}
+
+// classOf returns the class of the request and its budget
+func classOf(c *fiber.Ctx) (string, Budget) {
+	switch c.Method() {
+	case fiber.MethodGet, fiber.MethodHead, fiber.MethodOptions:
+		return "read", cfg.Read
+	default:
+		return "write", cfg.Write
+	}
+}
+
+// Credentials applies the stricter credential budget, add it to the routes
+// accepting passwords or tokens to slow down brute-force attempts
+func Credentials(c *fiber.Ctx) error {
+	return limit(c, "credential", cfg.Credential)
+}
+
+// counter is the budget of one caller
+type counter struct {
+	kind  string
+	id    string
+	limit int
+}
+
+func limit(c *fiber.Ctx, class string, budget Budget) error {
+	if !cfg.Enabled || store == nil {
+		return c.Next()
+	}
+
+	counters := []counter{{"ip", c.IP(), budget.IP}}
+	if info := logging.RequestFrom(c.UserContext()); info != nil {
+		if info.UserID != 0 {
+			counters = append(counters, counter{"user", strconv.Itoa(info.UserID), budget.User})
+		}
+		if info.TenantID != 0 {
+			counters = append(counters, counter{"tenant", strconv.Itoa(info.TenantID), budget.Tenant})
+		}
+	}
+
+	window, reset := windowOf(time.Now(), cfg.Window)
+
+	tightest, remaining, exceeded := 0, math.MaxInt, false
+	for _, counter := range counters {
+		if counter.limit <= 0 {
+			continue
+		}
+		key := "ratelimit:" + class + ":" + counter.kind + ":" + counter.id + ":" + strconv.FormatInt(window.Unix(), 10)
+		count, err := increment(key, reset)
+		if err != nil {
+			// Fail open, an unavailable storage must not take the API down
+			slog.WarnContext(c.UserContext(), "Rate limit not checked", "error", err)
+			continue
+		}
+		// Once exhausted, the smaller budget is the one to report
+		if left := max(counter.limit-count, 0); left < remaining || left == remaining && counter.limit < tightest {
+			tightest, remaining = counter.limit, left
+		}
+		if count > counter.limit {
+			exceeded = true
+		}
+	}
+	if tightest == 0 {
+		return c.Next()
+	}
+	// A budget checked earlier in the request may be the tighter one
+	if left, err := strconv.Atoi(c.GetRespHeader(HeaderRemaining)); err == nil {
+		if earlier, _ := strconv.Atoi(c.GetRespHeader(HeaderLimit)); left < remaining || left == remaining && earlier < tightest {
+			tightest, remaining = earlier, left
+		}
+	}
+
+	seconds := strconv.Itoa(int(math.Ceil(reset.Seconds())))
+	c.Set(HeaderLimit, strconv.Itoa(tightest))
+	c.Set(HeaderRemaining, strconv.Itoa(remaining))
+	c.Set(HeaderReset, seconds)
+	if exceeded {
+		c.Set(fiber.HeaderRetryAfter, seconds)
+		return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+			"error": "Too many requests, retry in " + seconds + " seconds",
+		})
+	}
+	return c.Next()
+}
+
+// windowOf returns the start of the fixed window containing now and the time
+// left until the next one
+func windowOf(now time.Time, length time.Duration) (time.Time, time.Duration) {
+	start := now.Truncate(length)
+	return start, start.Add(length).Sub(now)
+}
+
+// increment adds one request to the counter of key and returns the new count.
+// The counter expires with its window.
+func increment(key string, ttl time.Duration) (int, error) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	lock := &locks[h.Sum32()%uint32(len(locks))]
+	lock.Lock()
+	defer lock.Unlock()
+
+	raw, err := store.Get(key)
+	if err != nil {
+		return 0, err
+	}
+	count, _ := strconv.Atoi(string(raw))
+	count++
+	if err := store.Set(key, []byte(strconv.Itoa(count)), ttl); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
@@ -0,0 +1,133 @@
+package ratelimit
+
+import (
+	"net/http/httptest"
+	"portier/pkg/cache"
+	"portier/pkg/logging"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestWindowOf(t *testing.T) {
+	at := func(value string) time.Time {
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	tests := []struct {
+		now    string
+		length time.Duration
+		start  string
+		reset  time.Duration
+	}{
+		{"2024-05-01T10:00:00Z", time.Minute, "2024-05-01T10:00:00Z", time.Minute},
+		{"2024-05-01T10:00:00.000000001Z", time.Minute, "2024-05-01T10:00:00Z", time.Minute - time.Nanosecond},
+		{"2024-05-01T10:00:59.5Z", time.Minute, "2024-05-01T10:00:00Z", 500 * time.Millisecond},
+		{"2024-05-01T10:01:00Z", time.Minute, "2024-05-01T10:01:00Z", time.Minute},
+		{"2024-05-01T10:07:30Z", 15 * time.Minute, "2024-05-01T10:00:00Z", 7*time.Minute + 30*time.Second},
+		{"2024-05-01T10:59:59Z", time.Hour, "2024-05-01T10:00:00Z", time.Second},
+		{"2024-05-01T10:00:07Z", 10 * time.Second, "2024-05-01T10:00:00Z", 3 * time.Second},
+		// Windows are aligned on the zero time, not on the time zone
+		{"2024-05-01T10:30:00+02:00", time.Hour, "2024-05-01T10:00:00+02:00", 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.now+"/"+tt.length.String(), func(t *testing.T) {
+			start, reset := windowOf(at(tt.now), tt.length)
+			if !start.Equal(at(tt.start)) || reset != tt.reset {
+				t.Errorf("windowOf = %v, %v, want %v, %v", start, reset, tt.start, tt.reset)
+			}
+		})
+	}
+}
+
+// memoryStorage is a fiber.Storage kept in memory
+type memoryStorage struct{ *cache.Memory }
+
+func (memoryStorage) Reset() error { return nil }
+
+func TestMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		userID    int
+		tenantID  int
+		limit     string // RateLimit-Limit of every request
+		remaining []int  // RateLimit-Remaining of each request, -1 when it is refused
+	}{
+		{"read budget of the IP", fiber.MethodGet, 0, 0, "3", []int{2, 1, 0, -1, -1}},
+		{"write budget of the IP", fiber.MethodPost, 0, 0, "2", []int{1, 0, -1}},
+		{"user budget is tighter", fiber.MethodGet, 7, 0, "2", []int{1, 0, -1}},
+		{"tenant budget is the tightest", fiber.MethodPost, 7, 3, "1", []int{0, -1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := cache.NewMemory(time.Hour)
+			t.Cleanup(func() { memory.Close() })
+			Setup(memoryStorage{memory}, Config{
+				Enabled: true,
+				Window:  time.Hour,
+				Read:    Budget{IP: 3, User: 2},
+				Write:   Budget{IP: 2, User: 5, Tenant: 1},
+			})
+			t.Cleanup(func() { Setup(nil, Config{}) })
+
+			// As in the routes, the IP budget is checked before the caller is known
+			app := fiber.New()
+			app.Use(Middleware, func(c *fiber.Ctx) error {
+				c.SetUserContext(logging.WithRequest(c.UserContext(), &logging.RequestInfo{UserID: tt.userID, TenantID: tt.tenantID}))
+				return c.Next()
+			}, Callers)
+			app.All("/", func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+
+			for i, remaining := range tt.remaining {
+				resp, err := app.Test(httptest.NewRequest(tt.method, "/", nil))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := resp.Header.Get(HeaderLimit); got != tt.limit {
+					t.Errorf("request %d %s = %q, want %q", i, HeaderLimit, got, tt.limit)
+				}
+				reset, _ := strconv.Atoi(resp.Header.Get(HeaderReset))
+				if reset < 1 || reset > 3600 {
+					t.Errorf("request %d %s = %d, want a number of seconds within the window", i, HeaderReset, reset)
+				}
+				if remaining < 0 {
+					if resp.StatusCode != fiber.StatusTooManyRequests || resp.Header.Get(fiber.HeaderRetryAfter) != resp.Header.Get(HeaderReset) {
+						t.Errorf("request %d = %d, Retry-After %q, want 429 retrying at the reset", i, resp.StatusCode, resp.Header.Get(fiber.HeaderRetryAfter))
+					}
+					remaining = 0
+				} else if resp.StatusCode != fiber.StatusOK {
+					t.Errorf("request %d = %d, want 200", i, resp.StatusCode)
+				}
+				if got := resp.Header.Get(HeaderRemaining); got != strconv.Itoa(remaining) {
+					t.Errorf("request %d %s = %q, want %d", i, HeaderRemaining, got, remaining)
+				}
+			}
+		})
+	}
+}
+
+func TestMiddlewareDisabled(t *testing.T) {
+	memory := cache.NewMemory(time.Hour)
+	t.Cleanup(func() { memory.Close() })
+	Setup(memoryStorage{memory}, Config{Enabled: true, Window: time.Hour, Read: Budget{User: 1}})
+	t.Cleanup(func() { Setup(nil, Config{}) })
+
+	// Without a caller and an IP budget, no budget applies
+	app := fiber.New()
+	app.Get("/", Middleware, Callers, func(c *fiber.Ctx) error { return c.SendStatus(fiber.StatusOK) })
+	for i := 0; i < 3; i++ {
+		resp, err := app.Test(httptest.NewRequest(fiber.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusOK || resp.Header.Get(HeaderLimit) != "" {
+			t.Errorf("request %d = %d, %s %q, want 200 without budget", i, resp.StatusCode, HeaderLimit, resp.Header.Get(HeaderLimit))
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Expr is a parsed filter (RFC 7644 3.4.2.2): a Compare, a Logical, a Not or a ValuePath
+type Expr interface {
+	expr()
+}
+
+// Compare is "path op value", or "path pr" with a nil value. Op is lower case:
+// eq, ne, co, sw, ew, gt, ge, lt, le or pr. Value is a string, a float64, a bool or nil.
+type Compare struct {
+	Path  string
+	Op    string
+	Value interface{}
+}
+
+// Logical joins two filters with "and" or "or"
+type Logical struct {
+	Op          string
+	Left, Right Expr
+}
+
+// Not negates a filter
+type Not struct {
+	Expr Expr
+}
+
+// ValuePath filters the values of a multi-valued attribute, "emails[type eq "work"]".
+// The paths of its filter are relative to Attr.
+type ValuePath struct {
+	Attr   string
+	Filter Expr
+}
+
+func (Compare) expr()   {}
+func (Logical) expr()   {}
+func (Not) expr()       {}
+func (ValuePath) expr() {}
+
+// Path is the target of a patch operation (RFC 7644 3.5.2): an attribute,
+// an optional filter of its values and an optional sub-attribute
+type Path struct {
+	Attr   string
+	Filter Expr
+	Sub    string
+}
+
+var operators = map[string]bool{"eq": true, "ne": true, "co": true, "sw": true, "ew": true, "gt": true, "ge": true, "lt": true, "le": true}
+
+// coreSchemas prefix the fully qualified attribute names, "urn:ietf:params:scim:schemas:core:2.0:User:userName"
+var coreSchemas = []string{SchemaUser + ":", SchemaGroup + ":"}
+
+// ParseFilter parses a filter. Attribute paths are returned in lower case without
+// the core schema, SCIM attribute names are case insensitive.
+func ParseFilter(filter string) (Expr, error) {
+	p, err := newParser(filter)
+	if err != nil {
+		return nil, err
+	}
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, invalidFilter("unexpected %q", p.peek().text)
+	}
+	return e, nil
+}
+
+// ParsePath parses the path of a patch operation, such as "active",
+// "name.givenName" or "members[value eq "2819c223"]"
+func ParsePath(path string) (Path, error) {
+	attr, rest, hasFilter := strings.Cut(path, "[")
+	attr = normalize(strings.TrimSpace(attr))
+	if !hasFilter {
+		// The sub-attribute follows the last colon, "2.0" of a schema is not one
+		name := attr[strings.LastIndex(attr, ":")+1:]
+		if parent, sub, ok := strings.Cut(name, "."); ok {
+			return Path{Attr: attr[:len(attr)-len(name)] + parent, Sub: sub}, validPath(path, attr)
+		}
+		return Path{Attr: attr}, validPath(path, attr)
+	}
+
+	filter, sub, ok := strings.Cut(rest, "]")
+	if !ok {
+		return Path{}, BadRequest(TypeInvalidPath, fmt.Sprintf("path %q misses a ]", path))
+	}
+	e, err := ParseFilter(filter)
+	if err != nil {
+		return Path{}, BadRequest(TypeInvalidPath, fmt.Sprintf("path %q: %s", path, err))
+	}
+	if sub != "" && !strings.HasPrefix(sub, ".") {
+		return Path{}, BadRequest(TypeInvalidPath, fmt.Sprintf("path %q: unexpected %q", path, sub))
+	}
+	return Path{Attr: attr, Filter: e, Sub: strings.ToLower(strings.TrimPrefix(sub, "."))}, validPath(path, attr)
+}
+
+func validPath(path, attr string) error {
+	if attr == "" {
+		return BadRequest(TypeInvalidPath, fmt.Sprintf("invalid path %q", path))
+	}
+	return nil
+}
+
+// normalize lower cases an attribute path and removes its core schema
+func normalize(attr string) string {
+	lower := strings.ToLower(attr)
+	for _, schema := range coreSchemas {
+		if strings.HasPrefix(lower, strings.ToLower(schema)) {
+			return lower[len(schema):]
+		}
+	}
+	return lower
+}
+
+func invalidFilter(format string, args ...interface{}) error {
+	return BadRequest(TypeInvalidFilter, "invalid filter: "+fmt.Sprintf(format, args...))
+}
+
+/*** PARSER ***/
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOpen  // (
+	tokenClose // )
+	tokenOpenBracket
+	tokenCloseBracket
+)
+
+var punctuation = map[byte]tokenKind{'(': tokenOpen, ')': tokenClose, '[': tokenOpenBracket, ']': tokenCloseBracket}
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func newParser(filter string) (*parser, error) {
+	var tokens []token
+	for i := 0; i < len(filter); {
+		switch c := filter[i]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case punctuation[c] != 0:
+			tokens = append(tokens, token{kind: punctuation[c], text: string(c)})
+			i++
+		case c == '"':
+			// A JSON string, with its escapes
+			end := i + 1
+			for end < len(filter) && filter[end] != '"' {
+				if filter[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(filter) {
+				return nil, invalidFilter("unterminated string")
+			}
+			var s string
+			if err := json.Unmarshal([]byte(filter[i:end+1]), &s); err != nil {
+				return nil, invalidFilter("invalid string %s", filter[i:end+1])
+			}
+			tokens = append(tokens, token{kind: tokenString, text: s})
+			i = end + 1
+		default:
+			end := i
+			for end < len(filter) && !strings.ContainsRune(" \t\n\r()[]\"", rune(filter[end])) {
+				end++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: filter[i:end]})
+			i = end
+		}
+	}
+	if len(tokens) == 0 {
+		return nil, invalidFilter("empty filter")
+	}
+	return &parser{tokens: tokens}, nil
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() token {
+	if p.done() {
+		return token{kind: -1}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+func (p *parser) keyword(word string) bool {
+	t := p.peek()
+	if t.kind == tokenWord && strings.EqualFold(t.text, word) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(kind tokenKind, text string) error {
+	if t := p.next(); t.kind != kind {
+		return invalidFilter("expected %s", text)
+	}
+	return nil
+}
+
+// or binds less than and
+func (p *parser) or() (Expr, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = Logical{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and() (Expr, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		left = Logical{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) unary() (Expr, error) {
+	if p.keyword("not") {
+		if err := p.expect(tokenOpen, "( after not"); err != nil {
+			return nil, err
+		}
+		e, err := p.group()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Expr: e}, nil
+	}
+	if p.peek().kind == tokenOpen {
+		p.next()
+		return p.group()
+	}
+	return p.attrExpr()
+}
+
+// group parses the filter inside parentheses, the opening one is consumed
+func (p *parser) group() (Expr, error) {
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	return e, p.expect(tokenClose, ")")
+}
+
+func (p *parser) attrExpr() (Expr, error) {
+	t := p.next()
+	if t.kind != tokenWord || !validAttr(t.text) {
+		return nil, invalidFilter("expected an attribute, got %q", t.text)
+	}
+	attr := normalize(t.text)
+
+	if p.peek().kind == tokenOpenBracket {
+		p.next()
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenCloseBracket, "]"); err != nil {
+			return nil, err
+		}
+		return ValuePath{Attr: attr, Filter: e}, nil
+	}
+
+	op := p.next()
+	if op.kind != tokenWord {
+		return nil, invalidFilter("expected an operator after %s", t.text)
+	}
+	name := strings.ToLower(op.text)
+	if name == "pr" {
+		return Compare{Path: attr, Op: name}, nil
+	}
+	if !operators[name] {
+		return nil, invalidFilter("unknown operator %q", op.text)
+	}
+
+	v := p.next()
+	switch {
+	case v.kind == tokenString:
+		return Compare{Path: attr, Op: name, Value: v.text}, nil
+	case v.kind == tokenWord:
+		var value interface{}
+		if err := json.Unmarshal([]byte(v.text), &value); err != nil {
+			return nil, invalidFilter("invalid value %q", v.text)
+		}
+		if _, ok := value.(string); ok {
+			return nil, invalidFilter("invalid value %q", v.text)
+		}
+		return Compare{Path: attr, Op: name, Value: value}, nil
+	}
+	return nil, invalidFilter("expected a value after %s %s", t.text, op.text)
+}
+
+func validAttr(attr string) bool {
+	for _, r := range attr {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("_-$:.", r) {
+			return false
+		}
+	}
+	return unicode.IsLetter(rune(attr[0]))
+}
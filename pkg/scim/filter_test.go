@@ -0,0 +1,210 @@
+package scim
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   Expr
+	}{
+		{`userName eq "ahmad"`, Compare{Path: "username", Op: "eq", Value: "ahmad"}},
+		{`USERNAME EQ "Ahmad"`, Compare{Path: "username", Op: "eq", Value: "Ahmad"}},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "ah"`, Compare{Path: "username", Op: "sw", Value: "ah"}},
+		{`name.familyName co "san"`, Compare{Path: "name.familyname", Op: "co", Value: "san"}},
+		{`title pr`, Compare{Path: "title", Op: "pr"}},
+		{`active eq true`, Compare{Path: "active", Op: "eq", Value: true}},
+		{`meta.version gt 3`, Compare{Path: "meta.version", Op: "gt", Value: float64(3)}},
+		{`externalId eq null`, Compare{Path: "externalid", Op: "eq", Value: nil}},
+		{`displayName eq "say \"hi\" é"`, Compare{Path: "displayname", Op: "eq", Value: `say "hi" é`}},
+		{
+			`userName eq "a" or userName eq "b" and active eq true`,
+			Logical{Op: "or",
+				Left:  Compare{Path: "username", Op: "eq", Value: "a"},
+				Right: Logical{Op: "and", Left: Compare{Path: "username", Op: "eq", Value: "b"}, Right: Compare{Path: "active", Op: "eq", Value: true}},
+			},
+		},
+		{
+			`(userName eq "a" or userName eq "b") and active eq true`,
+			Logical{Op: "and",
+				Left:  Logical{Op: "or", Left: Compare{Path: "username", Op: "eq", Value: "a"}, Right: Compare{Path: "username", Op: "eq", Value: "b"}},
+				Right: Compare{Path: "active", Op: "eq", Value: true},
+			},
+		},
+		{
+			`a eq 1 and b eq 2 and c eq 3`,
+			Logical{Op: "and",
+				Left:  Logical{Op: "and", Left: Compare{Path: "a", Op: "eq", Value: float64(1)}, Right: Compare{Path: "b", Op: "eq", Value: float64(2)}},
+				Right: Compare{Path: "c", Op: "eq", Value: float64(3)},
+			},
+		},
+		{`not (active eq false)`, Not{Expr: Compare{Path: "active", Op: "eq", Value: false}}},
+		{
+			`emails[type eq "work" and value ew "@example.com"]`,
+			ValuePath{Attr: "emails", Filter: Logical{Op: "and",
+				Left:  Compare{Path: "type", Op: "eq", Value: "work"},
+				Right: Compare{Path: "value", Op: "ew", Value: "@example.com"},
+			}},
+		},
+		{
+			`emails[type eq "work"] or userName eq "a"`,
+			Logical{Op: "or",
+				Left:  ValuePath{Attr: "emails", Filter: Compare{Path: "type", Op: "eq", Value: "work"}},
+				Right: Compare{Path: "username", Op: "eq", Value: "a"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			got, err := ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("ParseFilter = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseFilter = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		``,
+		`   `,
+		`userName`,
+		`userName eq`,
+		`userName xx "a"`,
+		`userName eq ahmad`,
+		`userName eq "unterminated`,
+		`userName eq "a" and`,
+		`userName eq "a" userName eq "b"`,
+		`(userName eq "a"`,
+		`userName eq "a")`,
+		`not userName eq "a"`,
+		`emails[type eq "work"`,
+		`1userName eq "a"`,
+		`user/name eq "a"`,
+		`"userName" eq "a"`,
+	} {
+		t.Run(filter, func(t *testing.T) {
+			_, err := ParseFilter(filter)
+			var scimErr *Error
+			if !errors.As(err, &scimErr) || scimErr.ScimType != TypeInvalidFilter || scimErr.StatusCode() != 400 {
+				t.Errorf("ParseFilter = %v, want a 400 invalidFilter error", err)
+			}
+		})
+	}
+}
+
+func TestParsePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want Path
+	}{
+		{`active`, Path{Attr: "active"}},
+		{`name.givenName`, Path{Attr: "name", Sub: "givenname"}},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:name.familyName`, Path{Attr: "name", Sub: "familyname"}},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:employeeNumber`, Path{Attr: "urn:ietf:params:scim:schemas:extension:enterprise:2.0:user:employeenumber"}},
+		{`members[value eq "7"]`, Path{Attr: "members", Filter: Compare{Path: "value", Op: "eq", Value: "7"}}},
+		{`emails[type eq "work"].value`, Path{Attr: "emails", Filter: Compare{Path: "type", Op: "eq", Value: "work"}, Sub: "value"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, err := ParsePath(tt.path)
+			if err != nil {
+				t.Fatalf("ParsePath = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePath = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+
+	for _, path := range []string{``, `emails[type eq "work"`, `emails[type eq]`, `emails[type eq "work"]value`} {
+		var scimErr *Error
+		if _, err := ParsePath(path); !errors.As(err, &scimErr) || scimErr.ScimType != TypeInvalidPath {
+			t.Errorf("ParsePath(%q) = %v, want an invalidPath error", path, err)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	user := map[string][]interface{}{
+		"username":     {"Ahmad"},
+		"active":       {true},
+		"emails.value": {"ahmad@example.com", "ahmad@home.example"},
+		"emails.type":  {"work", "home"},
+		"meta.version": {float64(3)},
+		"title":        {""},
+	}
+	values := func(path string) []interface{} { return user[path] }
+
+	tests := []struct {
+		filter string
+		match  bool
+	}{
+		{`userName eq "ahmad"`, true},
+		{`userName ne "ahmad"`, false},
+		{`userName co "HMA"`, true},
+		{`userName sw "ah"`, true},
+		{`userName ew "ad"`, true},
+		{`userName gt "a"`, true},
+		{`userName lt "a"`, false},
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`active gt true`, false},
+		{`meta.version ge 3`, true},
+		{`meta.version lt 3`, false},
+		{`meta.version eq "3"`, false},
+		{`emails.value ew "@home.example"`, true},
+		{`emails[type eq "home" and value co "home"]`, true},
+		{`title pr`, false},
+		{`userName pr`, true},
+		{`externalId pr`, false},
+		{`externalId ne "x"`, true},
+		{`externalId eq "x"`, false},
+		{`not (active eq true)`, false},
+		{`userName eq "x" or active eq true`, true},
+		{`userName eq "x" and active eq true`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			e, err := ParseFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Match(e, values); got != tt.match {
+				t.Errorf("Match = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestParseBool(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want bool
+		ok   bool
+	}{
+		{`true`, true, true},
+		{`false`, false, true},
+		{`"True"`, true, true},
+		{`"False"`, false, true},
+		{`"yes"`, false, false},
+		{`1`, false, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseBool(json.RawMessage(tt.raw))
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseBool(%s) = %v, %v", tt.raw, got, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), tt.raw) {
+			t.Errorf("ParseBool(%s) error %q does not show the value", tt.raw, err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package scim
+
+import (
+	"strings"
+)
+
+// Match evaluates a filter against a resource. values returns the values of a
+// lower case attribute path, such as "emails.value": a string, a bool, a float64
+// or nil. A multi-valued attribute matches when one of its values does.
+// Strings are compared case insensitively.
+func Match(e Expr, values func(path string) []interface{}) bool {
+	switch e := e.(type) {
+	case Logical:
+		if e.Op == "and" {
+			return Match(e.Left, values) && Match(e.Right, values)
+		}
+		return Match(e.Left, values) || Match(e.Right, values)
+	case Not:
+		return !Match(e.Expr, values)
+	case ValuePath:
+		return Match(e.Filter, func(path string) []interface{} {
+			return values(e.Attr + "." + path)
+		})
+	case Compare:
+		for _, v := range values(e.Path) {
+			if compare(v, e.Op, e.Value) {
+				return true
+			}
+		}
+		// ne also matches an attribute without value
+		return e.Op == "ne" && len(values(e.Path)) == 0 && e.Value != nil
+	}
+	return false
+}
+
+func compare(actual interface{}, op string, expected interface{}) bool {
+	if op == "pr" {
+		s, isString := actual.(string)
+		return actual != nil && (!isString || s != "")
+	}
+
+	switch a := actual.(type) {
+	case string:
+		b, ok := expected.(string)
+		if !ok {
+			return op == "ne"
+		}
+		a, b = strings.ToLower(a), strings.ToLower(b)
+		switch op {
+		case "eq":
+			return a == b
+		case "ne":
+			return a != b
+		case "co":
+			return strings.Contains(a, b)
+		case "sw":
+			return strings.HasPrefix(a, b)
+		case "ew":
+			return strings.HasSuffix(a, b)
+		case "gt":
+			return a > b
+		case "ge":
+			return a >= b
+		case "lt":
+			return a < b
+		case "le":
+			return a <= b
+		}
+	case float64:
+		b, ok := expected.(float64)
+		if !ok {
+			return op == "ne"
+		}
+		switch op {
+		case "eq":
+			return a == b
+		case "ne":
+			return a != b
+		case "gt":
+			return a > b
+		case "ge":
+			return a >= b
+		case "lt":
+			return a < b
+		case "le":
+			return a <= b
+		}
+	default:
+		// Booleans and null only compare for equality
+		switch op {
+		case "eq":
+			return actual == expected
+		case "ne":
+			return actual != expected
+		}
+	}
+	return false
+}
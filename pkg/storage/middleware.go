@@ -1,6 +1,8 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"portier/internal/config"
 	"portier/pkg/db"
 
@@ -8,16 +10,21 @@ import (
 	"github.com/gofiber/storage/postgres/v3"
 )
 
+// cache is the storage attached to every request
+var cache *postgres.Storage
+
 // SetupPostgresMiddleware initializes both the cache and database connections
 func SetupPostgresMiddleware(app *fiber.App, cfg config.Config) {
 	// Setup the PostgreSQL cache storage
 	storage := postgres.New(postgres.Config{
-		ConnectionURI: cfg.PostgresDSN,
+		ConnectionURI: cfg.Database.DSN,
 		Table:         "cache",
 	})
 
+	cache = storage
+
 	// Initialize general PostgreSQL connection (for CRUD operations)
-	db.ConnectPostgres(cfg.PostgresDSN)
+	db.ConnectPostgres(cfg.Database.DSN, cfg.Database.Pool())
 
 	// Attach the cache storage to the context
 	app.Use(func(c *fiber.Ctx) error {
@@ -25,3 +32,27 @@ func SetupPostgresMiddleware(app *fiber.App, cfg config.Config) {
 		return c.Next()
 	})
 }
+
+// Cache returns the storage shared by the middlewares, nil before SetupPostgresMiddleware
+func Cache() fiber.Storage {
+	if cache == nil {
+		return nil
+	}
+	return cache
+}
+
+// Ping checks that the cache storage is reachable
+func Ping(ctx context.Context) error {
+	if cache == nil {
+		return errors.New("cache storage is not set up")
+	}
+	return cache.Conn().Ping(ctx)
+}
+
+// Close releases the connections of the cache storage
+func Close() error {
+	if cache == nil {
+		return nil
+	}
+	return cache.Close()
+}
@@ -0,0 +1,85 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Supported exporters
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+// Config selects where spans are sent
+type Config struct {
+	Exporter    string  `mapstructure:"exporter" yaml:"exporter"`         // none, stdout or otlp
+	Endpoint    string  `mapstructure:"endpoint" yaml:"endpoint"`         // OTLP/HTTP host:port, empty = OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318
+	Insecure    bool    `mapstructure:"insecure" yaml:"insecure"`         // send OTLP without TLS
+	SampleRatio float64 `mapstructure:"sample_ratio" yaml:"sample_ratio"` // share of new traces that are recorded, between 0 and 1
+	ServiceName string  `mapstructure:"service_name" yaml:"service_name"`
+}
+
+// tracer creates the spans of this package, it is a no-op until Setup installs a provider
+var tracer = otel.Tracer("portier")
+
+// Setup installs the tracer provider and the W3C trace context propagator.
+// The returned function flushes the pending spans, it must be called on shutdown.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	// Incoming trace context is honoured even when nothing is exported
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		var opts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("invalid tracing exporter %q, expected none, stdout or otlp", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %v", cfg.Exporter, err)
+	}
+
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("invalid tracing sample ratio %v, expected a value between 0 and 1", cfg.SampleRatio)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		// Follow the decision of the caller, sample new traces by ratio
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", cfg.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// CopySpan returns dst with the span of src as parent, for work that
+// outlives the request such as background jobs and streamed bodies
+func CopySpan(dst, src context.Context) context.Context {
+	return trace.ContextWithSpanContext(dst, trace.SpanContextFromContext(src))
+}